@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"redix/pkg/redixclient"
+)
+
+// config holds the benchmark parameters
+type config struct {
+	addr        string
+	tokens      []string
+	channel     string
+	publishers  int
+	subscribers int
+	size        int
+	pipeline    int
+	duration    time.Duration
+	drain       time.Duration
+}
+
+func main() {
+	var cfg config
+	host := flag.String("host", "localhost", "Server hostname")
+	port := flag.Int("port", 6379, "Server port")
+	tokens := flag.String("tokens", "token1", "Comma separated tenant tokens; one tenant per token")
+	flag.StringVar(&cfg.channel, "channel", "bench", "Channel every tenant publishes on")
+	flag.IntVar(&cfg.publishers, "publishers", 4, "Number of publisher connections, spread across tenants")
+	flag.IntVar(&cfg.subscribers, "subscribers", 4, "Number of subscriber connections, spread across tenants")
+	flag.IntVar(&cfg.size, "size", 64, "Payload size in bytes")
+	flag.IntVar(&cfg.pipeline, "pipeline", 1, "Number of PUBLISH commands sent per round trip")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "How long to publish")
+	flag.DurationVar(&cfg.drain, "drain", 2*time.Second, "How long to wait for in-flight messages after publishing stops")
+	flag.Parse()
+
+	cfg.addr = net.JoinHostPort(*host, strconv.Itoa(*port))
+	for _, t := range strings.Split(*tokens, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.tokens = append(cfg.tokens, t)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	r, err := run(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Benchmark failed: %v\n", err)
+		os.Exit(1)
+	}
+	r.print(os.Stdout, cfg)
+	if !r.correct() {
+		os.Exit(1)
+	}
+}
+
+func (cfg config) validate() error {
+	switch {
+	case len(cfg.tokens) == 0:
+		return fmt.Errorf("at least one token is required")
+	case cfg.publishers < 1:
+		return fmt.Errorf("-publishers must be at least 1")
+	case cfg.subscribers < 0:
+		return fmt.Errorf("-subscribers must not be negative")
+	case cfg.pipeline < 1:
+		return fmt.Errorf("-pipeline must be at least 1")
+	case cfg.duration <= 0:
+		return fmt.Errorf("-duration must be positive")
+	case cfg.size < minPayloadSize:
+		return fmt.Errorf("-size must be at least %d bytes", minPayloadSize)
+	}
+	return nil
+}
+
+// run connects the subscribers, waits until every tenant's fan-out is in
+// place, publishes for the configured duration and collects the results
+func run(ctx context.Context, cfg config) (*report, error) {
+	tenants := make([]*tenant, len(cfg.tokens))
+	for i, token := range cfg.tokens {
+		c, err := redixclient.Dial(cfg.addr, token, &redixclient.Options{PoolSize: 1})
+		if err != nil {
+			return nil, fmt.Errorf("tenant %d: %w", i, err)
+		}
+		defer c.Close()
+		tenants[i] = &tenant{id: i, client: c}
+	}
+
+	var subs []*subscriber
+	for i := 0; i < cfg.subscribers; i++ {
+		t := tenants[i%len(tenants)]
+		s, err := newSubscriber(ctx, t, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		defer s.close()
+		subs = append(subs, s)
+		t.subscribers++
+	}
+	for _, t := range tenants {
+		if err := t.awaitSubscribers(ctx, cfg.channel); err != nil {
+			return nil, err
+		}
+	}
+
+	pubs := make([]*publisher, cfg.publishers)
+	for i := range pubs {
+		t := tenants[i%len(tenants)]
+		c, err := redixclient.Dial(cfg.addr, cfg.tokens[t.id], &redixclient.Options{PoolSize: 1})
+		if err != nil {
+			return nil, fmt.Errorf("publisher %d: %w", i, err)
+		}
+		defer c.Close()
+		pubs[i] = &publisher{id: i, tenant: t, client: c}
+	}
+
+	pubCtx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, p := range pubs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(pubCtx, cfg)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Give in-flight messages a chance to arrive before counting drops
+	expected := int64(0)
+	for _, p := range pubs {
+		expected += p.receivers.Load()
+	}
+	deadline := time.Now().Add(cfg.drain)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if delivered(subs) >= expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return newReport(elapsed, tenants, pubs, subs), nil
+}
+
+// tenant groups the publishers and subscribers sharing a token
+type tenant struct {
+	id          int
+	client      *redixclient.Client
+	subscribers int
+}
+
+// awaitSubscribers publishes warm-up messages until the server reports
+// every subscriber of the tenant, since subscriptions are asynchronous
+func (t *tenant) awaitSubscribers(ctx context.Context, channel string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		n, err := t.client.Publish(ctx, channel, warmupPayload)
+		if err != nil {
+			return fmt.Errorf("tenant %d warm-up: %w", t.id, err)
+		}
+		if n == int64(t.subscribers) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tenant %d: %d of %d subscribers ready after 10s", t.id, n, t.subscribers)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// publisher sends messages for one tenant over a dedicated connection
+type publisher struct {
+	id     int
+	tenant *tenant
+	client *redixclient.Client
+
+	sent      atomic.Int64
+	receivers atomic.Int64
+	// misfanned counts publishes whose receiver count differed from the
+	// number of subscribers in the tenant
+	misfanned atomic.Int64
+	errors    atomic.Int64
+}
+
+func (p *publisher) run(ctx context.Context, cfg config) {
+	var seq uint64
+	for ctx.Err() == nil {
+		pl := p.client.Pipeline()
+		for i := 0; i < cfg.pipeline; i++ {
+			seq++
+			pl.Publish(cfg.channel, encodePayload(p.id, seq, time.Now(), cfg.size))
+		}
+		replies, err := pl.Exec(context.Background())
+		if err != nil {
+			p.errors.Add(1)
+			continue
+		}
+		for _, r := range replies {
+			if r.Type != ':' {
+				p.errors.Add(1)
+				continue
+			}
+			p.sent.Add(1)
+			p.receivers.Add(r.Int)
+			if r.Int != int64(p.tenant.subscribers) {
+				p.misfanned.Add(1)
+			}
+		}
+	}
+}
+
+// subscriber receives one tenant's messages and records their latency
+type subscriber struct {
+	tenant *tenant
+	sub    *redixclient.Subscriber
+	done   chan struct{}
+
+	received atomic.Int64
+	// misrouted counts messages from another tenant's publishers
+	misrouted atomic.Int64
+	// reordered counts duplicate or out of order messages per publisher
+	reordered atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func newSubscriber(ctx context.Context, t *tenant, cfg config) (*subscriber, error) {
+	c, err := redixclient.Dial(cfg.addr, cfg.tokens[t.id], &redixclient.Options{PoolSize: 1, MessageBuffer: 4096})
+	if err != nil {
+		return nil, err
+	}
+	sub, err := c.Subscribe(ctx, cfg.channel)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s := &subscriber{tenant: t, sub: sub, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer c.Close()
+		s.run(cfg.publishers, len(cfg.tokens))
+	}()
+	return s, nil
+}
+
+func (s *subscriber) run(publishers, tenants int) {
+	last := make([]uint64, publishers)
+	for msg := range s.sub.Messages() {
+		now := time.Now()
+		pub, seq, sentAt, ok := decodePayload(msg.Payload)
+		if !ok {
+			continue
+		}
+		s.received.Add(1)
+		if pub >= publishers || pub%tenants != s.tenant.id {
+			s.misrouted.Add(1)
+			continue
+		}
+		if seq <= last[pub] {
+			s.reordered.Add(1)
+		}
+		last[pub] = seq
+
+		s.mu.Lock()
+		s.latencies = append(s.latencies, now.Sub(sentAt))
+		s.mu.Unlock()
+	}
+}
+
+func (s *subscriber) close() {
+	s.sub.Close()
+	<-s.done
+}
+
+func delivered(subs []*subscriber) int64 {
+	var n int64
+	for _, s := range subs {
+		n += s.received.Load()
+	}
+	return n
+}
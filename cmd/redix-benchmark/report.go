@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// warmupPayload is published while waiting for subscribers and ignored
+	// by them
+	warmupPayload = "warmup"
+	// minPayloadSize fits the publisher, sequence and timestamp header
+	minPayloadSize = 48
+)
+
+// encodePayload builds a message of size bytes carrying the publisher id,
+// its sequence number and the send time
+func encodePayload(pub int, seq uint64, at time.Time, size int) string {
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteString(strconv.Itoa(pub))
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatUint(seq, 10))
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatInt(at.UnixNano(), 10))
+	b.WriteByte(':')
+	for b.Len() < size {
+		b.WriteByte('x')
+	}
+	return b.String()
+}
+
+// decodePayload reverses encodePayload
+func decodePayload(payload string) (pub int, seq uint64, at time.Time, ok bool) {
+	parts := strings.SplitN(payload, ":", 4)
+	if len(parts) != 4 {
+		return 0, 0, time.Time{}, false
+	}
+	pub, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	return pub, seq, time.Unix(0, nanos), true
+}
+
+// report is the outcome of a benchmark run
+type report struct {
+	elapsed     time.Duration
+	tenants     int
+	published   int64
+	errors      int64
+	expected    int64
+	delivered   int64
+	misfanned   int64
+	misrouted   int64
+	reordered   int64
+	latencies   []time.Duration
+	subscribers int
+}
+
+func newReport(elapsed time.Duration, tenants []*tenant, pubs []*publisher, subs []*subscriber) *report {
+	r := &report{elapsed: elapsed, tenants: len(tenants), subscribers: len(subs)}
+	for _, p := range pubs {
+		r.published += p.sent.Load()
+		r.errors += p.errors.Load()
+		r.expected += p.receivers.Load()
+		r.misfanned += p.misfanned.Load()
+	}
+	for _, s := range subs {
+		r.delivered += s.received.Load()
+		r.misrouted += s.misrouted.Load()
+		r.reordered += s.reordered.Load()
+		s.mu.Lock()
+		r.latencies = append(r.latencies, s.latencies...)
+		s.mu.Unlock()
+	}
+	slices.Sort(r.latencies)
+	return r
+}
+
+// drops is the number of deliveries the server reported but subscribers
+// never received
+func (r *report) drops() int64 {
+	if d := r.expected - (r.delivered - r.misrouted); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// correct reports whether every message reached exactly the subscribers
+// of its tenant
+func (r *report) correct() bool {
+	return r.errors == 0 && r.drops() == 0 && r.misfanned == 0 && r.misrouted == 0 && r.reordered == 0
+}
+
+// percentile returns the latency below which p percent of deliveries fall
+func (r *report) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies))*p/100+0.5) - 1
+	i = max(0, min(i, len(r.latencies)-1))
+	return r.latencies[i]
+}
+
+func (r *report) print(w io.Writer, cfg config) {
+	secs := r.elapsed.Seconds()
+	fmt.Fprintf(w, "====== redix-benchmark ======\n")
+	fmt.Fprintf(w, "  %d tenants, %d publishers, %d subscribers\n", r.tenants, cfg.publishers, r.subscribers)
+	fmt.Fprintf(w, "  %d byte payload, pipeline %d, %s\n\n", cfg.size, cfg.pipeline, r.elapsed.Round(time.Millisecond))
+
+	fmt.Fprintf(w, "Publish\n")
+	fmt.Fprintf(w, "  messages:     %d\n", r.published)
+	fmt.Fprintf(w, "  throughput:   %.0f ops/sec\n", float64(r.published)/secs)
+	fmt.Fprintf(w, "  errors:       %d\n\n", r.errors)
+
+	fmt.Fprintf(w, "Delivery\n")
+	fmt.Fprintf(w, "  expected:     %d\n", r.expected)
+	fmt.Fprintf(w, "  delivered:    %d (%.0f msgs/sec)\n", r.delivered, float64(r.delivered)/secs)
+	fmt.Fprintf(w, "  drops:        %d\n", r.drops())
+	fmt.Fprintf(w, "  latency p50:  %s\n", r.percentile(50))
+	fmt.Fprintf(w, "  latency p99:  %s\n", r.percentile(99))
+	fmt.Fprintf(w, "  latency p999: %s\n", r.percentile(99.9))
+	if n := len(r.latencies); n > 0 {
+		fmt.Fprintf(w, "  latency max:  %s\n", r.latencies[n-1])
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "Fan-out\n")
+	fmt.Fprintf(w, "  wrong receiver count: %d\n", r.misfanned)
+	fmt.Fprintf(w, "  cross-tenant:         %d\n", r.misrouted)
+	fmt.Fprintf(w, "  duplicate/reordered:  %d\n", r.reordered)
+	if r.correct() {
+		fmt.Fprintf(w, "  result:               OK\n")
+	} else {
+		fmt.Fprintf(w, "  result:               FAILED\n")
+	}
+}
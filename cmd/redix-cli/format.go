@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"redix/pkg/protocol"
+	"redix/pkg/redixclient"
+)
+
+// printer renders replies and messages in the selected output mode
+type printer struct {
+	w    io.Writer
+	raw  bool
+	json bool
+}
+
+func newPrinter(w io.Writer, opts options) *printer {
+	return &printer{w: w, raw: opts.raw, json: opts.json}
+}
+
+// value prints a command reply
+func (p *printer) value(v protocol.Value) {
+	switch {
+	case p.json:
+		data, _ := json.Marshal(toJSON(v))
+		fmt.Fprintf(p.w, "%s\n", data)
+	case p.raw:
+		p.rawValue(v)
+	default:
+		p.pretty(v, "")
+	}
+}
+
+// message prints a message received in subscribe mode
+func (p *printer) message(at time.Time, msg redixclient.Message) {
+	switch {
+	case p.json:
+		out := map[string]string{
+			"time":    at.Format(time.RFC3339Nano),
+			"channel": msg.Channel,
+			"message": msg.Payload,
+		}
+		if msg.Pattern != "" {
+			out["pattern"] = msg.Pattern
+		}
+		data, _ := json.Marshal(out)
+		fmt.Fprintf(p.w, "%s\n", data)
+	case p.raw:
+		fmt.Fprintln(p.w, msg.Payload)
+	default:
+		fmt.Fprintf(p.w, "%s [%s] %s\n", at.Format("2006-01-02 15:04:05.000"), msg.Channel, strconv.Quote(msg.Payload))
+	}
+}
+
+// notice prints an informational line that is not part of the data
+func (p *printer) notice(text string) {
+	if !p.json && !p.raw {
+		fmt.Fprintln(p.w, text)
+	}
+}
+
+// pretty prints v the way redis-cli does, indenting nested arrays
+func (p *printer) pretty(v protocol.Value, indent string) {
+	switch v.Type {
+	case protocol.SimpleString:
+		fmt.Fprintln(p.w, v.Str)
+	case protocol.Error:
+		fmt.Fprintf(p.w, "(error) %s\n", v.Str)
+	case protocol.Integer:
+		fmt.Fprintf(p.w, "(integer) %d\n", v.Int)
+	case protocol.BulkString:
+		if v.Null {
+			fmt.Fprintln(p.w, "(nil)")
+			return
+		}
+		fmt.Fprintln(p.w, strconv.Quote(v.Str))
+	case protocol.Array:
+		if v.Null {
+			fmt.Fprintln(p.w, "(nil)")
+			return
+		}
+		if len(v.Array) == 0 {
+			fmt.Fprintln(p.w, "(empty array)")
+			return
+		}
+		width := len(strconv.Itoa(len(v.Array)))
+		for i, elem := range v.Array {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			if i > 0 {
+				fmt.Fprint(p.w, indent)
+			}
+			fmt.Fprint(p.w, prefix)
+			p.pretty(elem, indent+strings.Repeat(" ", len(prefix)))
+		}
+	}
+}
+
+// rawValue prints v without annotations, one array element per line
+func (p *printer) rawValue(v protocol.Value) {
+	switch {
+	case v.Type == protocol.Array:
+		for _, elem := range v.Array {
+			p.rawValue(elem)
+		}
+	case v.Null:
+		fmt.Fprintln(p.w)
+	default:
+		fmt.Fprintln(p.w, v.String())
+	}
+}
+
+// toJSON converts a reply to a JSON-friendly value; errors become
+// {"error": "..."} objects
+func toJSON(v protocol.Value) any {
+	switch v.Type {
+	case protocol.Error:
+		return map[string]string{"error": v.Str}
+	case protocol.Integer:
+		return v.Int
+	case protocol.Array:
+		if v.Null {
+			return nil
+		}
+		out := make([]any, len(v.Array))
+		for i, elem := range v.Array {
+			out[i] = toJSON(elem)
+		}
+		return out
+	default:
+		if v.Null {
+			return nil
+		}
+		return v.Str
+	}
+}
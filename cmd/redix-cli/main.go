@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"redix/pkg/protocol"
+	"redix/pkg/redixclient"
+)
+
+// options holds the command line flags
+type options struct {
+	addr        string
+	token       string
+	raw         bool
+	json        bool
+	historyFile string
+}
+
+func main() {
+	var opts options
+	host := flag.String("host", "localhost", "Server hostname")
+	port := flag.Int("port", 6379, "Server port")
+	flag.StringVar(&opts.token, "token", os.Getenv("REDIX_TOKEN"), "Tenant token used to authenticate (defaults to $REDIX_TOKEN)")
+	flag.BoolVar(&opts.raw, "raw", false, "Print replies without type annotations or quoting")
+	flag.BoolVar(&opts.json, "json", false, "Print replies and messages as JSON")
+	flag.StringVar(&opts.historyFile, "history-file", defaultHistoryFile(), "File the interactive history is kept in (empty to disable)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: redix-cli [flags] [command [arg ...]]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts.addr = net.JoinHostPort(*host, strconv.Itoa(*port))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c, err := redixclient.Dial(opts.addr, opts.token, &redixclient.Options{PoolSize: 1})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to Redix at %s: %v\n", opts.addr, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	out := newPrinter(os.Stdout, opts)
+
+	if args := flag.Args(); len(args) > 0 {
+		if err := run(ctx, c, out, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	repl(ctx, c, out, opts)
+}
+
+// run executes one command, entering subscribe mode for SUBSCRIBE and PSUBSCRIBE
+func run(ctx context.Context, c *redixclient.Client, out *printer, args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) < 2 {
+			return fmt.Errorf("wrong number of arguments for %s", args[0])
+		}
+		return subscribe(ctx, c, out, strings.ToUpper(args[0]) == "PSUBSCRIBE", args[1:])
+	}
+
+	v, err := c.Do(ctx, args...)
+	var replyErr redixclient.Error
+	if err != nil && !errors.As(err, &replyErr) {
+		return err
+	}
+	out.value(v)
+	return nil
+}
+
+// subscribe prints messages until ctx is canceled
+func subscribe(ctx context.Context, c *redixclient.Client, out *printer, pattern bool, names []string) error {
+	var (
+		sub *redixclient.Subscriber
+		err error
+	)
+	if pattern {
+		sub, err = c.PSubscribe(ctx, names...)
+	} else {
+		sub, err = c.Subscribe(ctx, names...)
+	}
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	out.notice(fmt.Sprintf("Reading messages on %s (press Ctrl-C to quit)", strings.Join(names, ", ")))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return nil
+			}
+			out.message(time.Now(), msg)
+		}
+	}
+}
+
+// repl runs the interactive prompt
+func repl(ctx context.Context, c *redixclient.Client, out *printer, opts options) {
+	h := loadHistory(opts.historyFile)
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	prompt := opts.addr + "> "
+	for {
+		fmt.Print(prompt)
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			recalled, err := h.recall(line[1:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			line = recalled
+			fmt.Println(line)
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid argument(s): %v\n", err)
+			continue
+		}
+		h.add(line)
+
+		switch strings.ToLower(args[0]) {
+		case "quit", "exit":
+			return
+		case "history":
+			h.print(os.Stdout)
+			continue
+		case "help":
+			fmt.Println("Type a command such as PUBLISH channel message.")
+			fmt.Println("  history   show previous commands, !N reruns command N and !! the last one")
+			fmt.Println("  quit      leave the prompt")
+			continue
+		}
+
+		// Subscribe mode runs until Ctrl-C, which also ends the prompt
+		if err := run(ctx, c, out, args); err != nil {
+			fmt.Fprintf(os.Stderr, "(error) %v\n", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// history keeps the commands entered at the prompt and appends them to a file
+type history struct {
+	lines []string
+	file  string
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".redix_history")
+}
+
+func loadHistory(file string) *history {
+	h := &history{file: file}
+	if file == "" {
+		return h
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	return h
+}
+
+func (h *history) add(line string) {
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if h.file == "" {
+		return
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// recall returns history entry ref: "!" for the last entry or a 1-based number
+func (h *history) recall(ref string) (string, error) {
+	if ref == "!" {
+		if len(h.lines) == 0 {
+			return "", errors.New("history is empty")
+		}
+		return h.lines[len(h.lines)-1], nil
+	}
+	n, err := strconv.Atoi(ref)
+	if err != nil || n < 1 || n > len(h.lines) {
+		return "", fmt.Errorf("no history entry %q", ref)
+	}
+	return h.lines[n-1], nil
+}
+
+func (h *history) print(w io.Writer) {
+	start := 0
+	if len(h.lines) > 100 {
+		start = len(h.lines) - 100
+	}
+	for i := start; i < len(h.lines); i++ {
+		fmt.Fprintf(w, "%5d  %s\n", i+1, h.lines[i])
+	}
+}
+
+// splitArgs splits a prompt line into arguments with the same quoting
+// rules the server applies to inline commands
+func splitArgs(line string) ([]string, error) {
+	args, err := protocol.SplitArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"redix/pkg/admin"
+	"redix/pkg/audit"
+	"redix/pkg/backplane"
+	"redix/pkg/cluster"
+	"redix/pkg/config"
+	"redix/pkg/httpapi"
+	"redix/pkg/logging"
+	"redix/pkg/migrate"
+	"redix/pkg/pubsub"
 	"redix/pkg/server"
 
 	_ "github.com/go-sql-driver/mysql" // Register MySQL driver
+	_ "github.com/mattn/go-sqlite3"    // Register SQLite driver
 
 	"github.com/joho/godotenv"
 )
@@ -17,41 +36,300 @@ import (
 func main() {
 	_ = godotenv.Load()
 
-	// Define command line flags
-	mysqlHost := flag.String("mysql-host", "localhost", "MySQL host address")
-	mysqlPort := flag.String("mysql-port", "3306", "MySQL port")
-	mysqlUser := flag.String("mysql-user", "root", "MySQL username")
-	mysqlPass := flag.String("mysql-pass", "root", "MySQL password")
-	mysqlDB := flag.String("mysql-db", "redix", "MySQL database name")
-	redixPort := flag.String("port", ":6379", "Redix server port")
-
+	flags := config.RegisterFlags(flag.CommandLine)
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print the effective settings and exit")
 	flag.Parse()
 
-	// Build DSN from flags or fallback to environment variable
-	var dsn string
-	if *mysqlHost != "" {
-		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-			*mysqlUser, *mysqlPass, *mysqlHost, *mysqlPort, *mysqlDB)
-	} else {
-		dsn = os.Getenv("MYSQL_DSN")
+	cfg, err := flags.Load(os.LookupEnv)
+	if *checkConfig {
+		cfg.Write(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("\nConfiguration OK")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
 	}
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	logger, logLevel := logging.New(os.Stderr, logging.Options{
+		Level:            cfg.Logging.Level,
+		Format:           cfg.Logging.Format,
+		SampleInitial:    cfg.Logging.SampleInitial,
+		SampleThereafter: cfg.Logging.SampleThereafter,
+	})
+	slog.SetDefault(logger)
 
-	if dsn == "" {
-		log.Fatal("MySQL connection information not provided. Use command line flags or MYSQL_DSN environment variable")
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		fatal("TLS setup failed", err)
 	}
 
-	db, err := sql.Open("mysql", dsn)
+	db, err := sql.Open(cfg.TokenStore.Driver, cfg.DSN())
 	if err != nil {
-		log.Fatalf("MySQL connect error: %v", err)
+		fatal("token store connect failed", err)
 	}
 	if err = db.Ping(); err != nil {
-		log.Fatalf("MySQL ping failed: %v", err)
+		fatal("token store ping failed", err)
 	}
 	defer db.Close()
 
 	srv := server.New(db)
-	log.Printf("🚀 Redix server running on %s", *redixPort)
-	if err := srv.Listen(*redixPort); err != nil {
-		log.Fatalf("Server error: %v", err)
+	srv.SetLimits(cfg.Limits)
+	srv.SetProtocolLimits(cfg.Protocol.Limits())
+	srv.PubSub().SetRetention(cfg.Retention.Messages)
+	srv.PubSub().SetReliable(pubsub.ReliableOptions{
+		VisibilityTimeout: cfg.Reliable.VisibilityTimeout,
+		MaxPending:        cfg.Reliable.MaxPending,
+	})
+	srv.Webhooks().SetAllowedNetworks(cfg.Webhooks.NetworkList())
+	if err := srv.Webhooks().Load(); err != nil {
+		slog.Warn("webhooks not loaded", "error", err)
+	}
+	if err := srv.LoadBridges(); err != nil {
+		slog.Warn("bridges not loaded", "error", err)
+	}
+	if err := srv.LoadTenants(); err != nil {
+		slog.Warn("tenant limits not loaded", "error", err)
+	}
+
+	var auditLog *audit.Log
+	if cfg.Audit.File != "" {
+		auditLog, err = audit.Open(cfg.Audit.File, audit.Options{
+			MaxSize:  int64(cfg.Audit.MaxSize) << 20,
+			MaxFiles: cfg.Audit.MaxFiles,
+			Key:      []byte(cfg.Audit.Key),
+		})
+		if err != nil {
+			fatal("audit log open failed", err)
+		}
+		defer auditLog.Close()
+		srv.SetAudit(auditLog)
+		if cfg.Audit.Key == "" {
+			slog.Warn("audit.key is not set; anyone who can write the audit log can rewrite its hash chain")
+		}
+	}
+
+	runtimeConfig := config.NewManager(cfg, func() (*config.Config, error) {
+		return flags.Load(os.LookupEnv)
+	})
+	runtimeConfig.OnChange(func(cfg *config.Config, changed []string) {
+		srv.SetLimits(cfg.Limits)
+		srv.PubSub().SetRetention(cfg.Retention.Messages)
+		srv.PubSub().SetReliable(pubsub.ReliableOptions{
+			VisibilityTimeout: cfg.Reliable.VisibilityTimeout,
+			MaxPending:        cfg.Reliable.MaxPending,
+		})
+		srv.Webhooks().SetAllowedNetworks(cfg.Webhooks.NetworkList())
+		logLevel.UnmarshalText([]byte(cfg.Logging.Level))
+		slog.Info("configuration changed", "keys", changed)
+	})
+	srv.SetConfig(runtimeConfig)
+	go reloadOnSignal(runtimeConfig, auditLog)
+
+	if addr := cfg.Admin.Listen; addr != "" {
+		go func() {
+			slog.Info("admin HTTP listening", "addr", addr, "tls", tlsConfig != nil)
+			adm := admin.New(srv)
+			adm.SetTenants(srv, srv.Auth(), server.DefaultRotationGrace)
+			adm.SetAudit(auditLog)
+			if err := adm.ListenAndServe(addr, tlsConfig); err != nil {
+				fatal("admin HTTP failed", err)
+			}
+		}()
+	}
+
+	if addr := cfg.Listeners.HTTP; addr != "" {
+		go func() {
+			slog.Info("HTTP API listening", "addr", addr, "tls", tlsConfig != nil)
+			api := httpapi.New(srv.Auth(), srv.PubSub())
+			api.SetAudit(auditLog)
+			api.SetProtocolLimits(cfg.Protocol.Limits())
+			api.SetSessions(srv)
+			api.SetAllowedOrigins(cfg.Listeners.OriginList())
+			// No WriteTimeout: SSE and WebSocket responses stream for as
+			// long as the client stays subscribed
+			hs := &http.Server{
+				Addr:              addr,
+				Handler:           api.Handler(),
+				TLSConfig:         tlsConfig,
+				ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+				ReadTimeout:       cfg.HTTP.ReadTimeout,
+				IdleTimeout:       cfg.Limits.IdleTimeout,
+			}
+			var err error
+			if tlsConfig != nil {
+				err = hs.ListenAndServeTLS("", "")
+			} else {
+				err = hs.ListenAndServe()
+			}
+			fatal("HTTP API failed", err)
+		}()
+	}
+
+	if addr := cfg.Cluster.Listen; addr != "" {
+		node := cluster.New(srv.PubSub(), cluster.Options{
+			NodeID:           cfg.Cluster.NodeID,
+			Advertise:        cfg.Cluster.Advertise,
+			ClientAddr:       cfg.Listeners.Redis,
+			Peers:            cfg.Cluster.PeerList(),
+			Secret:           cfg.Cluster.Secret,
+			ProbeInterval:    cfg.Cluster.ProbeInterval,
+			SuspicionTimeout: cfg.Cluster.SuspicionTimeout,
+		})
+		srv.SetCluster(node)
+		if err := node.Listen(addr); err != nil {
+			fatal("cluster listen failed", err)
+		}
+		if cfg.Cluster.Secret == "" {
+			slog.Warn("cluster.secret is not set; any host that reaches the cluster port can join")
+		}
+		slog.Info("cluster listening", "addr", addr, "node_id", node.ID(), "advertise", node.Addr(), "seeds", len(cfg.Cluster.PeerList()))
+	}
+
+	if addr := cfg.Backplane.Redis; addr != "" {
+		bp := backplane.New(srv.PubSub(), backplane.Options{
+			Addr:     addr,
+			Username: cfg.Backplane.Username,
+			Password: cfg.Backplane.Password,
+			Prefix:   cfg.Backplane.Prefix,
+		})
+		srv.SetBackplane(bp)
+		bp.Start()
+		slog.Info("redis backplane enabled", "redis", addr, "prefix", cfg.Backplane.Prefix)
+	}
+
+	go shutdownOnSignal(srv, cfg.Server.ShutdownDelay)
+
+	ln, err := net.Listen("tcp", cfg.Listeners.Redis)
+	if err != nil {
+		fatal("server failed", err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	slog.Info("🚀 Redix server running", "addr", cfg.Listeners.Redis, "tls", tlsConfig != nil)
+	if err := srv.Serve(ln); err != nil {
+		fatal("server failed", err)
+	}
+}
+
+// runMigrate runs "redix migrate up|down [n]|status|force <version>"
+// against the configured token store
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: redix migrate up|down [n]|status|force <version>")
+	}
+	db, err := sql.Open(cfg.TokenStore.Driver, cfg.DSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := migrate.New(db, cfg.TokenStore.Driver)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, mig := range done {
+			fmt.Printf("applied %04d_%s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		done, err := m.Down(ctx, steps)
+		for _, mig := range done {
+			fmt.Printf("reverted %04d_%s\n", mig.Version, mig.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.Applied {
+				state = "applied " + st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-24s %s\n", st.Version, st.Name, state)
+		}
+		return nil
+
+	case "force":
+		if len(args) != 2 {
+			return errors.New("usage: redix migrate force <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return m.Force(ctx, version)
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP
+func reloadOnSignal(m *config.Manager, auditLog *audit.Log) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		restart, err := m.Reload()
+		if err != nil {
+			slog.Error("configuration reload rejected", "error", err)
+			auditLog.Record(audit.Event{Type: audit.ConfigReload, Outcome: audit.Failure, Target: "SIGHUP"})
+			continue
+		}
+		auditLog.Record(audit.Event{Type: audit.ConfigReload, Outcome: audit.Success, Target: "SIGHUP"})
+		if len(restart) > 0 {
+			slog.Warn("configuration reloaded; restart required to apply some settings", "keys", restart)
+		} else {
+			slog.Info("configuration reloaded")
+		}
+	}
+}
+
+// shutdownOnSignal drains and stops the server on SIGINT or SIGTERM
+func shutdownOnSignal(srv *server.Server, delay time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	slog.Info("shutting down", "drain", delay)
+	srv.Drain()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "error", err)
 	}
 }
@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+)
+
+// probeTimeout bounds how long a readiness check may take
+const probeTimeout = 2 * time.Second
+
+// Probe reports the liveness and readiness of the Redix server
+type Probe interface {
+	Healthy() bool
+	Ready(ctx context.Context) error
+}
+
+// Server is the admin HTTP listener
+type Server struct {
+	probe        Probe
+	mux          *http.ServeMux
+	tenants      Tenants
+	auth         *auth.Validator
+	audit        *audit.Log
+	defaultGrace time.Duration
+}
+
+// New creates a new admin HTTP server backed by the given probe
+func New(probe Probe) *Server {
+	s := &Server{
+		probe: probe,
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	return s
+}
+
+// Handler returns the HTTP handler serving the admin endpoints
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// SetAudit records rejected administration requests to l
+func (s *Server) SetAudit(l *audit.Log) {
+	s.audit = l
+}
+
+// ListenAndServe starts the admin HTTP listener on the specified address,
+// serving HTTPS when tlsConfig is set
+func (s *Server) ListenAndServe(addr string, tlsConfig *tls.Config) error {
+	hs := &http.Server{Addr: addr, Handler: s.mux, TLSConfig: tlsConfig, ReadHeaderTimeout: probeTimeout}
+	if tlsConfig != nil {
+		return hs.ListenAndServeTLS("", "")
+	}
+	return hs.ListenAndServe()
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !s.probe.Healthy() {
+		writeStatus(w, http.StatusServiceUnavailable, "listener not accepting")
+		return
+	}
+	writeStatus(w, http.StatusOK, "")
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	if err := s.probe.Ready(ctx); err != nil {
+		writeStatus(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeStatus(w, http.StatusOK, "")
+}
+
+// writeStatus writes a small JSON status document
+func writeStatus(w http.ResponseWriter, code int, reason string) {
+	body := map[string]string{"status": "ok"}
+	if code != http.StatusOK {
+		body["status"] = "fail"
+		body["reason"] = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
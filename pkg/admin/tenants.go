@@ -0,0 +1,381 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+)
+
+// maxBodySize bounds the size of a request body
+const maxBodySize = 1 << 20
+
+// Tenants manages tenants and tokens. Methods taking an audit.Event record
+// the change as made by that actor.
+type Tenants interface {
+	Tenants() ([]auth.Tenant, error)
+	Tenant(name string) (auth.Tenant, error)
+	CreateTenant(by audit.Event, t auth.Tenant) error
+	UpdateTenant(by audit.Event, t auth.Tenant) error
+	DeleteTenant(by audit.Event, name string) error
+
+	Tokens(tenant string) ([]auth.Token, error)
+	Token(id int64) (auth.Token, error)
+	CreateToken(by audit.Event, t auth.Token) (auth.Token, error)
+	UpdateToken(by audit.Event, t auth.Token) error
+	DeleteToken(by audit.Event, id int64) error
+	RotateToken(by audit.Event, id int64, grace time.Duration) (auth.Token, error)
+}
+
+// SetTenants serves the tenant and token administration endpoints under
+// /v1/admin, authenticated with the master token as validated by v
+func (s *Server) SetTenants(t Tenants, v *auth.Validator, defaultGrace time.Duration) {
+	s.tenants = t
+	s.auth = v
+	s.defaultGrace = defaultGrace
+	s.mux.HandleFunc("GET /v1/admin/tenants", s.master(s.handleListTenants))
+	s.mux.HandleFunc("POST /v1/admin/tenants", s.master(s.handleCreateTenant))
+	s.mux.HandleFunc("GET /v1/admin/tenants/{tenant}", s.master(s.handleGetTenant))
+	s.mux.HandleFunc("PATCH /v1/admin/tenants/{tenant}", s.master(s.handleUpdateTenant))
+	s.mux.HandleFunc("DELETE /v1/admin/tenants/{tenant}", s.master(s.handleDeleteTenant))
+	s.mux.HandleFunc("GET /v1/admin/tenants/{tenant}/tokens", s.master(s.handleListTokens))
+	s.mux.HandleFunc("POST /v1/admin/tenants/{tenant}/tokens", s.master(s.handleCreateToken))
+	s.mux.HandleFunc("GET /v1/admin/tokens/{id}", s.master(s.handleGetToken))
+	s.mux.HandleFunc("PATCH /v1/admin/tokens/{id}", s.master(s.handleUpdateToken))
+	s.mux.HandleFunc("DELETE /v1/admin/tokens/{id}", s.master(s.handleDeleteToken))
+	s.mux.HandleFunc("POST /v1/admin/tokens/{id}/rotate", s.master(s.handleRotateToken))
+}
+
+// adminHandler is an HTTP handler run on behalf of the master token
+type adminHandler func(w http.ResponseWriter, r *http.Request, by audit.Event)
+
+// master rejects, and records, requests whose bearer token is not an
+// active token of the master tenant in the token store
+func (s *Server) master(next adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := audit.Event{RemoteAddr: r.RemoteAddr, Details: map[string]string{"method": r.Method, "path": r.URL.Path}}
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			e.Type, e.Outcome = audit.AuthFailure, audit.Failure
+			s.audit.Record(e)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="redix-admin"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		tok, ok := s.auth.Lookup(token)
+		if !ok {
+			e.Type, e.Outcome, e.Target = audit.AuthFailure, audit.Failure, auth.Redact(token)
+			s.audit.Record(e)
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		e.Tenant = auth.Redact(token)
+		if !auth.IsMasterTenant(tok.Tenant) {
+			e.Type, e.Outcome = audit.ACLDenied, audit.Denied
+			s.audit.Record(e)
+			writeError(w, http.StatusForbidden, "only master token can manage tenants")
+			return
+		}
+		next(w, r, audit.Event{RemoteAddr: r.RemoteAddr, Tenant: e.Tenant})
+	}
+}
+
+// tenantJSON is the JSON form of a tenant
+type tenantJSON struct {
+	Name             string `json:"name"`
+	Active           bool   `json:"active"`
+	MaxChannels      int    `json:"max_channels"`
+	MaxSubscriptions int    `json:"max_subscriptions"`
+}
+
+func newTenantJSON(t auth.Tenant) tenantJSON {
+	return tenantJSON{Name: t.Name, Active: t.Active, MaxChannels: t.MaxChannels, MaxSubscriptions: t.MaxSubscriptions}
+}
+
+// tokenJSON is the JSON form of a token. The token value is only shown in
+// full when it is created.
+type tokenJSON struct {
+	ID        int64      `json:"id"`
+	Token     string     `json:"token"`
+	Tenant    string     `json:"tenant"`
+	Active    bool       `json:"active"`
+	Publish   []string   `json:"publish"`
+	Subscribe []string   `json:"subscribe"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newTokenJSON(t auth.Token, reveal bool) tokenJSON {
+	out := tokenJSON{
+		ID:        t.ID,
+		Token:     t.Token,
+		Tenant:    t.Tenant,
+		Active:    t.Active,
+		Publish:   nonNil(t.ACL.Publish),
+		Subscribe: nonNil(t.ACL.Subscribe),
+	}
+	if !reveal {
+		out.Token = auth.Redact(t.Token)
+	}
+	if !t.ExpiresAt.IsZero() {
+		expires := t.ExpiresAt.UTC()
+		out.ExpiresAt = &expires
+	}
+	return out
+}
+
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	tenants, err := s.tenants.Tenants()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	out := make([]tenantJSON, len(tenants))
+	for i, t := range tenants {
+		out[i] = newTenantJSON(t)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tenants": out})
+}
+
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	req := tenantJSON{Active: true}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t := auth.Tenant{Name: req.Name, Active: req.Active, MaxChannels: req.MaxChannels, MaxSubscriptions: req.MaxSubscriptions}
+	if err := s.tenants.CreateTenant(by, t); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newTenantJSON(t))
+}
+
+func (s *Server) handleGetTenant(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	t, err := s.tenants.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTenantJSON(t))
+}
+
+func (s *Server) handleUpdateTenant(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	var req struct {
+		Active           *bool `json:"active"`
+		MaxChannels      *int  `json:"max_channels"`
+		MaxSubscriptions *int  `json:"max_subscriptions"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := s.tenants.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if req.Active != nil {
+		t.Active = *req.Active
+	}
+	if req.MaxChannels != nil {
+		t.MaxChannels = *req.MaxChannels
+	}
+	if req.MaxSubscriptions != nil {
+		t.MaxSubscriptions = *req.MaxSubscriptions
+	}
+	if err := s.tenants.UpdateTenant(by, t); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTenantJSON(t))
+}
+
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	if err := s.tenants.DeleteTenant(by, r.PathValue("tenant")); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	tenant := r.PathValue("tenant")
+	if _, err := s.tenants.Tenant(tenant); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	tokens, err := s.tenants.Tokens(tenant)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	out := make([]tokenJSON, len(tokens))
+	for i, t := range tokens {
+		out[i] = newTokenJSON(t, false)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tokens": out})
+}
+
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	var req struct {
+		Token     string   `json:"token"`
+		Publish   []string `json:"publish"`
+		Subscribe []string `json:"subscribe"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := s.tenants.CreateToken(by, auth.Token{
+		Token:  req.Token,
+		Tenant: r.PathValue("tenant"),
+		Active: true,
+		ACL:    auth.ACL{Publish: req.Publish, Subscribe: req.Subscribe},
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newTokenJSON(t, true))
+}
+
+func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	t, err := s.tenants.Token(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTokenJSON(t, false))
+}
+
+func (s *Server) handleUpdateToken(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Active    *bool     `json:"active"`
+		Publish   *[]string `json:"publish"`
+		Subscribe *[]string `json:"subscribe"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := s.tenants.Token(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if req.Active != nil {
+		t.Active = *req.Active
+	}
+	if req.Publish != nil {
+		t.ACL.Publish = *req.Publish
+	}
+	if req.Subscribe != nil {
+		t.ACL.Subscribe = *req.Subscribe
+	}
+	if err := s.tenants.UpdateToken(by, t); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTokenJSON(t, false))
+}
+
+func (s *Server) handleDeleteToken(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	if err := s.tenants.DeleteToken(by, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRotateToken(w http.ResponseWriter, r *http.Request, by audit.Event) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		GraceSeconds *int `json:"grace_seconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	grace := s.defaultGrace
+	if req.GraceSeconds != nil {
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+	t, err := s.tenants.RotateToken(by, id, grace)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newTokenJSON(t, true))
+}
+
+// tokenID parses the {id} path value, replying 400 when it is malformed
+func tokenID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "token id must be an integer")
+		return 0, false
+	}
+	return id, true
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.New("invalid JSON body: " + err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// writeStoreError maps a store error to an HTTP status
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, auth.ErrInvalid):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,372 @@
+// Package audit writes an append-only, tamper-evident log of security
+// events. Each record carries the hash of the previous one, so removing or
+// editing a record breaks the chain. Hashes are keyed with a secret when
+// one is configured, and the last record is anchored in a head file, so
+// that the chain can be neither rewritten nor cut short unnoticed.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	AuthSuccess     = "auth.success"
+	AuthFailure     = "auth.failure"
+	ACLDenied       = "acl.denied"
+	AdminDisconnect = "admin.disconnect"
+	AdminClientKill = "admin.client_kill"
+	AdminBridge     = "admin.bridge"
+	AdminTenant     = "admin.tenant"
+	AdminToken      = "admin.token"
+	TokenRevoked    = "token.revoked"
+	ConfigChange    = "config.change"
+	ConfigRewrite   = "config.rewrite"
+	ConfigReload    = "config.reload"
+)
+
+// Outcomes
+const (
+	Success = "success"
+	Failure = "failure"
+	Denied  = "denied"
+)
+
+// GenesisHash is the previous hash of the first record
+var GenesisHash = strings.Repeat("0", 64)
+
+// ErrChainBroken is returned by Verify when a record does not follow the
+// previous one
+var ErrChainBroken = errors.New("audit chain broken")
+
+// Event is one audit record
+type Event struct {
+	Seq        uint64            `json:"seq"`
+	Time       time.Time         `json:"time"`
+	Type       string            `json:"type"`
+	Outcome    string            `json:"outcome"`
+	ConnID     uint64            `json:"conn_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+// computeHash hashes the record with its Hash field empty, with
+// HMAC-SHA256 when key is set and SHA-256 otherwise
+func (e Event) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Options configures a Log
+type Options struct {
+	// MaxSize is the size in bytes after which the file is rotated
+	// (0 disables rotation)
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept
+	MaxFiles int
+	// Key keys the record hashes, so that only its holders can write a
+	// valid chain (empty for plain SHA-256)
+	Key []byte
+}
+
+// Head is the last record of a log, anchored in the file at HeadPath so
+// that records removed from the end of the log are detected
+type Head struct {
+	Seq  uint64
+	Hash string
+}
+
+// HeadPath returns the file anchoring the head of the log at path
+func HeadPath(path string) string {
+	return path + ".head"
+}
+
+// ReadHead returns the anchored head of the log at path, or the zero Head
+// when nothing was recorded yet
+func ReadHead(path string) (Head, error) {
+	data, err := os.ReadFile(HeadPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return Head{}, nil
+	}
+	if err != nil {
+		return Head{}, err
+	}
+	var h Head
+	if _, err := fmt.Sscanf(string(data), "%d %s", &h.Seq, &h.Hash); err != nil {
+		return Head{}, fmt.Errorf("audit: head of %s: %w", path, err)
+	}
+	return h, nil
+}
+
+// Log appends events to a file. A nil *Log discards events, so callers do
+// not need to check whether auditing is enabled.
+type Log struct {
+	path string
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	head *os.File
+	size int64
+	seq  uint64
+	prev string
+}
+
+// Open opens or creates the audit file at path and resumes the hash chain
+// from its last record. It fails with ErrChainBroken when the log ends
+// before its anchored head, so that a cut log is not silently extended.
+func Open(path string, opts Options) (*Log, error) {
+	l := &Log{path: path, opts: opts, prev: GenesisHash}
+
+	last, err := lastEvent(path)
+	if err == nil && last == nil {
+		last, err = lastEvent(rotated(path, 1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+	head, err := ReadHead(path)
+	if err != nil {
+		return nil, err
+	}
+	// The head trails the log by a record when writing it was cut short
+	if head.Seq > l.seq || head.Seq == l.seq && head.Seq > 0 && head.Hash != l.prev {
+		return nil, fmt.Errorf("audit: %s: %w: log ends at seq %d, head is seq %d", path, ErrChainBroken, l.seq, head.Seq)
+	}
+
+	if l.head, err = os.OpenFile(HeadPath(path), os.O_CREATE|os.O_WRONLY, 0o600); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		l.head.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Record appends e to the log, filling in its sequence number, time and
+// hashes. Write failures are logged; auditing never blocks a request.
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.prev
+	hash, err := e.computeHash(l.opts.Key)
+	if err != nil {
+		slog.Error("audit record failed", "type", e.Type, "error", err)
+		return
+	}
+	e.Hash = hash
+
+	line, _ := json.Marshal(e)
+	line = append(line, '\n')
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("audit rotation failed", "error", err)
+		}
+	}
+	if l.f == nil {
+		slog.Error("audit record dropped", "type", e.Type, "error", "audit file not open")
+		return
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("audit record failed", "type", e.Type, "error", err)
+		return
+	}
+	l.seq, l.prev = e.Seq, e.Hash
+	// Fixed-width heads overwrite each other in place
+	if _, err := l.head.WriteAt([]byte(fmt.Sprintf("%020d %s\n", l.seq, l.prev)), 0); err != nil {
+		slog.Error("audit head not written", "seq", l.seq, "error", err)
+	}
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new
+// file. The chain continues into the new file. The caller holds l.mu.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+
+	keep := max(l.opts.MaxFiles, 1)
+	os.Remove(rotated(l.path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(rotated(l.path, i), rotated(l.path, i+1))
+	}
+	if err := os.Rename(l.path, rotated(l.path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
+	}
+	if l.head != nil {
+		if herr := l.head.Close(); err == nil {
+			err = herr
+		}
+		l.head = nil
+	}
+	return err
+}
+
+func rotated(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// lastEvent returns the last record of the file at path, or nil when the
+// file does not exist or is empty
+func lastEvent(path string) (*Event, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("audit: last record of %s: %w", path, err)
+	}
+	return &e, nil
+}
+
+// Verify checks the records read from r, which must follow prevHash, with
+// the key the log was written with. It returns the hash of the last
+// record, to verify rotated files oldest first. VerifyLog also checks the
+// anchored head.
+func Verify(r io.Reader, prevHash string, key []byte) (string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return prevHash, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.PrevHash != prevHash {
+			return prevHash, fmt.Errorf("line %d (seq %d): %w: previous hash does not match", line, e.Seq, ErrChainBroken)
+		}
+		hash, err := e.computeHash(key)
+		if err != nil {
+			return prevHash, err
+		}
+		if hash != e.Hash {
+			return prevHash, fmt.Errorf("line %d (seq %d): %w: record was modified", line, e.Seq, ErrChainBroken)
+		}
+		prevHash = e.Hash
+	}
+	return prevHash, sc.Err()
+}
+
+// VerifyLog checks the log at path and its rotated files, oldest first,
+// and that the log ends at its anchored head. When there are rotated
+// files, the oldest one is taken to follow its first record, as older
+// files are dropped.
+func VerifyLog(path string, key []byte) error {
+	paths := []string{path}
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotated(path, n)); err != nil {
+			break
+		}
+		paths = append([]string{rotated(path, n)}, paths...)
+	}
+
+	prev := GenesisHash
+	for i, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if i == 0 && len(paths) > 1 {
+			var first Event
+			line, _, _ := bytes.Cut(data, []byte("\n"))
+			if err := json.Unmarshal(line, &first); err != nil {
+				return fmt.Errorf("%s: line 1: %w", p, err)
+			}
+			prev = first.PrevHash
+		}
+		if prev, err = Verify(bytes.NewReader(data), prev, key); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	head, err := ReadHead(path)
+	if err != nil {
+		return err
+	}
+	if head.Hash != prev && (head.Seq > 0 || prev != GenesisHash) {
+		return fmt.Errorf("%s: %w: log does not end at its head, seq %d", path, ErrChainBroken, head.Seq)
+	}
+	return nil
+}
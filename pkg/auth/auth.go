@@ -1,32 +1,129 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
+	"log/slog"
+	"strings"
 )
 
 const (
 	// MasterToken is the special token that has administrative privileges
 	MasterToken = "MASTER_TOKEN"
+	// MasterTenant is the tenant of the master token. The name is
+	// reserved.
+	MasterTenant = MasterToken
+	// AllTenants is the publisher of a broadcast, which reaches the
+	// subscribers of every tenant. The name is reserved.
+	AllTenants = "*"
+	// TokenTenantPrefix starts the tenant of a token stored without one,
+	// keeping those tenants apart from named ones. Tenant names with the
+	// prefix are reserved.
+	TokenTenantPrefix = "token:"
 )
 
 // Validator handles token validation
 type Validator struct {
-	db *sql.DB
+	store Store
 }
 
-// NewValidator creates a new token validator
+// NewValidator creates a new token validator backed by the SQL token store
 func NewValidator(db *sql.DB) *Validator {
-	return &Validator{db: db}
+	return NewStoreValidator(NewSQLStore(db))
+}
+
+// NewStoreValidator creates a new token validator backed by store
+func NewStoreValidator(store Store) *Validator {
+	return &Validator{store: store}
+}
+
+// Store returns the store holding tenants and tokens
+func (v *Validator) Store() Store {
+	return v.store
 }
 
 // IsValidToken checks if a token is valid
 func (v *Validator) IsValidToken(token string) bool {
-	var count int
-	_ = v.db.QueryRow("SELECT COUNT(*) FROM clients WHERE token = ? AND is_active = 1", token).Scan(&count)
-	return count > 0
+	_, ok := v.Lookup(token)
+	return ok
+}
+
+// Lookup returns an active token with its tenant resolved: tokens without
+// a tenant are their own tenant, named by TokenTenant, and the master
+// token belongs to MasterTenant.
+func (v *Validator) Lookup(token string) (Token, bool) {
+	t, err := v.store.Lookup(token)
+	if err != nil {
+		if err != ErrNotFound {
+			slog.Error("token lookup failed", "tenant", Redact(token), "error", err)
+		}
+		return Token{}, false
+	}
+	t.Tenant = tenantOf(token, t.Tenant)
+	return t, true
+}
+
+// tenantOf returns the tenant of token given its stored tenant name
+func tenantOf(token, name string) string {
+	switch {
+	case IsMasterToken(token):
+		return MasterTenant
+	case name == "" || name == AllTenants:
+		return TokenTenant(token)
+	}
+	return name
+}
+
+// TokenTenant returns the tenant of a token stored without one
+func TokenTenant(token string) string {
+	if IsMasterToken(token) {
+		return MasterTenant
+	}
+	return TokenTenantPrefix + token
+}
+
+// Ping checks that the token store is reachable
+func (v *Validator) Ping(ctx context.Context) error {
+	return v.store.Ping(ctx)
 }
 
 // IsMasterToken checks if a token is the master token
 func IsMasterToken(token string) bool {
 	return token == MasterToken
 }
+
+// IsMasterTenant checks if a tenant is the master tenant
+func IsMasterTenant(tenant string) bool {
+	return tenant == MasterTenant
+}
+
+// IsTokenTenant checks if a tenant is the tenant of a token stored
+// without one
+func IsTokenTenant(tenant string) bool {
+	return strings.HasPrefix(tenant, TokenTenantPrefix)
+}
+
+// RedactTenant returns a form of tenant that is safe to log, redacting the
+// token of a TokenTenant
+func RedactTenant(tenant string) string {
+	if token, ok := strings.CutPrefix(tenant, TokenTenantPrefix); ok {
+		return TokenTenantPrefix + Redact(token)
+	}
+	return tenant
+}
+
+// IsBroadcast checks if a publisher tenant is AllTenants
+func IsBroadcast(tenant string) bool {
+	return tenant == AllTenants
+}
+
+// Redact returns a form of token that is safe to log
+func Redact(token string) string {
+	if IsMasterToken(token) {
+		return "master"
+	}
+	if len(token) <= 4 {
+		return "****"
+	}
+	return token[:4] + "****"
+}
@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"redix/pkg/glob"
+)
+
+// Errors returned by a Store
+var (
+	ErrNotFound = errors.New("no such tenant or token")
+	ErrExists   = errors.New("tenant or token already exists")
+	ErrInvalid  = errors.New("invalid tenant or token")
+)
+
+// Tenant is a namespace of channels shared by its tokens. Zero limits
+// fall back to the configured defaults.
+type Tenant struct {
+	Name             string
+	Active           bool
+	MaxChannels      int
+	MaxSubscriptions int
+}
+
+// Token is a credential of a tenant
+type Token struct {
+	ID     int64
+	Token  string
+	Tenant string
+	Active bool
+	ACL    ACL
+	// ExpiresAt ends the grace period of a rotated token; zero means the
+	// token does not expire
+	ExpiresAt time.Time
+}
+
+// ACL restricts the channels a token may use. Each list holds glob
+// patterns; an empty list allows every channel.
+type ACL struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// CanPublish reports whether the ACL allows publishing on channel
+func (a ACL) CanPublish(channel string) bool {
+	return allowed(a.Publish, channel)
+}
+
+// CanSubscribe reports whether the ACL allows subscribing to a channel or
+// pattern
+func (a ACL) CanSubscribe(name string) bool {
+	return allowed(a.Subscribe, name)
+}
+
+func allowed(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if glob.Match(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store holds tenants and tokens. It can be backed by anything; NewSQLStore
+// uses the SQL token store.
+type Store interface {
+	// Lookup returns an active, unexpired token of an active tenant, or
+	// ErrNotFound
+	Lookup(token string) (Token, error)
+	Ping(ctx context.Context) error
+
+	Tenants() ([]Tenant, error)
+	Tenant(name string) (Tenant, error)
+	CreateTenant(t Tenant) error
+	UpdateTenant(t Tenant) error
+	// DeleteTenant deletes a tenant and its tokens
+	DeleteTenant(name string) error
+
+	Tokens(tenant string) ([]Token, error)
+	Token(id int64) (Token, error)
+	// CreateToken stores a token and returns its ID
+	CreateToken(t Token) (int64, error)
+	UpdateToken(t Token) error
+	DeleteToken(id int64) error
+}
+
+// GenerateToken returns a new random token
+func GenerateToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Schema levels of the SQL token store, newest first
+const (
+	schemaTenants      = iota // tenants table, ACLs and expiry
+	schemaTenantColumn        // clients.tenant only
+	schemaLegacy              // clients(token, is_active)
+)
+
+// SQLStore is a Store backed by the clients and tenants tables
+type SQLStore struct {
+	db *sql.DB
+	// schema is the newest schema level the database was found to have, so
+	// token stores created before tenants keep working
+	schema atomic.Int32
+}
+
+// NewSQLStore creates a store using db
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Ping checks that the database is reachable
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Lookup implements Store
+func (s *SQLStore) Lookup(token string) (Token, error) {
+	for {
+		level := s.schema.Load()
+		t, err := s.lookup(level, token)
+		if err == nil || err == ErrNotFound || level == schemaLegacy {
+			return t, err
+		}
+		// Only a schema mismatch moves to an older level: the table itself
+		// must still be readable
+		if s.db.QueryRow("SELECT 1 FROM clients WHERE 1 = 0").Scan() != sql.ErrNoRows {
+			return Token{}, err
+		}
+		s.schema.CompareAndSwap(level, level+1)
+	}
+}
+
+func (s *SQLStore) lookup(level int32, token string) (Token, error) {
+	t := Token{Token: token, Active: true}
+	var err error
+	switch level {
+	case schemaTenants:
+		var tenant, publish, subscribe sql.NullString
+		var expires sql.NullTime
+		err = s.db.QueryRow(`SELECT c.id, c.tenant, c.publish_acl, c.subscribe_acl, c.expires_at
+			FROM clients c LEFT JOIN tenants t ON t.name = c.tenant
+			WHERE c.token = ? AND c.is_active = 1 AND (c.expires_at IS NULL OR c.expires_at > ?)
+			AND (t.is_active IS NULL OR t.is_active = 1)`, token, time.Now().UTC()).
+			Scan(&t.ID, &tenant, &publish, &subscribe, &expires)
+		if err == nil {
+			t.Tenant = tenant.String
+			t.ExpiresAt = expires.Time
+			err = decodeACL(&t.ACL, publish, subscribe)
+		}
+	case schemaTenantColumn:
+		var tenant sql.NullString
+		err = s.db.QueryRow("SELECT tenant FROM clients WHERE token = ? AND is_active = 1", token).Scan(&tenant)
+		t.Tenant = tenant.String
+	default:
+		var count int
+		err = s.db.QueryRow("SELECT COUNT(*) FROM clients WHERE token = ? AND is_active = 1", token).Scan(&count)
+		if err == nil && count == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		return Token{}, ErrNotFound
+	}
+	return t, err
+}
+
+// Tenants implements Store
+func (s *SQLStore) Tenants() ([]Tenant, error) {
+	rows, err := s.db.Query("SELECT name, is_active, max_channels, max_subscriptions FROM tenants ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.Name, &t.Active, &t.MaxChannels, &t.MaxSubscriptions); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// Tenant implements Store
+func (s *SQLStore) Tenant(name string) (Tenant, error) {
+	t := Tenant{Name: name}
+	err := s.db.QueryRow("SELECT is_active, max_channels, max_subscriptions FROM tenants WHERE name = ?", name).
+		Scan(&t.Active, &t.MaxChannels, &t.MaxSubscriptions)
+	if err == sql.ErrNoRows {
+		return Tenant{}, ErrNotFound
+	}
+	return t, err
+}
+
+// CreateTenant implements Store
+func (s *SQLStore) CreateTenant(t Tenant) error {
+	if _, err := s.Tenant(t.Name); err != ErrNotFound {
+		if err == nil {
+			return ErrExists
+		}
+		return err
+	}
+	_, err := s.db.Exec("INSERT INTO tenants (name, is_active, max_channels, max_subscriptions) VALUES (?, ?, ?, ?)",
+		t.Name, t.Active, t.MaxChannels, t.MaxSubscriptions)
+	return err
+}
+
+// UpdateTenant implements Store
+func (s *SQLStore) UpdateTenant(t Tenant) error {
+	res, err := s.db.Exec("UPDATE tenants SET is_active = ?, max_channels = ?, max_subscriptions = ? WHERE name = ?",
+		t.Active, t.MaxChannels, t.MaxSubscriptions, t.Name)
+	return affected(res, err)
+}
+
+// DeleteTenant implements Store
+func (s *SQLStore) DeleteTenant(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM tenants WHERE name = ?", name)
+	if err := affected(res, err); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM clients WHERE tenant = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const tokenColumns = "id, token, tenant, is_active, publish_acl, subscribe_acl, expires_at"
+
+// Tokens implements Store
+func (s *SQLStore) Tokens(tenant string) ([]Token, error) {
+	rows, err := s.db.Query("SELECT "+tokenColumns+" FROM clients WHERE tenant = ? ORDER BY id", tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Token implements Store
+func (s *SQLStore) Token(id int64) (Token, error) {
+	t, err := scanToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM clients WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Token{}, ErrNotFound
+	}
+	return t, err
+}
+
+// CreateToken implements Store
+func (s *SQLStore) CreateToken(t Token) (int64, error) {
+	var exists int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM clients WHERE token = ?", t.Token).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists > 0 {
+		return 0, ErrExists
+	}
+	publish, subscribe, err := encodeACL(t.ACL)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`INSERT INTO clients (token, tenant, is_active, publish_acl, subscribe_acl, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, t.Token, t.Tenant, t.Active, publish, subscribe, nullTime(t.ExpiresAt))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// UpdateToken implements Store. The token value and tenant do not change.
+func (s *SQLStore) UpdateToken(t Token) error {
+	publish, subscribe, err := encodeACL(t.ACL)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec("UPDATE clients SET is_active = ?, publish_acl = ?, subscribe_acl = ?, expires_at = ? WHERE id = ?",
+		t.Active, publish, subscribe, nullTime(t.ExpiresAt), t.ID)
+	return affected(res, err)
+}
+
+// DeleteToken implements Store
+func (s *SQLStore) DeleteToken(id int64) error {
+	res, err := s.db.Exec("DELETE FROM clients WHERE id = ?", id)
+	return affected(res, err)
+}
+
+// scanner is a *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (Token, error) {
+	var t Token
+	var tenant, publish, subscribe sql.NullString
+	var expires sql.NullTime
+	if err := row.Scan(&t.ID, &t.Token, &tenant, &t.Active, &publish, &subscribe, &expires); err != nil {
+		return Token{}, err
+	}
+	t.Tenant = tenant.String
+	t.ExpiresAt = expires.Time
+	return t, decodeACL(&t.ACL, publish, subscribe)
+}
+
+// encodeACL returns the ACL lists as JSON columns, NULL when empty
+func encodeACL(a ACL) (publish, subscribe sql.NullString, err error) {
+	for _, c := range []struct {
+		list []string
+		col  *sql.NullString
+	}{{a.Publish, &publish}, {a.Subscribe, &subscribe}} {
+		if len(c.list) == 0 {
+			continue
+		}
+		b, err := json.Marshal(c.list)
+		if err != nil {
+			return publish, subscribe, err
+		}
+		*c.col = sql.NullString{String: string(b), Valid: true}
+	}
+	return publish, subscribe, nil
+}
+
+func decodeACL(a *ACL, publish, subscribe sql.NullString) error {
+	if publish.Valid && publish.String != "" {
+		if err := json.Unmarshal([]byte(publish.String), &a.Publish); err != nil {
+			return err
+		}
+	}
+	if subscribe.Valid && subscribe.String != "" {
+		if err := json.Unmarshal([]byte(subscribe.String), &a.Subscribe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// affected turns an update of no rows into ErrNotFound
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,593 @@
+// Package backplane relays publishes between Redix nodes through a Redis
+// server, so stateless nodes behind a load balancer share one message
+// space.
+//
+// Every local publish is sent to Redis with PUBLISH on a namespaced
+// channel, <prefix><tenant>:<channel>. The tenant part is a hash of the
+// publisher's tenant, so tokens never reach Redis, or "all" for
+// broadcasts. Each node subscribes in Redis to the channels and patterns its
+// own clients need, in their tenant's namespace and in the broadcast one, and
+// delivers what arrives to its local subscribers only. Messages carry the
+// ID of the node that published them, so a node skips its own publishes.
+// Shard channels are relayed the same way under <prefix>shard:.
+package backplane
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+	pingInterval = 5 * time.Second
+	maxBackoff   = 5 * time.Second
+	// queueSize bounds the commands waiting to be written to Redis.
+	// Publishes beyond it are dropped.
+	queueSize = 8192
+	// dedupSize is how many recent message IDs are remembered, since a
+	// publish matching several of a node's subscriptions arrives once per
+	// subscription
+	dedupSize = 1024
+	// resubscribeBatch is how many channels or patterns one SUBSCRIBE or
+	// PSUBSCRIBE carries when resubscribing after a reconnect
+	resubscribeBatch = 1000
+	// broadcastNamespace is the namespace of broadcasts
+	broadcastNamespace = "all"
+	// shardPrefix marks the Redis channels of shard channels, which are
+	// separate from regular channels
+	shardPrefix = "shard:"
+)
+
+// DefaultPrefix is the channel prefix used when Options.Prefix is empty
+const DefaultPrefix = "redix:"
+
+// Options configures a Backplane
+type Options struct {
+	// Addr is the Redis server address
+	Addr string
+	// Username and Password authenticate to Redis when set
+	Username string
+	Password string
+	// Prefix namespaces the Redis channels, so several Redix deployments
+	// can share a Redis
+	Prefix string
+}
+
+// Stats counts the messages relayed through Redis
+type Stats struct {
+	// Connected is set while both Redis connections are up
+	Connected bool
+	Published uint64
+	Received  uint64
+	// Dropped counts publishes discarded because Redis was too slow or
+	// unreachable for too long
+	Dropped uint64
+}
+
+// Backplane bridges a local PubSub to Redis
+type Backplane struct {
+	opts   Options
+	pubsub *pubsub.PubSub
+	log    *slog.Logger
+	origin string
+	pubQ   chan string
+
+	mu       sync.Mutex
+	sub      *link
+	pubUp    bool
+	channels map[string]int // Redis channels subscribed to
+	patterns map[string]int // Redis patterns subscribed to
+	tenants  map[string]*tenant
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+	conns    map[net.Conn]struct{}
+
+	// seen holds recently delivered message IDs, oldest first in ring
+	seenMu sync.Mutex
+	seen   map[string]struct{}
+	ring   []string
+
+	published atomic.Uint64
+	received  atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// tenant maps a Redis namespace back to the tenant of local subscribers
+type tenant struct {
+	name string
+	refs int
+}
+
+// link is the subscriber connection's write queue
+type link struct {
+	conn net.Conn
+	out  chan string
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// send queues a command without blocking. A full queue closes the link,
+// which resubscribes everything on reconnect.
+func (l *link) send(cmd string) {
+	select {
+	case l.out <- cmd:
+	default:
+		l.close()
+	}
+}
+
+// New creates a backplane for ps. Call Start to connect to Redis.
+func New(ps *pubsub.PubSub, opts Options) *Backplane {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	b := &Backplane{
+		opts:     opts,
+		pubsub:   ps,
+		log:      slog.Default().With("component", "backplane", "redis", opts.Addr),
+		origin:   hex.EncodeToString(id),
+		pubQ:     make(chan string, queueSize),
+		channels: make(map[string]int),
+		patterns: make(map[string]int),
+		tenants:  make(map[string]*tenant),
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		seen:     make(map[string]struct{}),
+	}
+	ps.WatchInterest(b.interestChanged)
+	ps.OnPublish(b.forward)
+	return b
+}
+
+// Start connects to Redis and keeps reconnecting until Close
+func (b *Backplane) Start() {
+	b.wg.Add(2)
+	go b.retry("publisher", b.runPublisher)
+	go b.retry("subscriber", b.runSubscriber)
+}
+
+// Close disconnects from Redis and waits for the connection goroutines to
+// exit
+func (b *Backplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+// Stats returns the relay counters
+func (b *Backplane) Stats() Stats {
+	b.mu.Lock()
+	connected := b.pubUp && b.sub != nil
+	b.mu.Unlock()
+	return Stats{
+		Connected: connected,
+		Published: b.published.Load(),
+		Received:  b.received.Load(),
+		Dropped:   b.dropped.Load(),
+	}
+}
+
+// namespace returns the Redis channel segment for tenant
+func namespace(tenant string) string {
+	if auth.IsBroadcast(tenant) {
+		return broadcastNamespace
+	}
+	sum := sha256.Sum256([]byte(tenant))
+	return hex.EncodeToString(sum[:16])
+}
+
+// escapeGlob escapes the Redis glob metacharacters in s
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// interestChanged subscribes in Redis to what a local interest needs: the
+// tenant's namespace and the broadcast one. It runs with the PubSub locked.
+func (b *Backplane) interestChanged(in pubsub.Interest, added bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ns := namespace(in.Tenant)
+	if ns != broadcastNamespace {
+		t := b.tenants[ns]
+		if added {
+			if t == nil {
+				t = &tenant{name: in.Tenant}
+				b.tenants[ns] = t
+			}
+			t.refs++
+		} else if t != nil {
+			if t.refs--; t.refs <= 0 {
+				delete(b.tenants, ns)
+			}
+		}
+	}
+
+	index, prefix, sub, unsub := b.channels, b.opts.Prefix, "SUBSCRIBE", "UNSUBSCRIBE"
+	if in.Pattern {
+		index, prefix, sub, unsub = b.patterns, escapeGlob(b.opts.Prefix), "PSUBSCRIBE", "PUNSUBSCRIBE"
+	}
+	if in.Shard {
+		prefix += shardPrefix
+	}
+	names := []string{prefix + ns + ":" + in.Name}
+	if ns != broadcastNamespace {
+		names = append(names, prefix+broadcastNamespace+":"+in.Name)
+	}
+	for _, name := range names {
+		n := index[name]
+		switch {
+		case added:
+			index[name] = n + 1
+		case n > 1:
+			index[name] = n - 1
+		default:
+			delete(index, name)
+		}
+		if b.sub == nil {
+			continue
+		}
+		if added && n == 0 {
+			b.sub.send(protocol.FormatArray(sub, name))
+		} else if !added && n == 1 {
+			b.sub.send(protocol.FormatArray(unsub, name))
+		}
+	}
+}
+
+// forward sends a local publish to Redis
+func (b *Backplane) forward(publisher string, msg client.Message) {
+	prefix := b.opts.Prefix
+	if msg.Sharded {
+		prefix += shardPrefix
+	}
+	channel := prefix + namespace(publisher) + ":" + msg.Topic
+	id := b.origin + ":" + strconv.FormatUint(msg.ID, 10)
+	select {
+	case b.pubQ <- protocol.FormatArray("PUBLISH", channel, id+":"+msg.Payload):
+	default:
+		if b.dropped.Add(1) == 1 {
+			b.log.Warn("dropping publishes: Redis is not keeping up")
+		}
+	}
+}
+
+// receive delivers a message from a Redis channel to the local subscribers
+func (b *Backplane) receive(channel, data string) {
+	rest, ok := strings.CutPrefix(channel, b.opts.Prefix)
+	if !ok {
+		return
+	}
+	rest, sharded := strings.CutPrefix(rest, shardPrefix)
+	ns, topic, ok := strings.Cut(rest, ":")
+	if !ok {
+		return
+	}
+	origin, rest, ok1 := strings.Cut(data, ":")
+	seq, payload, ok2 := strings.Cut(rest, ":")
+	// A bridged message is published once per tenant with the same ID, so
+	// the channel is part of the key
+	if !ok1 || !ok2 || origin == b.origin || !b.firstSeen(channel+" "+origin+":"+seq) {
+		return
+	}
+
+	name := auth.AllTenants
+	if ns != broadcastNamespace {
+		b.mu.Lock()
+		t := b.tenants[ns]
+		b.mu.Unlock()
+		if t == nil {
+			return
+		}
+		name = t.name
+	}
+	b.received.Add(1)
+	if sharded {
+		b.pubsub.SDeliver(topic, payload, name)
+	} else {
+		b.pubsub.Deliver(topic, payload, name)
+	}
+}
+
+// firstSeen records id and reports whether it was not seen recently
+func (b *Backplane) firstSeen(id string) bool {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	if len(b.ring) >= dedupSize {
+		delete(b.seen, b.ring[0])
+		b.ring = b.ring[1:]
+	}
+	b.seen[id] = struct{}{}
+	b.ring = append(b.ring, id)
+	return true
+}
+
+// retry runs a connection until Close, reconnecting with backoff
+func (b *Backplane) retry(role string, run func(net.Conn, *protocol.Reader) error) {
+	defer b.wg.Done()
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+
+		conn, r, err := b.dial()
+		if err == nil {
+			b.log.Info("redis connection up", "role", role)
+			err = run(conn, r)
+			b.untrack(conn)
+			backoff = 100 * time.Millisecond
+		}
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		b.log.Warn("redis connection down", "role", role, "error", err)
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// dial connects and authenticates to Redis
+func (b *Backplane) dial() (net.Conn, *protocol.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.opts.Addr, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		conn.Close()
+		return nil, nil, errors.New("backplane closed")
+	}
+	b.conns[conn] = struct{}{}
+	b.mu.Unlock()
+
+	r := protocol.NewReader(conn)
+	if b.opts.Password != "" {
+		args := []string{"AUTH", b.opts.Password}
+		if b.opts.Username != "" {
+			args = []string{"AUTH", b.opts.Username, b.opts.Password}
+		}
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		if _, err := conn.Write([]byte(protocol.FormatArray(args...))); err != nil {
+			b.untrack(conn)
+			return nil, nil, err
+		}
+		reply, err := r.ReadValue()
+		if err == nil && reply.Type == protocol.Error {
+			err = fmt.Errorf("AUTH: %s", reply.Str)
+		}
+		if err != nil {
+			b.untrack(conn)
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, r, nil
+}
+
+func (b *Backplane) untrack(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
+
+// runPublisher writes queued publishes until the connection fails
+func (b *Backplane) runPublisher(conn net.Conn, r *protocol.Reader) error {
+	b.mu.Lock()
+	b.pubUp = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.pubUp = false
+		b.mu.Unlock()
+	}()
+
+	// Replies are receiver counts; errors are logged
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			v, err := r.ReadValue()
+			if err != nil {
+				failed <- err
+				conn.Close()
+				return
+			}
+			if v.Type == protocol.Error {
+				b.log.Warn("redis rejected publish", "error", v.Str)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	var buf []byte
+	for {
+		var sent uint64
+		select {
+		case cmd := <-b.pubQ:
+			buf, sent = append(buf[:0], cmd...), 1
+			for more := true; more && len(buf) < 64<<10; {
+				select {
+				case cmd := <-b.pubQ:
+					buf = append(buf, cmd...)
+					sent++
+				default:
+					more = false
+				}
+			}
+		case <-ping.C:
+			buf = append(buf[:0], protocol.FormatArray("PING")...)
+		case err := <-failed:
+			return err
+		case <-b.done:
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		b.published.Add(sent)
+	}
+}
+
+// runSubscriber subscribes to every needed channel and pattern, then
+// delivers messages until the connection fails
+func (b *Backplane) runSubscriber(conn net.Conn, r *protocol.Reader) error {
+	l := &link{conn: conn, out: make(chan string, queueSize), done: make(chan struct{})}
+	b.mu.Lock()
+	// The current subscriptions are written before the queue rather than
+	// through it, as there may be more of them than it holds. Changes from
+	// here on are queued behind them.
+	resubscribe := batch("SUBSCRIBE", b.channels)
+	resubscribe = append(resubscribe, batch("PSUBSCRIBE", b.patterns)...)
+	b.sub = l
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		if b.sub == l {
+			b.sub = nil
+		}
+		b.mu.Unlock()
+		l.close()
+	}()
+
+	go b.writeLoop(l, resubscribe)
+	for {
+		// Pings are answered at least every pingInterval
+		conn.SetReadDeadline(time.Now().Add(3 * pingInterval))
+		v, err := r.ReadValue()
+		if err != nil {
+			return err
+		}
+		if v.Type == protocol.Error {
+			b.log.Warn("redis rejected subscription", "error", v.Str)
+			continue
+		}
+		if len(v.Array) < 3 {
+			continue
+		}
+		switch kind := v.Array[0].Str; {
+		case kind == "message":
+			b.receive(v.Array[1].Str, v.Array[2].Str)
+		case kind == "pmessage" && len(v.Array) == 4:
+			b.receive(v.Array[2].Str, v.Array[3].Str)
+		}
+	}
+}
+
+// batch formats cmd over names, resubscribeBatch names per command
+func batch(cmd string, names map[string]int) []byte {
+	var out []byte
+	args := []string{cmd}
+	for name := range names {
+		args = append(args, name)
+		if len(args) > resubscribeBatch {
+			out = append(out, protocol.FormatArray(args...)...)
+			args = args[:1]
+		}
+	}
+	if len(args) > 1 {
+		out = append(out, protocol.FormatArray(args...)...)
+	}
+	return out
+}
+
+// writeLoop writes first, then subscription changes and pings to the
+// subscriber connection. It runs beside the reader, so Redis can answer
+// a long resubscription without either side blocking.
+func (b *Backplane) writeLoop(l *link, first []byte) {
+	defer l.close()
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := l.conn.Write(first); err != nil {
+		return
+	}
+	var buf []byte
+	for {
+		select {
+		case cmd := <-l.out:
+			buf = append(buf[:0], cmd...)
+			for more := true; more && len(buf) < 64<<10; {
+				select {
+				case cmd := <-l.out:
+					buf = append(buf, cmd...)
+				default:
+					more = false
+				}
+			}
+		case <-ping.C:
+			buf = append(buf[:0], protocol.FormatArray("PING")...)
+		case <-l.done:
+			return
+		case <-b.done:
+			return
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := l.conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package bridge persists the cross-tenant channel bridges defined by the
+// administrator in the SQL token store
+package bridge
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"redix/pkg/pubsub"
+)
+
+// Store persists bridges next to the tokens in the SQL token store
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new bridge store
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Add stores a bridge and returns its ID
+func (s *Store) Add(b pubsub.Bridge) (int64, error) {
+	targets, err := json.Marshal(b.Targets)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(
+		"INSERT INTO bridges (tenant, channel, targets, read_only) VALUES (?, ?, ?, ?)",
+		b.Tenant, b.Channel, string(targets), b.ReadOnly)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Remove deletes a bridge
+func (s *Store) Remove(id int64) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM bridges WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// All returns every stored bridge
+func (s *Store) All() ([]pubsub.Bridge, error) {
+	rows, err := s.db.Query("SELECT id, tenant, channel, targets, read_only FROM bridges ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bridges []pubsub.Bridge
+	for rows.Next() {
+		var b pubsub.Bridge
+		var targets string
+		if err := rows.Scan(&b.ID, &b.Tenant, &b.Channel, &targets, &b.ReadOnly); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(targets), &b.Targets); err != nil {
+			return nil, err
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges, rows.Err()
+}
@@ -1,25 +1,128 @@
 package client
 
 import (
+	"errors"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/protocol"
 )
 
+// Message is a published message pushed to a subscriber
+type Message struct {
+	ID      uint64
+	Topic   string
+	Payload string
+	// Pattern is the matching pattern for pattern subscriptions
+	Pattern string
+	// Sharded is set for messages published with SPUBLISH
+	Sharded bool
+}
+
+// Transport delivers server pushes to clients that do not speak RESP,
+// such as WebSocket and SSE subscribers
+type Transport interface {
+	Message(msg Message) error
+	Error(message string) error
+	Close() error
+}
+
 // Client represents a connected client
 type Client struct {
-	Conn   net.Conn
-	Token  string
-	Authed bool
-	Subs   map[string]bool
-	mu     sync.RWMutex
+	// ID identifies the connection in logs
+	ID        uint64
+	Conn      net.Conn
+	Token     string
+	Tenant    string // empty when the token is its own tenant
+	ACL       auth.ACL
+	Authed    bool
+	Subs      map[string]bool
+	PSubs     map[string]bool
+	SSubs     map[string]bool
+	Groups    map[string]bool // consumer groups joined with RSUBSCRIBE
+	Transport Transport
+	// WriteTimeout bounds each write; a client that does not accept a
+	// write in time is disconnected (0 disables the deadline)
+	WriteTimeout time.Duration
+	log          *slog.Logger
+	mu           sync.RWMutex
 }
 
 // New creates a new client instance
 func New(conn net.Conn) *Client {
 	return &Client{
-		Conn: conn,
-		Subs: make(map[string]bool),
+		Conn:   conn,
+		Subs:   make(map[string]bool),
+		PSubs:  make(map[string]bool),
+		SSubs:  make(map[string]bool),
+		Groups: make(map[string]bool),
+	}
+}
+
+// Logger returns the logger carrying the client's connection attributes
+func (c *Client) Logger() *slog.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.log == nil {
+		return slog.Default()
 	}
+	return c.log
+}
+
+// SetLogger replaces the client's logger
+func (c *Client) SetLogger(l *slog.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.log = l
+}
+
+// Authenticate marks the client as authenticated with t
+func (c *Client) Authenticate(t auth.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Token = t.Token
+	c.Tenant = t.Tenant
+	c.ACL = t.ACL
+	c.Authed = true
+}
+
+// AuthenticatedAs reports whether the client is authenticated with token.
+// It is safe to call from other goroutines.
+func (c *Client) AuthenticatedAs(token string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Authed && c.Token == token
+}
+
+// Authenticated reports whether the client is authenticated. It is safe
+// to call from other goroutines.
+func (c *Client) Authenticated() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Authed
+}
+
+// AuthToken returns the token the client authenticated with, and false
+// when it is not authenticated. It is safe to call from other goroutines.
+func (c *Client) AuthToken() (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Token, c.Authed
+}
+
+// Namespace returns the tenant whose channels the client uses. It is safe
+// to call from other goroutines.
+func (c *Client) Namespace() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.Tenant != "" {
+		return c.Tenant
+	}
+	return c.Token
 }
 
 // IsSubscribed checks if the client is subscribed to a topic
@@ -43,20 +146,177 @@ func (c *Client) Unsubscribe(topic string) {
 	delete(c.Subs, topic)
 }
 
-// UnsubscribeAll removes all topics from the client's subscriptions
+// SubscribePattern adds a pattern to the client's subscriptions
+func (c *Client) SubscribePattern(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PSubs[pattern] = true
+}
+
+// UnsubscribePattern removes a pattern from the client's subscriptions
+func (c *Client) UnsubscribePattern(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.PSubs, pattern)
+}
+
+// SubscribeShard adds a shard channel to the client's subscriptions
+func (c *Client) SubscribeShard(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SSubs[topic] = true
+}
+
+// UnsubscribeShard removes a shard channel from the client's subscriptions
+func (c *Client) UnsubscribeShard(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.SSubs, topic)
+}
+
+// JoinGroup records that the client consumes for a reliable consumer group
+func (c *Client) JoinGroup(group string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Groups == nil {
+		c.Groups = make(map[string]bool)
+	}
+	c.Groups[group] = true
+}
+
+// LeaveGroup removes a consumer group from the client's groups
+func (c *Client) LeaveGroup(group string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.Groups, group)
+}
+
+// UnsubscribeAll removes all topics, patterns, shard channels and consumer
+// groups from the client's subscriptions
 func (c *Client) UnsubscribeAll() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.Subs = make(map[string]bool)
+	c.PSubs = make(map[string]bool)
+	c.SSubs = make(map[string]bool)
+	c.Groups = make(map[string]bool)
+}
+
+// Subscriptions returns the topics the client is subscribed to
+func (c *Client) Subscriptions() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	topics := make([]string, 0, len(c.Subs))
+	for topic := range c.Subs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Patterns returns the patterns the client is subscribed to
+func (c *Client) Patterns() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	patterns := make([]string, 0, len(c.PSubs))
+	for pattern := range c.PSubs {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// ShardSubscriptions returns the shard channels the client is subscribed to
+func (c *Client) ShardSubscriptions() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	topics := make([]string, 0, len(c.SSubs))
+	for topic := range c.SSubs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// ConsumerGroups returns the consumer groups the client consumes for
+func (c *Client) ConsumerGroups() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	groups := make([]string, 0, len(c.Groups))
+	for group := range c.Groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// GroupCount returns the number of consumer groups the client consumes for
+func (c *Client) GroupCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Groups)
+}
+
+// SubscriptionCount returns the number of topics and patterns the client is subscribed to
+func (c *Client) SubscriptionCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Subs) + len(c.PSubs)
+}
+
+// ShardSubscriptionCount returns the number of shard channels the client
+// is subscribed to
+func (c *Client) ShardSubscriptionCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.SSubs)
 }
 
 // Write sends a message to the client
 func (c *Client) Write(message string) error {
+	if c.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
 	_, err := c.Conn.Write([]byte(message))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// A partial frame may have been written, so the connection
+		// cannot be used any more
+		c.Logger().Warn("write timed out, closing connection", "timeout", c.WriteTimeout)
+		c.Conn.Close()
+	}
 	return err
 }
 
-// Close closes the client's connection
+// SetReadDeadline bounds the next read from the connection (the zero time
+// removes the deadline)
+func (c *Client) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Deliver pushes a published message to the client, using its Transport
+// when set and a RESP message frame otherwise
+func (c *Client) Deliver(msg Message) error {
+	if c.Transport != nil {
+		return c.Transport.Message(msg)
+	}
+	if msg.Sharded {
+		return c.Write(protocol.FormatSMessage(msg.Topic, msg.Payload))
+	}
+	if msg.Pattern != "" {
+		return c.Write(protocol.FormatPMessage(msg.Pattern, msg.Topic, msg.Payload))
+	}
+	return c.Write(protocol.FormatMessage(msg.Topic, msg.Payload))
+}
+
+// WriteError pushes an error to the client, using its Transport when set
+// and a RESP error otherwise
+func (c *Client) WriteError(message string) error {
+	if c.Transport != nil {
+		return c.Transport.Error(message)
+	}
+	return c.Write(protocol.FormatError(message))
+}
+
+// Close closes the client's connection, through its Transport when set
 func (c *Client) Close() error {
+	if c.Transport != nil {
+		return c.Transport.Close()
+	}
 	return c.Conn.Close()
 }
@@ -0,0 +1,752 @@
+// Package cluster links Redix nodes into a full mesh so that messages
+// published on one node reach subscribers on every other node.
+//
+// Nodes find each other through a SWIM-style gossip membership over UDP on
+// the cluster port, starting from a list of seed addresses. Each node dials
+// every alive member and uses that link to send its own interests (the channels and patterns its clients subscribed
+// to, per tenant) and the publishes that match the peer's interests. Links
+// accepted from peers carry the peers' interests and publishes the other
+// way. A publish received from a peer is only delivered locally, never
+// forwarded again. Links to members declared dead are dropped together with
+// their interests.
+package cluster
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/glob"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// Frames exchanged over links, as RESP arrays
+const (
+	frameHello  = "HELLO"  // HELLO node-id secret, answered with +node-id
+	frameSub    = "SUB"    // SUB tenant channel
+	frameUnsub  = "UNSUB"  // UNSUB tenant channel
+	framePSub   = "PSUB"   // PSUB tenant pattern
+	framePUnsub = "PUNSUB" // PUNSUB tenant pattern
+	framePub    = "PUB"    // PUB tenant channel payload
+	framePing   = "PING"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+	pingInterval = 5 * time.Second
+	maxBackoff   = 5 * time.Second
+	// queueSize bounds the frames waiting to be written to a peer. A peer
+	// that falls further behind is disconnected and resynchronized.
+	queueSize = 8192
+)
+
+// ErrClosed is returned by Listen after Close
+var ErrClosed = errors.New("cluster: node closed")
+
+// Options configures a Node
+type Options struct {
+	// NodeID identifies the node to its peers. It defaults to the
+	// advertised address.
+	NodeID string
+	// Advertise is the address peers reach the node on. It defaults to
+	// the listen address, with the host name when listening on all
+	// interfaces.
+	Advertise string
+	// ClientAddr is the address clients reach this node's RESP listener
+	// on, used to redirect them to the node owning a hash slot. A missing
+	// or unspecified host is replaced with the advertised host.
+	ClientAddr string
+	// Peers are seed addresses used to join the cluster. Other members are
+	// learned by gossip. The node's own address may be listed.
+	Peers []string
+	// Secret authenticates links and gossip between nodes
+	Secret string
+	// ProbeInterval is how often a member is probed (default 1s)
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a direct probe waits for an ack before
+	// asking other members to probe (default a third of ProbeInterval)
+	ProbeTimeout time.Duration
+	// SuspicionTimeout is how long a suspect member has to refute the
+	// suspicion before it is declared dead (default 5s)
+	SuspicionTimeout time.Duration
+	// IndirectChecks is the number of members asked to probe a member
+	// that missed a direct probe (default 3)
+	IndirectChecks int
+}
+
+// Node is a cluster member bridging a local PubSub to its peers
+type Node struct {
+	id     string
+	opts   Options
+	pubsub *pubsub.PubSub
+	log    *slog.Logger
+
+	mu       sync.RWMutex
+	local    map[pubsub.Interest]bool
+	links    map[string]*link         // outbound, by peer ID
+	remote   map[string]*interestSet  // interests, by peer ID
+	inbound  map[string]net.Conn      // accepted links, by peer ID
+	dialers  map[string]chan struct{} // closed to stop dialing a peer
+	watchers []func()
+	gossip   *memberlist
+	ln       net.Listener
+	pc       net.PacketConn
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+	accepted map[net.Conn]struct{}
+}
+
+// link is an outbound connection to a peer
+type link struct {
+	id   string
+	addr string
+	conn net.Conn
+	out  chan string
+	once sync.Once
+	done chan struct{}
+}
+
+// close drops the link; its goroutines exit and the dialer reconnects
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// send queues a frame without blocking. A full queue closes the link,
+// since a dropped interest update would leave the peer inconsistent.
+func (l *link) send(frame string) {
+	select {
+	case l.out <- frame:
+	default:
+		l.close()
+	}
+}
+
+// New creates a node for ps. Call Listen to join the cluster.
+func New(ps *pubsub.PubSub, opts Options) *Node {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = time.Second
+	}
+	if opts.ProbeTimeout <= 0 || opts.ProbeTimeout >= opts.ProbeInterval {
+		opts.ProbeTimeout = opts.ProbeInterval / 3
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = 5 * time.Second
+	}
+	if opts.IndirectChecks <= 0 {
+		opts.IndirectChecks = 3
+	}
+	n := &Node{
+		id:       opts.NodeID,
+		opts:     opts,
+		pubsub:   ps,
+		log:      slog.Default().With("component", "cluster"),
+		local:    make(map[pubsub.Interest]bool),
+		links:    make(map[string]*link),
+		remote:   make(map[string]*interestSet),
+		inbound:  make(map[string]net.Conn),
+		dialers:  make(map[string]chan struct{}),
+		done:     make(chan struct{}),
+		accepted: make(map[net.Conn]struct{}),
+	}
+
+	ps.WatchInterest(n.interestChanged)
+	ps.OnPublish(n.forward)
+	return n
+}
+
+// ID returns the node ID. It is set by Listen.
+func (n *Node) ID() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.id
+}
+
+// Addr returns the advertised cluster address. It is set by Listen.
+func (n *Node) Addr() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.gossip == nil {
+		return ""
+	}
+	return n.gossip.self.addr
+}
+
+// Listen binds the cluster port on addr for peer links (TCP) and gossip
+// (UDP), then joins the cluster through the seeds. It returns once the
+// node is running; Close stops it.
+func (n *Node) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// Gossip shares the port, which also makes a port of 0 usable
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	advertise := n.opts.Advertise
+	if advertise == "" {
+		advertise = advertiseAddr(addr, ln.Addr().(*net.TCPAddr).Port)
+	}
+	id := n.opts.NodeID
+	if id == "" {
+		id = advertise
+	}
+	clientAddr := n.opts.ClientAddr
+	if host, port, err := net.SplitHostPort(clientAddr); err == nil {
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host, _, _ = net.SplitHostPort(advertise)
+			clientAddr = net.JoinHostPort(host, port)
+		}
+	}
+
+	n.mu.Lock()
+	if n.closed || n.ln != nil {
+		n.mu.Unlock()
+		ln.Close()
+		pc.Close()
+		return ErrClosed
+	}
+	n.id = id
+	n.log = n.log.With("node_id", id)
+	n.ln, n.pc = ln, pc
+	n.gossip = newMemberlist(pc, member{id: id, addr: advertise, client: clientAddr}, n.opts, n.memberChanged)
+	n.wg.Add(3)
+	n.mu.Unlock()
+
+	go n.accept(ln)
+	go func() {
+		defer n.wg.Done()
+		n.gossip.receive()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.gossip.run(n.done)
+	}()
+	return nil
+}
+
+// advertiseAddr returns the address peers should use for a node listening
+// on addr with the given port
+func advertiseAddr(addr string, port int) string {
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host, _ = os.Hostname()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// accept accepts peer links until Close
+func (n *Node) accept(ln net.Listener) {
+	defer n.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			conn.Close()
+			return
+		}
+		n.accepted[conn] = struct{}{}
+		n.wg.Add(1)
+		n.mu.Unlock()
+		go n.serveConn(conn)
+	}
+}
+
+// Close stops the listener, closes every link and waits for the link
+// goroutines to exit
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	if n.ln != nil {
+		n.ln.Close()
+		n.pc.Close()
+	}
+	for _, l := range n.links {
+		l.close()
+	}
+	for conn := range n.accepted {
+		conn.Close()
+	}
+	n.mu.Unlock()
+
+	n.wg.Wait()
+	return nil
+}
+
+// interestChanged propagates a local interest change to every peer. It
+// runs with the PubSub locked, which keeps updates in order. Shard
+// channels are served by the node owning their slot, so they are not
+// propagated.
+func (n *Node) interestChanged(in pubsub.Interest, added bool) {
+	if in.Shard {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if added {
+		n.local[in] = true
+	} else {
+		delete(n.local, in)
+	}
+	frame := interestFrame(in, added)
+	for _, l := range n.links {
+		l.send(frame)
+	}
+}
+
+func interestFrame(in pubsub.Interest, added bool) string {
+	kind := frameSub
+	switch {
+	case in.Pattern && added:
+		kind = framePSub
+	case in.Pattern:
+		kind = framePUnsub
+	case !added:
+		kind = frameUnsub
+	}
+	return protocol.FormatArray(kind, in.Tenant, in.Name)
+}
+
+// forward sends a local publish to the peers with a matching interest
+func (n *Node) forward(publisher string, msg client.Message) {
+	if msg.Sharded {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var frame string
+	for id, interests := range n.remote {
+		l := n.links[id]
+		if l == nil || !interests.matches(publisher, msg.Topic) {
+			continue
+		}
+		if frame == "" {
+			frame = protocol.FormatArray(framePub, publisher, msg.Topic, msg.Payload)
+		}
+		l.send(frame)
+	}
+}
+
+// interestSet holds a peer's interests, indexed for matching publishes
+type interestSet struct {
+	channels map[pubsub.Interest]bool
+	// names counts the tenants subscribed to each channel name, for
+	// broadcasts
+	names    map[string]int
+	patterns map[pubsub.Interest]bool
+}
+
+func newInterestSet() *interestSet {
+	return &interestSet{
+		channels: make(map[pubsub.Interest]bool),
+		names:    make(map[string]int),
+		patterns: make(map[pubsub.Interest]bool),
+	}
+}
+
+func (s *interestSet) add(in pubsub.Interest) {
+	if in.Pattern {
+		s.patterns[in] = true
+	} else if !s.channels[in] {
+		s.channels[in] = true
+		s.names[in.Name]++
+	}
+}
+
+func (s *interestSet) remove(in pubsub.Interest) {
+	if in.Pattern {
+		delete(s.patterns, in)
+	} else if s.channels[in] {
+		delete(s.channels, in)
+		if s.names[in.Name]--; s.names[in.Name] <= 0 {
+			delete(s.names, in.Name)
+		}
+	}
+}
+
+func (s *interestSet) len() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// matches reports whether the peer has a subscriber that may receive a
+// publish by tenant on topic. Broadcasts reach every tenant.
+func (s *interestSet) matches(tenant, topic string) bool {
+	broadcast := auth.IsBroadcast(tenant)
+	if broadcast && s.names[topic] > 0 || s.channels[pubsub.Interest{Tenant: tenant, Name: topic}] {
+		return true
+	}
+	for in := range s.patterns {
+		if (broadcast || in.Tenant == tenant) && glob.Match(in.Name, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// memberChanged starts dialing a member that became known, drops
+// everything about a member declared dead and notifies the membership
+// watchers
+func (n *Node) memberChanged(id string) {
+	mem, ok := n.gossip.member(id)
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.updateMember(id, mem, ok)
+	watchers := n.watchers
+	n.mu.Unlock()
+
+	for _, fn := range watchers {
+		fn()
+	}
+}
+
+// OnMembershipChange registers fn to be called after a member joins or is
+// declared dead, when slot ownership may have moved
+func (n *Node) OnMembershipChange(fn func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.watchers = append(n.watchers, fn)
+}
+
+// updateMember dials or drops a member after its state changed. The caller
+// holds n.mu.
+func (n *Node) updateMember(id string, mem member, ok bool) {
+	if !ok || mem.state == StateDead {
+		if stop := n.dialers[id]; stop != nil {
+			close(stop)
+			delete(n.dialers, id)
+		}
+		if l := n.links[id]; l != nil {
+			l.close()
+		}
+		if conn := n.inbound[id]; conn != nil {
+			conn.Close()
+		}
+		delete(n.remote, id)
+		n.log.Warn("peer declared dead", "peer_id", id)
+		return
+	}
+
+	if n.dialers[id] == nil {
+		n.log.Info("peer joined", "peer_id", id, "peer", mem.addr)
+		stop := make(chan struct{})
+		n.dialers[id] = stop
+		n.wg.Add(1)
+		go n.dialLoop(id, stop)
+	}
+}
+
+// dialLoop keeps an outbound link to the member id, reconnecting with
+// backoff until stop or Close
+func (n *Node) dialLoop(id string, stop chan struct{}) {
+	defer n.wg.Done()
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-stop:
+			return
+		default:
+		}
+
+		// The member may have come back on another address
+		if mem, ok := n.gossip.member(id); ok {
+			err := n.runLink(id, mem.addr, stop)
+			if err != nil {
+				n.log.Debug("peer link down", "peer_id", id, "peer", mem.addr, "error", err)
+			} else {
+				backoff = 100 * time.Millisecond
+			}
+		}
+
+		select {
+		case <-n.done:
+			return
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// runLink connects to the member id at addr, performs the handshake, sends
+// the current interests and then streams frames until the link fails. It
+// returns nil when an established link was lost.
+func (n *Node) runLink(id, addr string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err := conn.Write([]byte(protocol.FormatArray(frameHello, n.id, n.opts.Secret))); err != nil {
+		return err
+	}
+	r := protocol.NewReader(conn)
+	reply, err := r.ReadValue()
+	if err != nil {
+		return err
+	}
+	if reply.Type == protocol.Error {
+		return fmt.Errorf("handshake rejected: %s", reply.Str)
+	}
+	if peerID := reply.Str; peerID != id {
+		return fmt.Errorf("expected peer %q, reached %q", id, peerID)
+	}
+	conn.SetDeadline(time.Time{})
+
+	l := &link{id: id, addr: addr, conn: conn, out: make(chan string, queueSize), done: make(chan struct{})}
+	n.mu.Lock()
+	if n.closed || n.dialers[id] != stop {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	if old := n.links[id]; old != nil {
+		old.close()
+	}
+	n.links[id] = l
+	// The current interests are written directly rather than queued, as
+	// there may be more of them than the queue holds. Changes from here on
+	// are queued behind them.
+	var initial []byte
+	for in := range n.local {
+		initial = append(initial, interestFrame(in, true)...)
+	}
+	n.mu.Unlock()
+	n.log.Info("peer link up", "peer", addr, "peer_id", id)
+
+	// The peer never writes after the handshake, so a read only returns
+	// when the link is gone
+	go func() {
+		io.Copy(io.Discard, conn)
+		l.close()
+	}()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(initial); err != nil {
+		l.close()
+	}
+	n.writeLoop(l)
+
+	n.mu.Lock()
+	if n.links[id] == l {
+		delete(n.links, id)
+	}
+	n.mu.Unlock()
+	n.log.Info("peer link down", "peer", addr, "peer_id", id)
+	return nil
+}
+
+// writeLoop writes queued frames to the link, batching what is queued,
+// and pings idle links so dead peers are noticed
+func (n *Node) writeLoop(l *link) {
+	defer l.close()
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	var buf []byte
+	for {
+		select {
+		case frame := <-l.out:
+			buf = append(buf[:0], frame...)
+			for more := true; more && len(buf) < 64<<10; {
+				select {
+				case frame := <-l.out:
+					buf = append(buf, frame...)
+				default:
+					more = false
+				}
+			}
+		case <-ping.C:
+			buf = append(buf[:0], protocol.FormatArray(framePing)...)
+		case <-l.done:
+			return
+		case <-n.done:
+			return
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := l.conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// serveConn reads interests and publishes from a peer's outbound link
+func (n *Node) serveConn(conn net.Conn) {
+	defer n.wg.Done()
+	defer func() {
+		n.mu.Lock()
+		delete(n.accepted, conn)
+		n.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := protocol.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	hello, err := r.ReadCommand()
+	if err != nil || len(hello) != 3 || !strings.EqualFold(hello[0], frameHello) {
+		conn.Write([]byte(protocol.FormatError("expected HELLO")))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hello[2]), []byte(n.opts.Secret)) != 1 {
+		n.log.Warn("peer rejected", "remote_addr", conn.RemoteAddr().String(), "reason", "invalid secret")
+		conn.Write([]byte(protocol.FormatError("invalid cluster secret")))
+		return
+	}
+	peerID := hello[1]
+	if _, err := conn.Write([]byte("+" + n.id + "\r\n")); err != nil {
+		return
+	}
+	if peerID == n.id {
+		return
+	}
+
+	n.mu.Lock()
+	if old := n.inbound[peerID]; old != nil {
+		old.Close()
+	}
+	n.inbound[peerID] = conn
+	interests := newInterestSet()
+	n.remote[peerID] = interests
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		if n.inbound[peerID] == conn {
+			delete(n.inbound, peerID)
+			delete(n.remote, peerID)
+		}
+		n.mu.Unlock()
+	}()
+
+	for {
+		// Peers ping at least every pingInterval
+		conn.SetReadDeadline(time.Now().Add(3 * pingInterval))
+		frame, err := r.ReadCommand()
+		if err != nil {
+			return
+		}
+		n.handleFrame(peerID, interests, frame)
+	}
+}
+
+// handleFrame applies one frame from peerID
+func (n *Node) handleFrame(peerID string, interests *interestSet, frame []string) {
+	switch {
+	case frame[0] == framePing:
+	case frame[0] == framePub && len(frame) == 4:
+		n.pubsub.Deliver(frame[2], frame[3], frame[1])
+	case len(frame) == 3:
+		in := pubsub.Interest{Tenant: frame[1], Name: frame[2]}
+		n.mu.Lock()
+		switch frame[0] {
+		case frameSub:
+			interests.add(in)
+		case frameUnsub:
+			interests.remove(in)
+		case framePSub:
+			in.Pattern = true
+			interests.add(in)
+		case framePUnsub:
+			in.Pattern = true
+			interests.remove(in)
+		}
+		n.mu.Unlock()
+	default:
+		n.log.Debug("unknown frame from peer", "peer_id", peerID, "frame", frame[0])
+	}
+}
+
+// Member describes a cluster member as seen by this node
+type Member struct {
+	ID   string
+	Addr string
+	// ClientAddr is the member's RESP address
+	ClientAddr  string
+	State       State
+	Incarnation uint64
+	// Self is set for the node itself
+	Self bool
+	// Connected is set while the outbound link to the member is up
+	Connected bool
+	// Interests is the number of channels and patterns the member's
+	// subscribers listen to
+	Interests int
+}
+
+// Members returns the node itself and every known member, ordered by ID
+func (n *Node) Members() []Member {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.gossip == nil {
+		return nil
+	}
+
+	var out []Member
+	for i, mem := range n.gossip.snapshot() {
+		m := Member{ID: mem.id, Addr: mem.addr, ClientAddr: mem.client, State: mem.state, Incarnation: mem.incarnation, Self: i == 0}
+		if !m.Self {
+			m.Connected = n.links[mem.id] != nil
+			if set := n.remote[mem.id]; set != nil {
+				m.Interests = set.len()
+			}
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// SlotOwner returns the member serving a hash slot. Slots are split into
+// equal ranges over the members not declared dead, ordered by ID, so every
+// node with the same membership view agrees on the owner.
+func (n *Node) SlotOwner(slot int) (Member, bool) {
+	var live []Member
+	for _, m := range n.Members() {
+		if m.State != StateDead {
+			live = append(live, m)
+		}
+	}
+	if len(live) == 0 || slot < 0 || slot >= Slots {
+		return Member{}, false
+	}
+	return live[slot*len(live)/Slots], true
+}
@@ -0,0 +1,510 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is a member's health as seen by this node
+type State int
+
+// Member states, in SWIM order of precedence for the same incarnation
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
+// Gossip message types
+const (
+	msgPing    = "ping"
+	msgAck     = "ack"
+	msgPingReq = "ping-req"
+)
+
+const (
+	// maxPacket is the largest gossip datagram read
+	maxPacket = 64 << 10
+	// maxUpdates bounds the updates piggybacked on one message
+	maxUpdates = 16
+	// retransmitMult scales how often an update is gossiped: each one is
+	// sent retransmitMult * log2(members+1) times
+	retransmitMult = 3
+	// seedInterval is how many probe periods pass between pings to seeds
+	// that are not members, so split clusters merge again
+	seedInterval = 10
+)
+
+// member is a node in the gossip membership
+type member struct {
+	id   string
+	addr string
+	// client is the address clients reach the member's RESP listener on
+	client      string
+	incarnation uint64
+	state       State
+	since       time.Time
+}
+
+// update returns the member as an update with the given state
+func (mem *member) update(state State) update {
+	return update{ID: mem.id, Addr: mem.addr, Client: mem.client, Incarnation: mem.incarnation, State: state}
+}
+
+// update is a membership change spread by gossip
+type update struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	Client      string `json:"client,omitempty"`
+	Incarnation uint64 `json:"inc"`
+	State       State  `json:"state"`
+}
+
+// packet is a gossip message. Packets are JSON prefixed with an
+// HMAC-SHA256 of the body keyed with the cluster secret.
+type packet struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+	From string `json:"from"`
+	// Target is the member to probe for a ping-req
+	Target     string   `json:"target,omitempty"`
+	TargetAddr string   `json:"target_addr,omitempty"`
+	Updates    []update `json:"updates,omitempty"`
+}
+
+// broadcast is an update waiting to be piggybacked
+type broadcast struct {
+	update    update
+	transmits int
+}
+
+// memberlist implements SWIM: every probe interval it pings one member in
+// round-robin order, asks other members to ping it indirectly when no ack
+// arrives in time, and marks it suspect when neither works. Suspects that
+// do not refute the suspicion with a higher incarnation before the
+// suspicion timeout are declared dead. Membership updates are piggybacked
+// on probe traffic.
+type memberlist struct {
+	conn    net.PacketConn
+	secret  []byte
+	opts    Options
+	seeds   []string
+	changed func(id string)
+
+	mu         sync.Mutex
+	self       member
+	members    map[string]*member
+	broadcasts map[string]*broadcast
+	acks       map[uint64]func()
+	seq        uint64
+	order      []string
+	next       int
+	period     int
+}
+
+func newMemberlist(conn net.PacketConn, self member, opts Options, changed func(string)) *memberlist {
+	self.state, self.since = StateAlive, time.Now()
+	return &memberlist{
+		conn:       conn,
+		secret:     []byte(opts.Secret),
+		opts:       opts,
+		seeds:      opts.Peers,
+		changed:    changed,
+		self:       self,
+		members:    make(map[string]*member),
+		broadcasts: make(map[string]*broadcast),
+		acks:       make(map[uint64]func()),
+	}
+}
+
+// run probes members until done is closed
+func (m *memberlist) run(done <-chan struct{}) {
+	m.pingSeeds()
+	ticker := time.NewTicker(m.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		m.expire()
+		m.mu.Lock()
+		m.period++
+		seeds := m.period%seedInterval == 0 || m.aliveLocked() == 0
+		m.mu.Unlock()
+		if seeds {
+			m.pingSeeds()
+		}
+		if target := m.nextTarget(); target != nil {
+			m.probe(target, done)
+		}
+	}
+}
+
+// pingSeeds pings the seed addresses that are not known members, which is
+// how a node joins: the ack carries the seed's view of the cluster
+func (m *memberlist) pingSeeds() {
+	m.mu.Lock()
+	known := map[string]bool{m.self.addr: true}
+	for _, mem := range m.members {
+		if mem.state != StateDead {
+			known[mem.addr] = true
+		}
+	}
+	m.mu.Unlock()
+
+	for _, addr := range m.seeds {
+		if known[addr] {
+			continue
+		}
+		m.send(addr, packet{Type: msgPing, Seq: m.nextSeq()})
+	}
+}
+
+// nextTarget returns the next member to probe, reshuffling the probe
+// order after each round
+func (m *memberlist) nextTarget() *member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tries := 0; tries < 2; tries++ {
+		for m.next < len(m.order) {
+			id := m.order[m.next]
+			m.next++
+			if mem := m.members[id]; mem != nil && mem.state != StateDead {
+				target := *mem
+				return &target
+			}
+		}
+		m.order = m.order[:0]
+		for id := range m.members {
+			m.order = append(m.order, id)
+		}
+		rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	return nil
+}
+
+// probe pings target directly, then indirectly through other members, and
+// suspects it when no ack arrives within the probe interval
+func (m *memberlist) probe(target *member, done <-chan struct{}) {
+	seq := m.nextSeq()
+	acked := make(chan struct{})
+	var once sync.Once
+	m.mu.Lock()
+	m.acks[seq] = func() { once.Do(func() { close(acked) }) }
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.acks, seq)
+		m.mu.Unlock()
+	}()
+
+	m.send(target.addr, packet{Type: msgPing, Seq: seq})
+	select {
+	case <-acked:
+		return
+	case <-done:
+		return
+	case <-time.After(m.opts.ProbeTimeout):
+	}
+
+	for _, helper := range m.randomMembers(m.opts.IndirectChecks, target.id) {
+		m.send(helper.addr, packet{Type: msgPingReq, Seq: seq, Target: target.id, TargetAddr: target.addr})
+	}
+	select {
+	case <-acked:
+		return
+	case <-done:
+		return
+	case <-time.After(m.opts.ProbeInterval - m.opts.ProbeTimeout):
+	}
+	m.apply(target.update(StateSuspect))
+}
+
+// randomMembers returns up to k alive members other than exclude
+func (m *memberlist) randomMembers(k int, exclude string) []member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []member
+	for id, mem := range m.members {
+		if id != exclude && mem.state == StateAlive {
+			out = append(out, *mem)
+		}
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// expire declares suspects dead after the suspicion timeout and forgets
+// dead members after a while, so a restarted node can join again
+func (m *memberlist) expire() {
+	now := time.Now()
+	var dead []update
+	m.mu.Lock()
+	for id, mem := range m.members {
+		switch {
+		case mem.state == StateSuspect && now.Sub(mem.since) >= m.opts.SuspicionTimeout:
+			dead = append(dead, mem.update(StateDead))
+		case mem.state == StateDead && now.Sub(mem.since) >= 10*m.opts.SuspicionTimeout:
+			delete(m.members, id)
+			delete(m.broadcasts, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, u := range dead {
+		m.apply(u)
+	}
+}
+
+// receive handles gossip packets until the connection is closed
+func (m *memberlist) receive() {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p, ok := m.decode(buf[:n])
+		if !ok || p.From == m.self.id {
+			continue
+		}
+
+		// The sender's view of itself is always the first update
+		m.mu.Lock()
+		_, known := m.members[p.From]
+		m.mu.Unlock()
+		for _, u := range p.Updates {
+			m.apply(u)
+		}
+
+		switch p.Type {
+		case msgPing:
+			ack := packet{Type: msgAck, Seq: p.Seq}
+			if !known {
+				// A joining node learns the whole cluster from its first ack
+				ack.Updates = m.state()
+			} else if mem, ok := m.member(p.From); ok && mem.state != StateAlive {
+				// Tell the sender it is suspected, so it can refute
+				ack.Updates = append(m.piggyback(), mem.update(mem.state))
+			}
+			m.send(from.String(), ack)
+
+		case msgPingReq:
+			seq := m.nextSeq()
+			origin, originSeq := from.String(), p.Seq
+			m.mu.Lock()
+			m.acks[seq] = func() { m.send(origin, packet{Type: msgAck, Seq: originSeq}) }
+			m.mu.Unlock()
+			time.AfterFunc(m.opts.ProbeInterval, func() {
+				m.mu.Lock()
+				delete(m.acks, seq)
+				m.mu.Unlock()
+			})
+			m.send(p.TargetAddr, packet{Type: msgPing, Seq: seq})
+
+		case msgAck:
+			m.mu.Lock()
+			fn := m.acks[p.Seq]
+			m.mu.Unlock()
+			if fn != nil {
+				fn()
+			}
+		}
+	}
+}
+
+// apply merges a membership update using the SWIM precedence rules and
+// queues it for gossip when it changed anything
+func (m *memberlist) apply(u update) {
+	m.mu.Lock()
+	if u.ID == m.self.id {
+		// Refute suspicion or death with a higher incarnation
+		if u.State != StateAlive && u.Incarnation >= m.self.incarnation {
+			m.self.incarnation = u.Incarnation + 1
+			m.queueLocked(m.selfUpdateLocked())
+		}
+		m.mu.Unlock()
+		return
+	}
+
+	mem := m.members[u.ID]
+	switch {
+	case mem == nil:
+		if u.State == StateDead {
+			m.mu.Unlock()
+			return
+		}
+		mem = &member{id: u.ID}
+		m.members[u.ID] = mem
+	case u.Incarnation > mem.incarnation:
+	case u.Incarnation == mem.incarnation && u.State > mem.state:
+	default:
+		m.mu.Unlock()
+		return
+	}
+
+	stateChanged := mem.state != u.State || mem.since.IsZero()
+	mem.addr, mem.client = u.Addr, u.Client
+	mem.incarnation = u.Incarnation
+	if stateChanged {
+		mem.state = u.State
+		mem.since = time.Now()
+	}
+	m.queueLocked(u)
+	m.mu.Unlock()
+
+	if stateChanged {
+		m.changed(u.ID)
+	}
+}
+
+// queueLocked schedules u for gossip, replacing older news about the same
+// member. The caller holds m.mu.
+func (m *memberlist) queueLocked(u update) {
+	m.broadcasts[u.ID] = &broadcast{update: u}
+}
+
+func (m *memberlist) selfUpdateLocked() update {
+	return m.self.update(StateAlive)
+}
+
+// piggyback returns the sender's own update followed by the queued updates
+// that were sent least often
+func (m *memberlist) piggyback() []update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	queued := make([]*broadcast, 0, len(m.broadcasts))
+	for _, b := range m.broadcasts {
+		queued = append(queued, b)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].transmits < queued[j].transmits })
+
+	out := []update{m.selfUpdateLocked()}
+	for _, b := range queued {
+		if len(out) > maxUpdates {
+			break
+		}
+		if b.update.ID == m.self.id {
+			continue
+		}
+		out = append(out, b.update)
+		if b.transmits++; b.transmits >= limit {
+			delete(m.broadcasts, b.update.ID)
+		}
+	}
+	return out
+}
+
+// state returns every known member, for a joining node
+func (m *memberlist) state() []update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []update{m.selfUpdateLocked()}
+	for _, mem := range m.members {
+		out = append(out, mem.update(mem.state))
+	}
+	return out
+}
+
+func (m *memberlist) send(addr string, p packet) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	p.From = m.self.id
+	if p.Updates == nil {
+		p.Updates = m.piggyback()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write(body)
+	m.conn.WriteTo(append(mac.Sum(nil), body...), udpAddr)
+}
+
+// decode verifies and parses a packet
+func (m *memberlist) decode(data []byte) (packet, bool) {
+	var p packet
+	if len(data) < sha256.Size {
+		return p, false
+	}
+	sum, body := data[:sha256.Size], data[sha256.Size:]
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write(body)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return p, false
+	}
+	if err := json.Unmarshal(body, &p); err != nil || p.From == "" {
+		return p, false
+	}
+	return p, true
+}
+
+func (m *memberlist) nextSeq() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	return m.seq
+}
+
+// aliveLocked counts members that are not dead. The caller holds m.mu.
+func (m *memberlist) aliveLocked() int {
+	n := 0
+	for _, mem := range m.members {
+		if mem.state != StateDead {
+			n++
+		}
+	}
+	return n
+}
+
+// member returns a copy of the member with id
+func (m *memberlist) member(id string) (member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mem, ok := m.members[id]
+	if !ok {
+		return member{}, false
+	}
+	return *mem, true
+}
+
+// snapshot returns the node itself followed by every known member
+func (m *memberlist) snapshot() []member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []member{m.self}
+	for _, mem := range m.members {
+		out = append(out, *mem)
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package cluster
+
+import "strings"
+
+// Slots is the number of hash slots shard channels are spread over
+const Slots = 16384
+
+// crcTable is the CRC16-CCITT (XMODEM) table used by Redis Cluster
+var crcTable = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crcTable[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// Slot returns the hash slot of a shard channel the way Redis Cluster
+// computes it for keys: CRC16 modulo Slots. When the name contains a
+// non-empty hash tag such as "{user1}", only the tag is hashed, so related
+// channels can be kept in one slot.
+func Slot(name string) int {
+	if start := strings.IndexByte(name, '{'); start >= 0 {
+		if end := strings.IndexByte(name[start+1:], '}'); end > 0 {
+			name = name[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(name) % Slots)
+}
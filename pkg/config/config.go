@@ -0,0 +1,696 @@
+// Package config loads the server configuration from defaults, a config
+// file, environment variables and command line flags, in that order of
+// precedence.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"redix/pkg/protocol"
+)
+
+// Config is the effective server configuration
+type Config struct {
+	Listeners  Listeners
+	HTTP       HTTP
+	Admin      Admin
+	TLS        TLS
+	TokenStore TokenStore
+	Limits     Limits
+	Protocol   Protocol
+	Retention  Retention
+	Reliable   Reliable
+	Webhooks   Webhooks
+	Logging    Logging
+	Audit      Audit
+	Cluster    Cluster
+	Backplane  Backplane
+	Server     ServerOptions
+
+	sources map[string]Source
+	// file is the config file the configuration was loaded from
+	file string
+}
+
+// Listeners are the client-facing listen addresses
+type Listeners struct {
+	Redis string
+	HTTP  string
+	// AllowedOrigins is a comma-separated list of browser origins that may
+	// open WebSocket sessions ("*" for any)
+	AllowedOrigins string
+}
+
+// HTTP bounds how long the HTTP API listener waits for a request
+type HTTP struct {
+	// ReadHeaderTimeout is the time a client has to send request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is the time a client has to send a whole request, body
+	// included
+	ReadTimeout time.Duration
+}
+
+// OriginList returns the allowed WebSocket origins
+func (l Listeners) OriginList() []string {
+	var out []string
+	for _, o := range strings.Split(l.AllowedOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// Admin configures the admin HTTP listener
+type Admin struct {
+	Listen string
+}
+
+// TLS configures certificates for the Redis and HTTP API listeners
+type TLS struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// TokenStore configures the database holding client tokens
+type TokenStore struct {
+	Driver   string
+	DSN      string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+}
+
+// Limits bounds resource usage
+type Limits struct {
+	MaxClients int
+	// MaxClientsPerToken caps the connections authenticated with one token
+	MaxClientsPerToken int
+	// AuthTimeout closes connections that do not authenticate in time
+	AuthTimeout time.Duration
+	// IdleTimeout closes authenticated connections without subscriptions
+	// that send no command in time
+	IdleTimeout time.Duration
+	// TCPKeepAlive is the keepalive probe period for new connections
+	TCPKeepAlive time.Duration
+	// WriteTimeout closes connections that do not accept a reply in time
+	WriteTimeout time.Duration
+	// TokenRecheck is how often authenticated connections have their token
+	// checked against the token store again
+	TokenRecheck time.Duration
+	// TenantMaxChannels caps the distinct channels and patterns a tenant
+	// has subscribers on
+	TenantMaxChannels int
+	// TenantMaxSubscriptions caps a tenant's subscriptions across all of
+	// its connections
+	TenantMaxSubscriptions int
+}
+
+// Protocol bounds the RESP input accepted from clients
+type Protocol struct {
+	MaxBulkLen      int
+	MaxMultibulkLen int
+	MaxInlineLen    int
+	MaxChannelLen   int
+}
+
+// Limits returns the reader limits for client connections
+func (p Protocol) Limits() protocol.Limits {
+	l := protocol.DefaultLimits()
+	l.MaxBulkLen = p.MaxBulkLen
+	l.MaxMultibulkLen = p.MaxMultibulkLen
+	l.MaxInlineLen = p.MaxInlineLen
+	l.MaxChannelLen = p.MaxChannelLen
+	return l
+}
+
+// Retention configures message history kept for resuming streams
+type Retention struct {
+	Messages int
+}
+
+// Reliable configures acknowledged consumer group subscriptions
+type Reliable struct {
+	// VisibilityTimeout is how long a consumer has to acknowledge a
+	// message before it is delivered again
+	VisibilityTimeout time.Duration
+	// MaxPending caps the unacknowledged messages of a consumer group
+	MaxPending int
+}
+
+// Webhooks configures outbound webhook deliveries
+type Webhooks struct {
+	// AllowedNetworks is a comma-separated list of loopback, link-local or
+	// private networks in CIDR notation that webhooks may point to
+	AllowedNetworks string
+}
+
+// NetworkList returns the allowed webhook networks, skipping invalid ones
+func (w Webhooks) NetworkList() []netip.Prefix {
+	var out []netip.Prefix
+	for _, n := range strings.Split(w.AllowedNetworks, ",") {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(n)); err == nil {
+			out = append(out, prefix)
+		}
+	}
+	return out
+}
+
+// Logging configures log output
+type Logging struct {
+	Level            string
+	Format           string
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// Audit configures the security audit log
+type Audit struct {
+	File     string
+	MaxSize  int
+	MaxFiles int
+	// Key keys the hash chain of the audit log
+	Key string
+}
+
+// Cluster configures links to other Redix nodes
+type Cluster struct {
+	// Listen is the address peers connect to (empty disables clustering)
+	Listen    string
+	NodeID    string
+	Advertise string
+	// Peers is a comma-separated list of seed cluster addresses
+	Peers            string
+	Secret           string
+	ProbeInterval    time.Duration
+	SuspicionTimeout time.Duration
+}
+
+// PeerList returns the peer addresses
+func (c Cluster) PeerList() []string {
+	var out []string
+	for _, p := range strings.Split(c.Peers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Backplane configures relaying messages between nodes through Redis
+type Backplane struct {
+	// Redis is the Redis address (empty disables the backplane)
+	Redis    string
+	Username string
+	Password string
+	Prefix   string
+}
+
+// ServerOptions holds process-level settings
+type ServerOptions struct {
+	ShutdownDelay time.Duration
+}
+
+// Source is where a configuration value came from
+type Source int
+
+const (
+	SourceDefault Source = iota
+	SourceFile
+	SourceEnv
+	SourceFlag
+	// SourceRuntime marks values changed with CONFIG SET
+	SourceRuntime
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	case SourceRuntime:
+		return "runtime"
+	}
+	return "default"
+}
+
+// option describes one configuration key. Runtime options can be changed
+// with CONFIG SET and on reload without restarting the server.
+type option struct {
+	key     string
+	usage   string
+	secret  bool
+	runtime bool
+	field   func(c *Config) any
+}
+
+// options lists every configuration key in display order
+var options = []option{
+	{key: "listeners.redis", usage: "Redis protocol listen address", field: func(c *Config) any { return &c.Listeners.Redis }},
+	{key: "listeners.http", usage: "HTTP API listen address (empty to disable)", field: func(c *Config) any { return &c.Listeners.HTTP }},
+	{key: "listeners.allowed_origins", usage: "Comma-separated browser origins allowed to open WebSocket sessions, * for any (empty allows the API's own host)", field: func(c *Config) any { return &c.Listeners.AllowedOrigins }},
+	{key: "http.read_header_timeout", usage: "Time an HTTP API client has to send request headers (0 to disable)", field: func(c *Config) any { return &c.HTTP.ReadHeaderTimeout }},
+	{key: "http.read_timeout", usage: "Time an HTTP API client has to send a whole request (0 to disable)", field: func(c *Config) any { return &c.HTTP.ReadTimeout }},
+	{key: "admin.listen", usage: "Admin HTTP listen address for health and readiness probes (empty to disable)", field: func(c *Config) any { return &c.Admin.Listen }},
+	{key: "tls.cert_file", usage: "TLS certificate for the Redis and HTTP API listeners", field: func(c *Config) any { return &c.TLS.CertFile }},
+	{key: "tls.key_file", usage: "TLS private key", field: func(c *Config) any { return &c.TLS.KeyFile }},
+	{key: "tls.client_ca_file", usage: "CA bundle used to require and verify client certificates", field: func(c *Config) any { return &c.TLS.ClientCAFile }},
+	{key: "token_store.driver", usage: "Token store database driver (mysql or sqlite3)", field: func(c *Config) any { return &c.TokenStore.Driver }},
+	{key: "token_store.dsn", usage: "Token store DSN; overrides host, port, user, password and database", secret: true, field: func(c *Config) any { return &c.TokenStore.DSN }},
+	{key: "token_store.host", usage: "MySQL host address", field: func(c *Config) any { return &c.TokenStore.Host }},
+	{key: "token_store.port", usage: "MySQL port", field: func(c *Config) any { return &c.TokenStore.Port }},
+	{key: "token_store.user", usage: "MySQL username", field: func(c *Config) any { return &c.TokenStore.User }},
+	{key: "token_store.password", usage: "MySQL password", secret: true, field: func(c *Config) any { return &c.TokenStore.Password }},
+	{key: "token_store.database", usage: "MySQL database name", field: func(c *Config) any { return &c.TokenStore.Database }},
+	{key: "limits.maxclients", runtime: true, usage: "Maximum number of simultaneous clients (0 for unlimited)", field: func(c *Config) any { return &c.Limits.MaxClients }},
+	{key: "limits.maxclients_per_token", runtime: true, usage: "Maximum number of simultaneous clients per tenant token (0 for unlimited)", field: func(c *Config) any { return &c.Limits.MaxClientsPerToken }},
+	{key: "limits.auth_timeout", runtime: true, usage: "Time a new connection has to authenticate (0 to disable)", field: func(c *Config) any { return &c.Limits.AuthTimeout }},
+	{key: "limits.idle_timeout", runtime: true, usage: "Close connections without subscriptions after this long without a command (0 to disable)", field: func(c *Config) any { return &c.Limits.IdleTimeout }},
+	{key: "limits.tcp_keepalive", runtime: true, usage: "TCP keepalive period for new connections (0 for the system default)", field: func(c *Config) any { return &c.Limits.TCPKeepAlive }},
+	{key: "limits.write_timeout", runtime: true, usage: "Close connections that block a write for this long (0 to disable)", field: func(c *Config) any { return &c.Limits.WriteTimeout }},
+	{key: "limits.token_recheck", runtime: true, usage: "Disconnect clients whose token the token store no longer accepts, checked this often (0 to disable)", field: func(c *Config) any { return &c.Limits.TokenRecheck }},
+	{key: "limits.tenant_max_channels", runtime: true, usage: "Maximum distinct channels and patterns per tenant (0 for unlimited)", field: func(c *Config) any { return &c.Limits.TenantMaxChannels }},
+	{key: "limits.tenant_max_subscriptions", runtime: true, usage: "Maximum subscriptions per tenant across its connections (0 for unlimited)", field: func(c *Config) any { return &c.Limits.TenantMaxSubscriptions }},
+	{key: "protocol.max_bulk_len", usage: "Largest bulk string a client may send, in bytes", field: func(c *Config) any { return &c.Protocol.MaxBulkLen }},
+	{key: "protocol.max_multibulk_len", usage: "Largest number of arguments in a command", field: func(c *Config) any { return &c.Protocol.MaxMultibulkLen }},
+	{key: "protocol.max_inline_len", usage: "Longest inline command or protocol line, in bytes", field: func(c *Config) any { return &c.Protocol.MaxInlineLen }},
+	{key: "protocol.max_channel_len", usage: "Longest channel name or pattern, in bytes", field: func(c *Config) any { return &c.Protocol.MaxChannelLen }},
+	{key: "retention.messages", runtime: true, usage: "Number of recent messages retained per channel for resuming streams (0 to disable)", field: func(c *Config) any { return &c.Retention.Messages }},
+	{key: "reliable.visibility_timeout", runtime: true, usage: "Time a reliable subscriber has to ACK a message before it is redelivered", field: func(c *Config) any { return &c.Reliable.VisibilityTimeout }},
+	{key: "reliable.max_pending", runtime: true, usage: "Unacknowledged messages per consumer group before publishes on its channels are rejected (0 for unlimited)", field: func(c *Config) any { return &c.Reliable.MaxPending }},
+	{key: "webhooks.allowed_networks", runtime: true, usage: "Comma-separated loopback, link-local or private CIDR networks webhooks may point to (empty allows none)", field: func(c *Config) any { return &c.Webhooks.AllowedNetworks }},
+	{key: "logging.level", runtime: true, usage: "Log level (debug, info, warn or error)", field: func(c *Config) any { return &c.Logging.Level }},
+	{key: "logging.format", usage: "Log format (text or json)", field: func(c *Config) any { return &c.Logging.Format }},
+	{key: "logging.sample_initial", usage: "Identical log records kept per second before sampling starts (0 disables sampling)", field: func(c *Config) any { return &c.Logging.SampleInitial }},
+	{key: "logging.sample_thereafter", usage: "Once sampling, keep every Nth identical record per second (0 drops them)", field: func(c *Config) any { return &c.Logging.SampleThereafter }},
+	{key: "audit.file", usage: "Security audit log file (empty to disable)", field: func(c *Config) any { return &c.Audit.File }},
+	{key: "audit.max_size", usage: "Audit log size in megabytes before it is rotated (0 disables rotation)", field: func(c *Config) any { return &c.Audit.MaxSize }},
+	{key: "audit.max_files", usage: "Number of rotated audit log files kept", field: func(c *Config) any { return &c.Audit.MaxFiles }},
+	{key: "audit.key", secret: true, usage: "Secret keying the audit log hash chain with HMAC-SHA256 (empty for plain SHA-256)", field: func(c *Config) any { return &c.Audit.Key }},
+	{key: "cluster.listen", usage: "Address for links from other cluster nodes (empty disables clustering)", field: func(c *Config) any { return &c.Cluster.Listen }},
+	{key: "cluster.node_id", usage: "Node name shown to peers (defaults to the advertised address)", field: func(c *Config) any { return &c.Cluster.NodeID }},
+	{key: "cluster.advertise", usage: "Cluster address announced to peers (defaults to the host name and cluster port)", field: func(c *Config) any { return &c.Cluster.Advertise }},
+	{key: "cluster.peers", usage: "Comma-separated seed cluster addresses used to join", field: func(c *Config) any { return &c.Cluster.Peers }},
+	{key: "cluster.secret", secret: true, usage: "Shared secret authenticating cluster links and gossip", field: func(c *Config) any { return &c.Cluster.Secret }},
+	{key: "cluster.probe_interval", usage: "How often each node probes one member for failure detection", field: func(c *Config) any { return &c.Cluster.ProbeInterval }},
+	{key: "cluster.suspicion_timeout", usage: "Time a suspected member has to refute before it is declared dead", field: func(c *Config) any { return &c.Cluster.SuspicionTimeout }},
+	{key: "backplane.redis", usage: "Redis address relaying messages between nodes (empty disables the backplane)", field: func(c *Config) any { return &c.Backplane.Redis }},
+	{key: "backplane.username", usage: "Redis ACL user name", field: func(c *Config) any { return &c.Backplane.Username }},
+	{key: "backplane.password", secret: true, usage: "Redis password", field: func(c *Config) any { return &c.Backplane.Password }},
+	{key: "backplane.prefix", usage: "Prefix of the Redis channels used by the backplane", field: func(c *Config) any { return &c.Backplane.Prefix }},
+	{key: "server.shutdown_delay", usage: "Time to keep serving after readiness starts failing on shutdown", field: func(c *Config) any { return &c.Server.ShutdownDelay }},
+}
+
+// Default returns the built-in configuration
+func Default() *Config {
+	defaultLimits := protocol.DefaultLimits()
+	return &Config{
+		Listeners: Listeners{Redis: ":6379", HTTP: ":8080"},
+		HTTP:      HTTP{ReadHeaderTimeout: 10 * time.Second, ReadTimeout: 30 * time.Second},
+		Admin:     Admin{Listen: "127.0.0.1:8081"},
+		TokenStore: TokenStore{
+			Driver:   "mysql",
+			Host:     "localhost",
+			Port:     3306,
+			User:     "root",
+			Password: "root",
+			Database: "redix",
+		},
+		Limits: Limits{
+			AuthTimeout:  10 * time.Second,
+			TCPKeepAlive: 300 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			TokenRecheck: 30 * time.Second,
+		},
+		Protocol: Protocol{
+			MaxBulkLen:      defaultLimits.MaxBulkLen,
+			MaxMultibulkLen: defaultLimits.MaxMultibulkLen,
+			MaxInlineLen:    defaultLimits.MaxInlineLen,
+			MaxChannelLen:   defaultLimits.MaxChannelLen,
+		},
+		Retention: Retention{Messages: 100},
+		Reliable:  Reliable{VisibilityTimeout: 30 * time.Second, MaxPending: 10000},
+		Logging:   Logging{Level: "info", Format: "text", SampleInitial: 100, SampleThereafter: 100},
+		Audit:     Audit{MaxSize: 100, MaxFiles: 10},
+		Cluster:   Cluster{ProbeInterval: time.Second, SuspicionTimeout: 5 * time.Second},
+		Backplane: Backplane{Prefix: "redix:"},
+		Server:    ServerOptions{ShutdownDelay: 5 * time.Second},
+		sources:   make(map[string]Source),
+	}
+}
+
+// Keys returns every configuration key in display order
+func Keys() []string {
+	keys := make([]string, len(options))
+	for i, o := range options {
+		keys[i] = o.key
+	}
+	return keys
+}
+
+func lookup(key string) (option, bool) {
+	for _, o := range options {
+		if o.key == key {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// Get returns the value of key formatted as a string
+func (c *Config) Get(key string) (string, error) {
+	o, ok := lookup(key)
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", key)
+	}
+	return format(o.field(c)), nil
+}
+
+// Set parses value into key and records where it came from
+func (c *Config) Set(key, value string, src Source) error {
+	o, ok := lookup(key)
+	if !ok {
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if err := parse(o.field(c), value); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if c.sources == nil {
+		c.sources = make(map[string]Source)
+	}
+	c.sources[key] = src
+	return nil
+}
+
+// Source returns where the value of key came from
+func (c *Config) Source(key string) Source {
+	return c.sources[key]
+}
+
+// IsRuntime reports whether key can be changed while the server is running
+func IsRuntime(key string) bool {
+	o, _ := lookup(key)
+	return o.runtime
+}
+
+// File returns the config file the configuration was loaded from, if any
+func (c *Config) File() string {
+	return c.file
+}
+
+// clone returns a copy of c that can be changed independently
+func (c *Config) clone() *Config {
+	out := *c
+	out.sources = make(map[string]Source, len(c.sources))
+	for k, v := range c.sources {
+		out.sources[k] = v
+	}
+	return &out
+}
+
+// IsSecret reports whether the value of key must not be displayed
+func IsSecret(key string) bool {
+	o, _ := lookup(key)
+	return o.secret
+}
+
+func parse(field any, value string) error {
+	value = strings.TrimSpace(value)
+	switch p := field.(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("unsupported type %T", field)
+	}
+	return nil
+}
+
+func format(field any) string {
+	switch p := field.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+// DSN returns the token store data source name. An explicit DSN wins unless
+// one of the individual MySQL settings came from a higher precedence source.
+func (c *Config) DSN() string {
+	ts := c.TokenStore
+	if ts.DSN != "" {
+		dsnSrc := c.Source("token_store.dsn")
+		overridden := false
+		for _, k := range []string{"token_store.host", "token_store.port", "token_store.user", "token_store.password", "token_store.database"} {
+			if c.Source(k) > dsnSrc {
+				overridden = true
+			}
+		}
+		if !overridden || ts.Driver != "mysql" {
+			return ts.DSN
+		}
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true",
+		ts.User, ts.Password, net.JoinHostPort(ts.Host, strconv.Itoa(ts.Port)), ts.Database)
+}
+
+// Validate checks the configuration and returns every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listeners.Redis == "" {
+		fail("listeners.redis: must not be empty")
+	}
+	seen := make(map[string]string)
+	for _, l := range []struct{ key, addr string }{
+		{"listeners.redis", c.Listeners.Redis},
+		{"listeners.http", c.Listeners.HTTP},
+		{"admin.listen", c.Admin.Listen},
+		{"cluster.listen", c.Cluster.Listen},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(l.addr); err != nil {
+			fail("%s: invalid address %q", l.key, l.addr)
+			continue
+		} else if port == "0" {
+			continue
+		}
+		if other, ok := seen[l.addr]; ok {
+			fail("%s: address %q already used by %s", l.key, l.addr, other)
+		}
+		seen[l.addr] = l.key
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls: cert_file and key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		fail("tls.client_ca_file: requires cert_file and key_file")
+	}
+	for _, f := range []struct{ key, path string }{
+		{"tls.cert_file", c.TLS.CertFile},
+		{"tls.key_file", c.TLS.KeyFile},
+		{"tls.client_ca_file", c.TLS.ClientCAFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			fail("%s: %v", f.key, err)
+		}
+	}
+
+	switch c.TokenStore.Driver {
+	case "mysql":
+		if c.TokenStore.DSN == "" && (c.TokenStore.Host == "" || c.TokenStore.Database == "") {
+			fail("token_store: host and database are required when dsn is not set")
+		}
+		if c.TokenStore.Port < 1 || c.TokenStore.Port > 65535 {
+			fail("token_store.port: must be between 1 and 65535")
+		}
+	case "sqlite3":
+		if c.TokenStore.DSN == "" {
+			fail("token_store.dsn: required for the sqlite3 driver")
+		}
+	default:
+		fail("token_store.driver: must be mysql or sqlite3, got %q", c.TokenStore.Driver)
+	}
+
+	if c.Limits.MaxClients < 0 {
+		fail("limits.maxclients: must not be negative")
+	}
+	if c.Limits.MaxClientsPerToken < 0 {
+		fail("limits.maxclients_per_token: must not be negative")
+	}
+	if c.Limits.TenantMaxChannels < 0 {
+		fail("limits.tenant_max_channels: must not be negative")
+	}
+	if c.Limits.TenantMaxSubscriptions < 0 {
+		fail("limits.tenant_max_subscriptions: must not be negative")
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"limits.auth_timeout", c.Limits.AuthTimeout},
+		{"limits.idle_timeout", c.Limits.IdleTimeout},
+		{"limits.tcp_keepalive", c.Limits.TCPKeepAlive},
+		{"limits.write_timeout", c.Limits.WriteTimeout},
+		{"limits.token_recheck", c.Limits.TokenRecheck},
+		{"http.read_header_timeout", c.HTTP.ReadHeaderTimeout},
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+	} {
+		if d.value < 0 {
+			fail("%s: must not be negative", d.key)
+		}
+	}
+	for _, p := range []struct {
+		key   string
+		value int
+	}{
+		{"protocol.max_bulk_len", c.Protocol.MaxBulkLen},
+		{"protocol.max_multibulk_len", c.Protocol.MaxMultibulkLen},
+		{"protocol.max_inline_len", c.Protocol.MaxInlineLen},
+		{"protocol.max_channel_len", c.Protocol.MaxChannelLen},
+	} {
+		if p.value < 1 {
+			fail("%s: must be at least 1", p.key)
+		}
+	}
+	if c.Retention.Messages < 0 {
+		fail("retention.messages: must not be negative")
+	}
+	if c.Reliable.VisibilityTimeout <= 0 {
+		fail("reliable.visibility_timeout: must be positive")
+	}
+	if c.Reliable.MaxPending < 0 {
+		fail("reliable.max_pending: must not be negative")
+	}
+	for _, n := range strings.Split(c.Webhooks.AllowedNetworks, ",") {
+		if n = strings.TrimSpace(n); n == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(n); err != nil {
+			fail("webhooks.allowed_networks: %q is not a CIDR network", n)
+		}
+	}
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("logging.level: must be debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		fail("logging.format: must be text or json, got %q", c.Logging.Format)
+	}
+	if c.Logging.SampleInitial < 0 || c.Logging.SampleThereafter < 0 {
+		fail("logging: sample_initial and sample_thereafter must not be negative")
+	}
+	if c.Audit.MaxSize < 0 {
+		fail("audit.max_size: must not be negative")
+	}
+	if c.Audit.MaxFiles < 1 {
+		fail("audit.max_files: must be at least 1")
+	}
+	if c.Cluster.Peers != "" && c.Cluster.Listen == "" {
+		fail("cluster.peers: requires cluster.listen")
+	}
+	for _, peer := range c.Cluster.PeerList() {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			fail("cluster.peers: invalid address %q", peer)
+		}
+	}
+	if c.Cluster.Advertise != "" {
+		if _, _, err := net.SplitHostPort(c.Cluster.Advertise); err != nil {
+			fail("cluster.advertise: invalid address %q", c.Cluster.Advertise)
+		}
+	}
+	if c.Cluster.ProbeInterval <= 0 {
+		fail("cluster.probe_interval: must be positive")
+	}
+	if c.Cluster.SuspicionTimeout < c.Cluster.ProbeInterval {
+		fail("cluster.suspicion_timeout: must be at least cluster.probe_interval")
+	}
+	if c.Backplane.Redis != "" {
+		if _, _, err := net.SplitHostPort(c.Backplane.Redis); err != nil {
+			fail("backplane.redis: invalid address %q", c.Backplane.Redis)
+		}
+		if c.Cluster.Listen != "" {
+			fail("backplane.redis: cannot be combined with cluster.listen")
+		}
+	}
+	if c.Server.ShutdownDelay < 0 {
+		fail("server.shutdown_delay: must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+// TLSConfig builds the listener TLS configuration, or returns nil when TLS
+// is not configured
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLS.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates found in %s", c.TLS.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variable of every key, so
+// limits.maxclients is read from REDIX_LIMITS_MAXCLIENTS
+const EnvPrefix = "REDIX_"
+
+// legacyFlags maps the original command line flags to their keys
+var legacyFlags = map[string]string{
+	"port":           "listeners.redis",
+	"http-port":      "listeners.http",
+	"admin-port":     "admin.listen",
+	"mysql-host":     "token_store.host",
+	"mysql-port":     "token_store.port",
+	"mysql-user":     "token_store.user",
+	"mysql-pass":     "token_store.password",
+	"mysql-db":       "token_store.database",
+	"retention":      "retention.messages",
+	"shutdown-delay": "server.shutdown_delay",
+}
+
+// legacyEnv maps environment variables used before the REDIX_ prefix
+var legacyEnv = map[string]string{
+	"MYSQL_DSN": "token_store.dsn",
+}
+
+// Flags holds the configuration flags registered on a FlagSet
+type Flags struct {
+	file string
+	set  []flagValue
+}
+
+type flagValue struct {
+	key, value string
+}
+
+// RegisterFlags registers -config and one flag per key, named after the
+// key, plus the original short flags such as -port and -mysql-host
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.file, "config", "", "Config file (.yaml, .yml, .toml or .json); defaults to $REDIX_CONFIG")
+
+	def := Default()
+	for _, o := range options {
+		key := o.key
+		usage := o.usage
+		if v := format(o.field(def)); v != "" && !o.secret {
+			usage += fmt.Sprintf(" (default %q)", v)
+		}
+		fs.Func(key, usage, f.record(key))
+	}
+	for name, key := range legacyFlags {
+		fs.Func(name, "Alias for -"+key, f.record(key))
+	}
+	return f
+}
+
+func (f *Flags) record(key string) func(string) error {
+	return func(v string) error {
+		f.set = append(f.set, flagValue{key, v})
+		return nil
+	}
+}
+
+// Load builds the configuration: defaults, then the config file, then
+// environment variables, then flags. The result is validated and every
+// problem found is returned together.
+func (f *Flags) Load(lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	var errs []error
+
+	file := f.file
+	if file == "" {
+		file, _ = lookupEnv(EnvPrefix + "CONFIG")
+	}
+	if file != "" {
+		if err := c.LoadFile(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for name, key := range legacyEnv {
+		if v, ok := lookupEnv(name); ok && v != "" {
+			if err := c.Set(key, v, SourceEnv); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	for _, key := range Keys() {
+		name := EnvName(key)
+		if v, ok := lookupEnv(name); ok {
+			if err := c.Set(key, v, SourceEnv); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+
+	for _, fv := range f.set {
+		if err := c.Set(fv.key, fv.value, SourceFlag); err != nil {
+			errs = append(errs, fmt.Errorf("flag %w", err))
+		}
+	}
+
+	return c, errors.Join(append(errs, c.Validate())...)
+}
+
+// EnvName returns the environment variable read for key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// LoadFile applies a config file, choosing the format by file extension.
+// Unknown keys are errors.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.file = path
+
+	var entries []entry
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		entries, err = parseYAML(string(data))
+	case ".toml":
+		entries, err = parseTOML(string(data))
+	case ".json":
+		entries, err = parseJSON(data)
+	default:
+		return fmt.Errorf("%s: unsupported config format %q", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	for _, e := range entries {
+		if err := c.Set(e.key, e.value, SourceFile); err != nil {
+			if e.line > 0 {
+				err = fmt.Errorf("%s:%d: %w", path, e.line, err)
+			} else {
+				err = fmt.Errorf("%s: %w", path, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Write prints the effective configuration, one key per line with the
+// source of its value. Secrets are masked.
+func (c *Config) Write(w io.Writer) error {
+	width := 0
+	for _, key := range Keys() {
+		width = max(width, len(key))
+	}
+	for _, o := range options {
+		v := format(o.field(c))
+		if o.secret && v != "" {
+			v = "********"
+		}
+		if _, ok := o.field(c).(*string); ok {
+			v = strconv.Quote(v)
+		}
+		if _, err := fmt.Fprintf(w, "%-*s = %-24s # %s\n", width, o.key, v, c.Source(o.key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
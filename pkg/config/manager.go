@@ -0,0 +1,284 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"redix/pkg/glob"
+)
+
+// ErrNoConfigFile is returned by Rewrite when the server was started
+// without a config file
+var ErrNoConfigFile = errors.New("the server is running without a config file")
+
+// ChangeHook is called after the live configuration changes with the keys
+// whose values changed
+type ChangeHook func(cfg *Config, changed []string)
+
+// Manager holds the live configuration. It applies CONFIG SET changes and
+// reloads, rejecting changes to settings that need a restart.
+type Manager struct {
+	// update serializes changes so hooks see them in order
+	update sync.Mutex
+	hooks  []ChangeHook
+
+	mu   sync.RWMutex
+	cfg  *Config
+	load func() (*Config, error)
+}
+
+// NewManager creates a manager for cfg. load rebuilds the configuration
+// from its sources and is used by Reload.
+func NewManager(cfg *Config, load func() (*Config, error)) *Manager {
+	return &Manager{cfg: cfg, load: load}
+}
+
+// OnChange registers a hook called after every change
+func (m *Manager) OnChange(hook ChangeHook) {
+	m.update.Lock()
+	defer m.update.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+// Config returns a snapshot of the live configuration
+func (m *Manager) Config() *Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.clone()
+}
+
+// Get returns key/value pairs for the keys matching pattern. Secrets are
+// masked.
+func (m *Manager) Get(pattern string) [][2]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out [][2]string
+	for _, o := range options {
+		if !glob.Match(strings.ToLower(pattern), o.key) {
+			continue
+		}
+		v := format(o.field(m.cfg))
+		if o.secret && v != "" {
+			v = "********"
+		}
+		out = append(out, [2]string{o.key, v})
+	}
+	return out
+}
+
+// Set changes runtime settings given as key/value pairs. Either every
+// change is applied or none is.
+func (m *Manager) Set(pairs ...string) error {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errors.New("settings must be given as key/value pairs")
+	}
+
+	m.update.Lock()
+	defer m.update.Unlock()
+
+	cur := m.Config()
+	next := cur.clone()
+	for i := 0; i < len(pairs); i += 2 {
+		key := strings.ToLower(pairs[i])
+		if _, ok := lookup(key); !ok {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		if !IsRuntime(key) {
+			return fmt.Errorf("%s can not be changed at runtime", key)
+		}
+		if err := next.Set(key, pairs[i+1], SourceRuntime); err != nil {
+			return err
+		}
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	m.swap(next)
+	m.notify(next, diff(cur, next))
+	return nil
+}
+
+// Reload rebuilds the configuration from its sources and swaps it in as a
+// whole. Invalid configurations are rejected and leave the live one intact.
+// Values set with CONFIG SET are replaced. Settings that need a restart keep
+// their current value; their keys are returned so the caller can warn.
+func (m *Manager) Reload() (restart []string, err error) {
+	m.update.Lock()
+	defer m.update.Unlock()
+
+	loaded, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	next := m.Config()
+	next.file = loaded.file
+	var changed []string
+	for _, o := range options {
+		if format(o.field(next)) == format(o.field(loaded)) {
+			next.sources[o.key] = loaded.sources[o.key]
+			continue
+		}
+		if !o.runtime {
+			restart = append(restart, o.key)
+			continue
+		}
+		parse(o.field(next), format(o.field(loaded)))
+		next.sources[o.key] = loaded.sources[o.key]
+		changed = append(changed, o.key)
+	}
+	m.swap(next)
+	m.notify(next, changed)
+	return restart, nil
+}
+
+// Rewrite persists the live configuration to the config file it was
+// loaded from. Values from the file and from CONFIG SET are written; values
+// from defaults, the environment and flags are not. Comments in the file
+// are not preserved. The file is replaced atomically.
+func (m *Manager) Rewrite() error {
+	m.update.Lock()
+	defer m.update.Unlock()
+
+	cfg := m.Config()
+	if cfg.file == "" {
+		return ErrNoConfigFile
+	}
+
+	var entries []entry
+	for _, o := range options {
+		if src := cfg.Source(o.key); src == SourceFile || src == SourceRuntime {
+			entries = append(entries, entry{key: o.key, value: format(o.field(cfg))})
+		}
+	}
+
+	data, err := encode(filepath.Ext(cfg.file), entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.file), ".redix-config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(cfg.file); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cfg.file)
+}
+
+func (m *Manager) swap(cfg *Config) {
+	m.mu.Lock()
+	m.cfg = cfg
+	m.mu.Unlock()
+}
+
+// notify runs the hooks; the caller holds m.update
+func (m *Manager) notify(cfg *Config, changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+	for _, hook := range m.hooks {
+		hook(cfg, changed)
+	}
+}
+
+// diff returns the keys whose values differ between a and b
+func diff(a, b *Config) []string {
+	var changed []string
+	for _, o := range options {
+		if format(o.field(a)) != format(o.field(b)) {
+			changed = append(changed, o.key)
+		}
+	}
+	return changed
+}
+
+// encode writes entries in the config file format for ext, grouping keys
+// by their first segment
+func encode(ext string, entries []entry) ([]byte, error) {
+	var b bytes.Buffer
+	section := func(key string) (string, string) {
+		s, name, _ := strings.Cut(key, ".")
+		return s, name
+	}
+	isInt := func(key string) bool {
+		o, _ := lookup(key)
+		_, ok := o.field(Default()).(*int)
+		return ok
+	}
+	scalar := func(e entry) string {
+		if isInt(e.key) {
+			return e.value
+		}
+		return strconv.Quote(e.value)
+	}
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		last := ""
+		for _, e := range entries {
+			s, name := section(e.key)
+			if s != last {
+				fmt.Fprintf(&b, "%s:\n", s)
+				last = s
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", name, scalar(e))
+		}
+	case ".toml":
+		last := ""
+		for _, e := range entries {
+			s, name := section(e.key)
+			if s != last {
+				if last != "" {
+					b.WriteByte('\n')
+				}
+				fmt.Fprintf(&b, "[%s]\n", s)
+				last = s
+			}
+			fmt.Fprintf(&b, "%s = %s\n", name, scalar(e))
+		}
+	case ".json":
+		root := make(map[string]map[string]any)
+		for _, e := range entries {
+			s, name := section(e.key)
+			if root[s] == nil {
+				root[s] = make(map[string]any)
+			}
+			var v any = e.value
+			if n, err := strconv.Atoi(e.value); err == nil && isInt(e.key) {
+				v = n
+			}
+			root[s][name] = v
+		}
+		data, err := json.MarshalIndent(root, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		b.Write(data)
+		b.WriteByte('\n')
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", ext)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// entry is a dotted key and its raw value read from a config file
+type entry struct {
+	key   string
+	value string
+	line  int
+}
+
+// parseYAML reads the subset of YAML used by config files: nested
+// mappings of scalars, indented with spaces
+func parseYAML(src string) ([]entry, error) {
+	// level is an open mapping: the indentation of its key and of its
+	// children, which must all line up
+	type level struct {
+		indent int
+		child  int
+		prefix string
+	}
+	var (
+		entries []entry
+		stack   []level
+		// pending is a key with no value whose nested mapping must follow
+		pending    string
+		pendingInd = -1
+	)
+
+	for i, raw := range strings.Split(src, "\n") {
+		line := i + 1
+		text := strings.TrimRight(stripComment(raw), " \r")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", line)
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		text = strings.TrimSpace(text)
+		if strings.HasPrefix(text, "- ") || text == "-" {
+			return nil, fmt.Errorf("line %d: lists are not supported", line)
+		}
+
+		if pending != "" {
+			if indent <= pendingInd {
+				return nil, fmt.Errorf("line %d: key %q has no value", line-1, pending)
+			}
+			stack = append(stack, level{indent: pendingInd, child: indent, prefix: pending})
+			pending = ""
+		}
+		for len(stack) > 0 && indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if (len(stack) > 0 && indent != stack[len(stack)-1].child) || (len(stack) == 0 && indent != 0) {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", line)
+		}
+
+		name, value, ok := strings.Cut(text, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("line %d: empty key", line)
+		}
+		key := name
+		if len(stack) > 0 {
+			key = stack[len(stack)-1].prefix + "." + name
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" {
+			pending, pendingInd = key, indent
+			continue
+		}
+		v, err := yamlScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry{key, v, line})
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("key %q has no value", pending)
+	}
+	return entries, nil
+}
+
+func yamlScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", v)
+		}
+		return s, nil
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("invalid quoted string %s", v)
+		}
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	case strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{"):
+		return "", fmt.Errorf("flow collections are not supported")
+	case v == "~" || v == "null":
+		return "", nil
+	}
+	return v, nil
+}
+
+// parseTOML reads the subset of TOML used by config files: [table]
+// headers and key = value pairs with string, integer or boolean values
+func parseTOML(src string) ([]entry, error) {
+	var (
+		entries []entry
+		table   string
+	)
+	for i, raw := range strings.Split(src, "\n") {
+		line := i + 1
+		text := strings.TrimSpace(stripComment(raw))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") || strings.HasPrefix(text, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", line)
+			}
+			table = strings.TrimSpace(text[1 : len(text)-1])
+			if table == "" {
+				return nil, fmt.Errorf("line %d: empty table name", line)
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", line)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("line %d: empty key", line)
+		}
+		key := name
+		if table != "" {
+			key = table + "." + name
+		}
+		v, err := tomlValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry{key, v, line})
+	}
+	return entries, nil
+}
+
+func tomlValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", v)
+		}
+		return s, nil
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") || strings.Contains(v[1:len(v)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	case v == "true" || v == "false":
+		return v, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(v, "_", ""), 10, 64); err == nil {
+		return strings.ReplaceAll(v, "_", ""), nil
+	}
+	return "", fmt.Errorf("invalid value %s (strings must be quoted)", v)
+}
+
+// stripComment removes a # comment that is not inside quotes
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case quote == '"' && ch == '\\':
+			i++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// parseJSON reads nested objects of scalars
+func parseJSON(data []byte) ([]entry, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var root map[string]any
+	if err := dec.Decode(&root); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the top-level object")
+	}
+
+	var entries []entry
+	var walk func(prefix string, m map[string]any) error
+	walk = func(prefix string, m map[string]any) error {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key := name
+			if prefix != "" {
+				key = prefix + "." + name
+			}
+			switch v := m[name].(type) {
+			case map[string]any:
+				if err := walk(key, v); err != nil {
+					return err
+				}
+			case string:
+				entries = append(entries, entry{key: key, value: v})
+			case json.Number:
+				entries = append(entries, entry{key: key, value: v.String()})
+			case bool:
+				entries = append(entries, entry{key: key, value: strconv.FormatBool(v)})
+			case nil:
+				entries = append(entries, entry{key: key})
+			default:
+				return fmt.Errorf("%s: arrays are not supported", key)
+			}
+		}
+		return nil
+	}
+	return entries, walk("", root)
+}
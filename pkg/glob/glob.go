@@ -0,0 +1,99 @@
+package glob
+
+// Match reports whether s matches the Redis-style glob pattern. It supports
+// "*" (any sequence), "?" (any single byte), "[abc]", "[^abc]" and "[a-z]"
+// character classes, and "\" to escape the next byte.
+func Match(pattern, s string) bool {
+	px, sx := 0, 0
+	// Position to resume from when the last "*" has to absorb one more byte
+	starP, starS := -1, 0
+
+	for sx < len(s) {
+		if px < len(pattern) {
+			switch pattern[px] {
+			case '*':
+				starP, starS = px, sx
+				px++
+				continue
+			case '?':
+				px++
+				sx++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, px, s[sx]); ok {
+					px = next
+					sx++
+					continue
+				}
+			case '\\':
+				if px+1 < len(pattern) && pattern[px+1] == s[sx] {
+					px += 2
+					sx++
+					continue
+				}
+			default:
+				if pattern[px] == s[sx] {
+					px++
+					sx++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		px, sx = starP+1, starS
+	}
+
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
+
+// matchClass matches c against the character class starting at pattern[start]
+// and returns the index just past the class
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	i := start + 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if i >= len(pattern) {
+		// Unterminated class: treat "[" as a literal
+		return start + 1, pattern[start] == c
+	}
+	return i + 1, matched != negate
+}
+
+// IsPattern reports whether s contains glob metacharacters
+func IsPattern(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
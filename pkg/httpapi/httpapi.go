@@ -0,0 +1,386 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// maxBodySize bounds the size of a publish request body
+const maxBodySize = 1 << 20
+
+// Sessions applies the connection limits of the Redis listener to
+// WebSocket and SSE sessions
+type Sessions interface {
+	// OpenSession registers a session, failing when the server is at its
+	// connection limit
+	OpenSession(c *client.Client, remoteAddr string) error
+	// ClaimSession counts a session against the cap of its token
+	ClaimSession(c *client.Client, token string) error
+	// CloseSession forgets a session
+	CloseSession(c *client.Client)
+}
+
+// Server is the public HTTP API listener
+type Server struct {
+	auth     *auth.Validator
+	pubsub   *pubsub.PubSub
+	audit    *audit.Log
+	limits   protocol.Limits
+	sessions Sessions
+	origins  []string
+	mux      *http.ServeMux
+}
+
+// New creates a new HTTP API server
+func New(validator *auth.Validator, ps *pubsub.PubSub) *Server {
+	s := &Server{
+		auth:   validator,
+		pubsub: ps,
+		limits: protocol.DefaultLimits(),
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("POST /v1/channels/{channel}/publish", s.authenticated(s.handleChannelPublish))
+	s.mux.HandleFunc("POST /v1/publish", s.authenticated(s.handleBatchPublish))
+	s.mux.HandleFunc("POST /v1/tenants/{tenant}/channels/{channel}/publish", s.authenticated(s.handleTenantPublish))
+	s.mux.HandleFunc("POST /v1/broadcast/{channel}", s.authenticated(s.handleBroadcast))
+	s.mux.HandleFunc("GET /v1/ws", s.handleWebSocket)
+	s.mux.HandleFunc("GET /v1/stream", s.authenticated(s.handleStream))
+	return s
+}
+
+// Handler returns the HTTP handler serving the API endpoints
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// SetAudit records authentication failures, and the authentication of
+// WebSocket and SSE sessions, to l
+func (s *Server) SetAudit(l *audit.Log) {
+	s.audit = l
+}
+
+// SetProtocolLimits bounds the channel names accepted by the API, as for
+// RESP clients. It must be called before serving.
+func (s *Server) SetProtocolLimits(l protocol.Limits) {
+	s.limits = l
+}
+
+// SetSessions applies the connection limits of ss to WebSocket and SSE
+// sessions. It must be called before serving.
+func (s *Server) SetSessions(ss Sessions) {
+	s.sessions = ss
+}
+
+// SetAllowedOrigins sets the browser origins that may open WebSocket
+// sessions; "*" allows any origin. With no origins only pages served from
+// the API's own host are allowed. It must be called before serving.
+func (s *Server) SetAllowedOrigins(origins []string) {
+	s.origins = origins
+}
+
+// originAllowed reports whether the Origin of a WebSocket request is
+// allowed. Requests without an Origin header do not come from a browser.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range s.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// openSession registers c with the session limits, if any
+func (s *Server) openSession(c *client.Client, remoteAddr string) error {
+	if s.sessions == nil {
+		return nil
+	}
+	return s.sessions.OpenSession(c, remoteAddr)
+}
+
+// claimSession counts c against the session cap of token, if any
+func (s *Server) claimSession(c *client.Client, token string) error {
+	if s.sessions == nil {
+		return nil
+	}
+	return s.sessions.ClaimSession(c, token)
+}
+
+// closeSession forgets c
+func (s *Server) closeSession(c *client.Client) {
+	if s.sessions != nil {
+		s.sessions.CloseSession(c)
+	}
+}
+
+// recordAuth writes an audit event for an authentication attempt
+func (s *Server) recordAuth(remoteAddr, path, token string, ok bool) {
+	e := audit.Event{Type: audit.AuthFailure, Outcome: audit.Failure, Target: auth.Redact(token)}
+	if ok {
+		e = audit.Event{Type: audit.AuthSuccess, Outcome: audit.Success, Tenant: auth.Redact(token)}
+	}
+	e.RemoteAddr = remoteAddr
+	e.Details = map[string]string{"path": path}
+	s.audit.Record(e)
+}
+
+// ListenAndServe starts the HTTP API listener on the specified address
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.mux)
+}
+
+// errNoPerm is returned when a token's ACL does not allow a channel
+var errNoPerm = errors.New("token has no permission to access this channel")
+
+// tokenHandler is an HTTP handler that receives the authenticated token
+type tokenHandler func(w http.ResponseWriter, r *http.Request, tok auth.Token)
+
+// authenticated validates the bearer token before calling next
+func (s *Server) authenticated(next tokenHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := requestToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="redix"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		tok, ok := s.auth.Lookup(token)
+		if !ok {
+			s.recordAuth(r.RemoteAddr, r.URL.Path, token, false)
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next(w, r, tok)
+	}
+}
+
+// channelPublishRequest is the body of a single channel publish. Either
+// Message or Messages must be set.
+type channelPublishRequest struct {
+	Message  *string  `json:"message"`
+	Messages []string `json:"messages"`
+}
+
+func (s *Server) handleChannelPublish(w http.ResponseWriter, r *http.Request, tok auth.Token) {
+	if err := s.checkPublish(tok, r.PathValue("channel")); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	s.publishChannel(w, r, tok.Tenant)
+}
+
+// checkPublish returns why tok may not publish on channel, if it may not
+func (s *Server) checkPublish(tok auth.Token, channel string) error {
+	if !tok.ACL.CanPublish(channel) {
+		return errNoPerm
+	}
+	return s.pubsub.CanPublish(tok.Tenant, channel)
+}
+
+// handleTenantPublish lets the master token publish as another tenant
+func (s *Server) handleTenantPublish(w http.ResponseWriter, r *http.Request, tok auth.Token) {
+	if !auth.IsMasterToken(tok.Token) {
+		writeError(w, http.StatusForbidden, "only master token can publish to other tenants")
+		return
+	}
+	target := r.PathValue("tenant")
+	if auth.IsMasterTenant(target) || auth.IsBroadcast(target) {
+		writeError(w, http.StatusBadRequest, "use /v1/broadcast to reach every tenant")
+		return
+	}
+	s.publishChannel(w, r, target)
+}
+
+// handleBroadcast lets the master token publish to every tenant
+func (s *Server) handleBroadcast(w http.ResponseWriter, r *http.Request, tok auth.Token) {
+	if !auth.IsMasterToken(tok.Token) {
+		writeError(w, http.StatusForbidden, "only master token can publish to other tenants")
+		return
+	}
+	s.publishChannel(w, r, auth.AllTenants)
+}
+
+// publishChannel publishes the messages of a channel publish request as
+// tenant
+func (s *Server) publishChannel(w http.ResponseWriter, r *http.Request, tenant string) {
+	channel := r.PathValue("channel")
+	if err := s.limits.CheckChannel(channel); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, err := readChannelMessages(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.pubsub.CanEnqueue(tenant, channel, len(messages)); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	if len(messages) == 1 {
+		writeJSON(w, http.StatusOK, map[string]int{
+			"receivers": s.pubsub.Publish(channel, messages[0], tenant),
+		})
+		return
+	}
+
+	receivers := make([]int, len(messages))
+	total := 0
+	for i, msg := range messages {
+		receivers[i] = s.pubsub.Publish(channel, msg, tenant)
+		total += receivers[i]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"receivers": receivers,
+		"total":     total,
+	})
+}
+
+// batchPublishRequest is the body of a multi-channel publish
+type batchPublishRequest struct {
+	Messages []struct {
+		Channel string `json:"channel"`
+		Message string `json:"message"`
+	} `json:"messages"`
+}
+
+func (s *Server) handleBatchPublish(w http.ResponseWriter, r *http.Request, tok auth.Token) {
+	var req batchPublishRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "messages must not be empty")
+		return
+	}
+	perChannel := make(map[string]int)
+	for _, m := range req.Messages {
+		if m.Channel == "" {
+			writeError(w, http.StatusBadRequest, "channel must not be empty")
+			return
+		}
+		if err := s.limits.CheckChannel(m.Channel); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.checkPublish(tok, m.Channel); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		perChannel[m.Channel]++
+	}
+	for channel, n := range perChannel {
+		if err := s.pubsub.CanEnqueue(tok.Tenant, channel, n); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+
+	receivers := make([]int, len(req.Messages))
+	total := 0
+	for i, m := range req.Messages {
+		receivers[i] = s.pubsub.Publish(m.Channel, m.Message, tok.Tenant)
+		total += receivers[i]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"receivers": receivers,
+		"total":     total,
+	})
+}
+
+// readChannelMessages reads the messages of a channel publish request. A
+// JSON body carries "message" or "messages"; any other body is published
+// verbatim as a single message.
+func readChannelMessages(r *http.Request) ([]string, error) {
+	if !isJSON(r) {
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+		if err != nil {
+			return nil, errors.New("request body too large")
+		}
+		return []string{string(body)}, nil
+	}
+
+	var req channelPublishRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	switch {
+	case req.Message != nil && req.Messages != nil:
+		return nil, errors.New("only one of message and messages may be set")
+	case req.Message != nil:
+		return []string{*req.Message}, nil
+	case len(req.Messages) > 0:
+		return req.Messages, nil
+	default:
+		return nil, errors.New("message or messages is required")
+	}
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// requestToken extracts the bearer token, falling back to a "token" query
+// parameter on GET requests since browser EventSource and WebSocket APIs
+// cannot set headers
+func requestToken(r *http.Request) (string, bool) {
+	if token, ok := bearerToken(r); ok {
+		return token, true
+	}
+	if r.Method == http.MethodGet {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+func isJSON(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/json"
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.New("invalid JSON body: " + err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
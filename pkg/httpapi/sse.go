@@ -0,0 +1,223 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+)
+
+const (
+	// sseKeepAlive is how often a comment is sent on an idle stream so
+	// proxies do not time it out
+	sseKeepAlive = 15 * time.Second
+
+	// sseBuffer is how many messages may queue for a slow stream before it
+	// is closed; the browser then reconnects and resumes from history
+	sseBuffer = 256
+
+	// sseRetry is the reconnection delay suggested to the browser, in milliseconds
+	sseRetry = 3000
+)
+
+var errSlowConsumer = errors.New("stream buffer full")
+
+// sseTransport queues pub/sub pushes for the goroutine writing the stream
+type sseTransport struct {
+	messages chan client.Message
+	errs     chan string
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newSSETransport() *sseTransport {
+	return &sseTransport{
+		messages: make(chan client.Message, sseBuffer),
+		errs:     make(chan string, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *sseTransport) Message(msg client.Message) error {
+	select {
+	case t.messages <- msg:
+		return nil
+	default:
+		t.Close()
+		return errSlowConsumer
+	}
+}
+
+func (t *sseTransport) Error(message string) error {
+	select {
+	case t.errs <- message:
+	default:
+	}
+	return nil
+}
+
+func (t *sseTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// sseEvent is the data of a message event
+type sseEvent struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+}
+
+// handleStream serves GET /v1/stream?channels=a,b as Server-Sent Events.
+// A Last-Event-ID header (or lastEventId query parameter) replays the
+// retained messages published after that ID before streaming live ones.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request, tok auth.Token) {
+	var channels []string
+	for _, ch := range strings.Split(r.URL.Query().Get("channels"), ",") {
+		if ch = strings.TrimSpace(ch); ch != "" {
+			channels = append(channels, ch)
+		}
+	}
+	if len(channels) == 0 {
+		writeError(w, http.StatusBadRequest, "channels is required")
+		return
+	}
+	for _, ch := range channels {
+		if err := s.limits.CheckChannel(ch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !tok.ACL.CanSubscribe(ch) {
+			writeError(w, http.StatusForbidden, errNoPerm.Error())
+			return
+		}
+	}
+	lastID, resume, err := lastEventID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.recordAuth(r.RemoteAddr, r.URL.Path, tok.Token, true)
+
+	t := newSSETransport()
+	c := client.New(nil)
+	if err := s.openSession(c, r.RemoteAddr); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer s.closeSession(c)
+	if err := s.claimSession(c, tok.Token); err != nil {
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	c.Transport = t
+	c.Authenticate(tok)
+	defer s.pubsub.UnsubscribeAll(c)
+
+	// The stream outlives the server's read timeout
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	for _, ch := range channels {
+		if err := s.pubsub.Subscribe(ch, c); err != nil {
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+
+	if resume {
+		var backlog []client.Message
+		for _, ch := range channels {
+			backlog = append(backlog, s.pubsub.History(ch, tok.Tenant, lastID)...)
+		}
+		sort.Slice(backlog, func(i, j int) bool { return backlog[i].ID < backlog[j].ID })
+		for _, msg := range backlog {
+			if err := writeSSEMessage(w, msg); err != nil {
+				return
+			}
+			lastID = msg.ID
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-t.done:
+			select {
+			case reason := <-t.errs:
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", reason)
+				rc.Flush()
+			default:
+			}
+			return
+
+		case msg := <-t.messages:
+			if resume && msg.ID <= lastID {
+				continue
+			}
+			if err := writeSSEMessage(w, msg); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeSSEMessage(w io.Writer, msg client.Message) error {
+	data, err := json.Marshal(sseEvent{Channel: msg.Topic, Message: msg.Payload})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.ID, data)
+	return err
+}
+
+// lastEventID returns the ID a reconnecting stream resumes after
+func lastEventID(r *http.Request) (uint64, bool, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("invalid Last-Event-ID")
+	}
+	return id, true, nil
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/websocket"
+)
+
+// wsPingInterval is how often the gateway pings idle browsers. A browser
+// that stays silent for two intervals is considered gone.
+const wsPingInterval = 30 * time.Second
+
+// wsRequest is a JSON frame sent by a browser
+type wsRequest struct {
+	Type     string   `json:"type"`
+	Token    string   `json:"token,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+// wsEvent is a JSON frame sent to a browser
+type wsEvent struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	Message string `json:"message,omitempty"`
+	Count   *int   `json:"count,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// wsTransport delivers pub/sub pushes to a browser as JSON frames
+type wsTransport struct {
+	ws *websocket.Conn
+}
+
+func (t *wsTransport) Message(msg client.Message) error {
+	return t.send(wsEvent{Type: "message", Channel: msg.Topic, Message: msg.Payload})
+}
+
+func (t *wsTransport) Error(message string) error {
+	return t.send(wsEvent{Type: "error", Error: message})
+}
+
+func (t *wsTransport) Close() error {
+	return t.ws.Close(websocket.ClosePolicyViolation, "disconnected")
+}
+
+func (t *wsTransport) send(ev wsEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return t.ws.WriteText(data)
+}
+
+// handleWebSocket upgrades the request and serves a browser subscriber.
+// Browsers cannot set an Authorization header on a WebSocket, so the token
+// may be passed as a "token" query parameter or in an "auth" frame.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.originAllowed(r) {
+		writeError(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+	token, _ := requestToken(r)
+	var tok auth.Token
+	if token != "" {
+		var ok bool
+		if tok, ok = s.auth.Lookup(token); !ok {
+			s.recordAuth(r.RemoteAddr, r.URL.Path, token, false)
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+	}
+
+	c := client.New(nil)
+	if err := s.openSession(c, r.RemoteAddr); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer s.closeSession(c)
+	if token != "" {
+		if err := s.claimSession(c, token); err != nil {
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+	}
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.CloseNow()
+	ws.WriteTimeout = c.WriteTimeout
+
+	t := &wsTransport{ws: ws}
+	c.Conn = ws.NetConn()
+	c.Transport = t
+	if token != "" {
+		s.recordAuth(r.RemoteAddr, r.URL.Path, token, true)
+		c.Authenticate(tok)
+		t.send(wsEvent{Type: "authenticated"})
+	}
+	defer s.pubsub.UnsubscribeAll(c)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go keepAlive(ws, stop)
+
+	for {
+		if !ws.Closing() {
+			ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		}
+		op, data, err := ws.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				ws.Close(websocket.CloseGoingAway, "")
+			}
+			return
+		}
+		if ws.Closing() {
+			continue
+		}
+		if op != websocket.OpText {
+			ws.Close(websocket.CloseUnsupportedData, "text frames only")
+			continue
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Error("invalid JSON frame")
+			continue
+		}
+		s.handleWebSocketRequest(c, t, req)
+	}
+}
+
+func (s *Server) handleWebSocketRequest(c *client.Client, t *wsTransport, req wsRequest) {
+	switch req.Type {
+	case "auth":
+		addr := c.Conn.RemoteAddr().String()
+		tok, ok := s.auth.Lookup(req.Token)
+		if !ok {
+			s.recordAuth(addr, "/v1/ws", req.Token, false)
+			t.Error("invalid token")
+			return
+		}
+		if err := s.claimSession(c, req.Token); err != nil {
+			t.Error(err.Error())
+			return
+		}
+		s.recordAuth(addr, "/v1/ws", req.Token, true)
+		if c.Authed && c.Namespace() != tok.Tenant {
+			s.pubsub.UnsubscribeAll(c)
+		}
+		c.Authenticate(tok)
+		t.send(wsEvent{Type: "authenticated"})
+
+	case "subscribe":
+		if !c.Authed {
+			t.Error("authentication required")
+			return
+		}
+		if !s.checkChannels(t, req.Channels) {
+			return
+		}
+		for _, channel := range req.Channels {
+			if !c.ACL.CanSubscribe(channel) {
+				t.Error(errNoPerm.Error())
+				return
+			}
+			if err := s.pubsub.Subscribe(channel, c); err != nil {
+				t.Error(err.Error())
+				return
+			}
+			count := len(c.Subscriptions())
+			t.send(wsEvent{Type: "subscribed", Channel: channel, Count: &count})
+		}
+
+	case "unsubscribe":
+		if !c.Authed {
+			t.Error("authentication required")
+			return
+		}
+		if !s.checkChannels(t, req.Channels) {
+			return
+		}
+		channels := req.Channels
+		if len(channels) == 0 {
+			channels = c.Subscriptions()
+		}
+		for _, channel := range channels {
+			s.pubsub.Unsubscribe(channel, c)
+			count := len(c.Subscriptions())
+			t.send(wsEvent{Type: "unsubscribed", Channel: channel, Count: &count})
+		}
+
+	default:
+		t.Error("unknown frame type")
+	}
+}
+
+// checkChannels sends a protocol error and closes the session when a
+// channel name is over the length limit, as for RESP clients
+func (s *Server) checkChannels(t *wsTransport, channels []string) bool {
+	for _, channel := range channels {
+		if err := s.limits.CheckChannel(channel); err != nil {
+			t.Error(err.Error())
+			t.ws.Close(websocket.ClosePolicyViolation, "channel name too long")
+			return false
+		}
+	}
+	return true
+}
+
+// keepAlive pings the browser until stop is closed
+func keepAlive(ws *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ws.Ping(nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Package logging builds the structured logger used across the server
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Options configures the logger
+type Options struct {
+	// Level is debug, info, warn or error
+	Level string
+	// Format is text or json
+	Format string
+	// SampleInitial is how many records with the same level and message are
+	// logged per SampleInterval before sampling starts (0 disables sampling)
+	SampleInitial int
+	// SampleThereafter logs every Nth further record in the interval
+	// (0 drops them all)
+	SampleThereafter int
+	SampleInterval   time.Duration
+}
+
+// New creates a logger writing to w. The returned level can be changed
+// while the logger is in use.
+func New(w io.Writer, opts Options) (*slog.Logger, *slog.LevelVar) {
+	level := new(slog.LevelVar)
+	level.UnmarshalText([]byte(opts.Level))
+	hopts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler = slog.NewTextHandler(w, hopts)
+	if opts.Format == "json" {
+		h = slog.NewJSONHandler(w, hopts)
+	}
+	if opts.SampleInitial > 0 {
+		h = NewSampler(h, opts.SampleInitial, opts.SampleThereafter, opts.SampleInterval)
+	}
+	return slog.New(h), level
+}
+
+// Sampler is a slog.Handler that limits repetitive records. Within each
+// interval the first records with a given level and message pass, then
+// only every Nth one does. Errors are never sampled.
+type Sampler struct {
+	next       slog.Handler
+	initial    uint64
+	thereafter uint64
+	interval   time.Duration
+	state      *samplerState
+}
+
+// samplerState is shared by a Sampler and the handlers derived from it
+type samplerState struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[samplerKey]uint64
+}
+
+type samplerKey struct {
+	level slog.Level
+	msg   string
+}
+
+// NewSampler wraps next with sampling
+func NewSampler(next slog.Handler, initial, thereafter int, interval time.Duration) *Sampler {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Sampler{
+		next:       next,
+		initial:    uint64(initial),
+		thereafter: uint64(thereafter),
+		interval:   interval,
+		state:      &samplerState{counts: make(map[samplerKey]uint64)},
+	}
+}
+
+// Enabled implements slog.Handler
+func (s *Sampler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (s *Sampler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError || s.allow(r) {
+		return s.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (s *Sampler) allow(r slog.Record) bool {
+	st := s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if r.Time.Sub(st.window) >= s.interval || r.Time.Before(st.window) {
+		st.window = r.Time
+		clear(st.counts)
+	}
+	key := samplerKey{r.Level, r.Message}
+	st.counts[key]++
+	n := st.counts[key]
+	if n <= s.initial {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.initial)%s.thereafter == 0
+}
+
+// WithAttrs implements slog.Handler
+func (s *Sampler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *s
+	out.next = s.next.WithAttrs(attrs)
+	return &out
+}
+
+// WithGroup implements slog.Handler
+func (s *Sampler) WithGroup(name string) slog.Handler {
+	out := *s
+	out.next = s.next.WithGroup(name)
+	return &out
+}
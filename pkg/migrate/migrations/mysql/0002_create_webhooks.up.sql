@@ -0,0 +1,22 @@
+-- webhooks.token holds the tenant of the subscription
+CREATE TABLE webhooks (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    token VARCHAR(255) NOT NULL,
+    pattern VARCHAR(255) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_webhooks_token (token)
+);
+
+CREATE TABLE webhook_dead_letters (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INT NOT NULL,
+    message_id BIGINT UNSIGNED NOT NULL,
+    channel VARCHAR(255) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT NOT NULL,
+    failed_at TIMESTAMP NOT NULL,
+    INDEX idx_dead_letters_webhook (webhook_id)
+);
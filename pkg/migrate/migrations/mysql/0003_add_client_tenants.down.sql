@@ -0,0 +1,2 @@
+DROP INDEX idx_clients_tenant ON clients;
+ALTER TABLE clients DROP COLUMN tenant;
@@ -0,0 +1,2 @@
+ALTER TABLE clients ADD COLUMN tenant VARCHAR(255) NULL;
+CREATE INDEX idx_clients_tenant ON clients (tenant);
@@ -0,0 +1,8 @@
+CREATE TABLE bridges (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    tenant VARCHAR(255) NOT NULL,
+    channel VARCHAR(1024) NOT NULL,
+    targets TEXT NOT NULL,
+    read_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+ALTER TABLE clients DROP COLUMN expires_at;
+ALTER TABLE clients DROP COLUMN subscribe_acl;
+ALTER TABLE clients DROP COLUMN publish_acl;
+DROP TABLE tenants;
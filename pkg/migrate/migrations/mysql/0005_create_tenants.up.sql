@@ -0,0 +1,12 @@
+CREATE TABLE tenants (
+    name VARCHAR(255) PRIMARY KEY,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    max_channels INT NOT NULL DEFAULT 0,
+    max_subscriptions INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ACLs are JSON arrays of glob patterns; NULL allows every channel
+ALTER TABLE clients ADD COLUMN publish_acl TEXT NULL;
+ALTER TABLE clients ADD COLUMN subscribe_acl TEXT NULL;
+ALTER TABLE clients ADD COLUMN expires_at DATETIME NULL;
@@ -0,0 +1,2 @@
+UPDATE webhooks SET token = SUBSTRING(token, 7) WHERE token LIKE 'token:%';
+UPDATE bridges SET tenant = SUBSTRING(tenant, 7) WHERE tenant LIKE 'token:%';
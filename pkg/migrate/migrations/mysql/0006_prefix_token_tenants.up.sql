@@ -0,0 +1,6 @@
+-- Tokens without a tenant are now the tenant token:<token>, apart from
+-- named tenants
+UPDATE webhooks SET token = CONCAT('token:', token)
+WHERE token IN (SELECT token FROM clients WHERE (tenant IS NULL OR tenant = '' OR tenant = '*') AND token <> 'MASTER_TOKEN');
+UPDATE bridges SET tenant = CONCAT('token:', tenant)
+WHERE tenant IN (SELECT token FROM clients WHERE (tenant IS NULL OR tenant = '' OR tenant = '*') AND token <> 'MASTER_TOKEN');
@@ -0,0 +1,6 @@
+CREATE TABLE clients (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE
+);
+CREATE UNIQUE INDEX idx_clients_token ON clients (token);
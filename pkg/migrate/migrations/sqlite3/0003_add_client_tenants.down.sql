@@ -0,0 +1,2 @@
+DROP INDEX idx_clients_tenant;
+ALTER TABLE clients DROP COLUMN tenant;
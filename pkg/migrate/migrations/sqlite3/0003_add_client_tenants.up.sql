@@ -0,0 +1,2 @@
+ALTER TABLE clients ADD COLUMN tenant TEXT NULL;
+CREATE INDEX idx_clients_tenant ON clients (tenant);
@@ -0,0 +1,8 @@
+CREATE TABLE bridges (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    targets TEXT NOT NULL,
+    read_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
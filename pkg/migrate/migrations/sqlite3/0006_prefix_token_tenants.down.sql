@@ -0,0 +1,2 @@
+UPDATE webhooks SET token = substr(token, 7) WHERE token LIKE 'token:%';
+UPDATE bridges SET tenant = substr(tenant, 7) WHERE tenant LIKE 'token:%';
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrUnbalancedQuotes is returned by SplitArgs for an unterminated quote or
+// a closing quote not followed by whitespace
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes")
+
+// SplitArgs splits an inline command line into arguments the way Redis
+// does. Arguments are separated by whitespace. Double quotes support the
+// escapes \n, \r, \t, \b, \a, \xHH and a backslash before any other
+// character; single quotes only support \'. A blank line has no arguments.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var (
+			cur   strings.Builder
+			quote byte
+		)
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, ErrUnbalancedQuotes
+				}
+				break
+			}
+			ch := line[i]
+			switch {
+			case quote == '"' && ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+				b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+				cur.WriteByte(byte(b))
+				i += 3
+			case quote == '"' && ch == '\\' && i+1 < len(line):
+				i++
+				cur.WriteByte(unescape(line[i]))
+			case quote == '\'' && ch == '\\' && i+1 < len(line) && line[i+1] == '\'':
+				i++
+				cur.WriteByte('\'')
+			case quote != 0 && ch == quote:
+				// The closing quote must end the argument
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, ErrUnbalancedQuotes
+				}
+				done = true
+			case quote != 0:
+				cur.WriteByte(ch)
+			case isSpace(ch):
+				done = true
+			case ch == '"' || ch == '\'':
+				quote = ch
+			default:
+				cur.WriteByte(ch)
+			}
+		}
+		args = append(args, cur.String())
+	}
+}
+
+func unescape(ch byte) byte {
+	switch ch {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return ch
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\v' || ch == '\f' || ch == 0
+}
+
+func isHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F'
+}
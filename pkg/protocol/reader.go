@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RESP type prefixes
+const (
+	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
+	BulkString   = '$'
+	Array        = '*'
+)
+
+// ErrProtocol is wrapped by errors caused by malformed input
+var ErrProtocol = errors.New("Protocol error")
+
+// Value is a decoded RESP value
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Array []Value
+	// Null is set for null bulk strings and null arrays
+	Null bool
+}
+
+// String returns the value as a string: the text of simple strings, errors
+// and bulk strings, or the decimal form of integers
+func (v Value) String() string {
+	if v.Type == Integer {
+		return strconv.FormatInt(v.Int, 10)
+	}
+	return v.Str
+}
+
+// Limits bounds the input a Reader accepts, so a hostile client cannot make
+// the server allocate unbounded memory. Zero fields are unlimited.
+type Limits struct {
+	// MaxBulkLen is the largest bulk string in bytes
+	MaxBulkLen int
+	// MaxMultibulkLen is the largest number of elements in an array
+	MaxMultibulkLen int
+	// MaxInlineLen is the longest line, inline commands included
+	MaxInlineLen int
+	// MaxChannelLen is the longest channel name or pattern
+	MaxChannelLen int
+	// MaxDepth is how deeply arrays may nest in a reply
+	MaxDepth int
+}
+
+// DefaultLimits returns limits matching Redis: 512MB bulk strings, 1M
+// element arrays and 64KB inline commands
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBulkLen:      512 << 20,
+		MaxMultibulkLen: 1 << 20,
+		MaxInlineLen:    64 << 10,
+		MaxChannelLen:   1024,
+		MaxDepth:        32,
+	}
+}
+
+// CheckChannel returns a protocol error when name exceeds MaxChannelLen
+func (l Limits) CheckChannel(name string) error {
+	if l.MaxChannelLen > 0 && len(name) > l.MaxChannelLen {
+		return protocolError("channel name too long")
+	}
+	return nil
+}
+
+// Reader decodes RESP values and commands from a stream
+type Reader struct {
+	br     *bufio.Reader
+	limits Limits
+}
+
+// NewReader creates a new RESP reader with DefaultLimits
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReader(r), limits: DefaultLimits()}
+}
+
+// SetLimits replaces the reader's limits
+func (r *Reader) SetLimits(l Limits) {
+	r.limits = l
+}
+
+// Buffered returns the number of bytes that can be read without blocking
+func (r *Reader) Buffered() int {
+	return r.br.Buffered()
+}
+
+// ReadValue reads the next RESP value
+func (r *Reader) ReadValue() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, protocolError("empty line")
+	}
+
+	v := Value{Type: line[0]}
+	body := line[1:]
+	switch v.Type {
+	case SimpleString, Error:
+		v.Str = body
+
+	case Integer:
+		if v.Int, err = strconv.ParseInt(body, 10, 64); err != nil {
+			return Value{}, protocolError("invalid integer")
+		}
+
+	case BulkString:
+		n, err := r.bulkLength(body)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		if v.Str, err = r.readBulk(n); err != nil {
+			return Value{}, err
+		}
+
+	case Array:
+		n, err := r.multibulkLength(body)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		if r.limits.MaxDepth > 0 && depth >= r.limits.MaxDepth {
+			return Value{}, protocolError("arrays nested too deeply")
+		}
+		v.Array = make([]Value, 0, min(n, preallocMax))
+		for i := 0; i < n; i++ {
+			elem, err := r.readValue(depth + 1)
+			if err != nil {
+				return Value{}, err
+			}
+			v.Array = append(v.Array, elem)
+		}
+
+	default:
+		return Value{}, protocolError(fmt.Sprintf("unexpected type byte %q", v.Type))
+	}
+	return v, nil
+}
+
+// ReadCommand reads the next client command: a multibulk array of bulk
+// strings, or an inline command line split by SplitArgs. Input over the
+// reader's limits is a protocol error; the stream cannot be resynchronized
+// after one, so the connection should be closed.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		b, err := r.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != Array {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			args, err := SplitArgs(line)
+			if err != nil {
+				return nil, protocolError("unbalanced quotes in request")
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.multibulkLength(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+
+		args := make([]string, 0, min(n, preallocMax))
+		for i := 0; i < n; i++ {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != BulkString {
+				return nil, protocolError(fmt.Sprintf("expected '$', got '%s'", firstByte(line)))
+			}
+			size, err := r.bulkLength(line[1:])
+			if err != nil || size < 0 {
+				return nil, protocolError("invalid bulk length")
+			}
+			arg, err := r.readBulk(size)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// preallocMax caps slices allocated from a length the client sent, so
+// memory grows with the data actually received
+const preallocMax = 1024
+
+// readLine reads a line terminated by CRLF (or a bare LF) without the
+// terminator. Lines longer than MaxInlineLen are a protocol error.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if max := r.limits.MaxInlineLen; max > 0 && len(line) > max+2 {
+			return "", protocolError("too big inline request")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+// readBulk reads n bytes of bulk data followed by CRLF
+func (r *Reader) readBulk(n int) (string, error) {
+	var buf bytes.Buffer
+	buf.Grow(min(n+2, 64<<10))
+	if _, err := io.CopyN(&buf, r.br, int64(n+2)); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	data := buf.Bytes()
+	if data[n] != '\r' || data[n+1] != '\n' {
+		return "", protocolError("bulk string not terminated by CRLF")
+	}
+	return string(data[:n]), nil
+}
+
+// bulkLength parses a bulk string length and checks it against MaxBulkLen
+func (r *Reader) bulkLength(s string) (int, error) {
+	n, err := parseLength(s)
+	if err != nil {
+		return 0, err
+	}
+	if max := r.limits.MaxBulkLen; max > 0 && n > max {
+		return 0, protocolError("invalid bulk length")
+	}
+	return n, nil
+}
+
+// multibulkLength parses an array length and checks it against
+// MaxMultibulkLen
+func (r *Reader) multibulkLength(s string) (int, error) {
+	n, err := parseLength(s)
+	if err != nil {
+		return 0, err
+	}
+	if max := r.limits.MaxMultibulkLen; max > 0 && n > max {
+		return 0, protocolError("invalid multibulk length")
+	}
+	return n, nil
+}
+
+func parseLength(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 || n > math.MaxInt32 {
+		return 0, protocolError("invalid length")
+	}
+	return n, nil
+}
+
+func firstByte(s string) string {
+	if s == "" {
+		return ""
+	}
+	return s[:1]
+}
+
+func protocolError(msg string) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, msg)
+}
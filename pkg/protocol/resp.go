@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -22,17 +23,48 @@ func FormatSubscribe(topic string) string {
 	return fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(topic), topic)
 }
 
+// FormatSubscription formats a subscribe, unsubscribe, psubscribe or
+// punsubscribe confirmation carrying the client's subscription count
+func FormatSubscription(kind, name string, count int) string {
+	return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
+		len(kind), kind, len(name), name, count)
+}
+
+// FormatPMessage formats a pub/sub message delivered through a pattern subscription
+func FormatPMessage(pattern, topic, message string) string {
+	return fmt.Sprintf("*4\r\n$8\r\npmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(pattern), pattern, len(topic), topic, len(message), message)
+}
+
 // FormatMessage formats a pub/sub message
 func FormatMessage(topic, message string) string {
 	return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
 		len(topic), topic, len(message), message)
 }
 
+// FormatSMessage formats a sharded pub/sub message
+func FormatSMessage(topic, message string) string {
+	return fmt.Sprintf("*3\r\n$8\r\nsmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(topic), topic, len(message), message)
+}
+
+// FormatRMessage formats a message of a reliable subscription, which the
+// consumer acknowledges with its ID
+func FormatRMessage(group, topic string, id uint64, message string) string {
+	return FormatArray("rmessage", group, topic, strconv.FormatUint(id, 10), message)
+}
+
 // FormatError formats an error message
 func FormatError(message string) string {
 	return fmt.Sprintf("-ERR %s\r\n", message)
 }
 
+// FormatErrorCode formats an error with its own error code instead of ERR,
+// such as MOVED
+func FormatErrorCode(code, message string) string {
+	return fmt.Sprintf("-%s %s\r\n", code, message)
+}
+
 // FormatOK formats an OK message
 func FormatOK() string {
 	return "+OK\r\n"
@@ -43,6 +75,26 @@ func FormatInteger(n int) string {
 	return fmt.Sprintf(":%d\r\n", n)
 }
 
+// FormatBulkString formats a bulk string
+func FormatBulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// FormatArray formats an array of bulk strings
+func FormatArray(items ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, item := range items {
+		b.WriteString(FormatBulkString(item))
+	}
+	return b.String()
+}
+
+// FormatRawArray formats an array of already formatted elements
+func FormatRawArray(elements []string) string {
+	return fmt.Sprintf("*%d\r\n", len(elements)) + strings.Join(elements, "")
+}
+
 // FormatNoAuth formats a no auth message
 func FormatNoAuth() string {
 	return "-NOAUTH Authentication required\r\n"
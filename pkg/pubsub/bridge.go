@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+// ErrReadOnlyBridge is returned when a target tenant publishes on a
+// channel bridged to it read-only
+var ErrReadOnlyBridge = errors.New("channel is bridged read-only from another tenant")
+
+// Bridge mirrors a channel of one tenant into the same channel of the
+// target tenants. Targets of a read-only bridge only receive; otherwise
+// their publishes reach the source and the other targets too.
+type Bridge struct {
+	ID       int64
+	Tenant   string
+	Channel  string
+	Targets  []string
+	ReadOnly bool
+}
+
+// SetBridges replaces the bridges
+func (p *PubSub) SetBridges(bridges []Bridge) {
+	index := make(map[string][]Bridge)
+	for _, b := range bridges {
+		index[b.Channel] = append(index[b.Channel], b)
+	}
+
+	p.mu.Lock()
+	p.bridges = index
+	p.mu.Unlock()
+}
+
+// AddBridge starts mirroring a channel
+func (p *PubSub) AddBridge(b Bridge) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bridges[b.Channel] = append(p.bridges[b.Channel], b)
+}
+
+// RemoveBridge stops mirroring the bridge with the given ID
+func (p *PubSub) RemoveBridge(id int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for channel, bridges := range p.bridges {
+		for i, b := range bridges {
+			if b.ID != id {
+				continue
+			}
+			if len(bridges) == 1 {
+				delete(p.bridges, channel)
+			} else {
+				p.bridges[channel] = append(bridges[:i:i], bridges[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Bridges returns the bridges ordered by ID
+func (p *PubSub) Bridges() []Bridge {
+	p.mu.RLock()
+	var out []Bridge
+	for _, bridges := range p.bridges {
+		out = append(out, bridges...)
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// CanPublish reports whether tenant may publish on channel, which it may
+// not when the channel is bridged to it read-only
+func (p *PubSub) CanPublish(tenant, channel string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, b := range p.bridges[channel] {
+		if b.ReadOnly && slices.Contains(b.Targets, tenant) {
+			return ErrReadOnlyBridge
+		}
+	}
+	return nil
+}
+
+// audience returns the tenants a publish by tenant on channel reaches:
+// the tenant itself followed by those bridged to it
+func (p *PubSub) audience(tenant, channel string) []string {
+	tenants := []string{tenant}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, b := range p.bridges[channel] {
+		switch {
+		case b.Tenant == tenant:
+		case !b.ReadOnly && slices.Contains(b.Targets, tenant):
+			tenants = append(tenants, b.Tenant)
+		default:
+			continue
+		}
+		for _, t := range b.Targets {
+			if !slices.Contains(tenants, t) {
+				tenants = append(tenants, t)
+			}
+		}
+	}
+	return tenants
+}
@@ -1,37 +1,222 @@
 package pubsub
 
 import (
-	"net"
+	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"redix/pkg/auth"
 	"redix/pkg/client"
-	"redix/pkg/protocol"
+	"redix/pkg/glob"
 )
 
-// PubSub handles the pub/sub functionality
+// Errors returned when a subscription would exceed the tenant's limits
+var (
+	ErrChannelLimit      = errors.New("tenant channel limit reached")
+	ErrSubscriptionLimit = errors.New("tenant subscription limit reached")
+)
+
+// PubSub handles the pub/sub functionality. State is split into one
+// Namespace per tenant, so a publish only looks at the subscribers of its
+// own tenant; master publishes visit every namespace.
 type PubSub struct {
-	subscribers map[string]map[net.Conn]*client.Client
-	mu          sync.RWMutex
+	tenants   map[string]*Namespace
+	interest  map[Interest]int
+	defaults  TenantLimits
+	overrides map[string]TenantLimits
+	bridges   map[string][]Bridge // by channel
+	mu        sync.RWMutex
+
+	seq       uint64
+	retention int
+	history   map[string]*topicHistory
+	histMu    sync.Mutex
+
+	hooks         []PublishHook
+	interestHooks []InterestHook
+
+	// groups holds the reliable consumer groups by tenant and name
+	groups   map[string]map[string]*group
+	reliable ReliableOptions
+	relMu    sync.Mutex
+}
+
+// PublishHook is called after every publish with the publisher's tenant
+// and the published message
+type PublishHook func(tenant string, msg client.Message)
+
+// Interest is a channel, pattern or shard channel some local client of
+// Tenant subscribed to
+type Interest struct {
+	Tenant  string
+	Name    string
+	Pattern bool
+	Shard   bool
+}
+
+// InterestHook is called when the first subscriber of an interest arrives
+// (added is true) or the last one leaves. It is called with the PubSub
+// locked, so it must not block or call back into the PubSub.
+type InterestHook func(in Interest, added bool)
+
+// TenantLimits bounds what one tenant's clients can subscribe to. Zero
+// means unlimited. The master tenant is not limited.
+type TenantLimits struct {
+	// MaxChannels is the number of distinct channels, patterns and shard
+	// channels the tenant's clients may subscribe to
+	MaxChannels int
+	// MaxSubscriptions is the number of subscriptions across all of the
+	// tenant's clients
+	MaxSubscriptions int
+}
+
+// TenantStats describes a tenant's namespace
+type TenantStats struct {
+	// Tenant is the tenant name, with the token of a token's own tenant
+	// redacted
+	Tenant string
+	// Clients is the number of clients with at least one subscription
+	Clients       int
+	Channels      int
+	Patterns      int
+	ShardChannels int
+	Subscriptions int
+	// Published counts messages published by the tenant on this node and
+	// Delivered the messages pushed to its subscribers
+	Published uint64
+	Delivered uint64
+}
+
+// Namespace is one tenant's share of the pub/sub state. Channels, patterns
+// and shard channels of different tenants never meet.
+type Namespace struct {
+	tenant        string
+	subscribers   map[string]map[*client.Client]struct{}
+	patterns      map[string]map[*client.Client]struct{}
+	shards        map[string]map[*client.Client]struct{}
+	consumers     map[string]map[*client.Client]struct{} // consumer group members by group
+	groupChannels int                                    // channels of the tenant's consumer groups
+	clients       map[*client.Client]int
+	subscriptions int
+	published     atomic.Uint64
+	delivered     atomic.Uint64
+}
+
+func newNamespace(tenant string) *Namespace {
+	return &Namespace{
+		tenant:      tenant,
+		subscribers: make(map[string]map[*client.Client]struct{}),
+		patterns:    make(map[string]map[*client.Client]struct{}),
+		shards:      make(map[string]map[*client.Client]struct{}),
+		consumers:   make(map[string]map[*client.Client]struct{}),
+		clients:     make(map[*client.Client]int),
+	}
+}
+
+// index returns the namespace index holding in's kind of subscription
+func (ns *Namespace) index(in Interest) map[string]map[*client.Client]struct{} {
+	switch {
+	case in.Pattern:
+		return ns.patterns
+	case in.Shard:
+		return ns.shards
+	}
+	return ns.subscribers
+}
+
+// channels counts the distinct channels, patterns, shard channels and
+// consumer group channels
+func (ns *Namespace) channels() int {
+	return len(ns.subscribers) + len(ns.patterns) + len(ns.shards) + ns.groupChannels
+}
+
+// retained is a message kept in a topic's history
+type retained struct {
+	msg     client.Message
+	tenants []string
+}
+
+// topicHistory is a bounded log of the most recent messages of a topic
+type topicHistory struct {
+	entries []retained
 }
 
 // New creates a new PubSub instance
 func New() *PubSub {
 	return &PubSub{
-		subscribers: make(map[string]map[net.Conn]*client.Client),
+		tenants:   make(map[string]*Namespace),
+		interest:  make(map[Interest]int),
+		overrides: make(map[string]TenantLimits),
+		bridges:   make(map[string][]Bridge),
+		history:   make(map[string]*topicHistory),
+		groups:    make(map[string]map[string]*group),
+		reliable:  ReliableOptions{VisibilityTimeout: DefaultVisibilityTimeout, MaxPending: DefaultMaxPending},
+	}
+}
+
+// SetRetention sets how many recent messages are kept per topic for
+// resuming subscribers (0 disables retention)
+func (p *PubSub) SetRetention(n int) {
+	p.histMu.Lock()
+	defer p.histMu.Unlock()
+
+	p.retention = n
+	for topic, h := range p.history {
+		if n == 0 {
+			delete(p.history, topic)
+		} else if len(h.entries) > n {
+			h.entries = append([]retained(nil), h.entries[len(h.entries)-n:]...)
+		}
+	}
+}
+
+// SetDefaultTenantLimits sets the limits of tenants without their own
+func (p *PubSub) SetDefaultTenantLimits(l TenantLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.defaults = l
+}
+
+// SetTenantLimits overrides the default limits for one tenant. Existing
+// subscriptions over the new limits are kept.
+func (p *PubSub) SetTenantLimits(tenant string, l TenantLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides[tenant] = l
+}
+
+// ClearTenantLimits makes a tenant use the default limits again
+func (p *PubSub) ClearTenantLimits(tenant string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.overrides, tenant)
+}
+
+// TenantLimits returns the limits that apply to a tenant
+func (p *PubSub) TenantLimits(tenant string) TenantLimits {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.limitsLocked(tenant)
+}
+
+func (p *PubSub) limitsLocked(tenant string) TenantLimits {
+	if l, ok := p.overrides[tenant]; ok {
+		return l
 	}
+	return p.defaults
 }
 
 // Subscribe adds a client to a topic's subscribers
-func (p *PubSub) Subscribe(topic string, c *client.Client) {
+func (p *PubSub) Subscribe(topic string, c *client.Client) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.subscribers[topic] == nil {
-		p.subscribers[topic] = make(map[net.Conn]*client.Client)
+	if err := p.add(Interest{Name: topic}, c); err != nil {
+		return err
 	}
-	p.subscribers[topic][c.Conn] = c
 	c.Subscribe(topic)
+	return nil
 }
 
 // Unsubscribe removes a client from a topic's subscribers
@@ -39,62 +224,472 @@ func (p *PubSub) Unsubscribe(topic string, c *client.Client) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if subs, ok := p.subscribers[topic]; ok {
-		delete(subs, c.Conn)
-		c.Unsubscribe(topic)
+	p.remove(Interest{Name: topic}, c)
+	c.Unsubscribe(topic)
+}
+
+// PSubscribe adds a client to a pattern's subscribers
+func (p *PubSub) PSubscribe(pattern string, c *client.Client) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.add(Interest{Name: pattern, Pattern: true}, c); err != nil {
+		return err
+	}
+	c.SubscribePattern(pattern)
+	return nil
+}
+
+// PUnsubscribe removes a client from a pattern's subscribers
+func (p *PubSub) PUnsubscribe(pattern string, c *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.remove(Interest{Name: pattern, Pattern: true}, c)
+	c.UnsubscribePattern(pattern)
+}
+
+// SSubscribe adds a client to a shard channel's subscribers
+func (p *PubSub) SSubscribe(topic string, c *client.Client) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.add(Interest{Name: topic, Shard: true}, c); err != nil {
+		return err
+	}
+	c.SubscribeShard(topic)
+	return nil
+}
+
+// SUnsubscribe removes a client from a shard channel's subscribers
+func (p *PubSub) SUnsubscribe(topic string, c *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.remove(Interest{Name: topic, Shard: true}, c)
+	c.UnsubscribeShard(topic)
+}
+
+// UnsubscribeAll removes a client from every topic, pattern, shard channel
+// and consumer group it is subscribed to
+func (p *PubSub) UnsubscribeAll(c *client.Client) {
+	p.mu.Lock()
+	out := p.removeAll(c)
+	c.UnsubscribeAll()
+	p.mu.Unlock()
+	send(out)
+}
+
+// removeAll removes c from every index and returns the messages its
+// consumer groups hand to other consumers. The caller holds p.mu.
+func (p *PubSub) removeAll(c *client.Client) []delivery {
+	for _, topic := range c.Subscriptions() {
+		p.remove(Interest{Name: topic}, c)
+	}
+	for _, pattern := range c.Patterns() {
+		p.remove(Interest{Name: pattern, Pattern: true}, c)
+	}
+	for _, topic := range c.ShardSubscriptions() {
+		p.remove(Interest{Name: topic, Shard: true}, c)
 	}
+	var out []delivery
+	for _, name := range c.ConsumerGroups() {
+		out = append(out, p.leave(name, c)...)
+	}
+	return out
 }
 
-// Publish sends a message to all subscribers of a topic
-func (p *PubSub) Publish(topic, message string, publisherToken string) int {
+// namespaceLocked returns the tenant's namespace, creating it when create
+// is set. The caller holds p.mu, for writing when create is set.
+func (p *PubSub) namespaceLocked(tenant string, create bool) *Namespace {
+	ns := p.tenants[tenant]
+	if ns == nil && create {
+		ns = newNamespace(tenant)
+		p.tenants[tenant] = ns
+	}
+	return ns
+}
+
+// namespace returns the tenant's namespace, creating it if needed
+func (p *PubSub) namespace(tenant string) *Namespace {
 	p.mu.RLock()
-	defer p.mu.RUnlock()
+	ns := p.tenants[tenant]
+	p.mu.RUnlock()
+	if ns != nil {
+		return ns
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.namespaceLocked(tenant, true)
+}
+
+// add subscribes c to in.Name in its tenant's namespace, within the
+// tenant's limits. The caller holds p.mu.
+func (p *PubSub) add(in Interest, c *client.Client) error {
+	in.Tenant = c.Namespace()
+	ns := p.namespaceLocked(in.Tenant, true)
+	index := ns.index(in)
+	subs := index[in.Name]
+	if _, ok := subs[c]; ok {
+		return nil
+	}
+
+	if err := p.admit(ns, true, subs == nil); err != nil {
+		return err
+	}
 
-	subs := p.subscribers[topic]
 	if subs == nil {
+		subs = make(map[*client.Client]struct{})
+		index[in.Name] = subs
+	}
+	subs[c] = struct{}{}
+	ns.clients[c]++
+	ns.subscriptions++
+	p.track(in, 1)
+	return nil
+}
+
+// admit checks that the tenant's limits leave room for a new subscription
+// when newSub is set and for a new channel when newChannel is set. The
+// caller holds p.mu.
+func (p *PubSub) admit(ns *Namespace, newSub, newChannel bool) error {
+	if auth.IsMasterTenant(ns.tenant) {
+		return nil
+	}
+	limits := p.limitsLocked(ns.tenant)
+	if newSub && limits.MaxSubscriptions > 0 && ns.subscriptions >= limits.MaxSubscriptions {
+		return ErrSubscriptionLimit
+	}
+	if newChannel && limits.MaxChannels > 0 && ns.channels() >= limits.MaxChannels {
+		return ErrChannelLimit
+	}
+	return nil
+}
+
+// remove unsubscribes c from in.Name in its tenant's namespace. The caller
+// holds p.mu.
+func (p *PubSub) remove(in Interest, c *client.Client) {
+	in.Tenant = c.Namespace()
+	ns := p.tenants[in.Tenant]
+	if ns == nil {
+		return
+	}
+	index := ns.index(in)
+	subs := index[in.Name]
+	if _, ok := subs[c]; !ok {
+		return
+	}
+	delete(subs, c)
+	if len(subs) == 0 {
+		delete(index, in.Name)
+	}
+	if ns.clients[c]--; ns.clients[c] <= 0 {
+		delete(ns.clients, c)
+	}
+	ns.subscriptions--
+	p.track(in, -1)
+}
+
+// track counts subscribers per interest and runs the interest hooks when
+// an interest appears or disappears. The caller holds p.mu.
+func (p *PubSub) track(in Interest, delta int) {
+	n := p.interest[in] + delta
+	if n > 0 {
+		p.interest[in] = n
+	} else {
+		delete(p.interest, in)
+	}
+	if (n == 1 && delta > 0) || n == 0 {
+		for _, hook := range p.interestHooks {
+			hook(in, n > 0)
+		}
+	}
+}
+
+// WatchInterest registers a hook called when interests change. The hook is
+// called right away for every current interest, so the caller misses no
+// change.
+func (p *PubSub) WatchInterest(hook InterestHook) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.interestHooks = append(p.interestHooks, hook)
+	for in := range p.interest {
+		hook(in, true)
+	}
+}
+
+// OnPublish registers a hook called after every publish
+func (p *PubSub) OnPublish(hook PublishHook) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks = append(p.hooks, hook)
+}
+
+// Publish sends a message to the subscribers of a topic in the
+// publisher's tenant and the tenants bridged to it, or in every tenant when
+// the publisher is auth.AllTenants, and runs the publish hooks
+func (p *PubSub) Publish(topic, message string, tenant string) int {
+	tenants := p.audience(tenant, topic)
+	msg := p.record(topic, message, tenants...)
+	return p.publish(msg, tenant, tenants)
+}
+
+// Deliver sends a message published elsewhere, such as on another cluster
+// node, to the local subscribers of a topic. Publish hooks are not run, so
+// the message is not forwarded again.
+func (p *PubSub) Deliver(topic, message string, tenant string) int {
+	msg := p.record(topic, message, tenant)
+
+	p.mu.RLock()
+	count := p.deliverLocked(msg, tenant)
+	p.mu.RUnlock()
+	send(p.enqueue(msg, tenant))
+	return count
+}
+
+// SPublish sends a message to the subscribers of a shard channel and runs
+// the publish hooks with a sharded message
+func (p *PubSub) SPublish(topic, message string, tenant string) int {
+	tenants := p.audience(tenant, topic)
+	msg := client.Message{ID: p.nextID(), Topic: topic, Payload: message, Sharded: true}
+	return p.publish(msg, tenant, tenants)
+}
+
+// publish delivers a message published by tenant to the namespaces of
+// tenants and runs the publish hooks once per tenant, so that other nodes
+// and webhooks see a bridged message as published in each tenant
+func (p *PubSub) publish(msg client.Message, tenant string, tenants []string) int {
+	if auth.IsBroadcast(tenant) {
+		// Only the master token broadcasts
+		tenant = auth.MasterTenant
+	}
+	p.namespace(tenant).published.Add(1)
+
+	p.mu.RLock()
+	count := 0
+	for _, t := range tenants {
+		count += p.deliverLocked(msg, t)
+	}
+	hooks := p.hooks
+	p.mu.RUnlock()
+
+	for _, t := range tenants {
+		send(p.enqueue(msg, t))
+	}
+	for _, t := range tenants {
+		for _, hook := range hooks {
+			hook(t, msg)
+		}
+	}
+	return count
+}
+
+// SDeliver sends a sharded message published elsewhere to the local
+// subscribers of a shard channel, without running the publish hooks
+func (p *PubSub) SDeliver(topic, message string, tenant string) int {
+	msg := client.Message{ID: p.nextID(), Topic: topic, Payload: message, Sharded: true}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.deliverLocked(msg, tenant)
+}
+
+// deliverLocked sends msg to the namespaces visible to the publishing
+// tenant: its own, or all of them for a broadcast. The caller holds p.mu.
+func (p *PubSub) deliverLocked(msg client.Message, tenant string) int {
+	if !auth.IsBroadcast(tenant) {
+		if ns := p.tenants[tenant]; ns != nil {
+			return ns.deliver(msg)
+		}
 		return 0
 	}
+	count := 0
+	for _, ns := range p.tenants {
+		count += ns.deliver(msg)
+	}
+	return count
+}
 
+// deliver sends msg to the namespace's subscribers: shard channel
+// subscribers for sharded messages, channel and pattern subscribers
+// otherwise. The caller holds the PubSub lock.
+func (ns *Namespace) deliver(msg client.Message) int {
 	count := 0
-	for _, client := range subs {
-		if client.Authed && (publisherToken == auth.MasterToken || client.Token == publisherToken) {
-			client.Write(protocol.FormatMessage(topic, message))
-			count++
+	if msg.Sharded {
+		for client := range ns.shards[msg.Topic] {
+			count += deliver(client, msg)
+		}
+		ns.delivered.Add(uint64(count))
+		return count
+	}
+
+	for client := range ns.subscribers[msg.Topic] {
+		count += deliver(client, msg)
+	}
+	for pattern, subs := range ns.patterns {
+		if !glob.Match(pattern, msg.Topic) {
+			continue
+		}
+		pmsg := msg
+		pmsg.Pattern = pattern
+		for client := range subs {
+			count += deliver(client, pmsg)
 		}
 	}
+	ns.delivered.Add(uint64(count))
 	return count
 }
 
-// DisconnectToken disconnects all clients with a specific token
+// deliver pushes msg to c when it is authenticated, logging failures, and
+// returns the number of clients reached
+func deliver(c *client.Client, msg client.Message) int {
+	if !c.Authenticated() {
+		return 0
+	}
+	if err := c.Deliver(msg); err != nil {
+		c.Logger().Debug("delivery failed", "channel", msg.Topic, "error", err)
+	}
+	return 1
+}
+
+// History returns the retained messages of a topic visible to tenant whose
+// ID is greater than afterID, oldest first
+func (p *PubSub) History(topic, tenant string, afterID uint64) []client.Message {
+	p.histMu.Lock()
+	defer p.histMu.Unlock()
+
+	h := p.history[topic]
+	if h == nil {
+		return nil
+	}
+
+	var out []client.Message
+	for _, e := range h.entries {
+		if e.msg.ID > afterID && visible(e.tenants, tenant) {
+			out = append(out, e.msg)
+		}
+	}
+	return out
+}
+
+// visible reports whether a message published to tenants reaches tenant
+func visible(tenants []string, tenant string) bool {
+	for _, t := range tenants {
+		if t == tenant || auth.IsBroadcast(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextID assigns the next message ID without retaining the message
+func (p *PubSub) nextID() uint64 {
+	p.histMu.Lock()
+	defer p.histMu.Unlock()
+	p.seq++
+	return p.seq
+}
+
+// record assigns the next message ID and appends the message to the topic
+// history, as visible to tenants, when retention is enabled
+func (p *PubSub) record(topic, message string, tenants ...string) client.Message {
+	p.histMu.Lock()
+	defer p.histMu.Unlock()
+
+	p.seq++
+	msg := client.Message{ID: p.seq, Topic: topic, Payload: message}
+	if p.retention == 0 {
+		return msg
+	}
+
+	h := p.history[topic]
+	if h == nil {
+		h = &topicHistory{}
+		p.history[topic] = h
+	}
+	if len(h.entries) >= p.retention {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, retained{msg: msg, tenants: tenants})
+	return msg
+}
+
+// DisconnectToken disconnects all subscribed clients, consumer group
+// members included, with a specific token
 func (p *PubSub) DisconnectToken(targetToken string) int {
 	p.mu.Lock()
-	defer p.mu.Unlock()
 
-	disconnectedConns := make(map[net.Conn]bool)
-	disconnected := 0
-
-	for _, subscribers := range p.subscribers {
-		for conn, client := range subscribers {
-			if client.Token == targetToken && !disconnectedConns[conn] {
-				disconnectedConns[conn] = true
-				client.Write(protocol.FormatError("disconnected by master"))
-				client.Close()
-				delete(subscribers, conn)
-				disconnected++
+	var disconnected []*client.Client
+	for _, ns := range p.tenants {
+		for client := range ns.clients {
+			if client.AuthenticatedAs(targetToken) {
+				disconnected = append(disconnected, client)
 			}
 		}
 	}
 
-	return disconnected
+	var out []delivery
+	for _, client := range disconnected {
+		client.Logger().Info("client disconnected by master")
+		client.WriteError("disconnected by master")
+		client.Close()
+		out = append(out, p.removeAll(client)...)
+	}
+	p.mu.Unlock()
+	send(out)
+	return len(disconnected)
 }
 
-// GetSubscriberCount returns the number of subscribers for a topic
+// GetSubscriberCount returns the number of subscribers for a topic across
+// all tenants
 func (p *PubSub) GetSubscriberCount(topic string) int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if subs, ok := p.subscribers[topic]; ok {
-		return len(subs)
+	count := 0
+	for _, ns := range p.tenants {
+		count += len(ns.subscribers[topic])
+	}
+	return count
+}
+
+// TenantStats returns the statistics of one tenant
+func (p *PubSub) TenantStats(tenant string) TenantStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if ns := p.tenants[tenant]; ns != nil {
+		return ns.stats()
+	}
+	return TenantStats{Tenant: tenant}
+}
+
+// Tenants returns the statistics of every tenant seen by this node,
+// ordered by tenant
+func (p *PubSub) Tenants() []TenantStats {
+	p.mu.RLock()
+	out := make([]TenantStats, 0, len(p.tenants))
+	for _, ns := range p.tenants {
+		out = append(out, ns.stats())
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Tenant < out[j].Tenant })
+	return out
+}
+
+// stats snapshots the namespace. The caller holds the PubSub lock.
+func (ns *Namespace) stats() TenantStats {
+	return TenantStats{
+		Tenant:        auth.RedactTenant(ns.tenant),
+		Clients:       len(ns.clients),
+		Channels:      len(ns.subscribers),
+		Patterns:      len(ns.patterns),
+		ShardChannels: len(ns.shards),
+		Subscriptions: ns.subscriptions,
+		Published:     ns.published.Load(),
+		Delivered:     ns.delivered.Load(),
 	}
-	return 0
 }
@@ -0,0 +1,468 @@
+package pubsub
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+)
+
+// Reliable subscription defaults
+const (
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultMaxPending        = 10000
+)
+
+// Errors returned by reliable subscriptions
+var (
+	// ErrNoGroup is returned for a consumer group unknown to the tenant
+	ErrNoGroup = errors.New("no such consumer group")
+	// ErrGroupFull is returned for a publish that a consumer group has no
+	// room for
+	ErrGroupFull = errors.New("consumer group pending list full")
+	// ErrGroupBusy is returned for destroying a consumer group that still
+	// has consumers
+	ErrGroupBusy = errors.New("consumer group has consumers")
+)
+
+// ReliableOptions configures reliable subscriptions
+type ReliableOptions struct {
+	// VisibilityTimeout is how long a consumer has to acknowledge a
+	// message before it is delivered again
+	VisibilityTimeout time.Duration
+	// MaxPending caps the unacknowledged messages of a group; publishes
+	// that would exceed it are rejected with ErrGroupFull until consumers
+	// catch up (0 for unlimited)
+	MaxPending int
+}
+
+// Pending describes an unacknowledged message of a consumer group
+type Pending struct {
+	ID      uint64
+	Channel string
+	// Consumer is the ID of the connection holding the message, or 0 when
+	// the message waits for a consumer
+	Consumer   uint64
+	Deliveries int
+	// Idle is the time since the message was last delivered, or published
+	// when it was never delivered
+	Idle time.Duration
+}
+
+// group is a reliable consumer group of one tenant. Every message
+// published on one of its channels is pending until a consumer of the
+// group acknowledges it; each message goes to one consumer at a time.
+type group struct {
+	tenant    string
+	name      string
+	channels  map[string]bool
+	consumers []*client.Client
+	next      int
+	pending   map[uint64]*pendingEntry
+	// order holds pending IDs oldest first; acknowledged IDs are skipped
+	// and compacted once they make up half of it
+	order []uint64
+	timer *time.Timer
+	// due is when the timer fires, zero when it is stopped
+	due time.Time
+}
+
+type pendingEntry struct {
+	msg        client.Message
+	consumer   *client.Client
+	deliveries int
+	since      time.Time
+	deadline   time.Time
+}
+
+// delivery is a message for a consumer, written once the PubSub locks are
+// released so that a slow consumer holds up nobody else
+type delivery struct {
+	c       *client.Client
+	group   string
+	channel string
+	frame   string
+}
+
+// send writes deliveries collected under the PubSub locks
+func send(out []delivery) {
+	for _, d := range out {
+		if err := d.c.Write(d.frame); err != nil {
+			d.c.Logger().Debug("delivery failed", "group", d.group, "channel", d.channel, "error", err)
+		}
+	}
+}
+
+// SetReliable configures reliable subscriptions. A new visibility timeout
+// applies to the next deliveries.
+func (p *PubSub) SetReliable(o ReliableOptions) {
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+	p.reliable = o
+}
+
+// RSubscribe makes c a consumer of a reliable group of its tenant and adds
+// channel to the group's channels, within the tenant's limits: each
+// consumer counts as a subscription and each group channel as a channel.
+// It returns the number of channels of the group.
+func (p *PubSub) RSubscribe(name, channel string, c *client.Client) (int, error) {
+	n, out, err := p.rsubscribe(name, channel, c)
+	send(out)
+	return n, err
+}
+
+func (p *PubSub) rsubscribe(name, channel string, c *client.Client) (int, []delivery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	tenant := c.Namespace()
+	ns := p.namespaceLocked(tenant, true)
+	g := p.groups[tenant][name]
+	joined := g != nil && slices.Contains(g.consumers, c)
+	newChannel := g == nil || !g.channels[channel]
+	if err := p.admit(ns, !joined, newChannel); err != nil {
+		return 0, nil, err
+	}
+
+	if g == nil {
+		if p.groups[tenant] == nil {
+			p.groups[tenant] = make(map[string]*group)
+		}
+		g = &group{tenant: tenant, name: name, channels: make(map[string]bool), pending: make(map[uint64]*pendingEntry)}
+		p.groups[tenant][name] = g
+	}
+	if newChannel {
+		g.channels[channel] = true
+		ns.groupChannels++
+		// Other nodes forward the channel's messages as for a subscriber
+		p.track(Interest{Tenant: tenant, Name: channel}, 1)
+	}
+	if joined {
+		return len(g.channels), nil, nil
+	}
+
+	g.consumers = append(g.consumers, c)
+	members := ns.consumers[name]
+	if members == nil {
+		members = make(map[*client.Client]struct{})
+		ns.consumers[name] = members
+	}
+	members[c] = struct{}{}
+	ns.clients[c]++
+	ns.subscriptions++
+	c.JoinGroup(name)
+	return len(g.channels), p.dispatch(g), nil
+}
+
+// RUnsubscribe removes c from a consumer group. Its unacknowledged
+// messages go to the other consumers right away.
+func (p *PubSub) RUnsubscribe(name string, c *client.Client) {
+	p.mu.Lock()
+	out := p.leave(name, c)
+	p.mu.Unlock()
+	send(out)
+}
+
+// leave removes c from a group, dropping the group once it has neither
+// consumers nor pending messages, and returns the messages handed to other
+// consumers. The caller holds p.mu.
+func (p *PubSub) leave(name string, c *client.Client) []delivery {
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	c.LeaveGroup(name)
+	ns := p.tenants[c.Namespace()]
+	if ns == nil {
+		return nil
+	}
+	if members := ns.consumers[name]; members != nil {
+		if _, ok := members[c]; ok {
+			delete(members, c)
+			if len(members) == 0 {
+				delete(ns.consumers, name)
+			}
+			if ns.clients[c]--; ns.clients[c] <= 0 {
+				delete(ns.clients, c)
+			}
+			ns.subscriptions--
+		}
+	}
+
+	g := p.groups[ns.tenant][name]
+	if g == nil {
+		return nil
+	}
+	for i, other := range g.consumers {
+		if other == c {
+			g.consumers = append(g.consumers[:i], g.consumers[i+1:]...)
+			break
+		}
+	}
+	for _, e := range g.pending {
+		if e.consumer == c {
+			e.consumer = nil
+		}
+	}
+	out := p.dispatch(g)
+	p.dropIfIdle(g)
+	return out
+}
+
+// Ack acknowledges messages of a consumer group of c's tenant and returns
+// how many were pending for c. Messages held by another consumer are left
+// alone.
+func (p *PubSub) Ack(name string, c *client.Client, ids []uint64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	g := p.groups[c.Namespace()][name]
+	if g == nil {
+		return 0
+	}
+	acked := 0
+	for _, id := range ids {
+		if e, ok := g.pending[id]; ok && e.consumer == c {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+	p.dropIfIdle(g)
+	return acked
+}
+
+// DestroyGroup drops a consumer group of tenant that has no consumers,
+// discarding its pending messages, and reports whether it existed
+func (p *PubSub) DestroyGroup(name, tenant string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	g := p.groups[tenant][name]
+	if g == nil {
+		return false, nil
+	}
+	if len(g.consumers) > 0 {
+		return false, ErrGroupBusy
+	}
+	clear(g.pending)
+	p.dropIfIdle(g)
+	return true, nil
+}
+
+// CanEnqueue reports whether the consumer groups that n messages published
+// by tenant on channel reach have room for them
+func (p *PubSub) CanEnqueue(tenant, channel string, n int) error {
+	tenants := p.audience(tenant, channel)
+
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	max := p.reliable.MaxPending
+	if max == 0 {
+		return nil
+	}
+	for _, target := range tenants {
+		for _, g := range p.groupsOf(target) {
+			if g.channels[channel] && len(g.pending)+n > max {
+				return ErrGroupFull
+			}
+		}
+	}
+	return nil
+}
+
+// groupsOf returns the consumer groups a publish by tenant reaches: the
+// tenant's own, or every group for a broadcast. The caller holds p.relMu.
+func (p *PubSub) groupsOf(tenant string) []*group {
+	var out []*group
+	if !auth.IsBroadcast(tenant) {
+		for _, g := range p.groups[tenant] {
+			out = append(out, g)
+		}
+		return out
+	}
+	for _, groups := range p.groups {
+		for _, g := range groups {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// PendingMessages lists the unacknowledged messages of a tenant's consumer
+// group, oldest first
+func (p *PubSub) PendingMessages(name, tenant string) ([]Pending, error) {
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	g := p.groups[tenant][name]
+	if g == nil {
+		return nil, ErrNoGroup
+	}
+	now := time.Now()
+	out := make([]Pending, 0, len(g.pending))
+	for _, e := range g.pending {
+		pm := Pending{ID: e.msg.ID, Channel: e.msg.Topic, Deliveries: e.deliveries, Idle: now.Sub(e.since)}
+		if e.consumer != nil {
+			pm.Consumer = e.consumer.ID
+		}
+		out = append(out, pm)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// enqueue adds msg to the pending lists of the groups consuming its
+// channel in tenant, or in every tenant for a broadcast, and returns the
+// deliveries to make. Publishers check CanEnqueue first, so a group only
+// goes over MaxPending with messages from other nodes or racing publishes.
+func (p *PubSub) enqueue(msg client.Message, tenant string) []delivery {
+	if msg.Sharded {
+		return nil
+	}
+	p.relMu.Lock()
+	defer p.relMu.Unlock()
+
+	var out []delivery
+	now := time.Now()
+	for _, g := range p.groupsOf(tenant) {
+		if !g.channels[msg.Topic] {
+			continue
+		}
+		e := &pendingEntry{msg: msg, since: now}
+		g.pending[msg.ID] = e
+		g.order = append(g.order, msg.ID)
+		g.compact()
+		// Older messages are already held by consumers or wait for one,
+		// so only the new message needs a consumer
+		if len(g.consumers) > 0 {
+			out = append(out, p.deliver(g, e, now))
+			if g.due.IsZero() || e.deadline.Before(g.due) {
+				p.arm(g, e.deadline)
+			}
+		}
+	}
+	return out
+}
+
+// compact drops acknowledged IDs from the group's order once they make up
+// half of it
+func (g *group) compact() {
+	if len(g.order) < 2*len(g.pending) {
+		return
+	}
+	live := g.order[:0]
+	for _, id := range g.order {
+		if _, ok := g.pending[id]; ok {
+			live = append(live, id)
+		}
+	}
+	g.order = live
+}
+
+// dispatch hands the group's messages that no consumer holds to its
+// consumers, round robin, schedules their redelivery and returns the
+// deliveries to make. The caller holds p.relMu.
+func (p *PubSub) dispatch(g *group) []delivery {
+	g.compact()
+
+	var out []delivery
+	now := time.Now()
+	for _, id := range g.order {
+		e := g.pending[id]
+		if e == nil || e.consumer != nil || len(g.consumers) == 0 {
+			continue
+		}
+		out = append(out, p.deliver(g, e, now))
+	}
+	p.schedule(g)
+	return out
+}
+
+// deliver hands a pending message to the group's next consumer and returns
+// the delivery to make. The caller holds p.relMu.
+func (p *PubSub) deliver(g *group, e *pendingEntry, now time.Time) delivery {
+	c := g.consumers[g.next%len(g.consumers)]
+	g.next++
+	e.consumer = c
+	e.deliveries++
+	e.since = now
+	e.deadline = now.Add(p.reliable.VisibilityTimeout)
+	return delivery{c: c, group: g.name, channel: e.msg.Topic,
+		frame: protocol.FormatRMessage(g.name, e.msg.Topic, e.msg.ID, e.msg.Payload)}
+}
+
+// schedule arms the group's timer for the earliest redelivery. The caller
+// holds p.relMu.
+func (p *PubSub) schedule(g *group) {
+	var next time.Time
+	for _, e := range g.pending {
+		if e.consumer != nil && (next.IsZero() || e.deadline.Before(next)) {
+			next = e.deadline
+		}
+	}
+	if next.IsZero() {
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		g.due = time.Time{}
+		return
+	}
+	p.arm(g, next)
+}
+
+// arm sets the group's timer to fire at due. The caller holds p.relMu.
+func (p *PubSub) arm(g *group, due time.Time) {
+	g.due = due
+	d := time.Until(due)
+	if g.timer == nil {
+		g.timer = time.AfterFunc(d, func() { p.redeliver(g) })
+	} else {
+		g.timer.Reset(d)
+	}
+}
+
+// redeliver takes back the group's messages whose visibility timeout
+// expired and delivers them again
+func (p *PubSub) redeliver(g *group) {
+	p.relMu.Lock()
+	now := time.Now()
+	for _, e := range g.pending {
+		if e.consumer != nil && !now.Before(e.deadline) {
+			e.consumer = nil
+		}
+	}
+	out := p.dispatch(g)
+	p.relMu.Unlock()
+	send(out)
+}
+
+// dropIfIdle forgets a group without consumers or pending messages. The
+// caller holds p.mu and p.relMu.
+func (p *PubSub) dropIfIdle(g *group) {
+	if len(g.consumers) > 0 || len(g.pending) > 0 {
+		return
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	if ns := p.tenants[g.tenant]; ns != nil {
+		ns.groupChannels -= len(g.channels)
+	}
+	for channel := range g.channels {
+		p.track(Interest{Tenant: g.tenant, Name: channel}, -1)
+	}
+	delete(p.groups[g.tenant], g.name)
+	if len(p.groups[g.tenant]) == 0 {
+		delete(p.groups, g.tenant)
+	}
+}
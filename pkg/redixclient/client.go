@@ -0,0 +1,236 @@
+// Package redixclient is the Go client for Redix servers. A Client
+// publishes over a pool of authenticated connections; a Subscriber holds a
+// dedicated connection that is re-established, with all of its channels
+// and patterns re-subscribed, whenever it drops.
+package redixclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"redix/pkg/protocol"
+)
+
+// ErrClosed is returned when using a closed Client or Subscriber
+var ErrClosed = errors.New("redixclient: closed")
+
+// Error is an error reply sent by the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Options configures a Client
+type Options struct {
+	// PoolSize is the maximum number of connections used for publishing
+	PoolSize int
+	// DialTimeout bounds establishing a connection
+	DialTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	// of a Subscriber
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MessageBuffer is the capacity of a Subscriber's message channel
+	MessageBuffer int
+}
+
+// DefaultOptions returns the options used when Dial is given nil
+func DefaultOptions() *Options {
+	return &Options{
+		PoolSize:      10,
+		DialTimeout:   5 * time.Second,
+		MinBackoff:    100 * time.Millisecond,
+		MaxBackoff:    10 * time.Second,
+		MessageBuffer: 256,
+	}
+}
+
+// Client is a Redix client authenticated as one tenant token. It is safe
+// for concurrent use.
+type Client struct {
+	addr  string
+	token string
+	opts  *Options
+
+	idle   chan *conn
+	slots  chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+// Dial connects to the server at addr and authenticates with token
+func Dial(addr, token string, opts *Options) (*Client, error) {
+	o := DefaultOptions()
+	if opts != nil {
+		if opts.PoolSize > 0 {
+			o.PoolSize = opts.PoolSize
+		}
+		if opts.DialTimeout > 0 {
+			o.DialTimeout = opts.DialTimeout
+		}
+		if opts.MinBackoff > 0 {
+			o.MinBackoff = opts.MinBackoff
+		}
+		if opts.MaxBackoff > 0 {
+			o.MaxBackoff = opts.MaxBackoff
+		}
+		if opts.MessageBuffer > 0 {
+			o.MessageBuffer = opts.MessageBuffer
+		}
+	}
+
+	c := &Client{
+		addr:  addr,
+		token: token,
+		opts:  o,
+		idle:  make(chan *conn, o.PoolSize),
+		slots: make(chan struct{}, o.PoolSize),
+	}
+
+	// Dial one connection up front so bad addresses and tokens fail fast
+	cn, err := c.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c.put(cn)
+	return c, nil
+}
+
+// Do sends a command and returns its reply. Error replies are returned as
+// an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (protocol.Value, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	defer c.put(cn)
+	return cn.do(ctx, args...)
+}
+
+// Publish publishes msg on channel and returns the number of receivers
+func (c *Client) Publish(ctx context.Context, channel, msg string) (int64, error) {
+	v, err := c.Do(ctx, "PUBLISH", channel, msg)
+	if err != nil {
+		return 0, err
+	}
+	return v.Int, nil
+}
+
+// PublishTenant publishes msg on a channel of another tenant. It needs the
+// master token.
+func (c *Client) PublishTenant(ctx context.Context, tenant, channel, msg string) (int64, error) {
+	v, err := c.Do(ctx, "PUBLISH.TENANT", tenant, channel, msg)
+	if err != nil {
+		return 0, err
+	}
+	return v.Int, nil
+}
+
+// Broadcast publishes msg on channel in every tenant. It needs the master
+// token.
+func (c *Client) Broadcast(ctx context.Context, channel, msg string) (int64, error) {
+	v, err := c.Do(ctx, "PUBLISH.BROADCAST", channel, msg)
+	if err != nil {
+		return 0, err
+	}
+	return v.Int, nil
+}
+
+// Pipeline returns a new pipeline sending its commands in one round trip
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// Subscribe returns a Subscriber listening on channels
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*Subscriber, error) {
+	s := newSubscriber(c)
+	if err := s.Subscribe(ctx, channels...); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// PSubscribe returns a Subscriber listening on channels matching patterns
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*Subscriber, error) {
+	s := newSubscriber(c)
+	if err := s.PSubscribe(ctx, patterns...); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the pooled connections. Subscribers are closed separately.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle pooled connection or dials a new one, waiting for a
+// free slot when the pool is full
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case c.slots <- struct{}{}:
+		cn, err := dial(ctx, c.addr, c.token, c.opts)
+		if err != nil {
+			<-c.slots
+			return nil, err
+		}
+		return cn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns a connection to the pool, discarding it if it is broken
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if cn.broken || closed {
+		cn.close()
+		<-c.slots
+		return
+	}
+	c.idle <- cn
+}
+
+// replyError converts an error reply to an Error
+func replyError(v protocol.Value) error {
+	if v.Type == protocol.Error {
+		return Error(v.Str)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package redixclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"redix/pkg/protocol"
+)
+
+// conn is a single authenticated connection to a Redix server
+type conn struct {
+	nc     net.Conn
+	r      *protocol.Reader
+	w      *bufio.Writer
+	broken bool
+}
+
+// dial opens a connection and authenticates it with token
+func dial(ctx context.Context, addr, token string, opts *Options) (*conn, error) {
+	d := net.Dialer{Timeout: opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{
+		nc: nc,
+		r:  protocol.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}
+	if token != "" {
+		if _, err := cn.do(ctx, "AUTH", token); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// do sends one command and reads its reply
+func (cn *conn) do(ctx context.Context, args ...string) (protocol.Value, error) {
+	replies, err := cn.pipeline(ctx, [][]string{args})
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	return replies[0], replyError(replies[0])
+}
+
+// pipeline writes all commands in one batch and then reads one reply per
+// command. Server error replies are returned as values, not errors.
+func (cn *conn) pipeline(ctx context.Context, cmds [][]string) ([]protocol.Value, error) {
+	stop := cn.bind(ctx)
+	defer stop()
+
+	for _, args := range cmds {
+		if err := cn.writeCommand(args); err != nil {
+			return nil, cn.fail(ctx, err)
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, cn.fail(ctx, err)
+	}
+
+	replies := make([]protocol.Value, len(cmds))
+	for i := range cmds {
+		v, err := cn.r.ReadValue()
+		if err != nil {
+			return nil, cn.fail(ctx, err)
+		}
+		replies[i] = v
+	}
+	return replies, nil
+}
+
+// send writes a command without waiting for a reply
+func (cn *conn) send(args ...string) error {
+	if err := cn.writeCommand(args); err != nil {
+		return err
+	}
+	return cn.w.Flush()
+}
+
+func (cn *conn) writeCommand(args []string) error {
+	_, err := cn.w.WriteString(protocol.FormatArray(args...))
+	return err
+}
+
+// bind makes blocking I/O on the connection honor ctx, returning a function
+// that releases the binding
+func (cn *conn) bind(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.nc.SetDeadline(deadline)
+	} else {
+		cn.nc.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Unix(1, 0))
+	})
+	return func() { stop() }
+}
+
+// bindWrite makes writes on the connection honor ctx without affecting a
+// read in progress on another goroutine
+func (cn *conn) bindWrite(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.nc.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetWriteDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		cn.nc.SetWriteDeadline(time.Time{})
+	}
+}
+
+// fail marks the connection unusable and prefers the context's error
+func (cn *conn) fail(ctx context.Context, err error) error {
+	cn.broken = true
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (cn *conn) close() error {
+	return cn.nc.Close()
+}
@@ -0,0 +1,47 @@
+package redixclient
+
+import (
+	"context"
+
+	"redix/pkg/protocol"
+)
+
+// Pipeline queues commands and sends them in a single round trip
+type Pipeline struct {
+	client *Client
+	cmds   [][]string
+}
+
+// Do queues a command
+func (p *Pipeline) Do(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Publish queues a PUBLISH
+func (p *Pipeline) Publish(channel, msg string) {
+	p.Do("PUBLISH", channel, msg)
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns their replies in order. Error
+// replies are returned as values of type protocol.Error; the returned
+// error is only set when the round trip itself fails. The pipeline is
+// empty afterwards.
+func (p *Pipeline) Exec(ctx context.Context) ([]protocol.Value, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	cn, err := p.client.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.client.put(cn)
+	return cn.pipeline(ctx, cmds)
+}
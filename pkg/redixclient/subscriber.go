@@ -0,0 +1,253 @@
+package redixclient
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"redix/pkg/protocol"
+)
+
+// Message is a message received by a Subscriber
+type Message struct {
+	Channel string
+	Payload string
+	// Pattern is the matching pattern for pattern subscriptions
+	Pattern string
+}
+
+// Subscriber receives messages on a dedicated connection. When the
+// connection drops it reconnects with exponential backoff and re-subscribes
+// every channel and pattern; messages published while disconnected are lost.
+type Subscriber struct {
+	client *Client
+	msgs   chan Message
+
+	mu       sync.Mutex
+	cn       *conn
+	channels map[string]bool
+	patterns map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSubscriber(c *Client) *Subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Subscriber{
+		client:   c,
+		msgs:     make(chan Message, c.opts.MessageBuffer),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Messages returns the channel on which messages are delivered. It is
+// closed when the Subscriber is closed.
+func (s *Subscriber) Messages() <-chan Message {
+	return s.msgs
+}
+
+// Subscribe adds channels to the subscription
+func (s *Subscriber) Subscribe(ctx context.Context, channels ...string) error {
+	return s.change(ctx, "SUBSCRIBE", s.channels, true, channels)
+}
+
+// Unsubscribe removes channels from the subscription
+func (s *Subscriber) Unsubscribe(ctx context.Context, channels ...string) error {
+	return s.change(ctx, "UNSUBSCRIBE", s.channels, false, channels)
+}
+
+// PSubscribe adds patterns to the subscription
+func (s *Subscriber) PSubscribe(ctx context.Context, patterns ...string) error {
+	return s.change(ctx, "PSUBSCRIBE", s.patterns, true, patterns)
+}
+
+// PUnsubscribe removes patterns from the subscription
+func (s *Subscriber) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return s.change(ctx, "PUNSUBSCRIBE", s.patterns, false, patterns)
+}
+
+// Channels returns the subscribed channels
+func (s *Subscriber) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return keys(s.channels)
+}
+
+// Patterns returns the subscribed patterns
+func (s *Subscriber) Patterns() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return keys(s.patterns)
+}
+
+// Close stops the subscriber and closes its message channel
+func (s *Subscriber) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	if s.cn != nil {
+		s.cn.close()
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+// change records a subscription change and sends it if connected. While
+// reconnecting the change is applied when the connection is re-established.
+func (s *Subscriber) change(ctx context.Context, command string, set map[string]bool, add bool, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return ErrClosed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		if add {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+	}
+	if s.cn == nil {
+		return nil
+	}
+
+	stop := s.cn.bindWrite(ctx)
+	defer stop()
+	if err := s.cn.send(append([]string{command}, names...)...); err != nil {
+		// The read loop notices the broken connection and reconnects
+		s.cn.close()
+	}
+	return ctx.Err()
+}
+
+// run owns the connection: it reads pushes until the connection fails and
+// then reconnects, until the subscriber is closed
+func (s *Subscriber) run() {
+	defer close(s.done)
+	defer close(s.msgs)
+
+	for attempt := 0; ; attempt++ {
+		cn, err := s.connect()
+		if err == nil {
+			attempt = 0
+			s.read(cn)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(s.backoff(attempt)):
+		}
+	}
+}
+
+// connect dials a new connection and re-subscribes everything
+func (s *Subscriber) connect() (*conn, error) {
+	cn, err := dial(s.ctx, s.client.addr, s.client.token, s.client.opts)
+	if err != nil {
+		return nil, err
+	}
+	cn.nc.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		cn.close()
+		return nil, ErrClosed
+	}
+	if len(s.channels) > 0 {
+		if err := cn.writeCommand(append([]string{"SUBSCRIBE"}, keys(s.channels)...)); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	if len(s.patterns) > 0 {
+		if err := cn.writeCommand(append([]string{"PSUBSCRIBE"}, keys(s.patterns)...)); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		cn.close()
+		return nil, err
+	}
+	s.cn = cn
+	return cn, nil
+}
+
+// read delivers pushes from cn until it fails
+func (s *Subscriber) read(cn *conn) {
+	defer func() {
+		s.mu.Lock()
+		s.cn = nil
+		s.mu.Unlock()
+		cn.close()
+	}()
+
+	for {
+		v, err := cn.r.ReadValue()
+		if err != nil {
+			return
+		}
+		msg, ok := parsePush(v)
+		if !ok {
+			continue
+		}
+		select {
+		case s.msgs <- msg:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// backoff returns the delay before reconnect attempt n: exponential,
+// capped at MaxBackoff, with jitter in its upper half
+func (s *Subscriber) backoff(attempt int) time.Duration {
+	d := s.client.opts.MaxBackoff
+	if attempt < 32 {
+		if exp := s.client.opts.MinBackoff << attempt; exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parsePush extracts a message from a "message" or "pmessage" push
+func parsePush(v protocol.Value) (Message, bool) {
+	if v.Type != protocol.Array || len(v.Array) == 0 {
+		return Message{}, false
+	}
+	switch kind := strings.ToLower(v.Array[0].Str); {
+	case kind == "message" && len(v.Array) == 3:
+		return Message{Channel: v.Array[1].Str, Payload: v.Array[2].Str}, true
+	case kind == "pmessage" && len(v.Array) == 4:
+		return Message{Pattern: v.Array[1].Str, Channel: v.Array[2].Str, Payload: v.Array[3].Str}, true
+	}
+	return Message{}, false
+}
+
+func keys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+)
+
+// SetAudit records security events to l
+func (s *Server) SetAudit(l *audit.Log) {
+	s.handler.audit = l
+}
+
+// origin describes c as the actor of an audit event
+func origin(c *client.Client) audit.Event {
+	e := audit.Event{ConnID: c.ID}
+	if c.Conn != nil {
+		e.RemoteAddr = c.Conn.RemoteAddr().String()
+	}
+	if c.Authed {
+		e.Tenant = auth.Redact(c.Token)
+	}
+	return e
+}
+
+// record writes an audit event about an action taken by c
+func (h *Handler) record(c *client.Client, typ, outcome, target string, details map[string]string) {
+	h.recordAs(origin(c), typ, outcome, target, details)
+}
+
+// recordAs writes an audit event about an action taken by the actor
+// described by e
+func (h *Handler) recordAs(e audit.Event, typ, outcome, target string, details map[string]string) {
+	if h.audit == nil {
+		return
+	}
+	e.Type = typ
+	e.Outcome = outcome
+	e.Target = target
+	e.Details = details
+	h.audit.Record(e)
+}
+
+// deny answers a command that needs the master token and records the denial
+func (h *Handler) deny(c *client.Client, command, message string) {
+	h.record(c, audit.ACLDenied, audit.Denied, "", map[string]string{"command": command})
+	c.Logger().Warn("command denied", "command", command)
+	c.WriteError(message)
+}
+
+// checkACL replies with -NOPERM, recording the denial, when the client's
+// ACL does not allow publishing on (publish set) or subscribing to one of
+// names
+func (h *Handler) checkACL(c *client.Client, command string, publish bool, names []string) bool {
+	for _, name := range names {
+		if publish && c.ACL.CanPublish(name) || !publish && c.ACL.CanSubscribe(name) {
+			continue
+		}
+		h.record(c, audit.ACLDenied, audit.Denied, "", map[string]string{"command": command, "channel": name})
+		c.Logger().Warn("command denied", "command", command, "channel", name)
+		c.Write(protocol.FormatErrorCode("NOPERM", "this token has no permissions to access one of the channels used as arguments"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// bridge handles BRIDGE ADD|DEL|LIST|RELOAD. Bridges are managed by the
+// master token only:
+//
+//	BRIDGE ADD <tenant> <channel> <target> [<target> ...] [READONLY]
+//	BRIDGE DEL <id>
+//	BRIDGE LIST
+//	BRIDGE RELOAD
+func (h *Handler) bridge(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for BRIDGE"))
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	if !auth.IsMasterToken(c.Token) {
+		h.deny(c, "BRIDGE "+sub, "only master token can manage bridges")
+		return
+	}
+
+	switch sub {
+	case "ADD":
+		b := pubsub.Bridge{}
+		if n := len(args); n > 4 && strings.EqualFold(args[n-1], "READONLY") {
+			b.ReadOnly = true
+			args = args[:n-1]
+		}
+		if len(args) < 4 {
+			c.Write(protocol.FormatError("wrong number of arguments for BRIDGE ADD"))
+			return
+		}
+		b.Tenant, b.Channel = args[1], args[2]
+		for _, target := range args[3:] {
+			if !slices.Contains(b.Targets, target) {
+				b.Targets = append(b.Targets, target)
+			}
+		}
+		if reservedTenant(b.Tenant) || slices.ContainsFunc(b.Targets, reservedTenant) {
+			c.Write(protocol.FormatError("bridges cannot use the master tenant or *"))
+			return
+		}
+		if slices.Contains(b.Targets, b.Tenant) {
+			c.Write(protocol.FormatError("a bridge cannot target its own tenant"))
+			return
+		}
+
+		id, err := h.server.bridges.Add(b)
+		if err != nil {
+			c.Logger().Error("bridge not stored", "error", err)
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		b.ID = id
+		h.pubsub.AddBridge(b)
+		c.Logger().Info("bridge added", "id", id, "channel", b.Channel, "targets", len(b.Targets), "read_only", b.ReadOnly)
+		h.record(c, audit.AdminBridge, audit.Success, auth.RedactTenant(b.Tenant), map[string]string{
+			"action":    "add",
+			"id":        strconv.FormatInt(id, 10),
+			"channel":   b.Channel,
+			"read_only": strconv.FormatBool(b.ReadOnly),
+		})
+		c.Write(protocol.FormatInteger(int(id)))
+
+	case "DEL":
+		if len(args) != 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for BRIDGE DEL"))
+			return
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			c.Write(protocol.FormatError("value is not an integer or out of range"))
+			return
+		}
+		removed, err := h.server.bridges.Remove(id)
+		if err != nil {
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		// Bridges added on another node are only known here after a reload
+		removed = h.pubsub.RemoveBridge(id) || removed
+		if !removed {
+			c.Write(protocol.FormatInteger(0))
+			return
+		}
+		c.Logger().Info("bridge removed", "id", id)
+		h.record(c, audit.AdminBridge, audit.Success, "", map[string]string{"action": "del", "id": args[1]})
+		c.Write(protocol.FormatInteger(1))
+
+	case "LIST":
+		bridges := h.pubsub.Bridges()
+		items := make([]string, len(bridges))
+		for i, b := range bridges {
+			mode := "readwrite"
+			if b.ReadOnly {
+				mode = "readonly"
+			}
+			targets := make([]string, len(b.Targets))
+			for j, target := range b.Targets {
+				targets[j] = auth.RedactTenant(target)
+			}
+			items[i] = protocol.FormatArray(strconv.FormatInt(b.ID, 10), auth.RedactTenant(b.Tenant), b.Channel, strings.Join(targets, ","), mode)
+		}
+		c.Write(protocol.FormatRawArray(items))
+
+	case "RELOAD":
+		if err := h.server.LoadBridges(); err != nil {
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		h.record(c, audit.AdminBridge, audit.Success, "", map[string]string{"action": "reload"})
+		c.Write(protocol.FormatOK())
+
+	default:
+		c.Write(protocol.FormatError("unknown BRIDGE subcommand '" + sub + "'"))
+	}
+}
+
+// reservedTenant reports whether a tenant name is the master tenant or the
+// broadcast publisher
+func reservedTenant(tenant string) bool {
+	return auth.IsMasterTenant(tenant) || auth.IsBroadcast(tenant)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+)
+
+// clients returns the connected clients ordered by ID
+func (s *Server) clients() []*client.Client {
+	s.mu.Lock()
+	out := make([]*client.Client, 0, len(s.conns))
+	for c := range s.conns {
+		out = append(out, c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// clientCommand handles CLIENT ID|LIST|KILL. Tenants see their own
+// connections; the master token sees and can kill every connection.
+func (h *Handler) clientCommand(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for CLIENT"))
+		return
+	}
+
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "ID":
+		c.Write(protocol.FormatInteger(int(c.ID)))
+
+	case "LIST":
+		var b strings.Builder
+		for _, other := range h.server.clients() {
+			if !auth.IsMasterToken(c.Token) && other.Namespace() != c.Namespace() {
+				continue
+			}
+			tenant := ""
+			if token, ok := other.AuthToken(); ok {
+				tenant = auth.Redact(token)
+			}
+			fmt.Fprintf(&b, "id=%d addr=%s tenant=%s sub=%d psub=%d\n",
+				other.ID, other.Conn.RemoteAddr(), tenant, len(other.Subscriptions()), len(other.Patterns()))
+		}
+		c.Write(protocol.FormatBulkString(b.String()))
+
+	case "KILL":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "CLIENT KILL", "only master token can kill clients")
+			return
+		}
+		if len(args) != 3 {
+			c.Write(protocol.FormatError("wrong number of arguments for CLIENT KILL"))
+			return
+		}
+
+		var match func(*client.Client) bool
+		switch strings.ToUpper(args[1]) {
+		case "ID":
+			id, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil {
+				c.Write(protocol.FormatError("client-id should be greater than 0"))
+				return
+			}
+			match = func(o *client.Client) bool { return o.ID == id }
+		case "ADDR":
+			match = func(o *client.Client) bool { return o.Conn.RemoteAddr().String() == args[2] }
+		default:
+			c.Write(protocol.FormatError("syntax error"))
+			return
+		}
+
+		killed := 0
+		for _, other := range h.server.clients() {
+			if match(other) {
+				other.Logger().Info("client killed by master", "by_conn_id", c.ID)
+				other.Close()
+				killed++
+			}
+		}
+		h.record(c, audit.AdminClientKill, audit.Success, strings.ToLower(args[1])+"="+args[2],
+			map[string]string{"killed": strconv.Itoa(killed)})
+		c.Write(protocol.FormatInteger(killed))
+
+	default:
+		c.Write(protocol.FormatError("unknown CLIENT subcommand '" + sub + "'"))
+	}
+}
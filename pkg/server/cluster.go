@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+)
+
+// clusterCommand handles CLUSTER MYID|NODES. NODES describes every member
+// known to this node, one per line:
+//
+//	<id> <addr> <flags> <incarnation> <link> <interests>
+//
+// where flags is the member state, prefixed with "myself," for this node,
+// and link is connected or disconnected.
+func (h *Handler) clusterCommand(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for CLUSTER"))
+		return
+	}
+	h.server.mu.Lock()
+	node := h.server.cluster
+	h.server.mu.Unlock()
+	if node == nil {
+		c.Write(protocol.FormatError("This instance has cluster support disabled"))
+		return
+	}
+
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "MYID":
+		c.Write(protocol.FormatBulkString(node.ID()))
+
+	case "NODES":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "CLUSTER NODES", "only master token can list cluster nodes")
+			return
+		}
+		var b strings.Builder
+		for _, m := range node.Members() {
+			flags := m.State.String()
+			link := "disconnected"
+			if m.Self {
+				flags = "myself," + flags
+			}
+			if m.Self || m.Connected {
+				link = "connected"
+			}
+			fmt.Fprintf(&b, "%s %s %s %d %s %d\n", m.ID, m.Addr, flags, m.Incarnation, link, m.Interests)
+		}
+		c.Write(protocol.FormatBulkString(b.String()))
+
+	default:
+		c.Write(protocol.FormatError("unknown CLUSTER subcommand '" + sub + "'"))
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"strings"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/config"
+	"redix/pkg/protocol"
+)
+
+// SetConfig enables the CONFIG command backed by m
+func (s *Server) SetConfig(m *config.Manager) {
+	s.handler.config = m
+}
+
+// configCommand handles CONFIG GET|SET|REWRITE. Every subcommand needs the
+// master token.
+func (h *Handler) configCommand(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for CONFIG"))
+		return
+	}
+	if h.config == nil {
+		c.Write(protocol.FormatError("CONFIG is not available"))
+		return
+	}
+
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "GET":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "CONFIG GET", "only master token can read the configuration")
+			return
+		}
+		if len(args) < 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for CONFIG GET"))
+			return
+		}
+		var items []string
+		seen := make(map[string]bool)
+		for _, pattern := range args[1:] {
+			for _, kv := range h.config.Get(pattern) {
+				if !seen[kv[0]] {
+					seen[kv[0]] = true
+					items = append(items, kv[0], kv[1])
+				}
+			}
+		}
+		c.Write(protocol.FormatArray(items...))
+
+	case "SET":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "CONFIG SET", "only master token can change the configuration")
+			return
+		}
+		if len(args) < 3 || len(args)%2 != 1 {
+			c.Write(protocol.FormatError("wrong number of arguments for CONFIG SET"))
+			return
+		}
+		settings := make(map[string]string)
+		for i := 1; i+1 < len(args); i += 2 {
+			settings[strings.ToLower(args[i])] = args[i+1]
+		}
+		if err := h.config.Set(args[1:]...); err != nil {
+			c.Logger().Warn("config change rejected", "error", err)
+			h.record(c, audit.ConfigChange, audit.Failure, "", settings)
+			c.Write(protocol.FormatError("CONFIG SET failed: " + err.Error()))
+			return
+		}
+		c.Logger().Info("config changed", "settings", args[1:])
+		h.record(c, audit.ConfigChange, audit.Success, "", settings)
+		c.Write(protocol.FormatOK())
+
+	case "REWRITE":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "CONFIG REWRITE", "only master token can change the configuration")
+			return
+		}
+		file := h.config.Config().File()
+		if err := h.config.Rewrite(); err != nil {
+			c.Logger().Error("config rewrite failed", "error", err)
+			h.record(c, audit.ConfigRewrite, audit.Failure, file, nil)
+			c.Write(protocol.FormatError("CONFIG REWRITE failed: " + err.Error()))
+			return
+		}
+		c.Logger().Info("config rewritten", "file", file)
+		h.record(c, audit.ConfigRewrite, audit.Success, file, nil)
+		c.Write(protocol.FormatOK())
+
+	default:
+		c.Write(protocol.FormatError("unknown CONFIG subcommand '" + sub + "'"))
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+)
+
+// Errors returned to gateway sessions over a connection limit
+var (
+	ErrMaxClients         = errors.New("max number of clients reached")
+	ErrMaxClientsPerToken = errors.New("max number of clients reached for this token")
+)
+
+// OpenSession registers a WebSocket or SSE session so that the connection
+// limits cover it, giving it an ID and the current write timeout. It fails
+// when the server is at its connection limit.
+func (s *Server) OpenSession(c *client.Client, remoteAddr string) error {
+	c.ID = s.nextID.Add(1)
+	c.WriteTimeout = time.Duration(s.writeTimeout.Load())
+	c.SetLogger(slog.Default().With("conn_id", c.ID, "remote_addr", remoteAddr))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max := s.maxClients.Load(); max > 0 && int64(len(s.conns)+len(s.sessions)) >= max {
+		c.Logger().Warn("session rejected", "reason", "max number of clients reached", "maxclients", max)
+		return ErrMaxClients
+	}
+	s.sessions[c] = struct{}{}
+	return nil
+}
+
+// ClaimSession counts a session against the connection cap of the token
+// it authenticates with
+func (s *Server) ClaimSession(c *client.Client, token string) error {
+	if !s.claimToken(c, token) {
+		c.Logger().Warn("authentication rejected", "token", auth.Redact(token), "reason", "max number of clients reached for token")
+		return ErrMaxClientsPerToken
+	}
+	return nil
+}
+
+// CloseSession forgets a session registered with OpenSession
+func (s *Server) CloseSession(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, c)
+	s.releaseLocked(c)
+}
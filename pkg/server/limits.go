@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/config"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// SetLimits applies connection limits and timeouts. Timeouts apply to the
+// next read of every connection; keepalive and write timeouts to new
+// connections.
+func (s *Server) SetLimits(l config.Limits) {
+	s.maxClients.Store(int64(l.MaxClients))
+	s.maxPerToken.Store(int64(l.MaxClientsPerToken))
+	s.authTimeout.Store(int64(l.AuthTimeout))
+	s.idleTimeout.Store(int64(l.IdleTimeout))
+	s.keepAlive.Store(int64(l.TCPKeepAlive))
+	s.writeTimeout.Store(int64(l.WriteTimeout))
+	if s.tokenRecheck.Swap(int64(l.TokenRecheck)) != int64(l.TokenRecheck) {
+		select {
+		case s.recheck <- struct{}{}:
+		default:
+		}
+	}
+	s.pubsub.SetDefaultTenantLimits(pubsub.TenantLimits{
+		MaxChannels:      l.TenantMaxChannels,
+		MaxSubscriptions: l.TenantMaxSubscriptions,
+	})
+}
+
+// SetProtocolLimits bounds the RESP input accepted from new connections
+func (s *Server) SetProtocolLimits(l protocol.Limits) {
+	s.protoLimits.Store(&l)
+}
+
+// ProtocolLimits returns the limits applied to client input
+func (s *Server) ProtocolLimits() protocol.Limits {
+	if l := s.protoLimits.Load(); l != nil {
+		return *l
+	}
+	return protocol.DefaultLimits()
+}
+
+// claimToken counts c against the connection cap of token, releasing the
+// token c was authenticated with before. It reports false when the cap is
+// reached. The master token is not capped.
+func (s *Server) claimToken(c *client.Client, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.claims[c]
+	if ok && prev == token {
+		return true
+	}
+	if max := s.maxPerToken.Load(); max > 0 && !auth.IsMasterToken(token) && int64(s.tokens[token]) >= max {
+		return false
+	}
+	if ok {
+		s.releaseLocked(c)
+	}
+	s.claims[c] = token
+	s.tokens[token]++
+	return true
+}
+
+// releaseLocked drops c's token claim. The caller holds s.mu.
+func (s *Server) releaseLocked(c *client.Client) {
+	token, ok := s.claims[c]
+	if !ok {
+		return
+	}
+	delete(s.claims, c)
+	if s.tokens[token]--; s.tokens[token] <= 0 {
+		delete(s.tokens, token)
+	}
+}
+
+// readDeadline returns the deadline for the next command from c: the auth
+// deadline until it authenticates, then the idle timeout while it has no
+// subscriptions. Subscribers rely on TCP keepalive instead.
+func (s *Server) readDeadline(c *client.Client, connected time.Time) time.Time {
+	if !c.Authed {
+		if d := time.Duration(s.authTimeout.Load()); d > 0 {
+			return connected.Add(d)
+		}
+		return time.Time{}
+	}
+	if d := time.Duration(s.idleTimeout.Load()); d > 0 && c.SubscriptionCount()+c.ShardSubscriptionCount()+c.GroupCount() == 0 {
+		return time.Now().Add(d)
+	}
+	return time.Time{}
+}
+
+// setKeepAlive enables TCP keepalive probes on conn, looking through TLS
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(period)
+	}
+}
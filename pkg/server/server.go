@@ -1,36 +1,97 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"redix/pkg/audit"
 	"redix/pkg/auth"
+	"redix/pkg/backplane"
+	"redix/pkg/bridge"
 	"redix/pkg/client"
+	"redix/pkg/cluster"
+	"redix/pkg/config"
 	"redix/pkg/protocol"
 	"redix/pkg/pubsub"
+	"redix/pkg/webhook"
 )
 
 // Server represents the main server instance
 type Server struct {
-	db      *sql.DB
-	auth    *auth.Validator
-	pubsub  *pubsub.PubSub
-	handler *Handler
+	db        *sql.DB
+	auth      *auth.Validator
+	pubsub    *pubsub.PubSub
+	hooks     *webhook.Dispatcher
+	bridges   *bridge.Store
+	handler   *Handler
+	cluster   *cluster.Node
+	backplane *backplane.Backplane
+
+	ln         net.Listener
+	accepting  atomic.Bool
+	draining   atomic.Bool
+	maxClients atomic.Int64
+	nextID     atomic.Uint64
+
+	maxPerToken  atomic.Int64
+	authTimeout  atomic.Int64
+	idleTimeout  atomic.Int64
+	keepAlive    atomic.Int64
+	writeTimeout atomic.Int64
+	tokenRecheck atomic.Int64
+	protoLimits  atomic.Pointer[protocol.Limits]
+
+	// recheck wakes the token recheck loop when its interval changes, and
+	// done stops it
+	recheck  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[*client.Client]struct{}
+	// sessions are the WebSocket and SSE sessions of the HTTP API
+	sessions map[*client.Client]struct{}
+	claims   map[*client.Client]string
+	tokens   map[string]int
+	wg       sync.WaitGroup
 }
 
 // New creates a new server instance
 func New(db *sql.DB) *Server {
 	validator := auth.NewValidator(db)
 	ps := pubsub.New()
-	handler := NewHandler(validator, ps)
+	hooks := webhook.NewDispatcher(webhook.NewStore(db), webhook.DefaultOptions())
+	ps.OnPublish(hooks.Notify)
+	handler := NewHandler(validator, ps, hooks)
 
-	return &Server{
-		db:      db,
-		auth:    validator,
-		pubsub:  ps,
-		handler: handler,
+	s := &Server{
+		db:       db,
+		auth:     validator,
+		pubsub:   ps,
+		hooks:    hooks,
+		bridges:  bridge.NewStore(db),
+		handler:  handler,
+		conns:    make(map[*client.Client]struct{}),
+		sessions: make(map[*client.Client]struct{}),
+		claims:   make(map[*client.Client]string),
+		tokens:   make(map[string]int),
+		recheck:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
 	}
+	handler.server = s
+	go s.recheckTokens()
+	return s
 }
 
 // Listen starts the server on the specified address
@@ -39,60 +100,282 @@ func (s *Server) Listen(addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until the server is shut down
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	s.accepting.Store(true)
+	defer s.accepting.Store(false)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.draining.Load() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			continue
 		}
 
+		if d := time.Duration(s.keepAlive.Load()); d > 0 {
+			setKeepAlive(conn, d)
+		}
 		c := client.New(conn)
-		go s.handler.Handle(c)
+		c.ID = s.nextID.Add(1)
+		c.WriteTimeout = time.Duration(s.writeTimeout.Load())
+		c.SetLogger(slog.Default().With("conn_id", c.ID, "remote_addr", conn.RemoteAddr().String()))
+		if max := s.maxClients.Load(); max > 0 && int64(s.ClientCount()) >= max {
+			c.Logger().Warn("connection rejected", "reason", "max number of clients reached", "maxclients", max)
+			c.Write(protocol.FormatError("max number of clients reached"))
+			c.Close()
+			continue
+		}
+
+		s.track(c)
+		go func() {
+			defer s.untrack(c)
+			s.handler.Handle(c)
+		}()
+	}
+}
+
+// LoadBridges replaces the cross-tenant bridges with those in the token
+// store
+func (s *Server) LoadBridges() error {
+	bridges, err := s.bridges.All()
+	if err != nil {
+		return err
+	}
+	s.pubsub.SetBridges(bridges)
+	return nil
+}
+
+// PubSub returns the pub/sub instance shared by all connections
+func (s *Server) PubSub() *pubsub.PubSub {
+	return s.pubsub
+}
+
+// Auth returns the token validator used by the server
+func (s *Server) Auth() *auth.Validator {
+	return s.auth
+}
+
+// Webhooks returns the outbound webhook dispatcher
+func (s *Server) Webhooks() *webhook.Dispatcher {
+	return s.hooks
+}
+
+// SetCluster attaches the cluster node bridging this server's pub/sub to
+// its peers. Shutdown closes it.
+func (s *Server) SetCluster(n *cluster.Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cluster = n
+	n.OnMembershipChange(s.reshard)
+}
+
+// SetBackplane attaches the Redis backplane relaying this server's pub/sub
+// to other nodes. Shutdown closes it.
+func (s *Server) SetBackplane(b *backplane.Backplane) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backplane = b
+}
+
+// SetMaxClients sets the maximum number of simultaneous connections (0 means unlimited)
+func (s *Server) SetMaxClients(n int) {
+	s.maxClients.Store(int64(n))
+}
+
+// ClientCount returns the number of currently connected clients,
+// including WebSocket and SSE sessions
+func (s *Server) ClientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns) + len(s.sessions)
+}
+
+// Healthy reports whether the process is alive and the listener is accepting
+func (s *Server) Healthy() bool {
+	return s.accepting.Load()
+}
+
+// Ready reports whether the server should receive new traffic
+func (s *Server) Ready(ctx context.Context) error {
+	if s.draining.Load() {
+		return errors.New("shutting down")
+	}
+	if !s.accepting.Load() {
+		return errors.New("listener not accepting")
+	}
+	if err := s.auth.Ping(ctx); err != nil {
+		return fmt.Errorf("token store unreachable: %w", err)
+	}
+	if max := s.maxClients.Load(); max > 0 && int64(s.ClientCount()) >= max {
+		return errors.New("connection limit reached")
+	}
+	return nil
+}
+
+// Drain marks the server as shutting down so readiness starts failing,
+// while existing and new connections are still served
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Shutdown stops accepting connections, closes all clients and waits for
+// their handlers to return or for ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Drain()
+	s.stopOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	node, bp := s.cluster, s.backplane
+	s.mu.Unlock()
+	if node != nil {
+		node.Close()
+	}
+	if bp != nil {
+		bp.Close()
 	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.hooks.Close()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+}
+
+func (s *Server) untrack(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.releaseLocked(c)
+	s.wg.Done()
 }
 
 // Handler handles client connections and commands
 type Handler struct {
 	auth   *auth.Validator
 	pubsub *pubsub.PubSub
+	hooks  *webhook.Dispatcher
+	config *config.Manager
+	audit  *audit.Log
+	server *Server
 }
 
 // NewHandler creates a new command handler
-func NewHandler(validator *auth.Validator, ps *pubsub.PubSub) *Handler {
+func NewHandler(validator *auth.Validator, ps *pubsub.PubSub, hooks *webhook.Dispatcher) *Handler {
 	return &Handler{
 		auth:   validator,
 		pubsub: ps,
+		hooks:  hooks,
+	}
+}
+
+// checkChannels replies with a protocol error when a channel name or
+// pattern is over the length limit, after which the connection is closed
+func (h *Handler) checkChannels(c *client.Client, limits protocol.Limits, names []string) bool {
+	for _, name := range names {
+		if err := limits.CheckChannel(name); err != nil {
+			c.Logger().Warn("protocol error", "error", err, "length", len(name))
+			c.Write(protocol.FormatError(err.Error()))
+			return false
+		}
 	}
+	return true
 }
 
 // Handle processes client commands
 func (h *Handler) Handle(c *client.Client) {
+	start := time.Now()
+	c.Logger().Debug("client connected")
+	defer func() {
+		c.Logger().Debug("client disconnected", "duration", time.Since(start).Round(time.Millisecond))
+	}()
 	defer c.Close()
-	buf := make([]byte, 4096)
+	defer h.pubsub.UnsubscribeAll(c)
+	r := protocol.NewReader(c.Conn)
+	limits := h.server.ProtocolLimits()
+	r.SetLimits(limits)
 
 	for {
-		n, err := c.Conn.Read(buf)
+		c.SetReadDeadline(h.server.readDeadline(c, start))
+		cmd, err := r.ReadCommand()
 		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				reason := "idle timeout"
+				if !c.Authed {
+					reason = "authentication timeout"
+				}
+				c.Logger().Info("connection timed out", "reason", reason)
+				c.Write(protocol.FormatError(reason))
+			} else if errors.Is(err, protocol.ErrProtocol) {
+				c.Logger().Warn("protocol error", "error", err)
+				c.Write(protocol.FormatError(err.Error()))
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.Logger().Debug("read failed", "error", err)
+			}
 			break
 		}
 
-		cmd := protocol.ParseRESP(buf[:n])
-		if len(cmd) == 0 {
-			continue
-		}
-
 		switch strings.ToUpper(cmd[0]) {
+		case "PING":
+			if len(cmd) > 1 {
+				c.Write(protocol.FormatBulkString(cmd[1]))
+			} else {
+				c.Write("+PONG\r\n")
+			}
+
 		case "AUTH":
 			if len(cmd) < 2 {
 				c.Write(protocol.FormatError("wrong number of arguments for AUTH"))
 				continue
 			}
 			token := cmd[1]
-			if h.auth.IsValidToken(token) {
-				c.Authed = true
-				c.Token = token
+			if tok, ok := h.auth.Lookup(token); ok {
+				if !h.server.claimToken(c, token) {
+					c.Logger().Warn("authentication rejected", "token", auth.Redact(token), "reason", "max number of clients reached for token")
+					h.record(c, audit.AuthFailure, audit.Denied, auth.Redact(token), map[string]string{"reason": "maxclients_per_token"})
+					c.Write(protocol.FormatError("max number of clients reached for this token"))
+					continue
+				}
+				if c.Authed && c.Namespace() != tok.Tenant {
+					h.pubsub.UnsubscribeAll(c)
+				}
+				c.Authenticate(tok)
+				c.SetLogger(c.Logger().With("tenant", auth.Redact(token)))
+				c.Logger().Info("client authenticated")
+				h.record(c, audit.AuthSuccess, audit.Success, "", nil)
 				c.Write(protocol.FormatOK())
 			} else {
+				c.Logger().Warn("authentication failed", "token", auth.Redact(token))
+				h.record(c, audit.AuthFailure, audit.Failure, auth.Redact(token), nil)
 				c.Write(protocol.FormatError("invalid token"))
 			}
 
@@ -103,7 +386,7 @@ func (h *Handler) Handle(c *client.Client) {
 			}
 
 			if !auth.IsMasterToken(c.Token) {
-				c.Write(protocol.FormatError("only master token can disconnect clients"))
+				h.deny(c, "DISCONNECT", "only master token can disconnect clients")
 				continue
 			}
 
@@ -113,6 +396,8 @@ func (h *Handler) Handle(c *client.Client) {
 			}
 
 			disconnected := h.pubsub.DisconnectToken(cmd[1])
+			c.Logger().Info("tenant disconnected by master", "target", auth.Redact(cmd[1]), "clients", disconnected)
+			h.record(c, audit.AdminDisconnect, audit.Success, auth.Redact(cmd[1]), map[string]string{"clients": strconv.Itoa(disconnected)})
 			c.Write(protocol.FormatInteger(disconnected))
 
 		case "SUBSCRIBE":
@@ -120,11 +405,72 @@ func (h *Handler) Handle(c *client.Client) {
 				c.Write(protocol.FormatNoAuth())
 				continue
 			}
+			if !h.checkChannels(c, limits, cmd[1:]) {
+				return
+			}
+			if !h.checkACL(c, "SUBSCRIBE", false, cmd[1:]) {
+				continue
+			}
 
 			for _, topic := range cmd[1:] {
-				h.pubsub.Subscribe(topic, c)
+				if err := h.pubsub.Subscribe(topic, c); err != nil {
+					c.Write(protocol.FormatError(err.Error()))
+					break
+				}
 				c.Write(protocol.FormatSubscribe(topic))
 			}
+			c.Logger().Debug("subscribed", "channels", cmd[1:])
+
+		case "UNSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			topics := cmd[1:]
+			if len(topics) == 0 {
+				topics = c.Subscriptions()
+			}
+			for _, topic := range topics {
+				h.pubsub.Unsubscribe(topic, c)
+				c.Write(protocol.FormatSubscription("unsubscribe", topic, c.SubscriptionCount()))
+			}
+
+		case "PSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if !h.checkChannels(c, limits, cmd[1:]) {
+				return
+			}
+			if !h.checkACL(c, "PSUBSCRIBE", false, cmd[1:]) {
+				continue
+			}
+
+			for _, pattern := range cmd[1:] {
+				if err := h.pubsub.PSubscribe(pattern, c); err != nil {
+					c.Write(protocol.FormatError(err.Error()))
+					break
+				}
+				c.Write(protocol.FormatSubscription("psubscribe", pattern, c.SubscriptionCount()))
+			}
+			c.Logger().Debug("subscribed", "patterns", cmd[1:])
+
+		case "PUNSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			patterns := cmd[1:]
+			if len(patterns) == 0 {
+				patterns = c.Patterns()
+			}
+			for _, pattern := range patterns {
+				h.pubsub.PUnsubscribe(pattern, c)
+				c.Write(protocol.FormatSubscription("punsubscribe", pattern, c.SubscriptionCount()))
+			}
 
 		case "PUBLISH":
 			if !c.Authed {
@@ -137,11 +483,308 @@ func (h *Handler) Handle(c *client.Client) {
 				continue
 			}
 
+			if !h.checkChannels(c, limits, cmd[1:2]) {
+				return
+			}
+			if !h.checkACL(c, "PUBLISH", true, cmd[1:2]) {
+				continue
+			}
+			topic, msg := cmd[1], cmd[2]
+			if err := h.pubsub.CanPublish(c.Namespace(), topic); err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			if err := h.pubsub.CanEnqueue(c.Namespace(), topic, 1); err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			count := h.pubsub.Publish(topic, msg, c.Namespace())
+			c.Logger().Debug("message published", "channel", topic, "receivers", count)
+			c.Write(protocol.FormatInteger(count))
+
+		case "PUBLISH.TENANT", "PUBLISH.BROADCAST":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if !auth.IsMasterToken(c.Token) {
+				h.deny(c, strings.ToUpper(cmd[0]), "only master token can publish to other tenants")
+				continue
+			}
+
+			// PUBLISH.TENANT <tenant> <channel> <message> publishes as the
+			// tenant; PUBLISH.BROADCAST <channel> <message> reaches every
+			// tenant
+			tenant, args := auth.AllTenants, cmd[1:]
+			if strings.EqualFold(cmd[0], "PUBLISH.TENANT") {
+				if len(args) != 3 {
+					c.Write(protocol.FormatError("wrong number of arguments for PUBLISH.TENANT"))
+					continue
+				}
+				tenant, args = args[0], args[1:]
+				if reservedTenant(tenant) {
+					c.Write(protocol.FormatError("use PUBLISH.BROADCAST to reach every tenant"))
+					continue
+				}
+			} else if len(args) != 2 {
+				c.Write(protocol.FormatError("wrong number of arguments for PUBLISH.BROADCAST"))
+				continue
+			}
+			if !h.checkChannels(c, limits, args[:1]) {
+				return
+			}
+			if err := h.pubsub.CanEnqueue(tenant, args[0], 1); err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			count := h.pubsub.Publish(args[0], args[1], tenant)
+			c.Logger().Debug("message published", "channel", args[0], "tenant", auth.Redact(tenant), "receivers", count)
+			c.Write(protocol.FormatInteger(count))
+
+		case "SSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) < 2 {
+				c.Write(protocol.FormatError("wrong number of arguments for SSUBSCRIBE"))
+				continue
+			}
+			if !h.checkChannels(c, limits, cmd[1:]) {
+				return
+			}
+			if !h.checkACL(c, "SSUBSCRIBE", false, cmd[1:]) {
+				continue
+			}
+			if !h.checkSlot(c, cmd[1:]) {
+				continue
+			}
+
+			for _, topic := range cmd[1:] {
+				if err := h.pubsub.SSubscribe(topic, c); err != nil {
+					c.Write(protocol.FormatError(err.Error()))
+					break
+				}
+				c.Write(protocol.FormatSubscription("ssubscribe", topic, c.ShardSubscriptionCount()))
+			}
+			c.Logger().Debug("subscribed", "shard_channels", cmd[1:])
+
+		case "SUNSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			topics := cmd[1:]
+			if len(topics) == 0 {
+				topics = c.ShardSubscriptions()
+			}
+			for _, topic := range topics {
+				h.pubsub.SUnsubscribe(topic, c)
+				c.Write(protocol.FormatSubscription("sunsubscribe", topic, c.ShardSubscriptionCount()))
+			}
+
+		case "SPUBLISH":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) != 3 {
+				c.Write(protocol.FormatError("wrong number of arguments for SPUBLISH"))
+				continue
+			}
+			if !h.checkChannels(c, limits, cmd[1:2]) {
+				return
+			}
+			if !h.checkACL(c, "SPUBLISH", true, cmd[1:2]) {
+				continue
+			}
+			if !h.checkSlot(c, cmd[1:2]) {
+				continue
+			}
+
 			topic, msg := cmd[1], cmd[2]
-			count := h.pubsub.Publish(topic, msg, c.Token)
+			if err := h.pubsub.CanPublish(c.Namespace(), topic); err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			count := h.pubsub.SPublish(topic, msg, c.Namespace())
+			c.Logger().Debug("message published", "shard_channel", topic, "receivers", count)
 			c.Write(protocol.FormatInteger(count))
 
+		case "RSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) < 3 {
+				c.Write(protocol.FormatError("wrong number of arguments for RSUBSCRIBE"))
+				continue
+			}
+			if !h.checkChannels(c, limits, cmd[1:]) {
+				return
+			}
+			if !h.checkACL(c, "RSUBSCRIBE", false, cmd[2:]) {
+				continue
+			}
+
+			group := cmd[1]
+			for _, topic := range cmd[2:] {
+				n, err := h.pubsub.RSubscribe(group, topic, c)
+				if err != nil {
+					c.Write(protocol.FormatError(err.Error()))
+					break
+				}
+				c.Write(protocol.FormatSubscription("rsubscribe", topic, n))
+			}
+			c.Logger().Debug("subscribed", "group", group, "channels", cmd[2:])
+
+		case "RUNSUBSCRIBE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			groups := cmd[1:]
+			if len(groups) == 0 {
+				groups = c.ConsumerGroups()
+			}
+			for _, group := range groups {
+				h.pubsub.RUnsubscribe(group, c)
+				c.Write(protocol.FormatSubscription("runsubscribe", group, c.GroupCount()))
+			}
+
+		case "ACK":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) < 3 {
+				c.Write(protocol.FormatError("wrong number of arguments for ACK"))
+				continue
+			}
+
+			ids := make([]uint64, 0, len(cmd)-2)
+			for _, arg := range cmd[2:] {
+				id, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil {
+					ids = nil
+					break
+				}
+				ids = append(ids, id)
+			}
+			if ids == nil {
+				c.Write(protocol.FormatError("message id is not an integer or out of range"))
+				continue
+			}
+			c.Write(protocol.FormatInteger(h.pubsub.Ack(cmd[1], c, ids)))
+
+		case "RPENDING":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) != 2 {
+				c.Write(protocol.FormatError("wrong number of arguments for RPENDING"))
+				continue
+			}
+
+			pending, err := h.pubsub.PendingMessages(cmd[1], c.Namespace())
+			if err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			items := make([]string, len(pending))
+			for i, pm := range pending {
+				consumer := ""
+				if pm.Consumer != 0 {
+					consumer = strconv.FormatUint(pm.Consumer, 10)
+				}
+				items[i] = protocol.FormatArray(strconv.FormatUint(pm.ID, 10), pm.Channel, consumer,
+					strconv.Itoa(pm.Deliveries), strconv.FormatInt(pm.Idle.Milliseconds(), 10))
+			}
+			c.Write(protocol.FormatRawArray(items))
+
+		case "RDESTROY":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+			if len(cmd) != 2 {
+				c.Write(protocol.FormatError("wrong number of arguments for RDESTROY"))
+				continue
+			}
+
+			destroyed, err := h.pubsub.DestroyGroup(cmd[1], c.Namespace())
+			if err != nil {
+				c.Write(protocol.FormatError(err.Error()))
+				continue
+			}
+			if !destroyed {
+				c.Write(protocol.FormatInteger(0))
+				continue
+			}
+			c.Logger().Info("consumer group destroyed", "group", cmd[1])
+			c.Write(protocol.FormatInteger(1))
+
+		case "WEBHOOK":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.webhook(c, cmd[1:])
+
+		case "CLIENT":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.clientCommand(c, cmd[1:])
+
+		case "CONFIG":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.configCommand(c, cmd[1:])
+
+		case "CLUSTER":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.clusterCommand(c, cmd[1:])
+
+		case "BRIDGE":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.bridge(c, cmd[1:])
+
+		case "TENANT":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.tenant(c, cmd[1:])
+
+		case "TOKEN":
+			if !c.Authed {
+				c.Write(protocol.FormatNoAuth())
+				continue
+			}
+
+			h.token(c, cmd[1:])
+
 		default:
+			c.Logger().Debug("unknown command", "command", cmd[0])
 			c.Write(protocol.FormatError("unknown command"))
 		}
 	}
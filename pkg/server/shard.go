@@ -0,0 +1,59 @@
+package server
+
+import (
+	"strconv"
+
+	"redix/pkg/client"
+	"redix/pkg/cluster"
+	"redix/pkg/protocol"
+)
+
+// checkSlot makes sure the shard channels hash to one slot served by this
+// node. Otherwise it answers -CROSSSLOT or redirects the client with
+// -MOVED to the owning node and returns false. Without clustering every
+// slot is local.
+func (h *Handler) checkSlot(c *client.Client, names []string) bool {
+	h.server.mu.Lock()
+	node := h.server.cluster
+	h.server.mu.Unlock()
+	if node == nil || len(names) == 0 {
+		return true
+	}
+
+	slot := cluster.Slot(names[0])
+	for _, name := range names[1:] {
+		if cluster.Slot(name) != slot {
+			c.Write(protocol.FormatErrorCode("CROSSSLOT", "Keys in request don't hash to the same slot"))
+			return false
+		}
+	}
+	owner, ok := node.SlotOwner(slot)
+	if !ok || owner.Self {
+		return true
+	}
+	c.Logger().Debug("redirecting to slot owner", "slot", slot, "node_id", owner.ID)
+	c.Write(protocol.FormatErrorCode("MOVED", strconv.Itoa(slot)+" "+owner.ClientAddr))
+	return false
+}
+
+// reshard unsubscribes clients from the shard channels whose slot moved to
+// another node, sending them sunsubscribe so they subscribe again there
+func (s *Server) reshard() {
+	s.mu.Lock()
+	node := s.cluster
+	s.mu.Unlock()
+	if node == nil {
+		return
+	}
+
+	for _, c := range s.clients() {
+		for _, topic := range c.ShardSubscriptions() {
+			if owner, ok := node.SlotOwner(cluster.Slot(topic)); !ok || owner.Self {
+				continue
+			}
+			s.pubsub.SUnsubscribe(topic, c)
+			c.Write(protocol.FormatSubscription("sunsubscribe", topic, c.ShardSubscriptionCount()))
+			c.Logger().Info("shard channel moved", "channel", topic)
+		}
+	}
+}
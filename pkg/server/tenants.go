@@ -0,0 +1,603 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// DefaultRotationGrace is how long a rotated token keeps working when no
+// grace period is given
+const DefaultRotationGrace = time.Hour
+
+// LoadTenants applies the limits stored for each tenant
+func (s *Server) LoadTenants() error {
+	tenants, err := s.auth.Store().Tenants()
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		s.applyTenantLimits(t)
+	}
+	return nil
+}
+
+// applyTenantLimits overrides the default limits of a tenant that has its
+// own
+func (s *Server) applyTenantLimits(t auth.Tenant) {
+	if t.MaxChannels == 0 && t.MaxSubscriptions == 0 {
+		s.pubsub.ClearTenantLimits(t.Name)
+		return
+	}
+	s.pubsub.SetTenantLimits(t.Name, pubsub.TenantLimits{
+		MaxChannels:      t.MaxChannels,
+		MaxSubscriptions: t.MaxSubscriptions,
+	})
+}
+
+// Tenants returns the stored tenants
+func (s *Server) Tenants() ([]auth.Tenant, error) {
+	return s.auth.Store().Tenants()
+}
+
+// Tenant returns a stored tenant
+func (s *Server) Tenant(name string) (auth.Tenant, error) {
+	return s.auth.Store().Tenant(name)
+}
+
+// TenantStats returns the pub/sub statistics of a tenant on this node
+func (s *Server) TenantStats(name string) pubsub.TenantStats {
+	return s.pubsub.TenantStats(name)
+}
+
+// CreateTenant stores a new tenant. by describes who asked, for the audit
+// log.
+func (s *Server) CreateTenant(by audit.Event, t auth.Tenant) error {
+	if err := checkTenant(t); err != nil {
+		return err
+	}
+	if err := s.auth.Store().CreateTenant(t); err != nil {
+		return err
+	}
+	s.applyTenantLimits(t)
+	s.handler.recordAs(by, audit.AdminTenant, audit.Success, auth.Redact(t.Name), map[string]string{"action": "create"})
+	return nil
+}
+
+// UpdateTenant changes a tenant's state and limits. Deactivating a tenant
+// revokes its tokens on this node.
+func (s *Server) UpdateTenant(by audit.Event, t auth.Tenant) error {
+	if err := checkTenant(t); err != nil {
+		return err
+	}
+	store := s.auth.Store()
+	prev, err := store.Tenant(t.Name)
+	if err != nil {
+		return err
+	}
+	if err := store.UpdateTenant(t); err != nil {
+		return err
+	}
+	s.applyTenantLimits(t)
+	s.handler.recordAs(by, audit.AdminTenant, audit.Success, auth.Redact(t.Name), map[string]string{
+		"action":            "update",
+		"active":            strconv.FormatBool(t.Active),
+		"max_channels":      strconv.Itoa(t.MaxChannels),
+		"max_subscriptions": strconv.Itoa(t.MaxSubscriptions),
+	})
+	if prev.Active && !t.Active {
+		s.revokeTenant(by, t.Name, "tenant deactivated")
+	}
+	return nil
+}
+
+// DeleteTenant deletes a tenant and its tokens, revoking them on this node
+func (s *Server) DeleteTenant(by audit.Event, name string) error {
+	store := s.auth.Store()
+	tokens, err := store.Tokens(name)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteTenant(name); err != nil {
+		return err
+	}
+	s.pubsub.ClearTenantLimits(name)
+	s.handler.recordAs(by, audit.AdminTenant, audit.Success, auth.Redact(name), map[string]string{"action": "delete"})
+	for _, t := range tokens {
+		s.revokeToken(by, t, "tenant deleted")
+	}
+	return nil
+}
+
+// Tokens returns the tokens of a tenant
+func (s *Server) Tokens(tenant string) ([]auth.Token, error) {
+	return s.auth.Store().Tokens(tenant)
+}
+
+// Token returns a stored token
+func (s *Server) Token(id int64) (auth.Token, error) {
+	return s.auth.Store().Token(id)
+}
+
+// CreateToken stores a new token of an existing tenant, generating its
+// value when t.Token is empty, and returns it
+func (s *Server) CreateToken(by audit.Event, t auth.Token) (auth.Token, error) {
+	store := s.auth.Store()
+	if _, err := store.Tenant(t.Tenant); err != nil {
+		return auth.Token{}, err
+	}
+	if t.Token == "" {
+		var err error
+		if t.Token, err = auth.GenerateToken(); err != nil {
+			return auth.Token{}, err
+		}
+	} else if auth.IsMasterToken(t.Token) || auth.IsBroadcast(t.Token) {
+		return auth.Token{}, fmt.Errorf("%w: token is reserved", auth.ErrInvalid)
+	}
+	id, err := store.CreateToken(t)
+	if err != nil {
+		return auth.Token{}, err
+	}
+	t.ID = id
+	s.handler.recordAs(by, audit.AdminToken, audit.Success, auth.Redact(t.Token), map[string]string{
+		"action": "create",
+		"id":     strconv.FormatInt(id, 10),
+		"tenant": t.Tenant,
+	})
+	return t, nil
+}
+
+// UpdateToken changes a token's state and ACL. ACL changes apply to new
+// connections; deactivating a token revokes it on this node.
+func (s *Server) UpdateToken(by audit.Event, t auth.Token) error {
+	store := s.auth.Store()
+	prev, err := store.Token(t.ID)
+	if err != nil {
+		return err
+	}
+	if err := store.UpdateToken(t); err != nil {
+		return err
+	}
+	s.handler.recordAs(by, audit.AdminToken, audit.Success, auth.Redact(prev.Token), map[string]string{
+		"action":    "update",
+		"id":        strconv.FormatInt(t.ID, 10),
+		"active":    strconv.FormatBool(t.Active),
+		"publish":   strings.Join(t.ACL.Publish, ","),
+		"subscribe": strings.Join(t.ACL.Subscribe, ","),
+	})
+	if prev.Active && !t.Active {
+		s.revokeToken(by, prev, "token deactivated")
+	}
+	return nil
+}
+
+// DeleteToken deletes a token, revoking it on this node
+func (s *Server) DeleteToken(by audit.Event, id int64) error {
+	store := s.auth.Store()
+	prev, err := store.Token(id)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteToken(id); err != nil {
+		return err
+	}
+	s.revokeToken(by, prev, "token deleted")
+	return nil
+}
+
+// RotateToken replaces a token with a new one of the same tenant and ACL.
+// The old token keeps working for grace and is then revoked on this node;
+// other nodes disconnect its clients on their next token recheck.
+func (s *Server) RotateToken(by audit.Event, id int64, grace time.Duration) (auth.Token, error) {
+	if grace < 0 {
+		return auth.Token{}, fmt.Errorf("%w: grace period must not be negative", auth.ErrInvalid)
+	}
+	store := s.auth.Store()
+	old, err := store.Token(id)
+	if err != nil {
+		return auth.Token{}, err
+	}
+	if !old.Active || !old.ExpiresAt.IsZero() {
+		return auth.Token{}, fmt.Errorf("%w: only active tokens that are not being rotated can be rotated", auth.ErrInvalid)
+	}
+
+	next := auth.Token{Tenant: old.Tenant, Active: true, ACL: old.ACL}
+	if next.Token, err = auth.GenerateToken(); err != nil {
+		return auth.Token{}, err
+	}
+	if next.ID, err = store.CreateToken(next); err != nil {
+		return auth.Token{}, err
+	}
+	old.ExpiresAt = time.Now().Add(grace)
+	if err := store.UpdateToken(old); err != nil {
+		// Without an end to the old token the new one is not handed out
+		if derr := store.DeleteToken(next.ID); derr != nil {
+			slog.Error("rotated token not removed", "id", next.ID, "error", derr)
+		}
+		return auth.Token{}, err
+	}
+	s.handler.recordAs(by, audit.AdminToken, audit.Success, auth.Redact(old.Token), map[string]string{
+		"action":     "rotate",
+		"id":         strconv.FormatInt(id, 10),
+		"new_id":     strconv.FormatInt(next.ID, 10),
+		"expires_at": old.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	time.AfterFunc(grace, func() { s.revokeToken(by, old, "rotation grace period ended") })
+	return next, nil
+}
+
+// revokeTenant revokes every token of a tenant
+func (s *Server) revokeTenant(by audit.Event, name, reason string) {
+	tokens, err := s.auth.Store().Tokens(name)
+	if err != nil {
+		s.handler.recordAs(by, audit.TokenRevoked, audit.Failure, auth.Redact(name), map[string]string{"reason": reason, "error": err.Error()})
+		return
+	}
+	for _, t := range tokens {
+		s.revokeToken(by, t, reason)
+	}
+}
+
+// revokeToken disconnects the RESP connections and WebSocket and SSE
+// sessions authenticated with a token on this node, subscribed or not,
+// and records the revocation
+func (s *Server) revokeToken(by audit.Event, t auth.Token, reason string) {
+	revoked := s.authenticatedWith(t.Token)
+	for _, c := range revoked {
+		c.Logger().Info("client disconnected", "reason", reason)
+		c.WriteError("token revoked")
+		c.Close()
+		s.pubsub.UnsubscribeAll(c)
+	}
+	s.handler.recordAs(by, audit.TokenRevoked, audit.Success, auth.Redact(t.Token), map[string]string{
+		"id":      strconv.FormatInt(t.ID, 10),
+		"tenant":  t.Tenant,
+		"reason":  reason,
+		"clients": strconv.Itoa(len(revoked)),
+	})
+}
+
+// recheckTokens runs until shutdown, revoking every token recheck interval
+// the tokens that the token store no longer accepts
+func (s *Server) recheckTokens() {
+	for {
+		var tick <-chan time.Time
+		if d := time.Duration(s.tokenRecheck.Load()); d > 0 {
+			tick = time.After(d)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-s.recheck:
+		case <-tick:
+			s.revokeRejected()
+		}
+	}
+}
+
+// revokeRejected revokes the tokens of this node's connections and
+// sessions that the token store no longer accepts, which catches tokens
+// deactivated, deleted or rotated out through another node or in the
+// store itself. Tokens are kept when the store cannot be read.
+func (s *Server) revokeRejected() {
+	s.mu.Lock()
+	tokens := make([]string, 0, len(s.tokens))
+	for token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	s.mu.Unlock()
+
+	for _, token := range tokens {
+		if auth.IsMasterToken(token) {
+			continue
+		}
+		_, err := s.auth.Store().Lookup(token)
+		switch {
+		case err == nil:
+		case errors.Is(err, auth.ErrNotFound):
+			s.revokeToken(audit.Event{}, auth.Token{Token: token}, "token no longer accepted")
+		default:
+			slog.Warn("token recheck failed", "error", err)
+			return
+		}
+	}
+}
+
+// authenticatedWith returns the connections and gateway sessions
+// authenticated with token
+func (s *Server) authenticatedWith(token string) []*client.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*client.Client
+	for _, set := range []map[*client.Client]struct{}{s.conns, s.sessions} {
+		for c := range set {
+			if c.AuthenticatedAs(token) {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// checkTenant validates a tenant before it is stored
+func checkTenant(t auth.Tenant) error {
+	switch {
+	case t.Name == "":
+		return fmt.Errorf("%w: tenant name is required", auth.ErrInvalid)
+	case reservedTenant(t.Name) || auth.IsTokenTenant(t.Name):
+		return fmt.Errorf("%w: tenant name is reserved", auth.ErrInvalid)
+	case t.MaxChannels < 0 || t.MaxSubscriptions < 0:
+		return fmt.Errorf("%w: limits must not be negative", auth.ErrInvalid)
+	}
+	return nil
+}
+
+// tenant handles TENANT CREATE|LIST|ACTIVATE|DEACTIVATE|LIMITS|DELETE.
+// Tenants are managed by the master token only:
+//
+//	TENANT CREATE <name> [MAXCHANNELS <n>] [MAXSUBSCRIPTIONS <n>]
+//	TENANT LIST
+//	TENANT ACTIVATE|DEACTIVATE|DELETE <name>
+//	TENANT LIMITS <name> [MAXCHANNELS <n>] [MAXSUBSCRIPTIONS <n>]
+func (h *Handler) tenant(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for TENANT"))
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	if !auth.IsMasterToken(c.Token) {
+		h.deny(c, "TENANT "+sub, "only master token can manage tenants")
+		return
+	}
+	s := h.server
+
+	switch sub {
+	case "CREATE":
+		if len(args) < 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for TENANT CREATE"))
+			return
+		}
+		t := auth.Tenant{Name: args[1], Active: true}
+		if !parseTenantLimits(c, &t, args[2:]) {
+			return
+		}
+		h.reply(c, s.CreateTenant(origin(c), t))
+
+	case "LIST":
+		tenants, err := s.Tenants()
+		if err != nil {
+			h.reply(c, err)
+			return
+		}
+		items := make([]string, len(tenants))
+		for i, t := range tenants {
+			items[i] = protocol.FormatArray(t.Name, activeState(t.Active),
+				strconv.Itoa(t.MaxChannels), strconv.Itoa(t.MaxSubscriptions))
+		}
+		c.Write(protocol.FormatRawArray(items))
+
+	case "ACTIVATE", "DEACTIVATE", "LIMITS":
+		if len(args) < 2 || sub != "LIMITS" && len(args) != 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for TENANT " + sub))
+			return
+		}
+		t, err := s.Tenant(args[1])
+		if err != nil {
+			h.reply(c, err)
+			return
+		}
+		if sub == "LIMITS" {
+			if !parseTenantLimits(c, &t, args[2:]) {
+				return
+			}
+		} else {
+			t.Active = sub == "ACTIVATE"
+		}
+		h.reply(c, s.UpdateTenant(origin(c), t))
+
+	case "DELETE":
+		if len(args) != 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for TENANT DELETE"))
+			return
+		}
+		h.reply(c, s.DeleteTenant(origin(c), args[1]))
+
+	default:
+		c.Write(protocol.FormatError("unknown TENANT subcommand '" + sub + "'"))
+	}
+}
+
+// token handles TOKEN CREATE|LIST|ACTIVATE|DEACTIVATE|ACL|ROTATE|DELETE.
+// Tokens are managed by the master token only and named by ID:
+//
+//	TOKEN CREATE <tenant> [PUBLISH <patterns>] [SUBSCRIBE <patterns>]
+//	TOKEN LIST <tenant>
+//	TOKEN ACTIVATE|DEACTIVATE|DELETE <id>
+//	TOKEN ACL <id> [PUBLISH <patterns>] [SUBSCRIBE <patterns>]
+//	TOKEN ROTATE <id> [<grace-seconds>]
+//
+// Patterns are comma separated; "*" allows every channel.
+func (h *Handler) token(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for TOKEN"))
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	if !auth.IsMasterToken(c.Token) {
+		h.deny(c, "TOKEN "+sub, "only master token can manage tokens")
+		return
+	}
+	s := h.server
+	if len(args) < 2 {
+		c.Write(protocol.FormatError("wrong number of arguments for TOKEN " + sub))
+		return
+	}
+
+	switch sub {
+	case "CREATE":
+		t := auth.Token{Tenant: args[1], Active: true}
+		if !parseACL(c, &t.ACL, args[2:]) {
+			return
+		}
+		t, err := s.CreateToken(origin(c), t)
+		if err != nil {
+			h.reply(c, err)
+			return
+		}
+		c.Write(protocol.FormatArray(strconv.FormatInt(t.ID, 10), t.Token))
+
+	case "LIST":
+		tokens, err := s.Tokens(args[1])
+		if err != nil {
+			h.reply(c, err)
+			return
+		}
+		items := make([]string, len(tokens))
+		for i, t := range tokens {
+			expires := ""
+			if !t.ExpiresAt.IsZero() {
+				expires = t.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			items[i] = protocol.FormatArray(strconv.FormatInt(t.ID, 10), auth.Redact(t.Token), activeState(t.Active),
+				strings.Join(t.ACL.Publish, ","), strings.Join(t.ACL.Subscribe, ","), expires)
+		}
+		c.Write(protocol.FormatRawArray(items))
+
+	case "ACTIVATE", "DEACTIVATE", "ACL", "DELETE", "ROTATE":
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			c.Write(protocol.FormatError("value is not an integer or out of range"))
+			return
+		}
+		switch sub {
+		case "DELETE":
+			if len(args) != 2 {
+				c.Write(protocol.FormatError("wrong number of arguments for TOKEN DELETE"))
+				return
+			}
+			h.reply(c, s.DeleteToken(origin(c), id))
+			return
+		case "ROTATE":
+			grace := DefaultRotationGrace
+			if len(args) > 3 {
+				c.Write(protocol.FormatError("wrong number of arguments for TOKEN ROTATE"))
+				return
+			}
+			if len(args) == 3 {
+				secs, err := strconv.Atoi(args[2])
+				if err != nil || secs < 0 {
+					c.Write(protocol.FormatError("grace period must be a non-negative number of seconds"))
+					return
+				}
+				grace = time.Duration(secs) * time.Second
+			}
+			t, err := s.RotateToken(origin(c), id, grace)
+			if err != nil {
+				h.reply(c, err)
+				return
+			}
+			c.Write(protocol.FormatArray(strconv.FormatInt(t.ID, 10), t.Token))
+			return
+		}
+
+		if sub != "ACL" && len(args) != 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for TOKEN " + sub))
+			return
+		}
+		t, err := s.Token(id)
+		if err != nil {
+			h.reply(c, err)
+			return
+		}
+		if sub == "ACL" {
+			if !parseACL(c, &t.ACL, args[2:]) {
+				return
+			}
+		} else {
+			t.Active = sub == "ACTIVATE"
+		}
+		h.reply(c, s.UpdateToken(origin(c), t))
+
+	default:
+		c.Write(protocol.FormatError("unknown TOKEN subcommand '" + sub + "'"))
+	}
+}
+
+// reply answers an administration command with +OK or the error
+func (h *Handler) reply(c *client.Client, err error) {
+	if err != nil {
+		if !errors.Is(err, auth.ErrNotFound) && !errors.Is(err, auth.ErrExists) && !errors.Is(err, auth.ErrInvalid) {
+			c.Logger().Error("administration command failed", "error", err)
+		}
+		c.Write(protocol.FormatError(err.Error()))
+		return
+	}
+	c.Write(protocol.FormatOK())
+}
+
+// parseTenantLimits reads MAXCHANNELS and MAXSUBSCRIPTIONS options into t,
+// replying with an error when they are malformed
+func parseTenantLimits(c *client.Client, t *auth.Tenant, args []string) bool {
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.Write(protocol.FormatError("syntax error"))
+			return false
+		}
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil || n < 0 {
+			c.Write(protocol.FormatError("limits must be non-negative integers"))
+			return false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MAXCHANNELS":
+			t.MaxChannels = n
+		case "MAXSUBSCRIPTIONS":
+			t.MaxSubscriptions = n
+		default:
+			c.Write(protocol.FormatError("syntax error"))
+			return false
+		}
+	}
+	return true
+}
+
+// parseACL reads PUBLISH and SUBSCRIBE options into acl, replying with an
+// error when they are malformed
+func parseACL(c *client.Client, acl *auth.ACL, args []string) bool {
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.Write(protocol.FormatError("syntax error"))
+			return false
+		}
+		var patterns []string
+		if args[i+1] != "*" {
+			patterns = strings.Split(args[i+1], ",")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "PUBLISH":
+			acl.Publish = patterns
+		case "SUBSCRIBE":
+			acl.Subscribe = patterns
+		default:
+			c.Write(protocol.FormatError("syntax error"))
+			return false
+		}
+	}
+	return true
+}
+
+func activeState(active bool) string {
+	if active {
+		return "active"
+	}
+	return "inactive"
+}
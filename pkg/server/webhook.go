@@ -0,0 +1,92 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/protocol"
+	"redix/pkg/webhook"
+)
+
+// webhook handles WEBHOOK ADD|DEL|LIST|STATS for the client's token
+func (h *Handler) webhook(c *client.Client, args []string) {
+	if len(args) == 0 {
+		c.Write(protocol.FormatError("wrong number of arguments for WEBHOOK"))
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ADD":
+		if len(args) != 4 {
+			c.Write(protocol.FormatError("wrong number of arguments for WEBHOOK ADD"))
+			return
+		}
+		// A webhook receives what a subscription to its pattern would
+		if err := h.server.ProtocolLimits().CheckChannel(args[1]); err != nil {
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		if !h.checkACL(c, "WEBHOOK ADD", false, args[1:2]) {
+			return
+		}
+		id, err := h.hooks.Add(webhook.Subscription{
+			Tenant:  c.Namespace(),
+			Pattern: args[1],
+			URL:     args[2],
+			Secret:  args[3],
+		})
+		if err != nil {
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		c.Write(protocol.FormatInteger(int(id)))
+
+	case "DEL":
+		if len(args) != 2 {
+			c.Write(protocol.FormatError("wrong number of arguments for WEBHOOK DEL"))
+			return
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			c.Write(protocol.FormatError("value is not an integer or out of range"))
+			return
+		}
+		removed, err := h.hooks.Remove(c.Namespace(), id)
+		if err != nil {
+			c.Write(protocol.FormatError(err.Error()))
+			return
+		}
+		if removed {
+			c.Write(protocol.FormatInteger(1))
+		} else {
+			c.Write(protocol.FormatInteger(0))
+		}
+
+	case "LIST":
+		subs := h.hooks.List(c.Namespace())
+		items := make([]string, len(subs))
+		for i, sub := range subs {
+			items[i] = protocol.FormatArray(strconv.FormatInt(sub.ID, 10), sub.Pattern, sub.URL)
+		}
+		c.Write(protocol.FormatRawArray(items))
+
+	case "STATS":
+		if !auth.IsMasterToken(c.Token) {
+			h.deny(c, "WEBHOOK STATS", "only master token can read webhook stats")
+			return
+		}
+		st := h.hooks.Stats()
+		c.Write(protocol.FormatArray(
+			"delivered", strconv.FormatInt(st.Delivered, 10),
+			"failed", strconv.FormatInt(st.Failed, 10),
+			"retried", strconv.FormatInt(st.Retried, 10),
+			"dead_lettered", strconv.FormatInt(st.DeadLettered, 10),
+			"dropped", strconv.FormatInt(st.Dropped, 10),
+		))
+
+	default:
+		c.Write(protocol.FormatError("unknown WEBHOOK subcommand"))
+	}
+}
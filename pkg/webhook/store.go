@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Subscription is a tenant's request to receive messages published on
+// channels matching Pattern as HTTP POSTs to URL
+type Subscription struct {
+	ID      int64
+	Tenant  string
+	Pattern string
+	URL     string
+	Secret  string
+}
+
+// DeadLetter records a delivery that was abandoned after MaxAttempts
+type DeadLetter struct {
+	WebhookID int64
+	MessageID uint64
+	Channel   string
+	Payload   string
+	Attempts  int
+	LastError string
+	FailedAt  time.Time
+}
+
+// Store persists webhook subscriptions and dead letters next to the tokens
+// in the SQL token store
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new webhook store
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Add stores a subscription and returns its ID
+func (s *Store) Add(sub Subscription) (int64, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO webhooks (token, pattern, url, secret) VALUES (?, ?, ?, ?)",
+		sub.Tenant, sub.Pattern, sub.URL, sub.Secret)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Remove deletes a subscription owned by tenant
+func (s *Store) Remove(tenant string, id int64) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM webhooks WHERE id = ? AND token = ?", id, tenant)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// All returns every stored subscription
+func (s *Store) All() ([]Subscription, error) {
+	rows, err := s.db.Query("SELECT id, token, pattern, url, secret FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(&sub.ID, &sub.Tenant, &sub.Pattern, &sub.URL, &sub.Secret); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// RecordDeadLetter stores a delivery that exhausted its attempts
+func (s *Store) RecordDeadLetter(dl DeadLetter) error {
+	_, err := s.db.Exec(
+		`INSERT INTO webhook_dead_letters
+			(webhook_id, message_id, channel, payload, attempts, last_error, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		dl.WebhookID, dl.MessageID, dl.Channel, dl.Payload, dl.Attempts, dl.LastError, dl.FailedAt)
+	return err
+}
+
+// DeadLetters returns the dead letters recorded for a webhook
+func (s *Store) DeadLetters(webhookID int64) ([]DeadLetter, error) {
+	rows, err := s.db.Query(
+		`SELECT webhook_id, message_id, channel, payload, attempts, last_error, failed_at
+		FROM webhook_dead_letters WHERE webhook_id = ? ORDER BY id`, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DeadLetter
+	for rows.Next() {
+		var dl DeadLetter
+		if err := rows.Scan(&dl.WebhookID, &dl.MessageID, &dl.Channel, &dl.Payload,
+			&dl.Attempts, &dl.LastError, &dl.FailedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, dl)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,556 @@
+package webhook
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/glob"
+)
+
+const (
+	// SignatureHeader carries "sha256=<hex HMAC>" of "<timestamp>.<body>"
+	// keyed with the subscription secret
+	SignatureHeader = "X-Redix-Signature"
+	// TimestampHeader carries the Unix time the delivery was signed at
+	TimestampHeader = "X-Redix-Timestamp"
+	// DeliveryHeader carries the ID of the published message
+	DeliveryHeader = "X-Redix-Delivery"
+	// AttemptHeader carries the 1-based attempt number
+	AttemptHeader = "X-Redix-Attempt"
+)
+
+// ErrForbiddenAddress is returned for a webhook URL that resolves to a
+// loopback, link-local, private or unspecified address outside the allowed
+// networks
+var ErrForbiddenAddress = errors.New("url must not point to a loopback, link-local or private address")
+
+// Options configures a Dispatcher
+type Options struct {
+	// Concurrency is the number of deliveries in flight at once
+	Concurrency int
+	// QueueSize bounds the deliveries waiting for a worker, where further
+	// deliveries are dropped, and separately those waiting for a retry,
+	// where further failures are dead-lettered right away
+	QueueSize int
+	// MaxAttempts is the number of attempts before a delivery is dead-lettered
+	MaxAttempts int
+	// BaseDelay and MaxDelay bound the exponential retry backoff
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds a single delivery attempt
+	Timeout time.Duration
+	// Client sends the requests. When nil, a client that refuses to
+	// connect to forbidden addresses is used.
+	Client *http.Client
+	// AllowedNetworks are loopback, link-local or private networks that
+	// webhooks may point to anyway
+	AllowedNetworks []netip.Prefix
+}
+
+// DefaultOptions returns the options used by the server
+func DefaultOptions() Options {
+	return Options{
+		Concurrency: 8,
+		QueueSize:   1024,
+		MaxAttempts: 6,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    time.Minute,
+		Timeout:     10 * time.Second,
+	}
+}
+
+// Stats counts webhook deliveries
+type Stats struct {
+	Delivered    int64
+	Failed       int64
+	Retried      int64
+	DeadLettered int64
+	Dropped      int64
+}
+
+// Payload is the JSON body POSTed to a webhook
+type Payload struct {
+	ID        uint64 `json:"id"`
+	Channel   string `json:"channel"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// delivery is one message on its way to one subscription
+type delivery struct {
+	sub     Subscription
+	msg     client.Message
+	attempt int
+}
+
+// retry is a delivery waiting for its next attempt
+type retry struct {
+	at time.Time
+	dl delivery
+}
+
+// retryQueue orders retries by time, earliest first
+type retryQueue []retry
+
+func (q retryQueue) Len() int           { return len(q) }
+func (q retryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q retryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *retryQueue) Push(x any)        { *q = append(*q, x.(retry)) }
+func (q *retryQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+// Dispatcher delivers published messages to matching webhook subscriptions
+type Dispatcher struct {
+	store *Store
+	opts  Options
+
+	mu      sync.RWMutex
+	subs    map[string][]Subscription
+	allowed []netip.Prefix
+
+	queue   chan delivery
+	retryMu sync.Mutex
+	retries retryQueue
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	delivered    atomic.Int64
+	failed       atomic.Int64
+	retried      atomic.Int64
+	deadLettered atomic.Int64
+	dropped      atomic.Int64
+}
+
+// NewDispatcher creates a dispatcher and starts its workers and retry
+// scheduler
+func NewDispatcher(store *Store, opts Options) *Dispatcher {
+	defaults := DefaultOptions()
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaults.Concurrency
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaults.QueueSize
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaults.MaxAttempts
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = defaults.BaseDelay
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = defaults.MaxDelay
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		store:   store,
+		opts:    opts,
+		subs:    make(map[string][]Subscription),
+		allowed: opts.AllowedNetworks,
+		queue:   make(chan delivery, opts.QueueSize),
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if d.opts.Client == nil {
+		// Checking the address dialed, not only the URL added, also stops
+		// host names that resolve to another address later. A proxy would
+		// be the only address checked, so none is used.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: d.checkDial}).DialContext
+		d.opts.Client = &http.Client{Transport: transport}
+	}
+	for i := 0; i < opts.Concurrency; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	d.wg.Add(1)
+	go d.scheduler()
+	return d
+}
+
+// SetAllowedNetworks replaces the loopback, link-local or private networks
+// that webhooks may point to. It applies to new webhooks and deliveries.
+func (d *Dispatcher) SetAllowedNetworks(networks []netip.Prefix) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.allowed = networks
+}
+
+// permitted reports whether webhooks may reach addr
+func (d *Dispatcher) permitted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsPrivate() && !addr.IsUnspecified() {
+		return true
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, network := range d.allowed {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURL validates the URL of a new webhook: an absolute http or https
+// URL whose host resolves only to permitted addresses
+func (d *Dispatcher) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !d.permitted(addr) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, d.opts.Timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("url host does not resolve: %w", err)
+	}
+	for _, addr := range addrs {
+		if !d.permitted(addr) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// checkDial refuses connections to forbidden addresses
+func (d *Dispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !d.permitted(addrPort.Addr()) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Load replaces the in-memory subscriptions with those in the store
+func (d *Dispatcher) Load() error {
+	all, err := d.store.All()
+	if err != nil {
+		return err
+	}
+
+	subs := make(map[string][]Subscription)
+	for _, sub := range all {
+		subs[sub.Tenant] = append(subs[sub.Tenant], sub)
+	}
+
+	d.mu.Lock()
+	d.subs = subs
+	d.mu.Unlock()
+	return nil
+}
+
+// Add stores a new subscription and starts delivering to it
+func (d *Dispatcher) Add(sub Subscription) (int64, error) {
+	if sub.Pattern == "" {
+		return 0, errors.New("pattern is required")
+	}
+	if err := d.checkURL(sub.URL); err != nil {
+		return 0, err
+	}
+	id, err := d.store.Add(sub)
+	if err != nil {
+		return 0, err
+	}
+	sub.ID = id
+
+	d.mu.Lock()
+	d.subs[sub.Tenant] = append(d.subs[sub.Tenant], sub)
+	d.mu.Unlock()
+	return id, nil
+}
+
+// Remove deletes a subscription owned by tenant
+func (d *Dispatcher) Remove(tenant string, id int64) (bool, error) {
+	removed, err := d.store.Remove(tenant, id)
+	if err != nil || !removed {
+		return removed, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := d.subs[tenant]
+	for i, sub := range subs {
+		if sub.ID == id {
+			d.subs[tenant] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	return true, nil
+}
+
+// List returns the subscriptions owned by tenant
+func (d *Dispatcher) List(tenant string) []Subscription {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]Subscription(nil), d.subs[tenant]...)
+}
+
+// Notify queues a published message for every subscription that should
+// see it: those of the publishing tenant, or all of them for a broadcast
+func (d *Dispatcher) Notify(publisher string, msg client.Message) {
+	d.mu.RLock()
+	var matched []Subscription
+	for tenant, subs := range d.subs {
+		if !auth.IsBroadcast(publisher) && tenant != publisher {
+			continue
+		}
+		for _, sub := range subs {
+			if glob.Match(sub.Pattern, msg.Topic) {
+				matched = append(matched, sub)
+			}
+		}
+	}
+	d.mu.RUnlock()
+
+	for _, sub := range matched {
+		d.enqueue(delivery{sub: sub, msg: msg, attempt: 1})
+	}
+}
+
+// Stats returns the delivery counters
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Delivered:    d.delivered.Load(),
+		Failed:       d.failed.Load(),
+		Retried:      d.retried.Load(),
+		DeadLettered: d.deadLettered.Load(),
+		Dropped:      d.dropped.Load(),
+	}
+}
+
+// Close stops the workers and the retry scheduler; queued and scheduled
+// retries are abandoned
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) enqueue(dl delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case dl := <-d.queue:
+			d.attempt(dl)
+		}
+	}
+}
+
+// attempt performs one delivery attempt and schedules a retry or records a
+// dead letter on failure
+func (d *Dispatcher) attempt(dl delivery) {
+	err := d.post(dl)
+	if err == nil {
+		d.delivered.Add(1)
+		return
+	}
+	d.failed.Add(1)
+
+	if dl.attempt >= d.opts.MaxAttempts {
+		d.deadLetter(dl, err)
+		return
+	}
+	next := dl
+	next.attempt++
+	if !d.schedule(next, time.Now().Add(d.backoff(dl.attempt))) {
+		d.deadLetter(dl, fmt.Errorf("%w; retry queue full", err))
+		return
+	}
+	d.retried.Add(1)
+}
+
+// deadLetter records a delivery that will not be attempted again
+func (d *Dispatcher) deadLetter(dl delivery, err error) {
+	d.deadLettered.Add(1)
+	if err := d.store.RecordDeadLetter(DeadLetter{
+		WebhookID: dl.sub.ID,
+		MessageID: dl.msg.ID,
+		Channel:   dl.msg.Topic,
+		Payload:   dl.msg.Payload,
+		Attempts:  dl.attempt,
+		LastError: err.Error(),
+		FailedAt:  time.Now().UTC(),
+	}); err != nil {
+		slog.Error("webhook dead letter not recorded", "webhook_id", dl.sub.ID, "message_id", dl.msg.ID, "error", err)
+	}
+}
+
+// schedule queues a retry for at, unless QueueSize retries are waiting
+func (d *Dispatcher) schedule(dl delivery, at time.Time) bool {
+	d.retryMu.Lock()
+	if len(d.retries) >= d.opts.QueueSize {
+		d.retryMu.Unlock()
+		return false
+	}
+	heap.Push(&d.retries, retry{at: at, dl: dl})
+	d.retryMu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// scheduler hands retries to the workers when they are due, waiting for
+// a worker rather than dropping them
+func (d *Dispatcher) scheduler() {
+	defer d.wg.Done()
+	for {
+		d.retryMu.Lock()
+		var (
+			due  []delivery
+			wait <-chan time.Time
+		)
+		now := time.Now()
+		for len(d.retries) > 0 && !d.retries[0].at.After(now) {
+			due = append(due, heap.Pop(&d.retries).(retry).dl)
+		}
+		var timer *time.Timer
+		if len(due) == 0 && len(d.retries) > 0 {
+			timer = time.NewTimer(d.retries[0].at.Sub(now))
+			wait = timer.C
+		}
+		d.retryMu.Unlock()
+
+		for _, dl := range due {
+			select {
+			case d.queue <- dl:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		select {
+		case <-d.ctx.Done():
+		case <-d.wake:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if d.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// backoff returns the delay before the attempt following the given one:
+// exponential in the attempt number, capped at MaxDelay, with full jitter
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.opts.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		if exp := d.opts.BaseDelay << shift; exp > 0 && exp < delay {
+			delay = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func (d *Dispatcher) post(dl delivery) error {
+	now := time.Now().Unix()
+	body, err := json.Marshal(Payload{
+		ID:        dl.msg.ID,
+		Channel:   dl.msg.Topic,
+		Message:   dl.msg.Payload,
+		Timestamp: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "redix-webhook")
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, Sign(dl.sub.Secret, ts, body))
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(dl.msg.ID, 10))
+	req.Header.Set(AttemptHeader, strconv.Itoa(dl.attempt))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for a delivery body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is valid for the body and timestamp
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
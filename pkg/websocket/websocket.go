@@ -0,0 +1,457 @@
+// Package websocket implements the subset of RFC 6455 needed by the Redix
+// gateway on top of the standard library: the opening handshake, framing
+// with masking and fragmentation, ping/pong and the close handshake.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcodes defined by RFC 6455 section 5.2
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close status codes defined by RFC 6455 section 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+)
+
+// acceptGUID is the magic value appended to the client key in the handshake
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize bounds the size of a reassembled message
+const DefaultMaxMessageSize = 1 << 20
+
+// closeTimeout bounds how long Close waits for the peer's close frame
+const closeTimeout = 5 * time.Second
+
+// CloseError is returned by ReadMessage when the peer sends a close frame
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isClient bool
+
+	// MaxMessageSize bounds the size of a reassembled message
+	MaxMessageSize int64
+	// WriteTimeout bounds each frame write; a peer that does not accept a
+	// frame in time is disconnected (0 disables the deadline)
+	WriteTimeout time.Duration
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isClient bool) *Conn {
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		isClient:       isClient,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// IsUpgrade reports whether r asks to be upgraded to the WebSocket protocol
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade performs the server side of the opening handshake and takes over
+// the underlying connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method not GET")
+	}
+	if !IsUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newConn(conn, rw.Reader, false), nil
+}
+
+// Dial performs the client side of the opening handshake against a ws:// URL
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", req.URL.Scheme)
+	}
+	req.URL.Scheme = "http"
+
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: handshake failed with status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket: invalid Sec-WebSocket-Accept")
+	}
+
+	return newConn(conn, br, true), nil
+}
+
+// NetConn returns the underlying network connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SetReadDeadline sets the deadline for reading the next frame
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage reads the next text or binary message, reassembling
+// fragments. Pings are answered and pongs are skipped transparently; a
+// close frame is answered and returned as a *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		op  int
+		msg []byte
+	)
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOp {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(payload)
+		case OpText, OpBinary:
+			if op != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			op = frameOp
+		case OpContinuation:
+			if op == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(msg)+len(payload)) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			if op == OpText && !utf8.Valid(msg) {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8")
+			}
+			return op, msg, nil
+		}
+	}
+}
+
+// WriteMessage writes a single unfragmented message
+func (c *Conn) WriteMessage(op int, data []byte) error {
+	return c.writeFrame(op, data)
+}
+
+// WriteText writes a text message
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(OpText, data)
+}
+
+// Ping sends a ping control frame
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(OpPing, data)
+}
+
+// Close starts the close handshake. The caller's read loop receives the
+// peer's close frame as a *CloseError; if it does not arrive within the
+// close timeout the read fails and the connection should be dropped.
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.writeClose(code, reason); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
+
+// Closing reports whether a close frame has been sent
+func (c *Conn) Closing() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.closeSent
+}
+
+// CloseNow closes the underlying connection without a handshake
+func (c *Conn) CloseNow() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		c.fail(CloseProtocolError, "invalid close payload")
+		return ce
+	}
+	if len(payload) >= 2 {
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+	}
+	code := ce.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	c.writeClose(code, "")
+	return ce
+}
+
+// fail sends a close frame for a protocol violation and returns an error
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	c.wmu.Lock()
+	if c.closeSent {
+		c.wmu.Unlock()
+		return nil
+	}
+	c.closeSent = true
+	c.wmu.Unlock()
+
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return c.writeFrameLocked(OpClose, payload, true)
+}
+
+func (c *Conn) writeFrame(op int, payload []byte) error {
+	return c.writeFrameLocked(op, payload, false)
+}
+
+// writeFrameLocked writes one frame under the write lock. Frames other than
+// the close frame itself are refused once a close frame has been sent.
+func (c *Conn) writeFrameLocked(op int, payload []byte, closing bool) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent && !closing {
+		return errors.New("websocket: close sent")
+	}
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | byte(op)
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	if c.isClient {
+		header[1] |= 0x80
+		var mask [4]byte
+		rand.Read(mask[:])
+		header = append(header, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+
+	if c.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// A partial frame may have been written, so the connection
+			// cannot be used any more
+			c.conn.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	op = int(head[0] & 0x0F)
+	if head[0]&0x70 != 0 {
+		err = c.fail(CloseProtocolError, "reserved bits set")
+		return
+	}
+
+	masked := head[1]&0x80 != 0
+	if masked == c.isClient {
+		err = c.fail(CloseProtocolError, "invalid frame masking")
+		return
+	}
+
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if op >= OpClose && (!fin || length > 125) {
+		err = c.fail(CloseProtocolError, "invalid control frame")
+		return
+	}
+	if length < 0 || length > c.MaxMessageSize {
+		err = c.fail(CloseMessageTooBig, "message too big")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
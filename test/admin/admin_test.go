@@ -0,0 +1,240 @@
+package admin_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/admin"
+	"redix/pkg/audit"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// mockProbe is a mock implementation of admin.Probe for testing
+type mockProbe struct {
+	healthy  bool
+	readyErr error
+}
+
+func (m *mockProbe) Healthy() bool                   { return m.healthy }
+func (m *mockProbe) Ready(ctx context.Context) error { return m.readyErr }
+
+func TestProbeEndpoints(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe *mockProbe
+		path  string
+		want  int
+	}{
+		{
+			name:  "healthy",
+			probe: &mockProbe{healthy: true},
+			path:  "/healthz",
+			want:  http.StatusOK,
+		},
+		{
+			name:  "not accepting",
+			probe: &mockProbe{healthy: false},
+			path:  "/healthz",
+			want:  http.StatusServiceUnavailable,
+		},
+		{
+			name:  "ready",
+			probe: &mockProbe{healthy: true},
+			path:  "/readyz",
+			want:  http.StatusOK,
+		},
+		{
+			name:  "not ready",
+			probe: &mockProbe{healthy: true, readyErr: errors.New("shutting down")},
+			path:  "/readyz",
+			want:  http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			admin.New(tt.probe).Handler().ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadinessFailsOnDrain(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := server.New(db)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	for !srv.Healthy() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	h := admin.New(srv).Handler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /readyz before drain = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	srv.Drain()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz after drain = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz after drain = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestTenantEndpoints(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE tenants (name TEXT PRIMARY KEY, is_active INTEGER NOT NULL DEFAULT 1,
+		max_channels INTEGER NOT NULL DEFAULT 0, max_subscriptions INTEGER NOT NULL DEFAULT 0)`)
+	db.Exec(`CREATE TABLE clients (id INTEGER PRIMARY KEY, token TEXT UNIQUE, tenant TEXT, is_active INTEGER,
+		publish_acl TEXT, subscribe_acl TEXT, expires_at DATETIME)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('MASTER_TOKEN', 1), ('token1', 1)")
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(auditPath, audit.Options{})
+	if err != nil {
+		t.Fatalf("audit.Open() error = %v", err)
+	}
+	defer auditLog.Close()
+
+	srv := server.New(db)
+	a := admin.New(srv)
+	a.SetTenants(srv, srv.Auth(), time.Hour)
+	a.SetAudit(auditLog)
+	h := a.Handler()
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/v1/admin/tenants", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /v1/admin/tenants without a token = %d", rec.Code)
+	}
+	if rec := do("GET", "/v1/admin/tenants", "nope", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /v1/admin/tenants with an unknown token = %d", rec.Code)
+	}
+	if rec := do("GET", "/v1/admin/tenants", "token1", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("GET /v1/admin/tenants with a tenant token = %d", rec.Code)
+	}
+	logged, _ := os.ReadFile(auditPath)
+	for _, want := range []string{`"type":"auth.failure"`, `"type":"acl.denied"`, `"path":"/v1/admin/tenants"`} {
+		if !strings.Contains(string(logged), want) {
+			t.Errorf("audit log has no %s for the rejected requests:\n%s", want, logged)
+		}
+	}
+
+	const master = "MASTER_TOKEN"
+	if rec := do("POST", "/v1/admin/tenants", master, `{"name":"acme","max_channels":5}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /v1/admin/tenants = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/v1/admin/tenants", master, `{"name":"acme"}`); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate POST /v1/admin/tenants = %d", rec.Code)
+	}
+	if rec := do("PATCH", "/v1/admin/tenants/acme", master, `{"max_subscriptions":10}`); rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), `"max_channels":5,"max_subscriptions":10`) {
+		t.Errorf("PATCH /v1/admin/tenants/acme = %d %s", rec.Code, rec.Body)
+	}
+	if got := srv.PubSub().TenantLimits("acme").MaxSubscriptions; got != 10 {
+		t.Errorf("acme MaxSubscriptions = %d, want 10", got)
+	}
+
+	rec := do("POST", "/v1/admin/tenants/acme/tokens", master, `{"publish":["news.*"]}`)
+	var created struct {
+		ID    int64  `json:"id"`
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &created) != nil || created.Token == "" {
+		t.Fatalf("POST /v1/admin/tenants/acme/tokens = %d %s", rec.Code, rec.Body)
+	}
+	if tok, ok := srv.Auth().Lookup(created.Token); !ok || tok.Tenant != "acme" || !tok.ACL.CanPublish("news.eu") || tok.ACL.CanPublish("billing") {
+		t.Errorf("Lookup(created token) = %+v, %v", tok, ok)
+	}
+	if rec := do("POST", "/v1/admin/tenants/nobody/tokens", master, `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("POST a token for a missing tenant = %d", rec.Code)
+	}
+	for _, token := range []string{"*", "MASTER_TOKEN"} {
+		if rec := do("POST", "/v1/admin/tenants/acme/tokens", master, `{"token":"`+token+`"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST the reserved token %s = %d", token, rec.Code)
+		}
+	}
+
+	tokenPath := "/v1/admin/tokens/" + strconv.FormatInt(created.ID, 10)
+	rec = do("POST", tokenPath+"/rotate", master, `{"grace_seconds":60}`)
+	var rotated struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &rotated) != nil || rotated.Token == created.Token {
+		t.Fatalf("POST %s/rotate = %d %s", tokenPath, rec.Code, rec.Body)
+	}
+	for _, token := range []string{created.Token, rotated.Token} {
+		if _, ok := srv.Auth().Lookup(token); !ok {
+			t.Errorf("token %s rejected during the grace period", token)
+		}
+	}
+	if rec := do("GET", tokenPath, master, ""); !strings.Contains(rec.Body.String(), "expires_at") || strings.Contains(rec.Body.String(), created.Token) {
+		t.Errorf("GET %s = %s, want a redacted expiring token", tokenPath, rec.Body)
+	}
+
+	if rec := do("PATCH", tokenPath, master, `{"active":false}`); rec.Code != http.StatusOK {
+		t.Errorf("PATCH %s = %d", tokenPath, rec.Code)
+	}
+	if _, ok := srv.Auth().Lookup(created.Token); ok {
+		t.Error("deactivated token still accepted")
+	}
+	if rec := do("DELETE", "/v1/admin/tenants/acme", master, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE /v1/admin/tenants/acme = %d", rec.Code)
+	}
+	if _, ok := srv.Auth().Lookup(rotated.Token); ok {
+		t.Error("token of a deleted tenant still accepted")
+	}
+	if rec := do("GET", "/v1/admin/tenants/acme", master, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET a deleted tenant = %d", rec.Code)
+	}
+}
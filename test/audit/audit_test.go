@@ -0,0 +1,306 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openLog(t *testing.T, path string, opts audit.Options) *audit.Log {
+	t.Helper()
+	l, err := audit.Open(path, opts)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// verifyFiles checks the chain across files, oldest first
+func verifyFiles(t *testing.T, paths ...string) error {
+	t.Helper()
+	prev := audit.GenesisHash
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if prev, err = audit.Verify(bytes.NewReader(data), prev, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readEvents(t *testing.T, path string) []audit.Event {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var out []audit.Event
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid record %q: %v", sc.Text(), err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path, audit.Options{})
+	for i := 0; i < 5; i++ {
+		l.Record(audit.Event{Type: audit.AuthFailure, Outcome: audit.Failure, RemoteAddr: "10.0.0.1:5000"})
+	}
+	l.Close()
+
+	// Reopening resumes the chain
+	l = openLog(t, path, audit.Options{})
+	l.Record(audit.Event{Type: audit.ConfigChange, Outcome: audit.Success})
+	l.Close()
+
+	events := readEvents(t, path)
+	if len(events) != 6 || events[5].Seq != 6 || events[0].PrevHash != audit.GenesisHash {
+		t.Fatalf("events = %+v", events)
+	}
+	if err := verifyFiles(t, path); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+	}{
+		{"edited", func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], "10.0.0.1", "10.0.0.2", 1)
+			return lines
+		}},
+		{"deleted", func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			tampered := strings.Join(tt.tamper(lines), "\n")
+			if _, err := audit.Verify(strings.NewReader(tampered), audit.GenesisHash, nil); !errors.Is(err, audit.ErrChainBroken) {
+				t.Errorf("Verify() error = %v, want ErrChainBroken", err)
+			}
+		})
+	}
+}
+
+func TestKeyedChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("audit-secret")
+	l := openLog(t, path, audit.Options{Key: key})
+	for i := 0; i < 3; i++ {
+		l.Record(audit.Event{Type: audit.AuthFailure, Outcome: audit.Failure, RemoteAddr: "10.0.0.1:5000"})
+	}
+	l.Close()
+	if err := audit.VerifyLog(path, key); err != nil {
+		t.Fatalf("VerifyLog() error = %v", err)
+	}
+	if err := audit.VerifyLog(path, []byte("other")); !errors.Is(err, audit.ErrChainBroken) {
+		t.Errorf("VerifyLog() with another key error = %v, want ErrChainBroken", err)
+	}
+
+	// Rewriting the chain without the key does not verify
+	events := readEvents(t, path)
+	var b strings.Builder
+	prev := audit.GenesisHash
+	for _, e := range events {
+		e.RemoteAddr = "10.0.0.2:5000"
+		e.PrevHash, e.Hash = prev, ""
+		data, _ := json.Marshal(e)
+		sum := sha256.Sum256(data)
+		e.Hash = hex.EncodeToString(sum[:])
+		prev = e.Hash
+		line, _ := json.Marshal(e)
+		b.Write(append(line, '\n'))
+	}
+	if _, err := audit.Verify(strings.NewReader(b.String()), audit.GenesisHash, key); !errors.Is(err, audit.ErrChainBroken) {
+		t.Errorf("Verify() of a rewritten chain error = %v, want ErrChainBroken", err)
+	}
+}
+
+func TestHeadAnchor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path, audit.Options{})
+	for i := 0; i < 4; i++ {
+		l.Record(audit.Event{Type: audit.ConfigChange, Outcome: audit.Success})
+	}
+	l.Close()
+	if head, err := audit.ReadHead(path); err != nil || head.Seq != 4 {
+		t.Fatalf("ReadHead() = %+v, %v, want seq 4", head, err)
+	}
+	if err := audit.VerifyLog(path, nil); err != nil {
+		t.Fatalf("VerifyLog() error = %v", err)
+	}
+
+	// Removing the last records leaves a valid chain that ends early
+	data, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+	os.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0o600)
+	if err := audit.VerifyLog(path, nil); !errors.Is(err, audit.ErrChainBroken) {
+		t.Errorf("VerifyLog() of a truncated log error = %v, want ErrChainBroken", err)
+	}
+	if _, err := audit.Open(path, audit.Options{}); !errors.Is(err, audit.ErrChainBroken) {
+		t.Errorf("Open() of a truncated log error = %v, want ErrChainBroken", err)
+	}
+
+	// So does removing the anchor
+	os.Remove(audit.HeadPath(path))
+	if err := audit.VerifyLog(path, nil); !errors.Is(err, audit.ErrChainBroken) {
+		t.Errorf("VerifyLog() without a head error = %v, want ErrChainBroken", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path, audit.Options{MaxSize: 1024, MaxFiles: 2})
+	for i := 0; i < 30; i++ {
+		l.Record(audit.Event{Type: audit.AuthSuccess, Outcome: audit.Success, Tenant: "tena****"})
+	}
+	l.Close()
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than MaxFiles rotated files kept")
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", p, err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, want at most 1024", p, info.Size())
+		}
+	}
+
+	// The chain continues from the newest rotated file into the current one
+	oldest := readEvents(t, path+".2")
+	prev := oldest[0].PrevHash
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		data, _ := os.ReadFile(p)
+		var err error
+		if prev, err = audit.Verify(bytes.NewReader(data), prev, nil); err != nil {
+			t.Fatalf("Verify(%s) error = %v", p, err)
+		}
+	}
+	current := readEvents(t, path)
+	if last := current[len(current)-1]; last.Seq != 30 {
+		t.Errorf("last seq = %d, want 30", last.Seq)
+	}
+	if err := audit.VerifyLog(path, nil); err != nil {
+		t.Errorf("VerifyLog() error = %v", err)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('token1', 1), (?, 1)", auth.MasterToken)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	srv := server.New(db)
+	srv.SetAudit(openLog(t, path, audit.Options{}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	addr := ln.Addr().String()
+	redixclient.Dial(addr, "wrong-token", nil)
+	tenant, err := redixclient.Dial(addr, "token1", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer tenant.Close()
+	master, err := redixclient.Dial(addr, auth.MasterToken, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer master.Close()
+
+	if _, err := tenant.Do(ctx, "DISCONNECT", "token2"); err == nil {
+		t.Error("DISCONNECT with a tenant token succeeded")
+	}
+	id, err := tenant.Do(ctx, "CLIENT", "ID")
+	if err != nil {
+		t.Fatalf("CLIENT ID error = %v", err)
+	}
+	killed, err := master.Do(ctx, "CLIENT", "KILL", "ID", id.String())
+	if err != nil || killed.Int != 1 {
+		t.Fatalf("CLIENT KILL = %+v, %v", killed, err)
+	}
+
+	want := []struct{ typ, outcome string }{
+		{audit.AuthFailure, audit.Failure},
+		{audit.AuthSuccess, audit.Success},
+		{audit.AuthSuccess, audit.Success},
+		{audit.ACLDenied, audit.Denied},
+		{audit.AdminClientKill, audit.Success},
+	}
+	var events []audit.Event
+	deadline := time.Now().Add(2 * time.Second)
+	for len(events) < len(want) && time.Now().Before(deadline) {
+		events = readEvents(t, path)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Type != w.typ || events[i].Outcome != w.outcome {
+			t.Errorf("event %d = %s/%s, want %s/%s", i, events[i].Type, events[i].Outcome, w.typ, w.outcome)
+		}
+		if !strings.HasPrefix(events[i].RemoteAddr, "127.0.0.1:") {
+			t.Errorf("event %d remote addr = %q", i, events[i].RemoteAddr)
+		}
+	}
+	if events[0].Target != "wron****" || strings.Contains(events[0].Target, "wrong-token") {
+		t.Errorf("auth failure target = %q, want redacted token", events[0].Target)
+	}
+	if events[3].Tenant != "toke****" || events[3].Details["command"] != "DISCONNECT" {
+		t.Errorf("denial = %+v", events[3])
+	}
+	if err := verifyFiles(t, path); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
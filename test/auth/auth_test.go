@@ -2,7 +2,9 @@ package auth_test
 
 import (
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"redix/pkg/auth"
 
@@ -100,6 +102,138 @@ func TestIsValidToken(t *testing.T) {
 	}
 }
 
+func TestLookup(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE clients (
+			token TEXT PRIMARY KEY,
+			tenant TEXT,
+			is_active INTEGER
+		);
+		INSERT INTO clients VALUES ('token1', 'acme', 1), ('token2', 'acme', 1), ('token3', NULL, 1), ('token4', 'acme', 0);
+		INSERT INTO clients VALUES ('MASTER_TOKEN', NULL, 1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+
+	validator := auth.NewValidator(db)
+	tests := []struct {
+		token  string
+		tenant string
+		ok     bool
+	}{
+		{"token1", "acme", true},
+		{"token2", "acme", true},
+		{"token3", "token:token3", true},
+		{"token4", "", false},
+		{"missing", "", false},
+		{auth.MasterToken, auth.MasterTenant, true},
+	}
+	for _, tt := range tests {
+		tok, ok := validator.Lookup(tt.token)
+		if tenant := tok.Tenant; tenant != tt.tenant || ok != tt.ok {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.token, tenant, ok, tt.tenant, tt.ok)
+		}
+	}
+}
+
+func TestLookupWithoutTenantColumn(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER);
+		INSERT INTO clients VALUES ('token1', 1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+
+	validator := auth.NewValidator(db)
+	for i := 0; i < 2; i++ {
+		if tok, ok := validator.Lookup("token1"); tok.Tenant != "token:token1" || !ok {
+			t.Errorf("Lookup() = %q, %v, want token:token1, true", tok.Tenant, ok)
+		}
+		if _, ok := validator.Lookup("missing"); ok {
+			t.Error("Lookup() of a missing token succeeded")
+		}
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE tenants (name TEXT PRIMARY KEY, is_active INTEGER NOT NULL DEFAULT 1,
+			max_channels INTEGER NOT NULL DEFAULT 0, max_subscriptions INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE clients (id INTEGER PRIMARY KEY, token TEXT UNIQUE, tenant TEXT, is_active INTEGER,
+			publish_acl TEXT, subscribe_acl TEXT, expires_at DATETIME);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test tables: %v", err)
+	}
+
+	store := auth.NewSQLStore(db)
+	if err := store.CreateTenant(auth.Tenant{Name: "acme", Active: true, MaxChannels: 3}); err != nil {
+		t.Fatalf("CreateTenant() error = %v", err)
+	}
+	if err := store.CreateTenant(auth.Tenant{Name: "acme"}); !errors.Is(err, auth.ErrExists) {
+		t.Errorf("duplicate CreateTenant() error = %v, want ErrExists", err)
+	}
+
+	acl := auth.ACL{Publish: []string{"news.*"}}
+	id, err := store.CreateToken(auth.Token{Token: "t1", Tenant: "acme", Active: true, ACL: acl})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	tok, err := store.Lookup("t1")
+	if err != nil || tok.ID != id || tok.Tenant != "acme" || !tok.ACL.CanPublish("news.eu") || tok.ACL.CanPublish("billing") || !tok.ACL.CanSubscribe("billing") {
+		t.Errorf("Lookup() = %+v, %v", tok, err)
+	}
+
+	tok.ExpiresAt = time.Now().Add(-time.Second)
+	if err := store.UpdateToken(tok); err != nil {
+		t.Fatalf("UpdateToken() error = %v", err)
+	}
+	if _, err := store.Lookup("t1"); !errors.Is(err, auth.ErrNotFound) {
+		t.Errorf("Lookup() of an expired token error = %v, want ErrNotFound", err)
+	}
+	tok.ExpiresAt = time.Time{}
+	store.UpdateToken(tok)
+
+	if err := store.UpdateTenant(auth.Tenant{Name: "acme", Active: false}); err != nil {
+		t.Fatalf("UpdateTenant() error = %v", err)
+	}
+	if _, err := store.Lookup("t1"); !errors.Is(err, auth.ErrNotFound) {
+		t.Errorf("Lookup() in an inactive tenant error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.DeleteTenant("acme"); err != nil {
+		t.Fatalf("DeleteTenant() error = %v", err)
+	}
+	if _, err := store.Token(id); !errors.Is(err, auth.ErrNotFound) {
+		t.Errorf("Token() after DeleteTenant() error = %v, want ErrNotFound", err)
+	}
+	if err := store.DeleteTenant("acme"); !errors.Is(err, auth.ErrNotFound) {
+		t.Errorf("second DeleteTenant() error = %v, want ErrNotFound", err)
+	}
+}
+
 func TestIsMasterToken(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -0,0 +1,306 @@
+package backplane_test
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/backplane"
+	"redix/pkg/protocol"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// brokerToken authenticates to the broker when it is a Redix server
+const brokerToken = "backplane"
+
+// newServer starts a Redix server accepting token1, token2, the master
+// token and brokerToken
+func newServer(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('token1', 1), ('token2', 1), (?, 1), (?, 1)", auth.MasterToken, brokerToken)
+
+	srv := server.New(db)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv, ln.Addr().String()
+}
+
+// startBroker starts a local redis-server and returns its address and
+// password. Without redis-server on the PATH it falls back to a Redix
+// server, which speaks the same PUBLISH and SUBSCRIBE protocol.
+func startBroker(t *testing.T) (addr, password string) {
+	t.Helper()
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		_, addr := newServer(t)
+		return addr, brokerToken
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	cmd := exec.Command(path, "--port", strconv.Itoa(port), "--bind", "127.0.0.1", "--save", "", "--appendonly", "no")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("redis-server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	waitFor(t, "redis-server", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return addr, ""
+}
+
+// startNode starts a Redix server relaying through the broker
+func startNode(t *testing.T, broker, password string) (string, *backplane.Backplane) {
+	t.Helper()
+	srv, addr := newServer(t)
+	bp := backplane.New(srv.PubSub(), backplane.Options{Addr: broker, Password: password})
+	srv.SetBackplane(bp)
+	bp.Start()
+	waitFor(t, "broker connection", func() bool { return bp.Stats().Connected })
+	return addr, bp
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dial(t *testing.T, addr, token string) *redixclient.Client {
+	t.Helper()
+	c, err := redixclient.Dial(addr, token, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func subscribe(t *testing.T, c *redixclient.Client, pattern bool, names ...string) *redixclient.Subscriber {
+	t.Helper()
+	var (
+		sub *redixclient.Subscriber
+		err error
+	)
+	if pattern {
+		sub, err = c.PSubscribe(context.Background(), names...)
+	} else {
+		sub, err = c.Subscribe(context.Background(), names...)
+	}
+	if err != nil {
+		t.Fatalf("subscribe error = %v", err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return sub
+}
+
+func receive(t *testing.T, s *redixclient.Subscriber) redixclient.Message {
+	t.Helper()
+	select {
+	case msg := <-s.Messages():
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return redixclient.Message{}
+}
+
+// sync publishes on channel until every subscriber has received, since the
+// backplane subscribes in Redis asynchronously
+func sync(t *testing.T, pub *redixclient.Client, channel string, subs ...*redixclient.Subscriber) {
+	t.Helper()
+	pending := make(map[*redixclient.Subscriber]bool)
+	for _, s := range subs {
+		pending[s] = true
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pending) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no message on %s through the backplane", channel)
+		}
+		pub.Publish(context.Background(), channel, "sync")
+		time.Sleep(50 * time.Millisecond)
+		for _, s := range subs {
+			select {
+			case <-s.Messages():
+				delete(pending, s)
+			default:
+			}
+		}
+	}
+
+	// Drain the syncs still in flight
+	time.Sleep(200 * time.Millisecond)
+	for _, s := range subs {
+		for len(s.Messages()) > 0 {
+			<-s.Messages()
+		}
+	}
+}
+
+func expectNone(t *testing.T, s *redixclient.Subscriber) {
+	t.Helper()
+	select {
+	case msg := <-s.Messages():
+		t.Errorf("unexpected message %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRelay(t *testing.T) {
+	broker, password := startBroker(t)
+	a, _ := startNode(t, broker, password)
+	b, _ := startNode(t, broker, password)
+	ctx := context.Background()
+
+	subA := subscribe(t, dial(t, a, "token1"), false, "news")
+	patA := subscribe(t, dial(t, a, "token1"), true, "orders.*")
+	subB := subscribe(t, dial(t, b, "token2"), false, "news")
+	pubB := dial(t, b, "token1")
+	sync(t, pubB, "news", subA)
+	sync(t, pubB, "orders.sync", patA)
+
+	pubB.Publish(ctx, "orders.1", "order")
+	if msg := receive(t, patA); msg.Pattern != "orders.*" || msg.Channel != "orders.1" || msg.Payload != "order" {
+		t.Errorf("pattern subscriber received %+v", msg)
+	}
+
+	// Tenants stay isolated across nodes; broadcasts reach everyone
+	dial(t, a, auth.MasterToken).Broadcast(ctx, "news", "broadcast")
+	if msg := receive(t, subB); msg.Payload != "broadcast" {
+		t.Errorf("node B received %+v, want only the master broadcast", msg)
+	}
+	if msg := receive(t, subA); msg.Payload != "broadcast" {
+		t.Errorf("node A received %+v", msg)
+	}
+}
+
+func TestNoDuplicates(t *testing.T) {
+	broker, password := startBroker(t)
+	a, _ := startNode(t, broker, password)
+	b, _ := startNode(t, broker, password)
+	ctx := context.Background()
+
+	// Node A subscribes in Redis to both the channel and the pattern, so
+	// Redis sends it two copies of each publish
+	sub := subscribe(t, dial(t, a, "token1"), false, "news")
+	pat := subscribe(t, dial(t, a, "token1"), true, "n*")
+	pubB := dial(t, b, "token1")
+	sync(t, pubB, "news", sub, pat)
+
+	pubB.Publish(ctx, "news", "once")
+	if msg := receive(t, sub); msg.Payload != "once" {
+		t.Errorf("subscriber received %+v", msg)
+	}
+	if msg := receive(t, pat); msg.Payload != "once" {
+		t.Errorf("pattern subscriber received %+v", msg)
+	}
+	expectNone(t, sub)
+	expectNone(t, pat)
+
+	// A node does not get its own publishes back from Redis
+	if n, _ := dial(t, a, "token1").Publish(ctx, "news", "local"); n != 2 {
+		t.Errorf("local PUBLISH receivers = %d, want 2", n)
+	}
+	receive(t, sub)
+	receive(t, pat)
+	expectNone(t, sub)
+	expectNone(t, pat)
+}
+
+func TestResubscribeLargerThanQueue(t *testing.T) {
+	broker, password := startBroker(t)
+	srv, a := newServer(t)
+	channels := make([]string, 10000)
+	for i := range channels {
+		channels[i] = "ch." + strconv.Itoa(i)
+	}
+	sub := subscribe(t, dial(t, a, "token1"), false, channels...)
+	waitFor(t, "subscriptions", func() bool { return srv.PubSub().TenantStats(auth.TokenTenant("token1")).Channels == len(channels) })
+
+	// The backplane connects with more subscriptions than it queues
+	bp := backplane.New(srv.PubSub(), backplane.Options{Addr: broker, Password: password})
+	srv.SetBackplane(bp)
+	bp.Start()
+	waitFor(t, "broker connection", func() bool { return bp.Stats().Connected })
+	b, _ := startNode(t, broker, password)
+	pubB := dial(t, b, "token1")
+	sync(t, pubB, channels[0], sub)
+	sync(t, pubB, channels[len(channels)-1], sub)
+	if !bp.Stats().Connected {
+		t.Error("backplane disconnected after resubscribing")
+	}
+}
+
+func TestNamespacedChannels(t *testing.T) {
+	broker, password := startBroker(t)
+	a, bp := startNode(t, broker, password)
+
+	// Watch the backplane's traffic directly on the broker
+	conn, err := net.Dial("tcp", broker)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := protocol.NewReader(conn)
+	if password != "" {
+		conn.Write([]byte(protocol.FormatArray("AUTH", password)))
+		r.ReadValue()
+	}
+	conn.Write([]byte(protocol.FormatArray("PSUBSCRIBE", backplane.DefaultPrefix+"*")))
+	r.ReadValue()
+
+	dial(t, a, "token1").Publish(context.Background(), "news", "hello")
+	v, err := r.ReadValue()
+	if err != nil || len(v.Array) != 4 {
+		t.Fatalf("broker message = %+v, %v", v, err)
+	}
+	channel, payload := v.Array[2].Str, v.Array[3].Str
+	if !strings.HasPrefix(channel, backplane.DefaultPrefix) || !strings.HasSuffix(channel, ":news") || strings.Contains(channel, "token1") {
+		t.Errorf("Redis channel = %q, want the prefix, a tenant hash and the channel", channel)
+	}
+	if !strings.HasSuffix(payload, ":hello") {
+		t.Errorf("Redis payload = %q", payload)
+	}
+	if got := bp.Stats().Published; got != 1 {
+		t.Errorf("Stats().Published = %d, want 1", got)
+	}
+}
@@ -143,6 +143,21 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteTimeout(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := client.New(conn)
+	c.WriteTimeout = 50 * time.Millisecond
+
+	// Nobody reads from peer, so the write blocks until the deadline
+	if err := c.Write("stuck"); err == nil {
+		t.Fatal("Write() to a stalled peer succeeded")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("connection still open after write timeout")
+	}
+}
+
 func TestClose(t *testing.T) {
 	conn := &mockConn{}
 	c := client.New(conn)
@@ -0,0 +1,432 @@
+package cluster_test
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/cluster"
+	"redix/pkg/protocol"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// node is an in-process Redix node with clustering enabled
+type node struct {
+	addr    string
+	srv     *server.Server
+	cluster *cluster.Node
+}
+
+// startCluster starts one node per secret on loopback, with fast gossip
+// timings. Every node is seeded with the first node's address only; the
+// others are found through gossip.
+func startCluster(t *testing.T, secrets ...string) []*node {
+	t.Helper()
+	nodes := make([]*node, len(secrets))
+	var seeds []string
+	for i, secret := range secrets {
+		nodes[i] = startNode(t, secret, seeds)
+		if i == 0 {
+			seeds = []string{nodes[0].cluster.Addr()}
+		}
+	}
+	return nodes
+}
+
+// startNode starts a node on loopback that joins the cluster through seeds
+func startNode(t *testing.T, secret string, seeds []string) *node {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('token1', 1), ('token2', 1), (?, 1)", auth.MasterToken)
+
+	srv := server.New(db)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	cn := cluster.New(srv.PubSub(), cluster.Options{
+		ClientAddr:       ln.Addr().String(),
+		Peers:            seeds,
+		Secret:           secret,
+		ProbeInterval:    50 * time.Millisecond,
+		SuspicionTimeout: 300 * time.Millisecond,
+	})
+	srv.SetCluster(cn)
+	if err := cn.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	return &node{addr: ln.Addr().String(), srv: srv, cluster: cn}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// member returns what n knows of the member with id
+func member(n *node, id string) (cluster.Member, bool) {
+	for _, m := range n.cluster.Members() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return cluster.Member{}, false
+}
+
+// interests returns how many interests n knows of the member with id
+func interests(n *node, id string) int {
+	if m, ok := member(n, id); ok {
+		return m.Interests
+	}
+	return -1
+}
+
+func connected(n *node) int {
+	count := 0
+	for _, m := range n.cluster.Members() {
+		if m.Connected {
+			count++
+		}
+	}
+	return count
+}
+
+func dial(t *testing.T, addr, token string) *redixclient.Client {
+	t.Helper()
+	c, err := redixclient.Dial(addr, token, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func subscribe(t *testing.T, c *redixclient.Client, pattern bool, names ...string) *redixclient.Subscriber {
+	t.Helper()
+	var (
+		sub *redixclient.Subscriber
+		err error
+	)
+	if pattern {
+		sub, err = c.PSubscribe(context.Background(), names...)
+	} else {
+		sub, err = c.Subscribe(context.Background(), names...)
+	}
+	if err != nil {
+		t.Fatalf("subscribe error = %v", err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return sub
+}
+
+func receive(t *testing.T, s *redixclient.Subscriber) redixclient.Message {
+	t.Helper()
+	select {
+	case msg := <-s.Messages():
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return redixclient.Message{}
+}
+
+func TestCrossNodeFanOut(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret", "s3cret")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	for _, n := range nodes {
+		waitFor(t, "mesh", func() bool { return connected(n) == 2 })
+	}
+	ctx := context.Background()
+
+	subA := subscribe(t, dial(t, a.addr, "token1"), false, "news")
+	subB := subscribe(t, dial(t, b.addr, "token1"), true, "orders.*")
+	subC := subscribe(t, dial(t, c.addr, "token2"), false, "news")
+	waitFor(t, "interest propagation", func() bool {
+		return interests(b, a.cluster.ID()) == 1 && interests(c, a.cluster.ID()) == 1 &&
+			interests(a, b.cluster.ID()) == 1 && interests(a, c.cluster.ID()) == 1
+	})
+
+	if _, err := dial(t, b.addr, "token1").Publish(ctx, "news", "from b"); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if msg := receive(t, subA); msg.Channel != "news" || msg.Payload != "from b" {
+		t.Errorf("node A received %+v", msg)
+	}
+
+	dial(t, c.addr, "token1").Publish(ctx, "orders.1", "order")
+	if msg := receive(t, subB); msg.Pattern != "orders.*" || msg.Channel != "orders.1" || msg.Payload != "order" {
+		t.Errorf("node B received %+v", msg)
+	}
+
+	// Broadcasts reach every tenant; the token1 publish on news must not
+	// have reached token2 on node C before it
+	dial(t, a.addr, auth.MasterToken).Broadcast(ctx, "news", "broadcast")
+	if msg := receive(t, subC); msg.Payload != "broadcast" {
+		t.Errorf("node C received %+v, want only the master broadcast", msg)
+	}
+	if msg := receive(t, subA); msg.Payload != "broadcast" {
+		t.Errorf("node A received %+v", msg)
+	}
+}
+
+func TestInterestWithdrawn(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret")
+	a, b := nodes[0], nodes[1]
+	ctx := context.Background()
+
+	// Interests registered before the link is up are sent on connect
+	sub := subscribe(t, dial(t, a.addr, "token1"), false, "news", "alerts")
+	waitFor(t, "interest propagation", func() bool { return interests(b, a.cluster.ID()) == 2 })
+
+	if err := sub.Unsubscribe(ctx, "news", "alerts"); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	waitFor(t, "interest withdrawal", func() bool { return interests(b, a.cluster.ID()) == 0 })
+
+	// A second subscriber on the same channel keeps the interest alive
+	s1 := subscribe(t, dial(t, a.addr, "token1"), false, "news")
+	s2 := subscribe(t, dial(t, a.addr, "token1"), false, "news")
+	waitFor(t, "interest propagation", func() bool { return interests(b, a.cluster.ID()) == 1 })
+	s1.Close()
+	dial(t, b.addr, "token1").Publish(ctx, "news", "still here")
+	if msg := receive(t, s2); msg.Payload != "still here" {
+		t.Errorf("received %+v", msg)
+	}
+}
+
+func TestInterestSyncLargerThanQueue(t *testing.T) {
+	a := startNode(t, "s3cret", nil)
+	channels := make([]string, 10000)
+	for i := range channels {
+		channels[i] = "ch." + strconv.Itoa(i)
+	}
+	subscribe(t, dial(t, a.addr, "token1"), false, channels...)
+	waitFor(t, "subscriptions", func() bool { return a.srv.PubSub().TenantStats(auth.TokenTenant("token1")).Channels == len(channels) })
+
+	// The new node's link from a starts with more interests than a link
+	// queues
+	b := startNode(t, "s3cret", []string{a.cluster.Addr()})
+	waitFor(t, "interest sync", func() bool { return interests(b, a.cluster.ID()) == len(channels) })
+	if got := connected(b); got != 1 {
+		t.Errorf("%d links up after the sync, want 1", got)
+	}
+}
+
+func TestSecretMismatch(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "wrong")
+	time.Sleep(300 * time.Millisecond)
+	for _, n := range nodes {
+		if got := connected(n); got != 0 {
+			t.Errorf("%d links up between nodes with different secrets", got)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret", "s3cret")
+	// Nodes B and C only know A at start and find each other by gossip
+	for _, n := range nodes {
+		waitFor(t, "membership", func() bool {
+			alive := 0
+			for _, m := range n.cluster.Members() {
+				if m.State == cluster.StateAlive {
+					alive++
+				}
+			}
+			return alive == 3
+		})
+	}
+
+	b, c := nodes[1], nodes[2]
+	if m, _ := member(b, b.cluster.ID()); !m.Self || m.Addr != b.cluster.Addr() {
+		t.Errorf("self entry = %+v", m)
+	}
+	waitFor(t, "links", func() bool { return connected(b) == 2 && connected(c) == 2 })
+}
+
+func TestFailureDetection(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret", "s3cret")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	for _, n := range nodes {
+		waitFor(t, "mesh", func() bool { return connected(n) == 2 })
+	}
+	subscribe(t, dial(t, c.addr, "token1"), false, "news")
+	waitFor(t, "interest propagation", func() bool { return interests(b, c.cluster.ID()) == 1 })
+
+	c.cluster.Close()
+	for _, n := range []*node{a, b} {
+		waitFor(t, "failure detection", func() bool {
+			m, ok := member(n, c.cluster.ID())
+			return ok && m.State == cluster.StateDead
+		})
+		if m, _ := member(n, c.cluster.ID()); m.Connected || m.Interests != 0 {
+			t.Errorf("dead member kept its link or interests: %+v", m)
+		}
+	}
+	// The surviving nodes stay alive to each other
+	if m, _ := member(a, b.cluster.ID()); m.State != cluster.StateAlive {
+		t.Errorf("node B state on A = %v", m.State)
+	}
+}
+
+func TestClusterNodes(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret")
+	a, b := nodes[0], nodes[1]
+	waitFor(t, "mesh", func() bool { return connected(a) == 1 })
+	ctx := context.Background()
+
+	v, err := dial(t, a.addr, auth.MasterToken).Do(ctx, "CLUSTER", "NODES")
+	if err != nil {
+		t.Fatalf("CLUSTER NODES error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(v.Str), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("CLUSTER NODES = %q, want 2 lines", v.Str)
+	}
+	want := map[string]string{
+		a.cluster.ID(): a.cluster.ID() + " " + a.cluster.Addr() + " myself,alive 0 connected 0",
+		b.cluster.ID(): b.cluster.ID() + " " + b.cluster.Addr() + " alive 0 connected 0",
+	}
+	for _, line := range lines {
+		id, _, _ := strings.Cut(line, " ")
+		if line != want[id] {
+			t.Errorf("line = %q, want %q", line, want[id])
+		}
+	}
+
+	if v, err := dial(t, a.addr, "token1").Do(ctx, "CLUSTER", "MYID"); err != nil || v.Str != a.cluster.ID() {
+		t.Errorf("CLUSTER MYID = %+v, %v", v, err)
+	}
+	if _, err := dial(t, a.addr, "token1").Do(ctx, "CLUSTER", "NODES"); err == nil || !strings.Contains(err.Error(), "only master token") {
+		t.Errorf("CLUSTER NODES as tenant error = %v", err)
+	}
+}
+
+// raw is a RESP connection for commands the Go client does not cover
+type raw struct {
+	net.Conn
+	r *protocol.Reader
+}
+
+func dialRaw(t *testing.T, addr, token string) *raw {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &raw{Conn: nc, r: protocol.NewReader(nc)}
+	c.do(t, "AUTH", token)
+	return c
+}
+
+func (c *raw) do(t *testing.T, args ...string) protocol.Value {
+	t.Helper()
+	c.Write([]byte(protocol.FormatArray(args...)))
+	v, err := c.r.ReadValue()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return v
+}
+
+// channelOwnedBy returns a channel whose slot owner satisfies want
+func channelOwnedBy(t *testing.T, want func(slot int) bool) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		name := "orders." + strconv.Itoa(i)
+		if want(cluster.Slot(name)) {
+			return name
+		}
+	}
+	t.Fatal("no matching channel")
+	return ""
+}
+
+func owner(n *node, slot int) string {
+	m, _ := n.cluster.SlotOwner(slot)
+	return m.ID
+}
+
+func TestShardRedirect(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret")
+	a, b := nodes[0], nodes[1]
+	for _, n := range nodes {
+		waitFor(t, "membership", func() bool { return len(n.cluster.Members()) == 2 })
+	}
+
+	channel := channelOwnedBy(t, func(slot int) bool { return owner(a, slot) == b.cluster.ID() })
+	slot := cluster.Slot(channel)
+	want := "MOVED " + strconv.Itoa(slot) + " " + b.addr
+	for _, cmd := range [][]string{{"SPUBLISH", channel, "hello"}, {"SSUBSCRIBE", channel}} {
+		if v := dialRaw(t, a.addr, "token1").do(t, cmd...); v.Type != protocol.Error || v.Str != want {
+			t.Errorf("%s on node A = %+v, want -%s", cmd[0], v, want)
+		}
+	}
+
+	sub := dialRaw(t, b.addr, "token1")
+	if v := sub.do(t, "SSUBSCRIBE", channel); len(v.Array) != 3 || v.Array[0].Str != "ssubscribe" {
+		t.Fatalf("SSUBSCRIBE on owner = %+v", v)
+	}
+	if v := dialRaw(t, b.addr, "token1").do(t, "SPUBLISH", channel, "hello"); v.Int != 1 {
+		t.Errorf("SPUBLISH on owner = %+v, want 1 receiver", v)
+	}
+	if v, _ := sub.r.ReadValue(); len(v.Array) != 3 || v.Array[0].Str != "smessage" || v.Array[2].Str != "hello" {
+		t.Errorf("sharded message = %+v", v)
+	}
+
+	other := channelOwnedBy(t, func(s int) bool { return s != slot })
+	if v := dialRaw(t, b.addr, "token1").do(t, "SSUBSCRIBE", channel, other); v.Type != protocol.Error || !strings.HasPrefix(v.Str, "CROSSSLOT") {
+		t.Errorf("SSUBSCRIBE across slots = %+v, want -CROSSSLOT", v)
+	}
+}
+
+func TestShardMigration(t *testing.T) {
+	nodes := startCluster(t, "s3cret", "s3cret", "s3cret")
+	for _, n := range nodes {
+		waitFor(t, "membership", func() bool { return len(n.cluster.Members()) == 3 })
+	}
+
+	// Stop the node with the highest ID: the middle node then hands part
+	// of its range to the first one
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].cluster.ID() < nodes[j].cluster.ID() })
+	first, middle, last := nodes[0], nodes[1], nodes[2]
+	channel := channelOwnedBy(t, func(slot int) bool {
+		return owner(first, slot) == middle.cluster.ID() && slot*2/cluster.Slots == 0
+	})
+	sub := dialRaw(t, middle.addr, "token1")
+	if v := sub.do(t, "SSUBSCRIBE", channel); len(v.Array) != 3 || v.Array[0].Str != "ssubscribe" {
+		t.Fatalf("SSUBSCRIBE = %+v", v)
+	}
+
+	last.cluster.Close()
+	v, err := sub.r.ReadValue()
+	if err != nil || len(v.Array) != 3 || v.Array[0].Str != "sunsubscribe" || v.Array[1].Str != channel {
+		t.Errorf("push after the slot moved = %+v, %v", v, err)
+	}
+}
@@ -0,0 +1,35 @@
+package cluster_test
+
+import (
+	"testing"
+
+	"redix/pkg/cluster"
+)
+
+func TestSlot(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"123456789", 0x31C3},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"", 0},
+		// Only a non-empty hash tag is hashed
+		{"{foo}.news", 12182},
+		{"news.{foo}", 12182},
+		{"{foo}{bar}", 12182},
+	}
+	for _, tt := range tests {
+		if got := cluster.Slot(tt.name); got != tt.want {
+			t.Errorf("Slot(%q) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if cluster.Slot("{}foo") == cluster.Slot("foo") {
+		t.Error("an empty hash tag must not be used")
+	}
+	if a, b := cluster.Slot("{user1}.following"), cluster.Slot("{user1}.followers"); a != b {
+		t.Errorf("hash tag slots differ: %d and %d", a, b)
+	}
+}
@@ -0,0 +1,389 @@
+package config_test
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/config"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// load parses args and builds the configuration with env as the environment
+func load(t *testing.T, args []string, env map[string]string) (*config.Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("redix", flag.ContinueOnError)
+	flags := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return flags.Load(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := load(t, nil, nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Listeners.Redis != ":6379" || cfg.Retention.Messages != 100 || cfg.Server.ShutdownDelay != 5*time.Second {
+		t.Errorf("defaults = %+v", cfg)
+	}
+	if cfg.HTTP.ReadHeaderTimeout != 10*time.Second || cfg.HTTP.ReadTimeout != 30*time.Second {
+		t.Errorf("HTTP timeouts = %+v, want 10s and 30s", cfg.HTTP)
+	}
+	if got, want := cfg.DSN(), "root:root@tcp(localhost:3306)/redix?parseTime=true"; got != want {
+		t.Errorf("DSN() = %q, want %q", got, want)
+	}
+}
+
+func TestFileFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"redix.yaml", `
+listeners:
+  redis: ":7000"   # main listener
+  http: ""
+limits:
+  maxclients: 50
+logging:
+  level: 'debug'
+`},
+		{"redix.toml", `
+# main listener
+[listeners]
+redis = ":7000"
+http = ""
+
+[limits]
+maxclients = 50
+
+[logging]
+level = "debug"
+`},
+		{"redix.json", `{
+  "listeners": {"redis": ":7000", "http": ""},
+  "limits": {"maxclients": 50},
+  "logging": {"level": "debug"}
+}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.name, tt.content)
+			cfg, err := load(t, []string{"-config", path}, nil)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.Listeners.Redis != ":7000" || cfg.Listeners.HTTP != "" || cfg.Limits.MaxClients != 50 || cfg.Logging.Level != "debug" {
+				t.Errorf("config = %+v", cfg)
+			}
+			if src := cfg.Source("limits.maxclients"); src != config.SourceFile {
+				t.Errorf("Source() = %v, want file", src)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "redix.yaml", "limits:\n  maxclients: 10\nretention:\n  messages: 10\nlogging:\n  level: warn\n")
+	env := map[string]string{
+		"REDIX_CONFIG":            path,
+		"REDIX_LIMITS_MAXCLIENTS": "20",
+		"REDIX_LOGGING_LEVEL":     "error",
+	}
+
+	cfg, err := load(t, []string{"-limits.maxclients", "30"}, env)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Limits.MaxClients != 30 {
+		t.Errorf("maxclients = %d, want flag value 30", cfg.Limits.MaxClients)
+	}
+	if cfg.Logging.Level != "error" {
+		t.Errorf("level = %q, want env value error", cfg.Logging.Level)
+	}
+	if cfg.Retention.Messages != 10 {
+		t.Errorf("retention = %d, want file value 10", cfg.Retention.Messages)
+	}
+}
+
+func TestMySQLDSNFallback(t *testing.T) {
+	env := map[string]string{"MYSQL_DSN": "u:p@tcp(db:3306)/app"}
+
+	cfg, err := load(t, nil, env)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := cfg.DSN(); got != "u:p@tcp(db:3306)/app" {
+		t.Errorf("DSN() = %q, want MYSQL_DSN", got)
+	}
+
+	// An explicit flag outranks the DSN from the environment
+	cfg, err = load(t, []string{"-mysql-host", "other"}, env)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := cfg.DSN(); !strings.Contains(got, "tcp(other:3306)") {
+		t.Errorf("DSN() = %q, want host from flag", got)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		body string
+		args []string
+		want []string
+	}{
+		{"unknown key", "redix.toml", "[limits]\nmaxclient = 3\n", nil, []string{`redix.toml:2: unknown key "limits.maxclient"`}},
+		{"bad type", "redix.yaml", "limits:\n  maxclients: lots\n", nil, []string{"invalid integer"}},
+		{"bad indentation", "redix.yaml", "limits:\n  maxclients: 1\n   other: 2\n", nil, []string{"line 3: inconsistent indentation"}},
+		{"unquoted toml string", "redix.toml", "[logging]\nlevel = debug\n", nil, []string{"strings must be quoted"}},
+		{"all problems reported", "redix.json", `{"logging": {"format": "xml"}, "retention": {"messages": -1}}`,
+			[]string{"-listeners.redis", "nonsense"},
+			[]string{"logging.format", "retention.messages", `listeners.redis: invalid address "nonsense"`}},
+		{"tls pair", "redix.yaml", "tls:\n  cert_file: /tmp/cert.pem\n", nil, []string{"cert_file and key_file must be set together"}},
+		{"duplicate listener", "redix.yaml", "listeners:\n  http: \":6379\"\n", nil, []string{"already used by listeners.redis"}},
+		{"sqlite needs dsn", "redix.yaml", "token_store:\n  driver: sqlite3\n", nil, []string{"token_store.dsn: required"}},
+		{"http timeouts", "redix.yaml", "http:\n  read_timeout: -1s\n", nil, []string{"http.read_timeout: must not be negative"}},
+		{"webhook networks", "redix.yaml", "webhooks:\n  allowed_networks: \"10.0.0.0/8, intranet\"\n", nil, []string{`webhooks.allowed_networks: "intranet" is not a CIDR network`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.file, tt.body)
+			_, err := load(t, append([]string{"-config", path}, tt.args...), nil)
+			if err == nil {
+				t.Fatal("Load() error = nil, want validation error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load() error = %q, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMasksSecrets(t *testing.T) {
+	cfg, err := load(t, []string{"-mysql-pass", "hunter2"}, nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	var b strings.Builder
+	if err := cfg.Write(&b); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	out := b.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("Write() leaked the password:\n%s", out)
+	}
+	if !strings.Contains(out, "token_store.password") || !strings.Contains(out, "# flag") {
+		t.Errorf("Write() output missing password source:\n%s", out)
+	}
+}
+
+// newManager loads path and returns a manager that reloads it
+func newManager(t *testing.T, path string) *config.Manager {
+	t.Helper()
+	reload := func() (*config.Config, error) { return load(t, []string{"-config", path}, nil) }
+	cfg, err := reload()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return config.NewManager(cfg, reload)
+}
+
+func TestManagerSet(t *testing.T) {
+	m := newManager(t, writeFile(t, "redix.yaml", "limits:\n  maxclients: 10\n"))
+
+	var changes [][]string
+	m.OnChange(func(cfg *config.Config, changed []string) {
+		changes = append(changes, changed)
+	})
+
+	if err := m.Set("limits.maxclients", "20", "logging.level", "debug"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	cfg := m.Config()
+	if cfg.Limits.MaxClients != 20 || cfg.Logging.Level != "debug" {
+		t.Errorf("config after Set() = %+v", cfg)
+	}
+	if len(changes) != 1 || len(changes[0]) != 2 {
+		t.Errorf("change hooks = %v, want one call with two keys", changes)
+	}
+
+	if err := m.Set("listeners.redis", ":7000"); err == nil {
+		t.Error("Set() of a restart-only key succeeded")
+	}
+	// An invalid pair rejects the whole change
+	if err := m.Set("limits.maxclients", "30", "logging.level", "loud"); err == nil {
+		t.Error("Set() with an invalid level succeeded")
+	}
+	if got := m.Config().Limits.MaxClients; got != 20 {
+		t.Errorf("maxclients after rejected Set() = %d, want 20", got)
+	}
+}
+
+func TestManagerGet(t *testing.T) {
+	m := newManager(t, writeFile(t, "redix.yaml", "token_store:\n  password: hunter2\n"))
+
+	got := m.Get("token_store.*")
+	if len(got) != 7 {
+		t.Fatalf("Get() = %v, want 7 token_store keys", got)
+	}
+	for _, kv := range got {
+		if kv[1] == "hunter2" {
+			t.Errorf("Get() leaked %s", kv[0])
+		}
+	}
+	if got := m.Get("limits.maxclients"); len(got) != 1 || got[0][1] != "0" {
+		t.Errorf("Get(limits.maxclients) = %v", got)
+	}
+}
+
+func TestManagerRewrite(t *testing.T) {
+	for _, name := range []string{"redix.yaml", "redix.toml", "redix.json"} {
+		t.Run(name, func(t *testing.T) {
+			initial := map[string]string{
+				"redix.yaml": "listeners:\n  http: \"\"\nlimits:\n  maxclients: 10\n",
+				"redix.toml": "[listeners]\nhttp = \"\"\n[limits]\nmaxclients = 10\n",
+				"redix.json": `{"listeners": {"http": ""}, "limits": {"maxclients": 10}}`,
+			}[name]
+			path := writeFile(t, name, initial)
+			m := newManager(t, path)
+
+			if err := m.Set("limits.maxclients", "25", "retention.messages", "7"); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+			if err := m.Rewrite(); err != nil {
+				t.Fatalf("Rewrite() error = %v", err)
+			}
+
+			cfg, err := load(t, []string{"-config", path}, nil)
+			if err != nil {
+				t.Fatalf("Load() of rewritten file error = %v", err)
+			}
+			if cfg.Limits.MaxClients != 25 || cfg.Retention.Messages != 7 || cfg.Listeners.HTTP != "" {
+				t.Errorf("rewritten config = %+v", cfg)
+			}
+		})
+	}
+
+	cfg, _ := load(t, nil, nil)
+	m := config.NewManager(cfg, nil)
+	if err := m.Rewrite(); err != config.ErrNoConfigFile {
+		t.Errorf("Rewrite() without a file error = %v, want ErrNoConfigFile", err)
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	path := writeFile(t, "redix.yaml", "limits:\n  maxclients: 10\n")
+	m := newManager(t, path)
+
+	os.WriteFile(path, []byte("limits:\n  maxclients: 50\nlisteners:\n  redis: \":7000\"\n"), 0o600)
+	restart, err := m.Reload()
+	if err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	cfg := m.Config()
+	if cfg.Limits.MaxClients != 50 {
+		t.Errorf("maxclients after Reload() = %d, want 50", cfg.Limits.MaxClients)
+	}
+	if cfg.Listeners.Redis != ":6379" || len(restart) != 1 || restart[0] != "listeners.redis" {
+		t.Errorf("Reload() applied a restart-only key: redis=%q restart=%v", cfg.Listeners.Redis, restart)
+	}
+
+	os.WriteFile(path, []byte("limits:\n  maxclients: -1\n"), 0o600)
+	if _, err := m.Reload(); err == nil {
+		t.Error("Reload() of an invalid file succeeded")
+	}
+	if got := m.Config().Limits.MaxClients; got != 50 {
+		t.Errorf("maxclients after rejected Reload() = %d, want 50", got)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('token1', 1), (?, 1)", auth.MasterToken)
+
+	srv := server.New(db)
+	m := newManager(t, writeFile(t, "redix.yaml", "limits:\n  maxclients: 10\n"))
+	m.OnChange(func(cfg *config.Config, changed []string) {
+		srv.SetMaxClients(cfg.Limits.MaxClients)
+	})
+	srv.SetConfig(m)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	tenant, err := redixclient.Dial(ln.Addr().String(), "token1", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer tenant.Close()
+	master, err := redixclient.Dial(ln.Addr().String(), auth.MasterToken, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer master.Close()
+
+	if _, err := tenant.Do(ctx, "CONFIG", "GET", "limits.maxclients"); err == nil {
+		t.Error("CONFIG GET with a tenant token succeeded")
+	}
+	v, err := master.Do(ctx, "CONFIG", "GET", "limits.maxclients")
+	if err != nil || len(v.Array) != 2 || v.Array[1].Str != "10" {
+		t.Fatalf("CONFIG GET = %+v, %v", v, err)
+	}
+	if _, err := tenant.Do(ctx, "CONFIG", "SET", "limits.maxclients", "1"); err == nil {
+		t.Error("CONFIG SET with a tenant token succeeded")
+	}
+	if _, err := master.Do(ctx, "CONFIG", "SET", "limits.maxclients", "1"); err != nil {
+		t.Fatalf("CONFIG SET error = %v", err)
+	}
+	if err := srv.Ready(ctx); err == nil {
+		t.Error("Ready() = nil with two clients and maxclients 1")
+	}
+	if _, err := master.Do(ctx, "CONFIG", "SET", "listeners.redis", ":1"); err == nil {
+		t.Error("CONFIG SET of a restart-only key succeeded")
+	}
+	if _, err := master.Do(ctx, "CONFIG", "REWRITE"); err != nil {
+		t.Errorf("CONFIG REWRITE error = %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package glob_test
+
+import (
+	"testing"
+
+	"redix/pkg/glob"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "order", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "users.created", false},
+		{"*.created", "orders.created", true},
+		{"o*s.*d", "orders.created", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"[abc", "[abc", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.s, func(t *testing.T) {
+			if got := glob.Match(tt.pattern, tt.s); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPattern(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"orders", false},
+		{"orders.*", true},
+		{"h?llo", true},
+		{"[ab]", true},
+	}
+
+	for _, tt := range tests {
+		if got := glob.IsPattern(tt.s); got != tt.want {
+			t.Errorf("IsPattern(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package httpapi_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/httpapi"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// mockConn is a mock implementation of net.Conn for testing
+type mockConn struct {
+	writeData []byte
+}
+
+func (m *mockConn) Read(b []byte) (n int, err error) { return 0, nil }
+func (m *mockConn) Write(b []byte) (n int, err error) {
+	m.writeData = append(m.writeData, b...)
+	return len(b), nil
+}
+func (m *mockConn) Close() error                       { return nil }
+func (m *mockConn) LocalAddr() net.Addr                { return nil }
+func (m *mockConn) RemoteAddr() net.Addr               { return nil }
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newValidator creates a validator backed by an in-memory database holding the given tokens
+func newValidator(t *testing.T, tokens ...string) *auth.Validator {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`); err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+	for _, token := range tokens {
+		if _, err := db.Exec("INSERT INTO clients (token, is_active) VALUES (?, 1)", token); err != nil {
+			t.Fatalf("Failed to insert test data: %v", err)
+		}
+	}
+	return auth.NewValidator(db)
+}
+
+// subscriber creates an authenticated client subscribed to topic
+func subscriber(ps *pubsub.PubSub, token, topic string) *mockConn {
+	conn := &mockConn{}
+	c := client.New(conn)
+	c.Token = token
+	c.Tenant = auth.TokenTenant(token)
+	c.Authed = true
+	ps.Subscribe(topic, c)
+	return conn
+}
+
+func TestChannelPublish(t *testing.T) {
+	ps := pubsub.New()
+	api := httpapi.New(newValidator(t, "token1", "token2"), ps)
+
+	conn1 := subscriber(ps, "token1", "orders")
+	conn2 := subscriber(ps, "token2", "orders")
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+	}{
+		{
+			name:     "missing token",
+			body:     "hello",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "invalid token",
+			token:    "nope",
+			body:     "hello",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:        "raw body",
+			token:       "token1",
+			contentType: "text/plain",
+			body:        "hello",
+			wantCode:    http.StatusOK,
+			wantBody:    `{"receivers":1}`,
+		},
+		{
+			name:        "json message",
+			token:       "token1",
+			contentType: "application/json",
+			body:        `{"message":"hello"}`,
+			wantCode:    http.StatusOK,
+			wantBody:    `{"receivers":1}`,
+		},
+		{
+			name:        "json batch",
+			token:       "token2",
+			contentType: "application/json",
+			body:        `{"messages":["a","b"]}`,
+			wantCode:    http.StatusOK,
+			wantBody:    `{"receivers":[1,1],"total":2}`,
+		},
+		{
+			name:        "empty json",
+			token:       "token1",
+			contentType: "application/json",
+			body:        `{}`,
+			wantCode:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/channels/orders/publish", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			rec := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	if !strings.Contains(string(conn1.writeData), "hello") {
+		t.Error("token1 subscriber did not receive token1 message")
+	}
+	if strings.Contains(string(conn2.writeData), "hello") {
+		t.Error("token2 subscriber received token1 message")
+	}
+}
+
+func TestBatchPublish(t *testing.T) {
+	ps := pubsub.New()
+	api := httpapi.New(newValidator(t, "token1"), ps)
+
+	subscriber(ps, "token1", "a")
+	subscriber(ps, "token1", "b")
+	subscriber(ps, "token2", "b")
+
+	body := `{"messages":[{"channel":"a","message":"x"},{"channel":"b","message":"y"},{"channel":"c","message":"z"}]}`
+	req := httptest.NewRequest("POST", "/v1/publish", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token1")
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	api.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp struct {
+		Receivers []int `json:"receivers"`
+		Total     int   `json:"total"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []int{1, 1, 0}
+	for i, n := range want {
+		if resp.Receivers[i] != n {
+			t.Errorf("receivers[%d] = %d, want %d", i, resp.Receivers[i], n)
+		}
+	}
+	if resp.Total != 2 {
+		t.Errorf("total = %d, want 2", resp.Total)
+	}
+}
+
+func TestChannelNameLimit(t *testing.T) {
+	api := httpapi.New(newValidator(t, "token1"), pubsub.New())
+	limits := protocol.DefaultLimits()
+	limits.MaxChannelLen = 8
+	api.SetProtocolLimits(limits)
+
+	long := strings.Repeat("c", 9)
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"channel", "/v1/channels/" + long + "/publish", `{"message":"x"}`},
+		{"batch", "/v1/publish", `{"messages":[{"channel":"short","message":"x"},{"channel":"` + long + `","message":"y"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer token1")
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "channel name too long") {
+				t.Errorf("status = %d (%s), want 400 channel name too long", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPublishToFullGroup(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetReliable(pubsub.ReliableOptions{VisibilityTimeout: time.Minute, MaxPending: 1})
+	consumer := client.New(&mockConn{})
+	consumer.Token, consumer.Tenant, consumer.Authed = "token1", auth.TokenTenant("token1"), true
+	ps.RSubscribe("billing", "invoices", consumer)
+	api := httpapi.New(newValidator(t, "token1"), ps)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"first", "/v1/channels/invoices/publish", `{"message":"a"}`, http.StatusOK},
+		{"channel", "/v1/channels/invoices/publish", `{"message":"b"}`, http.StatusServiceUnavailable},
+		{"batch", "/v1/publish", `{"messages":[{"channel":"news","message":"x"},{"channel":"invoices","message":"y"}]}`, http.StatusServiceUnavailable},
+		{"other channel", "/v1/channels/news/publish", `{"message":"c"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer token1")
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d (%s), want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+	if pending, _ := ps.PendingMessages("billing", auth.TokenTenant("token1")); len(pending) != 1 {
+		t.Errorf("PendingMessages() = %+v, want only the first message", pending)
+	}
+}
+
+func TestMasterPublishForms(t *testing.T) {
+	ps := pubsub.New()
+	api := httpapi.New(newValidator(t, "token1", auth.MasterToken), ps)
+
+	conn1 := subscriber(ps, "token1", "news")
+	conn2 := subscriber(ps, "token2", "news")
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		status int
+		body   string
+	}{
+		{"plain master publish stays in the master tenant", auth.MasterToken, "/v1/channels/news/publish", http.StatusOK, `{"receivers":0}`},
+		{"tenant publish", auth.MasterToken, "/v1/tenants/token:token2/channels/news/publish", http.StatusOK, `{"receivers":1}`},
+		{"broadcast", auth.MasterToken, "/v1/broadcast/news", http.StatusOK, `{"receivers":2}`},
+		{"tenant publish needs the master token", "token1", "/v1/tenants/token:token2/channels/news/publish", http.StatusForbidden, ""},
+		{"broadcast needs the master token", "token1", "/v1/broadcast/news", http.StatusForbidden, ""},
+		{"reserved tenant", auth.MasterToken, "/v1/tenants/*/channels/news/publish", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader("hello"))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.body != "" && strings.TrimSpace(rec.Body.String()) != tt.body {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.body)
+			}
+		})
+	}
+
+	if n := strings.Count(string(conn1.writeData), "hello"); n != 1 {
+		t.Errorf("token1 received %d messages, want only the broadcast", n)
+	}
+	if n := strings.Count(string(conn2.writeData), "hello"); n != 2 {
+		t.Errorf("token2 received %d messages, want the tenant publish and the broadcast", n)
+	}
+}
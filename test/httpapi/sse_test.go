@@ -0,0 +1,205 @@
+package httpapi_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/audit"
+	"redix/pkg/auth"
+	"redix/pkg/httpapi"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+)
+
+// sseEvent is a parsed Server-Sent Event
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE parses events from r and sends them on the returned channel
+func readSSE(r *bufio.Reader) <-chan sseEvent {
+	out := make(chan sseEvent, 16)
+	go func() {
+		defer close(out)
+		var ev sseEvent
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "":
+				if ev.event != "" {
+					out <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return out
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+// openStream opens an SSE stream and waits until its channels are subscribed
+func openStream(t *testing.T, srv *httptest.Server, path, lastID string) <-chan sseEvent {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer token1")
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	return readSSE(bufio.NewReader(resp.Body))
+}
+
+func TestStream(t *testing.T) {
+	ps := pubsub.New()
+	srv := httptest.NewServer(httpapi.New(newValidator(t, "token1", "token2"), ps).Handler())
+	t.Cleanup(srv.Close)
+
+	events := openStream(t, srv, "/v1/stream?channels=a,b", "")
+
+	ps.Publish("a", "other tenant", auth.TokenTenant("token2"))
+	ps.Publish("a", "first", auth.TokenTenant("token1"))
+	ps.Publish("b", "second", auth.TokenTenant("token1"))
+
+	ev := nextEvent(t, events)
+	if ev.event != "message" || ev.data != `{"channel":"a","message":"first"}` {
+		t.Errorf("first event = %+v", ev)
+	}
+	if ev.id == "" {
+		t.Error("first event has no id")
+	}
+	ev = nextEvent(t, events)
+	if ev.data != `{"channel":"b","message":"second"}` {
+		t.Errorf("second event = %+v", ev)
+	}
+}
+
+func TestStreamOutlivesReadTimeout(t *testing.T) {
+	ps := pubsub.New()
+	srv := httptest.NewUnstartedServer(httpapi.New(newValidator(t, "token1"), ps).Handler())
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	events := openStream(t, srv, "/v1/stream?channels=a", "")
+	time.Sleep(300 * time.Millisecond)
+	ps.Publish("a", "late", auth.TokenTenant("token1"))
+	if ev := nextEvent(t, events); !strings.Contains(ev.data, `"late"`) {
+		t.Errorf("event = %+v, want late", ev)
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetRetention(10)
+	srv := httptest.NewServer(httpapi.New(newValidator(t, "token1"), ps).Handler())
+	t.Cleanup(srv.Close)
+
+	events := openStream(t, srv, "/v1/stream?channels=a", "")
+	ps.Publish("a", "one", auth.TokenTenant("token1"))
+	first := nextEvent(t, events)
+
+	ps.Publish("a", "two", auth.TokenTenant("token1"))
+	ps.Publish("a", "hidden", auth.TokenTenant("token2"))
+	ps.Publish("a", "three", auth.TokenTenant("token1"))
+
+	resumed := openStream(t, srv, "/v1/stream?channels=a", first.id)
+	for _, want := range []string{"two", "three"} {
+		ev := nextEvent(t, resumed)
+		if !strings.Contains(ev.data, `"message":"`+want+`"`) {
+			t.Errorf("resumed event = %+v, want %s", ev, want)
+		}
+	}
+
+	ps.Publish("a", "live", auth.TokenTenant("token1"))
+	if ev := nextEvent(t, resumed); !strings.Contains(ev.data, `"live"`) {
+		t.Errorf("live event = %+v, want live", ev)
+	}
+}
+
+func TestStreamRequiresChannels(t *testing.T) {
+	api := httpapi.New(newValidator(t, "token1"), pubsub.New())
+
+	req := httptest.NewRequest("GET", "/v1/stream?token=token1", nil)
+	rec := httptest.NewRecorder()
+	api.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestStreamRejectsInvalidRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(path, audit.Options{})
+	if err != nil {
+		t.Fatalf("audit.Open() error = %v", err)
+	}
+	api := httpapi.New(newValidator(t, "token1"), pubsub.New())
+	limits := protocol.DefaultLimits()
+	limits.MaxChannelLen = 8
+	api.SetProtocolLimits(limits)
+	api.SetAudit(log)
+
+	for _, target := range []string{
+		"/v1/stream?token=token1&channels=a," + strings.Repeat("x", 9),
+		"/v1/stream?token=token1&channels=a&lastEventId=abc",
+	} {
+		// A stream opened by mistake ends with the request context
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		rec := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rec, httptest.NewRequest("GET", target, nil).WithContext(ctx))
+		cancel()
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Rejected streams are not recorded as authenticated sessions
+	log.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if strings.Contains(string(data), audit.AuthSuccess) {
+		t.Errorf("audit log records a session for a rejected stream:\n%s", data)
+	}
+}
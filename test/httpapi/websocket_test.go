@@ -0,0 +1,254 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/httpapi"
+	"redix/pkg/protocol"
+	"redix/pkg/pubsub"
+	"redix/pkg/websocket"
+)
+
+// readEvent reads the next JSON frame from ws
+func readEvent(t *testing.T, ws *websocket.Conn) map[string]any {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	op, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if op != websocket.OpText {
+		t.Fatalf("ReadMessage() opcode = %d, want text", op)
+	}
+	var ev map[string]any
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatalf("Failed to decode frame %q: %v", data, err)
+	}
+	return ev
+}
+
+// dialGateway starts the API and opens a WebSocket to it
+func dialGateway(t *testing.T, ps *pubsub.PubSub, query string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(httpapi.New(newValidator(t, "token1", "token2"), ps).Handler())
+	t.Cleanup(srv.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws"+query, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { ws.CloseNow() })
+	return ws
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	ps := pubsub.New()
+	ws := dialGateway(t, ps, "")
+
+	send := func(v any) {
+		data, _ := json.Marshal(v)
+		if err := ws.WriteText(data); err != nil {
+			t.Fatalf("WriteText() error = %v", err)
+		}
+	}
+
+	send(map[string]any{"type": "subscribe", "channels": []string{"news"}})
+	if ev := readEvent(t, ws); ev["type"] != "error" {
+		t.Fatalf("subscribe before auth = %v, want error", ev)
+	}
+
+	send(map[string]any{"type": "auth", "token": "token1"})
+	if ev := readEvent(t, ws); ev["type"] != "authenticated" {
+		t.Fatalf("auth = %v, want authenticated", ev)
+	}
+
+	send(map[string]any{"type": "subscribe", "channels": []string{"news"}})
+	if ev := readEvent(t, ws); ev["type"] != "subscribed" || ev["channel"] != "news" {
+		t.Fatalf("subscribe = %v, want subscribed to news", ev)
+	}
+
+	if n := ps.Publish("news", "from token2", auth.TokenTenant("token2")); n != 0 {
+		t.Errorf("Publish() with other tenant reached %d subscribers, want 0", n)
+	}
+	if n := ps.Publish("news", "hello", auth.TokenTenant("token1")); n != 1 {
+		t.Errorf("Publish() reached %d subscribers, want 1", n)
+	}
+	ev := readEvent(t, ws)
+	if ev["type"] != "message" || ev["channel"] != "news" || ev["message"] != "hello" {
+		t.Errorf("message = %v, want hello on news", ev)
+	}
+
+	send(map[string]any{"type": "unsubscribe"})
+	if ev := readEvent(t, ws); ev["type"] != "unsubscribed" {
+		t.Fatalf("unsubscribe = %v, want unsubscribed", ev)
+	}
+	if n := ps.GetSubscriberCount("news"); n != 0 {
+		t.Errorf("GetSubscriberCount() = %d, want 0", n)
+	}
+}
+
+func TestWebSocketQueryTokenAndClose(t *testing.T) {
+	ps := pubsub.New()
+	ws := dialGateway(t, ps, "?token=token1")
+
+	if ev := readEvent(t, ws); ev["type"] != "authenticated" {
+		t.Fatalf("first frame = %v, want authenticated", ev)
+	}
+
+	if err := ws.Ping([]byte("hi")); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	if err := ws.Close(websocket.CloseNormal, "bye"); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	_, _, err := ws.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("ReadMessage() after close error = %v, want CloseError", err)
+	}
+	if ce.Code != websocket.CloseNormal {
+		t.Errorf("close code = %d, want %d", ce.Code, websocket.CloseNormal)
+	}
+}
+
+func TestWebSocketRejectsInvalidToken(t *testing.T) {
+	srv := httptest.NewServer(httpapi.New(newValidator(t, "token1"), pubsub.New()).Handler())
+	defer srv.Close()
+
+	_, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws?token=nope", nil)
+	if err == nil {
+		t.Fatal("Dial() with invalid token succeeded, want handshake failure")
+	}
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	api := httpapi.New(newValidator(t, "token1"), pubsub.New())
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/ws"
+
+	dial := func(origin string) error {
+		ws, err := websocket.Dial(url, http.Header{"Origin": {origin}})
+		if err == nil {
+			ws.CloseNow()
+		}
+		return err
+	}
+	if err := dial(srv.URL); err != nil {
+		t.Errorf("Dial() from the API's own origin error = %v", err)
+	}
+	if err := dial("https://evil.example.com"); err == nil {
+		t.Error("Dial() from another origin succeeded")
+	}
+
+	api.SetAllowedOrigins([]string{"https://app.example.com"})
+	if err := dial("https://app.example.com"); err != nil {
+		t.Errorf("Dial() from an allowed origin error = %v", err)
+	}
+	if err := dial(srv.URL); err == nil {
+		t.Error("Dial() from an origin missing from the allow list succeeded")
+	}
+}
+
+// sessionLimits admits a fixed number of sessions, and of sessions per token
+type sessionLimits struct {
+	mu       sync.Mutex
+	max      int
+	open     int
+	perToken map[string]int
+}
+
+func (l *sessionLimits) OpenSession(c *client.Client, remoteAddr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open >= l.max {
+		return errors.New("max number of clients reached")
+	}
+	l.open++
+	return nil
+}
+
+func (l *sessionLimits) ClaimSession(c *client.Client, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perToken[token] >= 1 {
+		return errors.New("max number of clients reached for this token")
+	}
+	l.perToken[token]++
+	return nil
+}
+
+func (l *sessionLimits) CloseSession(c *client.Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+}
+
+func TestWebSocketSessionLimits(t *testing.T) {
+	api := httpapi.New(newValidator(t, "token1", "token2"), pubsub.New())
+	api.SetSessions(&sessionLimits{max: 2, perToken: map[string]int{}})
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/ws"
+
+	first, err := websocket.Dial(url+"?token=token1", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer first.CloseNow()
+	if _, err := websocket.Dial(url+"?token=token1", nil); err == nil {
+		t.Error("Dial() over the per-token limit succeeded")
+	}
+
+	second, err := websocket.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer second.CloseNow()
+	data, _ := json.Marshal(map[string]any{"type": "auth", "token": "token1"})
+	second.WriteText(data)
+	if ev := readEvent(t, second); ev["type"] != "error" || !strings.Contains(ev["error"].(string), "for this token") {
+		t.Errorf("auth over the per-token limit = %v, want error", ev)
+	}
+
+	if _, err := websocket.Dial(url, nil); err == nil {
+		t.Error("Dial() over the session limit succeeded")
+	}
+}
+
+func TestWebSocketChannelNameLimit(t *testing.T) {
+	api := httpapi.New(newValidator(t, "token1"), pubsub.New())
+	limits := protocol.DefaultLimits()
+	limits.MaxChannelLen = 8
+	api.SetProtocolLimits(limits)
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws?token=token1", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer ws.CloseNow()
+	readEvent(t, ws)
+
+	data, _ := json.Marshal(map[string]any{"type": "subscribe", "channels": []string{strings.Repeat("c", 9)}})
+	ws.WriteText(data)
+	if ev := readEvent(t, ws); ev["type"] != "error" || !strings.Contains(ev["error"].(string), "channel name too long") {
+		t.Fatalf("subscribe = %v, want channel name too long", ev)
+	}
+	_, _, err = ws.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("ReadMessage() error = %v, want policy violation close", err)
+	}
+}
@@ -0,0 +1,172 @@
+package logging_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"redix/pkg/logging"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON log lines written so far
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []map[string]any
+	sc := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for sc.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", sc.Text(), err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	var buf syncBuffer
+	logger, level := logging.New(&buf, logging.Options{Level: "warn", Format: "json"})
+
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+	level.Set(slog.LevelDebug)
+	logger.Debug("enabled at runtime")
+
+	recs := buf.records(t)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2: %v", len(recs), recs)
+	}
+	if recs[0]["msg"] != "shown" || recs[0]["key"] != "value" || recs[0]["level"] != "WARN" {
+		t.Errorf("record = %v", recs[0])
+	}
+	if recs[1]["msg"] != "enabled at runtime" {
+		t.Errorf("record = %v, want debug record after level change", recs[1])
+	}
+}
+
+func TestSampler(t *testing.T) {
+	var buf syncBuffer
+	logger, _ := logging.New(&buf, logging.Options{
+		Level:            "debug",
+		Format:           "json",
+		SampleInitial:    3,
+		SampleThereafter: 10,
+		SampleInterval:   time.Hour,
+	})
+	// Derived loggers share the sampling budget
+	conn := logger.With("conn_id", 1)
+
+	for i := 0; i < 50; i++ {
+		conn.Debug("message published")
+		logger.Error("store failed")
+	}
+	logger.Info("other message")
+
+	counts := make(map[string]int)
+	for _, rec := range buf.records(t) {
+		counts[rec["msg"].(string)]++
+	}
+	// 3 initial records, then the 13th, 23rd, 33rd and 43rd
+	if counts["message published"] != 7 {
+		t.Errorf("sampled records = %d, want 7", counts["message published"])
+	}
+	if counts["store failed"] != 50 {
+		t.Errorf("error records = %d, want all 50", counts["store failed"])
+	}
+	if counts["other message"] != 1 {
+		t.Errorf("other records = %d, want 1", counts["other message"])
+	}
+}
+
+func TestConnectionAttributes(t *testing.T) {
+	var buf syncBuffer
+	logger, _ := logging.New(&buf, logging.Options{Level: "debug", Format: "json"})
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(prev)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('tenant-secret', 1)")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := server.New(db)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	if _, err := redixclient.Dial(ln.Addr().String(), "wrong", nil); err == nil {
+		t.Fatal("Dial() with an invalid token succeeded")
+	}
+	c, err := redixclient.Dial(ln.Addr().String(), "tenant-secret", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	c.Publish(context.Background(), "news", "hello")
+	c.Close()
+
+	var failed, published map[string]any
+	deadline := time.Now().Add(2 * time.Second)
+	for (failed == nil || published == nil) && time.Now().Before(deadline) {
+		for _, rec := range buf.records(t) {
+			switch rec["msg"] {
+			case "authentication failed":
+				failed = rec
+			case "message published":
+				published = rec
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failed == nil || published == nil {
+		t.Fatalf("missing records: auth failure %v, publish %v", failed, published)
+	}
+
+	for _, rec := range []map[string]any{failed, published} {
+		if rec["conn_id"] == nil || !strings.HasPrefix(rec["remote_addr"].(string), "127.0.0.1:") {
+			t.Errorf("record missing connection attributes: %v", rec)
+		}
+	}
+	if published["tenant"] != "tena****" || published["channel"] != "news" {
+		t.Errorf("publish record = %v, want redacted tenant and channel", published)
+	}
+	for _, rec := range buf.records(t) {
+		if line, _ := json.Marshal(rec); strings.Contains(string(line), "tenant-secret") {
+			t.Errorf("record leaked the token: %s", line)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"redix/pkg/auth"
+	"redix/pkg/bridge"
+	"redix/pkg/migrate"
+	"redix/pkg/pubsub"
+	"redix/pkg/webhook"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDriversHaveTheSameVersions(t *testing.T) {
+	mysql, err := migrate.Migrations("mysql")
+	if err != nil {
+		t.Fatalf("Migrations(mysql) error = %v", err)
+	}
+	sqlite, err := migrate.Migrations("sqlite3")
+	if err != nil {
+		t.Fatalf("Migrations(sqlite3) error = %v", err)
+	}
+	if len(mysql) != len(sqlite) {
+		t.Fatalf("mysql has %d migrations, sqlite3 has %d", len(mysql), len(sqlite))
+	}
+	for i := range mysql {
+		if mysql[i].Version != i+1 || mysql[i].Version != sqlite[i].Version || mysql[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d: mysql %d_%s, sqlite3 %d_%s", i, mysql[i].Version, mysql[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+	if _, err := migrate.Migrations("postgres"); err == nil {
+		t.Error("Migrations(postgres) succeeded")
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	m, err := migrate.New(db, "sqlite3")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	all, _ := migrate.Migrations("sqlite3")
+	done, err := m.Up(ctx)
+	if err != nil || len(done) != len(all) {
+		t.Fatalf("Up() = %d migrations, %v, want %d", len(done), err, len(all))
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+		t.Errorf("second Up() = %d migrations, %v, want none", len(done), err)
+	}
+
+	// The stores work on the migrated schema
+	store := auth.NewSQLStore(db)
+	if err := store.CreateTenant(auth.Tenant{Name: "acme", Active: true}); err != nil {
+		t.Fatalf("CreateTenant() error = %v", err)
+	}
+	if _, err := store.CreateToken(auth.Token{Token: "t1", Tenant: "acme", Active: true, ACL: auth.ACL{Publish: []string{"news"}}}); err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	if _, err := store.CreateToken(auth.Token{Token: "t1", Tenant: "acme", Active: true}); err == nil {
+		t.Error("duplicate token stored")
+	}
+	if tok, err := store.Lookup("t1"); err != nil || tok.Tenant != "acme" {
+		t.Errorf("Lookup() = %+v, %v", tok, err)
+	}
+	if _, err := webhook.NewStore(db).Add(webhook.Subscription{Tenant: "acme", Pattern: "news", URL: "http://example.com"}); err != nil {
+		t.Errorf("webhook Add() error = %v", err)
+	}
+	if _, err := bridge.NewStore(db).Add(pubsub.Bridge{Tenant: "acme", Channel: "news", Targets: []string{"globex"}}); err != nil {
+		t.Errorf("bridge Add() error = %v", err)
+	}
+
+	done, err = m.Down(ctx, 2)
+	if err != nil || len(done) != 2 || done[0].Version != len(all) {
+		t.Fatalf("Down(2) = %+v, %v", done, err)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	for _, st := range status {
+		if want := st.Version <= len(all)-2; st.Applied != want {
+			t.Errorf("migration %d applied = %v, want %v", st.Version, st.Applied, want)
+		}
+	}
+	if _, err := db.Exec("SELECT 1 FROM tenants"); err == nil {
+		t.Error("tenants table survived Down()")
+	}
+
+	if _, err := m.Down(ctx, len(all)); err != nil {
+		t.Fatalf("Down(all) error = %v", err)
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != len(all) {
+		t.Errorf("Up() after Down(all) = %d migrations, %v", len(done), err)
+	}
+}
+
+func TestForce(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	// A token store created by hand before migrations existed
+	db.Exec("CREATE TABLE clients (id INTEGER PRIMARY KEY AUTOINCREMENT, token TEXT NOT NULL, is_active BOOLEAN NOT NULL DEFAULT TRUE)")
+
+	m, _ := migrate.New(db, "sqlite3")
+	if _, err := m.Up(ctx); err == nil {
+		t.Fatal("Up() over an existing clients table succeeded")
+	}
+	if err := m.Force(ctx, 1); err != nil {
+		t.Fatalf("Force(1) error = %v", err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() after Force(1) error = %v", err)
+	}
+	status, _ := m.Status(ctx)
+	for _, st := range status {
+		if !st.Applied {
+			t.Errorf("migration %d not applied", st.Version)
+		}
+	}
+}
+
+func TestTokenTenants(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	m, _ := migrate.New(db, "sqlite3")
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	if _, err := m.Down(ctx, 1); err != nil {
+		t.Fatalf("Down(1) error = %v", err)
+	}
+
+	// Webhooks and bridges stored while tokens without a tenant were
+	// named by the token itself
+	db.Exec("INSERT INTO clients (token, tenant) VALUES ('legacy', NULL), ('acme-web', 'acme')")
+	webhook.NewStore(db).Add(webhook.Subscription{Tenant: "legacy", Pattern: "news", URL: "http://example.com"})
+	webhook.NewStore(db).Add(webhook.Subscription{Tenant: "acme", Pattern: "news", URL: "http://example.com"})
+	bridge.NewStore(db).Add(pubsub.Bridge{Tenant: "legacy", Channel: "news", Targets: []string{"acme"}})
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	subs, err := webhook.NewStore(db).All()
+	if err != nil || len(subs) != 2 || subs[0].Tenant != "token:legacy" || subs[1].Tenant != "acme" {
+		t.Errorf("webhooks = %+v, %v, want token:legacy and acme", subs, err)
+	}
+	bridges, err := bridge.NewStore(db).All()
+	if err != nil || len(bridges) != 1 || bridges[0].Tenant != "token:legacy" {
+		t.Errorf("bridges = %+v, %v, want token:legacy", bridges, err)
+	}
+}
@@ -0,0 +1,96 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"redix/pkg/protocol"
+)
+
+var fuzzLimits = protocol.Limits{MaxBulkLen: 1 << 10, MaxMultibulkLen: 64, MaxInlineLen: 256, MaxDepth: 8}
+
+func fuzzSeeds(f *testing.F) {
+	for _, seed := range []string{
+		"*3\r\n$7\r\nPUBLISH\r\n$4\r\nnews\r\n$5\r\nhello\r\n",
+		"*1\r\n$4\r\nPING\r\n",
+		"SUBSCRIBE a b\r\n",
+		"PUBLISH \"a b\" 'c\\'d' \"\\x41\\n\"\r\n",
+		"PING\n",
+		"*0\r\n*-1\r\n",
+		"*1\r\n$-1\r\n",
+		"*2\r\n$99999999999\r\n",
+		"+OK\r\n-ERR bad\r\n:42\r\n$-1\r\n*2\r\n$1\r\na\r\n*1\r\n:1\r\n",
+		"*1\r\n*1\r\n*1\r\n*1\r\n*1\r\n*1\r\n*1\r\n*1\r\n*1\r\n:1\r\n",
+		"$4\r\nPINGXX",
+	} {
+		f.Add([]byte(seed))
+	}
+}
+
+// FuzzReadCommand checks that the reader never panics, stays within its
+// limits and only fails with protocol or EOF errors
+func FuzzReadCommand(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := protocol.NewReader(bytes.NewReader(data))
+		r.SetLimits(fuzzLimits)
+		for {
+			args, err := r.ReadCommand()
+			if err != nil {
+				if !errors.Is(err, protocol.ErrProtocol) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if len(args) == 0 || len(args) > fuzzLimits.MaxMultibulkLen {
+				t.Fatalf("got %d arguments", len(args))
+			}
+			for _, arg := range args {
+				if len(arg) > fuzzLimits.MaxBulkLen {
+					t.Fatalf("argument of %d bytes over the limit", len(arg))
+				}
+			}
+
+			// A command written back in multibulk form reads the same
+			again, err := protocol.NewReader(bytes.NewReader([]byte(protocol.FormatArray(args...)))).ReadCommand()
+			if err != nil || !slices.Equal(args, again) {
+				t.Fatalf("round trip of %q = %q, %v", args, again, err)
+			}
+		}
+	})
+}
+
+// FuzzReadValue checks reply decoding the same way, including nesting
+func FuzzReadValue(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := protocol.NewReader(bytes.NewReader(data))
+		r.SetLimits(fuzzLimits)
+		for {
+			v, err := r.ReadValue()
+			if err != nil {
+				if !errors.Is(err, protocol.ErrProtocol) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if d := depth(v); d > fuzzLimits.MaxDepth+1 {
+				t.Fatalf("value nested %d deep", d)
+			}
+		}
+	})
+}
+
+func depth(v protocol.Value) int {
+	d := 0
+	for _, elem := range v.Array {
+		d = max(d, depth(elem))
+	}
+	if v.Type == protocol.Array {
+		d++
+	}
+	return d
+}
@@ -0,0 +1,62 @@
+package protocol_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"redix/pkg/protocol"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"plain", "PUBLISH chan hello", []string{"PUBLISH", "chan", "hello"}},
+		{"extra whitespace", "  PUBLISH\tchan   hello  ", []string{"PUBLISH", "chan", "hello"}},
+		{"blank", "   ", nil},
+		{"double quotes", `PUBLISH chan "hello world"`, []string{"PUBLISH", "chan", "hello world"}},
+		{"escapes", `PUBLISH chan "a\nb\t\"c\"\\"`, []string{"PUBLISH", "chan", "a\nb\t\"c\"\\"}},
+		{"hex escape", `PUBLISH chan "\x41\x7a\xZZ"`, []string{"PUBLISH", "chan", "AzxZZ"}},
+		{"single quotes", `PUBLISH chan 'it\'s "raw" \n'`, []string{"PUBLISH", "chan", `it's "raw" \n`}},
+		{"empty argument", `PUBLISH chan ""`, []string{"PUBLISH", "chan", ""}},
+		{"quote inside argument", `PUBLISH ch"an 1"`, []string{"PUBLISH", "chan 1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := protocol.SplitArgs(tt.input)
+			if err != nil {
+				t.Fatalf("SplitArgs() error = %v", err)
+			}
+			if len(got) != len(tt.want) || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("SplitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, input := range []string{`PUBLISH "chan`, `PUBLISH 'chan`, `PUBLISH "chan"x`, `PUBLISH "chan\"`} {
+		if _, err := protocol.SplitArgs(input); !errors.Is(err, protocol.ErrUnbalancedQuotes) {
+			t.Errorf("SplitArgs(%q) error = %v, want ErrUnbalancedQuotes", input, err)
+		}
+	}
+}
+
+func TestReadInlineCommand(t *testing.T) {
+	r := protocol.NewReader(strings.NewReader("PUBLISH news \"hello world\"\r\n\r\nPING\n" + `SUBSCRIBE "news` + "\r\n"))
+	for _, want := range []string{"PUBLISH|news|hello world", "PING"} {
+		got, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("ReadCommand() error = %v", err)
+		}
+		if strings.Join(got, "|") != want {
+			t.Errorf("ReadCommand() = %q, want %q", got, want)
+		}
+	}
+	_, err := r.ReadCommand()
+	if !errors.Is(err, protocol.ErrProtocol) || !strings.Contains(err.Error(), "unbalanced quotes") {
+		t.Errorf("ReadCommand() error = %v, want unbalanced quotes protocol error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package protocol_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"redix/pkg/protocol"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$7\r\nPUBLISH\r\n$4\r\nnews\r\n$12\r\nhello\r\nworld\r\n" +
+		"*1\r\n$4\r\nPING\r\n" +
+		"SUBSCRIBE a b\r\n"
+	r := protocol.NewReader(strings.NewReader(input))
+
+	want := [][]string{
+		{"PUBLISH", "news", "hello\r\nworld"},
+		{"PING"},
+		{"SUBSCRIBE", "a", "b"},
+	}
+	for _, w := range want {
+		got, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("ReadCommand() error = %v", err)
+		}
+		if strings.Join(got, "|") != strings.Join(w, "|") {
+			t.Errorf("ReadCommand() = %q, want %q", got, w)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("ReadCommand() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadCommandProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"invalid multibulk length", "*x\r\n"},
+		{"missing bulk prefix", "*1\r\n+PING\r\n"},
+		{"invalid bulk length", "*1\r\n$-5\r\n"},
+		{"bulk not terminated", "*1\r\n$4\r\nPINGXX"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := protocol.NewReader(strings.NewReader(tt.input)).ReadCommand()
+			if !errors.Is(err, protocol.ErrProtocol) {
+				t.Errorf("ReadCommand() error = %v, want protocol error", err)
+			}
+		})
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	input := "+OK\r\n-ERR bad\r\n:42\r\n$-1\r\n*2\r\n$1\r\na\r\n*1\r\n:1\r\n"
+	r := protocol.NewReader(strings.NewReader(input))
+
+	v, _ := r.ReadValue()
+	if v.Type != protocol.SimpleString || v.Str != "OK" {
+		t.Errorf("simple string = %+v", v)
+	}
+	v, _ = r.ReadValue()
+	if v.Type != protocol.Error || v.Str != "ERR bad" {
+		t.Errorf("error = %+v", v)
+	}
+	v, _ = r.ReadValue()
+	if v.Type != protocol.Integer || v.Int != 42 || v.String() != "42" {
+		t.Errorf("integer = %+v", v)
+	}
+	v, _ = r.ReadValue()
+	if v.Type != protocol.BulkString || !v.Null {
+		t.Errorf("null bulk = %+v", v)
+	}
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue() error = %v", err)
+	}
+	if v.Type != protocol.Array || len(v.Array) != 2 || v.Array[0].Str != "a" || v.Array[1].Array[0].Int != 1 {
+		t.Errorf("nested array = %+v", v)
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	limits := protocol.Limits{MaxBulkLen: 8, MaxMultibulkLen: 3, MaxInlineLen: 16, MaxDepth: 2}
+	tests := []struct {
+		name  string
+		input string
+		value bool
+		want  string
+	}{
+		{"bulk too long", "*1\r\n$9\r\n123456789\r\n", false, "invalid bulk length"},
+		{"too many arguments", "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", false, "invalid multibulk length"},
+		{"inline too long", "SUBSCRIBE " + strings.Repeat("a", 20) + "\r\n", false, "too big inline request"},
+		{"unterminated line", strings.Repeat("x", 100), false, "too big inline request"},
+		{"huge length", "*1\r\n$99999999999\r\n", false, "invalid bulk length"},
+		{"nested too deeply", "*1\r\n*1\r\n*1\r\n:1\r\n", true, "nested too deeply"},
+		{"reply array too long", "*4\r\n:1\r\n:2\r\n:3\r\n:4\r\n", true, "invalid multibulk length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := protocol.NewReader(strings.NewReader(tt.input))
+			r.SetLimits(limits)
+			var err error
+			if tt.value {
+				_, err = r.ReadValue()
+			} else {
+				_, err = r.ReadCommand()
+			}
+			if !errors.Is(err, protocol.ErrProtocol) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want protocol error %q", err, tt.want)
+			}
+		})
+	}
+
+	// Input at the limits is accepted
+	r := protocol.NewReader(strings.NewReader("*3\r\n$8\r\n12345678\r\n$1\r\nb\r\n$1\r\nc\r\nPING 1234567890\r\n"))
+	r.SetLimits(limits)
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadCommand(); err != nil {
+			t.Errorf("ReadCommand() at the limits error = %v", err)
+		}
+	}
+
+	if err := (protocol.Limits{MaxChannelLen: 4}).CheckChannel("news!"); !errors.Is(err, protocol.ErrProtocol) {
+		t.Errorf("CheckChannel() error = %v, want protocol error", err)
+	}
+}
@@ -1,23 +1,34 @@
 package pubsub_test
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"redix/pkg/auth"
 	"redix/pkg/client"
+	"redix/pkg/protocol"
 	"redix/pkg/pubsub"
 )
 
-// mockConn is a mock implementation of net.Conn for testing
+// mockConn is a mock implementation of net.Conn for testing. Writes are
+// serialized like those of a real connection, since consumer groups write
+// from their redelivery timers too.
 type mockConn struct {
+	mu        sync.Mutex
 	writeData []byte
 	closed    bool
 }
 
-func (m *mockConn) Read(b []byte) (n int, err error)   { return 0, nil }
-func (m *mockConn) Write(b []byte) (n int, err error)  { m.writeData = b; return len(b), nil }
+func (m *mockConn) Read(b []byte) (n int, err error) { return 0, nil }
+func (m *mockConn) Write(b []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeData = b
+	return len(b), nil
+}
 func (m *mockConn) Close() error                       { m.closed = true; return nil }
 func (m *mockConn) LocalAddr() net.Addr                { return nil }
 func (m *mockConn) RemoteAddr() net.Addr               { return nil }
@@ -113,18 +124,28 @@ func TestPublish(t *testing.T) {
 		t.Error("Publish() sent message to token2 subscriber")
 	}
 
-	// Test publishing with master token
+	// Test publishing with master token: only the master tenant's own
+	// subscribers receive it
 	conn1.writeData = nil
 	conn2.writeData = nil
-	count = ps.Publish("test", "hello", auth.MasterToken)
+	count = ps.Publish("test", "hello", auth.MasterTenant)
+	if count != 0 {
+		t.Errorf("Publish() count = %d, want 0", count)
+	}
+	if string(conn1.writeData) != "" || string(conn2.writeData) != "" {
+		t.Error("Publish() with master token reached another tenant")
+	}
+
+	// Test broadcasting
+	count = ps.Publish("test", "hello", auth.AllTenants)
 	if count != 2 {
 		t.Errorf("Publish() count = %d, want 2", count)
 	}
 	if string(conn1.writeData) == "" {
-		t.Error("Publish() did not send message to token1 subscriber with master token")
+		t.Error("Publish() did not send broadcast to token1 subscriber")
 	}
 	if string(conn2.writeData) == "" {
-		t.Error("Publish() did not send message to token2 subscriber with master token")
+		t.Error("Publish() did not send broadcast to token2 subscriber")
 	}
 }
 
@@ -260,8 +281,8 @@ func TestClientIsolation(t *testing.T) {
 	conn2.writeData = nil
 	conn3.writeData = nil
 
-	// Test 3: Publish with master token - should go to all clients
-	count = ps.Publish("test", "hello-master", auth.MasterToken)
+	// Test 3: Broadcast - should go to all clients
+	count = ps.Publish("test", "hello-master", auth.AllTenants)
 	if count != 3 {
 		t.Errorf("Publish() count = %d, want 3", count)
 	}
@@ -308,8 +329,8 @@ func TestUnauthenticatedClientIsolation(t *testing.T) {
 	conn1.writeData = nil
 	conn2.writeData = nil
 
-	// Test 2: Publish with master token - should still only go to authenticated client
-	count = ps.Publish("test", "hello-master", auth.MasterToken)
+	// Test 2: Broadcast - should still only go to authenticated client
+	count = ps.Publish("test", "hello-master", auth.AllTenants)
 	if count != 1 {
 		t.Errorf("Publish() count = %d, want 1", count)
 	}
@@ -366,3 +387,452 @@ func TestMultiTopicIsolation(t *testing.T) {
 		t.Error("Publish() did not send message to topic2 subscriber")
 	}
 }
+
+func TestHistory(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetRetention(2)
+
+	ps.Publish("test", "one", "token1")
+	ps.Publish("test", "two", "token1")
+	ps.Publish("test", "other", "token2")
+	ps.Publish("test", "three", "token1")
+
+	history := ps.History("test", "token1", 0)
+	if len(history) != 1 || history[0].Payload != "three" {
+		t.Fatalf("History() = %v, want only the retained token1 message", history)
+	}
+
+	all := ps.History("test", "token2", 0)
+	if len(all) != 1 || all[0].Payload != "other" {
+		t.Fatalf("History() for token2 = %v, want [other]", all)
+	}
+
+	if got := ps.History("test", "token1", history[0].ID); len(got) != 0 {
+		t.Errorf("History() after last ID = %v, want empty", got)
+	}
+
+	ps.SetRetention(0)
+	if got := ps.History("test", "token1", 0); len(got) != 0 {
+		t.Errorf("History() with retention disabled = %v, want empty", got)
+	}
+}
+
+func TestPSubscribe(t *testing.T) {
+	ps := pubsub.New()
+	conn1 := &mockConn{}
+	conn2 := &mockConn{}
+	c1 := client.New(conn1)
+	c2 := client.New(conn2)
+	c1.Token, c1.Authed = "token1", true
+	c2.Token, c2.Authed = "token2", true
+
+	ps.PSubscribe("orders.*", c1)
+	ps.PSubscribe("orders.*", c2)
+
+	count := ps.Publish("orders.created", "hello", "token1")
+	if count != 1 {
+		t.Errorf("Publish() count = %d, want 1", count)
+	}
+	if want := protocol.FormatPMessage("orders.*", "orders.created", "hello"); string(conn1.writeData) != want {
+		t.Errorf("pattern subscriber received %q, want %q", conn1.writeData, want)
+	}
+	if len(conn2.writeData) != 0 {
+		t.Error("Publish() sent message to token2 pattern subscriber")
+	}
+
+	ps.PUnsubscribe("orders.*", c1)
+	conn1.writeData = nil
+	if count := ps.Publish("orders.created", "again", "token1"); count != 0 {
+		t.Errorf("Publish() after PUnsubscribe() count = %d, want 0", count)
+	}
+}
+
+func TestWatchInterest(t *testing.T) {
+	ps := pubsub.New()
+	c1 := client.New(&mockConn{})
+	c2 := client.New(&mockConn{})
+	c1.Token, c1.Authed = "token1", true
+	c2.Token, c2.Authed = "token1", true
+	ps.Subscribe("news", c1)
+
+	var events []string
+	record := func(in pubsub.Interest, added bool) {
+		op := "-"
+		if added {
+			op = "+"
+		}
+		if in.Pattern {
+			op += "p"
+		}
+		events = append(events, op+in.Tenant+"/"+in.Name)
+	}
+	ps.WatchInterest(record)
+
+	ps.Subscribe("news", c2) // already known
+	ps.Subscribe("news", c2) // duplicate
+	ps.PSubscribe("orders.*", c1)
+	ps.Unsubscribe("news", c1) // c2 still subscribed
+	ps.UnsubscribeAll(c2)
+	ps.DisconnectToken("token1")
+
+	want := []string{"+token1/news", "+ptoken1/orders.*", "-token1/news", "-ptoken1/orders.*"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events = %v, want %v", events, want)
+			break
+		}
+	}
+}
+
+func TestDeliverSkipsHooks(t *testing.T) {
+	ps := pubsub.New()
+	conn := &mockConn{}
+	c := client.New(conn)
+	c.Token, c.Authed = "token1", true
+	ps.Subscribe("news", c)
+
+	hooked := 0
+	ps.OnPublish(func(string, client.Message) { hooked++ })
+
+	if n := ps.Deliver("news", "remote", "token1"); n != 1 || hooked != 0 {
+		t.Errorf("Deliver() = %d with %d hook calls, want 1 and 0", n, hooked)
+	}
+	if want := protocol.FormatMessage("news", "remote"); string(conn.writeData) != want {
+		t.Errorf("subscriber received %q, want %q", conn.writeData, want)
+	}
+	ps.Publish("news", "local", "token1")
+	if hooked != 1 {
+		t.Errorf("Publish() ran %d hooks, want 1", hooked)
+	}
+}
+
+func TestTenantNamespace(t *testing.T) {
+	ps := pubsub.New()
+	conns := []*mockConn{{}, {}, {}}
+	clients := make([]*client.Client, len(conns))
+	for i, conn := range conns {
+		clients[i] = client.New(conn)
+		clients[i].Authed = true
+	}
+	// Two tokens of tenant acme and one token of tenant globex
+	clients[0].Token, clients[0].Tenant = "token1", "acme"
+	clients[1].Token, clients[1].Tenant = "token2", "acme"
+	clients[2].Token, clients[2].Tenant = "token3", "globex"
+	for _, c := range clients {
+		if err := ps.Subscribe("news", c); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+	}
+
+	if got := ps.Publish("news", "hello", "acme"); got != 2 {
+		t.Errorf("Publish() by acme count = %d, want 2", got)
+	}
+	if conns[2].writeData != nil {
+		t.Error("Publish() by acme reached tenant globex")
+	}
+	if got := ps.Publish("news", "hello", auth.AllTenants); got != 3 {
+		t.Errorf("Publish() broadcast count = %d, want 3", got)
+	}
+
+	stats := ps.TenantStats("acme")
+	if stats.Clients != 2 || stats.Channels != 1 || stats.Subscriptions != 2 {
+		t.Errorf("TenantStats() = %+v, want 2 clients on 1 channel", stats)
+	}
+	if stats.Published != 1 || stats.Delivered != 4 {
+		t.Errorf("TenantStats() published=%d delivered=%d, want 1 and 4", stats.Published, stats.Delivered)
+	}
+	// The master tenant has a namespace for its publish counters
+	tenants := ps.Tenants()
+	if len(tenants) != 3 || tenants[0].Tenant != auth.MasterTenant || tenants[1].Tenant != "acme" {
+		t.Errorf("Tenants() = %+v, want master, acme and globex", tenants)
+	}
+
+	ps.UnsubscribeAll(clients[2])
+	if stats := ps.TenantStats("globex"); stats.Clients != 0 || stats.Subscriptions != 0 {
+		t.Errorf("TenantStats() after unsubscribe = %+v, want no clients", stats)
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetDefaultTenantLimits(pubsub.TenantLimits{MaxChannels: 2, MaxSubscriptions: 3})
+
+	c1 := client.New(&mockConn{})
+	c2 := client.New(&mockConn{})
+	c1.Token, c2.Token = "token1", "token2"
+	c1.Tenant, c2.Tenant = "acme", "acme"
+
+	if err := ps.Subscribe("a", c1); err != nil {
+		t.Fatalf("Subscribe(a) error = %v", err)
+	}
+	if err := ps.PSubscribe("b.*", c1); err != nil {
+		t.Fatalf("PSubscribe(b.*) error = %v", err)
+	}
+	if err := ps.Subscribe("c", c2); err != pubsub.ErrChannelLimit {
+		t.Errorf("Subscribe(c) error = %v, want ErrChannelLimit", err)
+	}
+	if err := ps.Subscribe("a", c2); err != nil {
+		t.Errorf("Subscribe(a) on an existing channel error = %v", err)
+	}
+	if err := ps.PSubscribe("b.*", c2); err != pubsub.ErrSubscriptionLimit {
+		t.Errorf("PSubscribe(b.*) error = %v, want ErrSubscriptionLimit", err)
+	}
+
+	// Overrides apply to one tenant only
+	ps.SetTenantLimits("acme", pubsub.TenantLimits{})
+	if err := ps.Subscribe("c", c2); err != nil {
+		t.Errorf("Subscribe(c) after override error = %v", err)
+	}
+	ps.ClearTenantLimits("acme")
+	if got := ps.TenantLimits("acme"); got.MaxChannels != 2 {
+		t.Errorf("TenantLimits() after clear = %+v, want the defaults", got)
+	}
+
+	master := client.New(&mockConn{})
+	master.Token = auth.MasterToken
+	for _, ch := range []string{"x", "y", "z"} {
+		if err := ps.Subscribe(ch, master); err != nil {
+			t.Errorf("Subscribe(%s) by master error = %v", ch, err)
+		}
+	}
+}
+
+func TestBridges(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetRetention(10)
+	conns := map[string]*mockConn{"acme": {}, "globex": {}, "initech": {}}
+	for tenant, conn := range conns {
+		c := client.New(conn)
+		c.Token, c.Authed = tenant, true
+		ps.Subscribe("news", c)
+	}
+	var hooked []string
+	ps.OnPublish(func(tenant string, msg client.Message) { hooked = append(hooked, tenant) })
+
+	ps.SetBridges([]pubsub.Bridge{
+		{ID: 1, Tenant: "acme", Channel: "news", Targets: []string{"globex"}, ReadOnly: true},
+		{ID: 2, Tenant: "initech", Channel: "news", Targets: []string{"acme"}},
+	})
+
+	// acme reaches globex over its read-only bridge, and initech because
+	// initech bridged its channel into acme writable
+	if got := ps.Publish("news", "from acme", "acme"); got != 3 {
+		t.Errorf("Publish() by acme count = %d, want 3", got)
+	}
+	if len(hooked) != 3 || hooked[0] != "acme" || hooked[1] != "globex" || hooked[2] != "initech" {
+		t.Errorf("publish hooks ran for %v, want acme, globex and initech", hooked)
+	}
+	if got := len(ps.History("news", "globex", 0)); got != 1 {
+		t.Errorf("History() for globex = %d messages, want 1", got)
+	}
+
+	// globex only receives, and initech's publishes stay out of globex
+	if err := ps.CanPublish("globex", "news"); err != pubsub.ErrReadOnlyBridge {
+		t.Errorf("CanPublish() by a read-only target = %v, want ErrReadOnlyBridge", err)
+	}
+	if err := ps.CanPublish("globex", "other"); err != nil {
+		t.Errorf("CanPublish() on another channel = %v", err)
+	}
+	conns["globex"].writeData = nil
+	if got := ps.Publish("news", "from initech", "initech"); got != 2 {
+		t.Errorf("Publish() by initech count = %d, want 2", got)
+	}
+	if conns["globex"].writeData != nil {
+		t.Error("Publish() by initech reached globex")
+	}
+
+	if !ps.RemoveBridge(1) || ps.RemoveBridge(1) {
+		t.Error("RemoveBridge() did not remove the bridge exactly once")
+	}
+	if got := ps.Bridges(); len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("Bridges() = %+v, want bridge 2", got)
+	}
+	if err := ps.CanPublish("globex", "news"); err != nil {
+		t.Errorf("CanPublish() after RemoveBridge() = %v", err)
+	}
+}
+
+func TestReliableGroups(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetReliable(pubsub.ReliableOptions{VisibilityTimeout: 50 * time.Millisecond})
+	consumers := make([]*client.Client, 3)
+	for i := range consumers {
+		consumers[i] = client.New(&mockConn{})
+		consumers[i].ID = uint64(i + 1)
+		consumers[i].Token, consumers[i].Tenant, consumers[i].Authed = "token", "acme", true
+	}
+	consumers[2].Tenant = "globex"
+	for _, c := range consumers {
+		if n, err := ps.RSubscribe("billing", "invoices", c); n != 1 || err != nil {
+			t.Errorf("RSubscribe() = %d channels, %v, want 1", n, err)
+		}
+	}
+
+	ps.Publish("invoices", "a", "acme")
+	ps.Publish("invoices", "b", "acme")
+	ps.Publish("refunds", "c", "acme")
+	pending, err := ps.PendingMessages("billing", "acme")
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("PendingMessages() = %+v, %v, want 2 messages", pending, err)
+	}
+	if pending[0].Consumer == pending[1].Consumer || pending[0].Deliveries != 1 {
+		t.Errorf("PendingMessages() = %+v, want one message per consumer", pending)
+	}
+	if other, _ := ps.PendingMessages("billing", "globex"); len(other) != 0 {
+		t.Errorf("globex group got acme messages: %+v", other)
+	}
+
+	if n := ps.Ack("billing", consumers[0], []uint64{pending[0].ID, pending[0].ID, 999}); n != 1 {
+		t.Errorf("Ack() = %d, want 1", n)
+	}
+	if n := ps.Ack("billing", consumers[2], []uint64{pending[1].ID}); n != 0 {
+		t.Errorf("Ack() by another tenant = %d, want 0", n)
+	}
+	if n := ps.Ack("billing", consumers[0], []uint64{pending[1].ID}); n != 0 {
+		t.Errorf("Ack() of another consumer's message = %d, want 0", n)
+	}
+
+	// Unacknowledged messages are delivered again after the visibility timeout
+	time.Sleep(120 * time.Millisecond)
+	pending, _ = ps.PendingMessages("billing", "acme")
+	if len(pending) != 1 || pending[0].Deliveries < 2 {
+		t.Errorf("PendingMessages() after the timeout = %+v, want a redelivered message", pending)
+	}
+
+	// Without consumers the group keeps its messages
+	ps.UnsubscribeAll(consumers[0])
+	ps.RUnsubscribe("billing", consumers[1])
+	ps.Publish("invoices", "d", auth.AllTenants)
+	pending, _ = ps.PendingMessages("billing", "acme")
+	if len(pending) != 2 || pending[0].Consumer != 0 || pending[1].Deliveries != 0 {
+		t.Fatalf("PendingMessages() without consumers = %+v", pending)
+	}
+	ps.RSubscribe("billing", "invoices", consumers[1])
+	pending, _ = ps.PendingMessages("billing", "acme")
+	for _, pm := range pending {
+		if pm.Consumer != consumers[1].ID {
+			t.Errorf("message %d not delivered to the new consumer: %+v", pm.ID, pm)
+		}
+	}
+
+	// A group without consumers or pending messages is dropped
+	ps.Ack("billing", consumers[1], []uint64{pending[0].ID, pending[1].ID})
+	ps.RUnsubscribe("billing", consumers[1])
+	if _, err := ps.PendingMessages("billing", "acme"); !errors.Is(err, pubsub.ErrNoGroup) {
+		t.Errorf("PendingMessages() of a drained group error = %v, want ErrNoGroup", err)
+	}
+}
+
+func TestReliableMaxPending(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetReliable(pubsub.ReliableOptions{VisibilityTimeout: time.Minute, MaxPending: 2})
+	c := client.New(&mockConn{})
+	c.Token, c.Authed = "token", true
+	ps.RSubscribe("billing", "invoices", c)
+
+	for _, m := range []string{"a", "b"} {
+		if err := ps.CanEnqueue("token", "invoices", 1); err != nil {
+			t.Fatalf("CanEnqueue(%s) error = %v", m, err)
+		}
+		ps.Publish("invoices", m, "token")
+	}
+	if err := ps.CanEnqueue("token", "invoices", 1); !errors.Is(err, pubsub.ErrGroupFull) {
+		t.Errorf("CanEnqueue() on a full group error = %v, want ErrGroupFull", err)
+	}
+	if err := ps.CanEnqueue("token", "refunds", 1); err != nil {
+		t.Errorf("CanEnqueue() on another channel error = %v", err)
+	}
+	pending, _ := ps.PendingMessages("billing", "token")
+	if len(pending) != 2 || pending[0].ID != 1 {
+		t.Fatalf("PendingMessages() = %+v, want the 2 oldest messages", pending)
+	}
+
+	ps.Ack("billing", c, []uint64{pending[0].ID})
+	if err := ps.CanEnqueue("token", "invoices", 1); err != nil {
+		t.Errorf("CanEnqueue() after Ack() error = %v", err)
+	}
+	if err := ps.CanEnqueue("token", "invoices", 2); !errors.Is(err, pubsub.ErrGroupFull) {
+		t.Errorf("CanEnqueue() of 2 messages error = %v, want ErrGroupFull", err)
+	}
+}
+
+func TestReliableDestroyGroup(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetReliable(pubsub.ReliableOptions{VisibilityTimeout: time.Minute, MaxPending: 2})
+	c := client.New(&mockConn{})
+	c.Token, c.Tenant, c.Authed = "token", "acme", true
+	ps.RSubscribe("billing", "invoices", c)
+	ps.Publish("invoices", "a", "acme")
+	ps.Publish("invoices", "b", "acme")
+
+	if _, err := ps.DestroyGroup("billing", "acme"); !errors.Is(err, pubsub.ErrGroupBusy) {
+		t.Errorf("DestroyGroup() with a consumer error = %v, want ErrGroupBusy", err)
+	}
+
+	// A full group whose consumers left blocks publishes until destroyed
+	ps.RUnsubscribe("billing", c)
+	if err := ps.CanEnqueue("acme", "invoices", 1); !errors.Is(err, pubsub.ErrGroupFull) {
+		t.Errorf("CanEnqueue() on an abandoned full group error = %v, want ErrGroupFull", err)
+	}
+	if ok, err := ps.DestroyGroup("billing", "globex"); ok || err != nil {
+		t.Errorf("DestroyGroup() of another tenant = %v, %v, want false", ok, err)
+	}
+	if ok, err := ps.DestroyGroup("billing", "acme"); !ok || err != nil {
+		t.Errorf("DestroyGroup() = %v, %v, want true", ok, err)
+	}
+	if err := ps.CanEnqueue("acme", "invoices", 1); err != nil {
+		t.Errorf("CanEnqueue() after DestroyGroup() error = %v", err)
+	}
+	if _, err := ps.PendingMessages("billing", "acme"); !errors.Is(err, pubsub.ErrNoGroup) {
+		t.Errorf("PendingMessages() of a destroyed group error = %v, want ErrNoGroup", err)
+	}
+	if ok, _ := ps.DestroyGroup("billing", "acme"); ok {
+		t.Error("DestroyGroup() of a destroyed group = true")
+	}
+}
+
+func TestReliableConsumerLimits(t *testing.T) {
+	ps := pubsub.New()
+	ps.SetDefaultTenantLimits(pubsub.TenantLimits{MaxChannels: 2, MaxSubscriptions: 2})
+	c1, c2, c3 := client.New(&mockConn{}), client.New(&mockConn{}), client.New(&mockConn{})
+	for _, c := range []*client.Client{c1, c2, c3} {
+		c.Token, c.Tenant, c.Authed = "token", "acme", true
+	}
+
+	if err := ps.Subscribe("news", c1); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if _, err := ps.RSubscribe("billing", "invoices", c1); err != nil {
+		t.Fatalf("RSubscribe() error = %v", err)
+	}
+	if _, err := ps.RSubscribe("billing", "refunds", c1); !errors.Is(err, pubsub.ErrChannelLimit) {
+		t.Errorf("RSubscribe() over the channel limit error = %v, want ErrChannelLimit", err)
+	}
+	if _, err := ps.RSubscribe("billing", "invoices", c2); !errors.Is(err, pubsub.ErrSubscriptionLimit) {
+		t.Errorf("RSubscribe() over the subscription limit error = %v, want ErrSubscriptionLimit", err)
+	}
+	if c2.GroupCount() != 0 {
+		t.Errorf("rejected consumer joined %d groups", c2.GroupCount())
+	}
+	if stats := ps.TenantStats("acme"); stats.Clients != 1 || stats.Subscriptions != 2 {
+		t.Errorf("TenantStats() = %+v, want 1 client with 2 subscriptions", stats)
+	}
+
+	// Disconnecting a token reaches consumers, which frees their room
+	ps.Unsubscribe("news", c1)
+	if err := ps.Subscribe("news", c3); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if n := ps.DisconnectToken("token"); n != 2 {
+		t.Errorf("DisconnectToken() = %d, want 2", n)
+	}
+	if c1.GroupCount() != 0 {
+		t.Errorf("disconnected consumer still in %d groups", c1.GroupCount())
+	}
+	if _, err := ps.RSubscribe("billing", "invoices", c2); err != nil {
+		t.Errorf("RSubscribe() after DisconnectToken() error = %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package redixclient_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/redixclient"
+	"redix/pkg/server"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// startServer runs a Redix server on a loopback port and returns its address
+func startServer(t *testing.T) string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`); err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+	for _, token := range []string{"token1", "token2", auth.MasterToken} {
+		if _, err := db.Exec("INSERT INTO clients (token, is_active) VALUES (?, 1)", token); err != nil {
+			t.Fatalf("Failed to insert test data: %v", err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := server.New(db)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr, token string, opts *redixclient.Options) *redixclient.Client {
+	t.Helper()
+	c, err := redixclient.Dial(addr, token, opts)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// publishUntilReceived publishes until at least one subscriber receives
+// the message, since subscriptions are established asynchronously
+func publishUntilReceived(t *testing.T, c *redixclient.Client, channel, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		n, err := c.Publish(context.Background(), channel, msg)
+		if err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a subscriber")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, s *redixclient.Subscriber) redixclient.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-s.Messages():
+		if !ok {
+			t.Fatal("Messages() closed")
+		}
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return redixclient.Message{}
+}
+
+func TestDialInvalidToken(t *testing.T) {
+	addr := startServer(t)
+
+	_, err := redixclient.Dial(addr, "nope", nil)
+	var replyErr redixclient.Error
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("Dial() error = %v, want server error reply", err)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startServer(t)
+	c1 := dial(t, addr, "token1", nil)
+	c2 := dial(t, addr, "token2", nil)
+	ctx := context.Background()
+
+	sub, err := c1.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+	if err := sub.PSubscribe(ctx, "orders.*"); err != nil {
+		t.Fatalf("PSubscribe() error = %v", err)
+	}
+
+	publishUntilReceived(t, c1, "news", "hello")
+	if msg := receive(t, sub); msg.Channel != "news" || msg.Payload != "hello" {
+		t.Errorf("message = %+v, want hello on news", msg)
+	}
+
+	if n, _ := c2.Publish(ctx, "news", "other tenant"); n != 0 {
+		t.Errorf("Publish() from token2 reached %d subscribers, want 0", n)
+	}
+
+	publishUntilReceived(t, c1, "orders.created", "order")
+	msg := receive(t, sub)
+	if msg.Pattern != "orders.*" || msg.Channel != "orders.created" || msg.Payload != "order" {
+		t.Errorf("pattern message = %+v", msg)
+	}
+
+	if err := sub.Unsubscribe(ctx, "news"); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if got := sub.Channels(); len(got) != 0 {
+		t.Errorf("Channels() = %v, want empty", got)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr, "token1", nil)
+
+	p := c.Pipeline()
+	for i := 0; i < 100; i++ {
+		p.Publish("bulk", "payload")
+	}
+	p.Do("NOSUCHCOMMAND")
+
+	replies, err := p.Exec(context.Background())
+	if err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	if len(replies) != 101 {
+		t.Fatalf("Exec() returned %d replies, want 101", len(replies))
+	}
+	for i, r := range replies[:100] {
+		if r.Type != ':' {
+			t.Fatalf("reply %d = %+v, want integer", i, r)
+		}
+	}
+	if replies[100].Type != '-' {
+		t.Errorf("last reply = %+v, want error", replies[100])
+	}
+	if p.Len() != 0 {
+		t.Errorf("Len() after Exec() = %d, want 0", p.Len())
+	}
+}
+
+func TestPoolConcurrentPublish(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr, "token1", &redixclient.Options{PoolSize: 3})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Publish(context.Background(), "load", "x"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Publish() error = %v", err)
+	}
+}
+
+func TestSubscriberReconnects(t *testing.T) {
+	addr := startServer(t)
+	opts := &redixclient.Options{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	c := dial(t, addr, "token1", opts)
+	master := dial(t, addr, auth.MasterToken, nil)
+	ctx := context.Background()
+
+	sub, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+	sub.PSubscribe(ctx, "alerts.*")
+
+	publishUntilReceived(t, c, "news", "before")
+	receive(t, sub)
+
+	if _, err := master.Do(ctx, "DISCONNECT", "token1"); err != nil {
+		t.Fatalf("DISCONNECT error = %v", err)
+	}
+
+	publishUntilReceived(t, c, "news", "after")
+	if msg := receive(t, sub); msg.Payload != "after" {
+		t.Errorf("message after reconnect = %+v, want after", msg)
+	}
+	publishUntilReceived(t, c, "alerts.cpu", "pattern")
+	if msg := receive(t, sub); msg.Pattern != "alerts.*" {
+		t.Errorf("pattern message after reconnect = %+v", msg)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr, "token1", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Publish(ctx, "news", "x"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Publish() with canceled context error = %v, want context.Canceled", err)
+	}
+	if _, err := c.Publish(context.Background(), "news", "x"); err != nil {
+		t.Errorf("Publish() after canceled call error = %v", err)
+	}
+}
@@ -0,0 +1,751 @@
+package server_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/config"
+	"redix/pkg/httpapi"
+	"redix/pkg/protocol"
+	"redix/pkg/server"
+	"redix/pkg/websocket"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// conn is a raw RESP connection to the server
+type conn struct {
+	net.Conn
+	r *protocol.Reader
+}
+
+func startServer(t *testing.T, limits config.Limits) string {
+	t.Helper()
+	return startServerWith(t, limits, protocol.DefaultLimits())
+}
+
+func startServerWith(t *testing.T, limits config.Limits, proto protocol.Limits) string {
+	t.Helper()
+	_, addr := newServer(t, limits, proto)
+	return addr
+}
+
+// newServer starts a server and returns it with its address
+func newServer(t *testing.T, limits config.Limits, proto protocol.Limits) (*server.Server, string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE clients (token TEXT PRIMARY KEY, is_active INTEGER)`)
+	db.Exec("INSERT INTO clients (token, is_active) VALUES ('token1', 1), ('token2', 1), ('MASTER_TOKEN', 1)")
+	db.Exec(`CREATE TABLE bridges (id INTEGER PRIMARY KEY, tenant TEXT, channel TEXT, targets TEXT, read_only INTEGER)`)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := server.New(db)
+	srv.SetLimits(limits)
+	srv.SetProtocolLimits(proto)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv, ln.Addr().String()
+}
+
+// startTenantServer starts a server whose token store has tenants, ACLs
+// and token expiry
+func startTenantServer(t *testing.T) string {
+	t.Helper()
+	_, addr := newTenantServer(t)
+	return addr
+}
+
+// newTenantServer starts a tenant server and returns it with its address
+func newTenantServer(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	return serveDB(t, newTenantDB(t))
+}
+
+// newTenantDB creates a token store with tenants and the master token
+func newTenantDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`CREATE TABLE tenants (name TEXT PRIMARY KEY, is_active INTEGER NOT NULL DEFAULT 1,
+			max_channels INTEGER NOT NULL DEFAULT 0, max_subscriptions INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE clients (id INTEGER PRIMARY KEY, token TEXT UNIQUE, tenant TEXT, is_active INTEGER,
+			publish_acl TEXT, subscribe_acl TEXT, expires_at DATETIME)`,
+		"INSERT INTO clients (token, is_active) VALUES ('MASTER_TOKEN', 1)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("schema: %v", err)
+		}
+	}
+	return db
+}
+
+// serveDB starts a server on db and returns it with its address
+func serveDB(t *testing.T, db *sql.DB) (*server.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := server.New(db)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv, ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *conn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	return &conn{Conn: nc, r: protocol.NewReader(nc)}
+}
+
+// do sends a command and returns the reply
+func (c *conn) do(t *testing.T, args ...string) protocol.Value {
+	t.Helper()
+	if _, err := c.Write([]byte(protocol.FormatArray(args...))); err != nil {
+		t.Fatalf("write %v: %v", args, err)
+	}
+	return c.read(t)
+}
+
+func (c *conn) read(t *testing.T) protocol.Value {
+	t.Helper()
+	v, err := c.r.ReadValue()
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return v
+}
+
+// expectClosed reads the final error and waits for the server to close
+func (c *conn) expectClosed(t *testing.T, want string) {
+	t.Helper()
+	v := c.read(t)
+	if v.Type != protocol.Error || !strings.Contains(v.Str, want) {
+		t.Errorf("reply = %+v, want error containing %q", v, want)
+	}
+	if _, err := c.r.ReadValue(); !errors.Is(err, io.EOF) {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	addr := startServer(t, config.Limits{MaxClients: 1})
+	first := dial(t, addr)
+	if v := first.do(t, "PING"); v.Str != "PONG" {
+		t.Fatalf("PING = %+v", v)
+	}
+	dial(t, addr).expectClosed(t, "ERR max number of clients reached")
+}
+
+func TestMaxClientsPerToken(t *testing.T) {
+	addr := startServer(t, config.Limits{MaxClientsPerToken: 1})
+	first := dial(t, addr)
+	if v := first.do(t, "AUTH", "token1"); v.Str != "OK" {
+		t.Fatalf("AUTH = %+v", v)
+	}
+
+	second := dial(t, addr)
+	if v := second.do(t, "AUTH", "token1"); v.Type != protocol.Error || !strings.Contains(v.Str, "max number of clients reached for this token") {
+		t.Errorf("AUTH over the cap = %+v", v)
+	}
+	// Other tokens are counted separately
+	if v := second.do(t, "AUTH", "token2"); v.Str != "OK" {
+		t.Errorf("AUTH with another token = %+v", v)
+	}
+	// Re-authenticating with the same token does not count twice
+	if v := first.do(t, "AUTH", "token1"); v.Str != "OK" {
+		t.Errorf("repeated AUTH = %+v", v)
+	}
+
+	// Closing a connection frees its slot
+	first.Close()
+	third := dial(t, addr)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		v := third.do(t, "AUTH", "token1")
+		if v.Str == "OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("AUTH after close = %+v", v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewaySessionLimits(t *testing.T) {
+	srv, addr := newServer(t, config.Limits{MaxClients: 2, MaxClientsPerToken: 1}, protocol.DefaultLimits())
+	api := httpapi.New(srv.Auth(), srv.PubSub())
+	api.SetSessions(srv)
+	hs := httptest.NewServer(api.Handler())
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/v1/ws"
+
+	ws, err := websocket.Dial(url+"?token=token1", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer ws.CloseNow()
+
+	// The WebSocket session holds token1's only slot
+	resp := dial(t, addr)
+	if v := resp.do(t, "AUTH", "token1"); v.Type != protocol.Error || !strings.Contains(v.Str, "for this token") {
+		t.Errorf("AUTH over the per-token cap = %+v", v)
+	}
+	// and, with the RESP connection, the server is full
+	if _, err := websocket.Dial(url, nil); err == nil {
+		t.Error("Dial() over maxclients succeeded")
+	}
+	dial(t, addr).expectClosed(t, "ERR max number of clients reached")
+	if n := srv.ClientCount(); n != 2 {
+		t.Errorf("ClientCount() = %d, want 2", n)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	addr := startServer(t, config.Limits{AuthTimeout: 100 * time.Millisecond})
+
+	// Commands before AUTH do not extend the deadline
+	c := dial(t, addr)
+	c.do(t, "PING")
+	c.expectClosed(t, "ERR authentication timeout")
+
+	authed := dial(t, addr)
+	if v := authed.do(t, "AUTH", "token1"); v.Str != "OK" {
+		t.Fatalf("AUTH = %+v", v)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if v := authed.do(t, "PING"); v.Str != "PONG" {
+		t.Errorf("PING after auth deadline = %+v", v)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := startServer(t, config.Limits{IdleTimeout: 100 * time.Millisecond})
+
+	idle := dial(t, addr)
+	idle.do(t, "AUTH", "token1")
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", "token1")
+	sub.do(t, "SUBSCRIBE", "news")
+
+	idle.expectClosed(t, "ERR idle timeout")
+
+	// Subscribers are not subject to the idle timeout
+	time.Sleep(100 * time.Millisecond)
+	pub := dial(t, addr)
+	pub.do(t, "AUTH", "token1")
+	if v := pub.do(t, "PUBLISH", "news", "hello"); v.Int != 1 {
+		t.Fatalf("PUBLISH = %+v, want 1 receiver", v)
+	}
+	if v := sub.read(t); len(v.Array) != 3 || v.Array[2].Str != "hello" {
+		t.Errorf("message = %+v", v)
+	}
+}
+
+func TestProtocolLimits(t *testing.T) {
+	proto := protocol.DefaultLimits()
+	proto.MaxBulkLen = 64
+	proto.MaxChannelLen = 8
+	addr := startServerWith(t, config.Limits{}, proto)
+
+	c := dial(t, addr)
+	c.Write([]byte("*2\r\n$4\r\nPING\r\n$1000000\r\n"))
+	c.expectClosed(t, "ERR Protocol error: invalid bulk length")
+
+	for _, cmd := range [][]string{
+		{"SUBSCRIBE", "ok", "channel-name"},
+		{"PSUBSCRIBE", "pattern-too-long.*"},
+		{"PUBLISH", "channel-name", "hello"},
+	} {
+		c := dial(t, addr)
+		c.do(t, "AUTH", "token1")
+		// Nothing is subscribed when any name is too long
+		c.Write([]byte(protocol.FormatArray(cmd...)))
+		c.expectClosed(t, "ERR Protocol error: channel name too long")
+	}
+}
+
+func TestShardedPubSub(t *testing.T) {
+	addr := startServer(t, config.Limits{})
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", "token1")
+	if v := sub.do(t, "SSUBSCRIBE", "orders"); len(v.Array) != 3 || v.Array[0].Str != "ssubscribe" || v.Array[2].Int != 1 {
+		t.Fatalf("SSUBSCRIBE = %+v", v)
+	}
+	plain := dial(t, addr)
+	plain.do(t, "AUTH", "token1")
+	plain.do(t, "SUBSCRIBE", "orders")
+
+	pub := dial(t, addr)
+	pub.do(t, "AUTH", "token1")
+	if v := pub.do(t, "SPUBLISH", "orders", "hello"); v.Int != 1 {
+		t.Errorf("SPUBLISH = %+v, want 1 receiver", v)
+	}
+	if v := sub.read(t); len(v.Array) != 3 || v.Array[0].Str != "smessage" || v.Array[1].Str != "orders" || v.Array[2].Str != "hello" {
+		t.Errorf("sharded message = %+v", v)
+	}
+
+	// Shard channels are separate from channels, and tenants stay isolated
+	if v := pub.do(t, "PUBLISH", "orders", "plain"); v.Int != 1 {
+		t.Errorf("PUBLISH = %+v, want only the channel subscriber", v)
+	}
+	if v := plain.read(t); len(v.Array) != 3 || v.Array[0].Str != "message" || v.Array[2].Str != "plain" {
+		t.Errorf("message = %+v", v)
+	}
+	other := dial(t, addr)
+	other.do(t, "AUTH", "token2")
+	if v := other.do(t, "SPUBLISH", "orders", "other tenant"); v.Int != 0 {
+		t.Errorf("SPUBLISH from another tenant = %+v, want 0 receivers", v)
+	}
+
+	if v := sub.do(t, "SUNSUBSCRIBE"); len(v.Array) != 3 || v.Array[0].Str != "sunsubscribe" || v.Array[2].Int != 0 {
+		t.Errorf("SUNSUBSCRIBE = %+v", v)
+	}
+	if v := pub.do(t, "SPUBLISH", "orders", "gone"); v.Int != 0 {
+		t.Errorf("SPUBLISH after SUNSUBSCRIBE = %+v", v)
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	addr := startServer(t, config.Limits{TenantMaxChannels: 1})
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", "token1")
+	if v := sub.do(t, "SUBSCRIBE", "a", "b"); len(v.Array) != 3 || v.Array[1].Str != "a" {
+		t.Fatalf("SUBSCRIBE a = %+v", v)
+	}
+	if v := sub.read(t); v.Type != protocol.Error || !strings.Contains(v.Str, "tenant channel limit reached") {
+		t.Errorf("SUBSCRIBE over the tenant limit = %+v", v)
+	}
+	if v := sub.do(t, "RSUBSCRIBE", "billing", "invoices"); v.Type != protocol.Error || !strings.Contains(v.Str, "tenant channel limit reached") {
+		t.Errorf("RSUBSCRIBE over the tenant limit = %+v", v)
+	}
+
+	// Other tenants have their own allowance
+	other := dial(t, addr)
+	other.do(t, "AUTH", "token2")
+	if v := other.do(t, "SUBSCRIBE", "b"); len(v.Array) != 3 || v.Array[0].Str != "subscribe" {
+		t.Errorf("SUBSCRIBE by another tenant = %+v", v)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	addr := startServer(t, config.Limits{})
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", "token2")
+	sub.do(t, "SUBSCRIBE", "announcements")
+	pub := dial(t, addr)
+	pub.do(t, "AUTH", "token1")
+
+	if v := pub.do(t, "BRIDGE", "ADD", "token1", "announcements", "token2"); v.Type != protocol.Error || !strings.Contains(v.Str, "only master token") {
+		t.Errorf("BRIDGE ADD by a tenant = %+v", v)
+	}
+	if v := pub.do(t, "PUBLISH", "announcements", "before"); v.Int != 0 {
+		t.Errorf("PUBLISH before the bridge = %+v, want 0 receivers", v)
+	}
+
+	// Tokens without a tenant are their own token:<token> tenant
+	v := admin.do(t, "BRIDGE", "ADD", "token:token1", "announcements", "token:token2", "READONLY")
+	if v.Type != protocol.Integer || v.Int < 1 {
+		t.Fatalf("BRIDGE ADD = %+v", v)
+	}
+	id := strconv.FormatInt(v.Int, 10)
+	if v := admin.do(t, "BRIDGE", "LIST"); len(v.Array) != 1 || len(v.Array[0].Array) != 5 || v.Array[0].Array[4].Str != "readonly" {
+		t.Errorf("BRIDGE LIST = %+v", v)
+	} else if tenant, targets := v.Array[0].Array[1].Str, v.Array[0].Array[3].Str; tenant != "token:toke****" || targets != "token:toke****" {
+		t.Errorf("BRIDGE LIST tenant = %q, targets = %q, want redacted tokens", tenant, targets)
+	}
+
+	if v := pub.do(t, "PUBLISH", "announcements", "hello"); v.Int != 1 {
+		t.Errorf("PUBLISH over the bridge = %+v, want 1 receiver", v)
+	}
+	if v := sub.read(t); len(v.Array) != 3 || v.Array[2].Str != "hello" {
+		t.Errorf("bridged message = %+v", v)
+	}
+	other := dial(t, addr)
+	other.do(t, "AUTH", "token2")
+	if v := other.do(t, "PUBLISH", "announcements", "reply"); v.Type != protocol.Error || !strings.Contains(v.Str, "read-only") {
+		t.Errorf("PUBLISH by a read-only target = %+v", v)
+	}
+
+	// Bridges survive a reload from the token store
+	if v := admin.do(t, "BRIDGE", "RELOAD"); v.Str != "OK" {
+		t.Errorf("BRIDGE RELOAD = %+v", v)
+	}
+	if v := admin.do(t, "BRIDGE", "LIST"); len(v.Array) != 1 {
+		t.Errorf("BRIDGE LIST after reload = %+v", v)
+	}
+
+	if v := admin.do(t, "BRIDGE", "DEL", id); v.Int != 1 {
+		t.Errorf("BRIDGE DEL = %+v", v)
+	}
+	if v := pub.do(t, "PUBLISH", "announcements", "after"); v.Int != 0 {
+		t.Errorf("PUBLISH after BRIDGE DEL = %+v, want 0 receivers", v)
+	}
+}
+
+func TestMasterPublishForms(t *testing.T) {
+	addr := startServer(t, config.Limits{})
+	sub1 := dial(t, addr)
+	sub1.do(t, "AUTH", "token1")
+	sub1.do(t, "SUBSCRIBE", "news")
+	sub2 := dial(t, addr)
+	sub2.do(t, "AUTH", "token2")
+	sub2.do(t, "SUBSCRIBE", "news")
+	master := dial(t, addr)
+	master.do(t, "AUTH", "MASTER_TOKEN")
+
+	if v := master.do(t, "PUBLISH", "news", "plain"); v.Int != 0 {
+		t.Errorf("plain master PUBLISH = %+v, want 0 receivers", v)
+	}
+	if v := master.do(t, "PUBLISH.TENANT", "token:token2", "news", "targeted"); v.Int != 1 {
+		t.Errorf("PUBLISH.TENANT = %+v, want 1 receiver", v)
+	}
+	if v := sub2.read(t); len(v.Array) != 3 || v.Array[2].Str != "targeted" {
+		t.Errorf("targeted message = %+v", v)
+	}
+	if v := master.do(t, "PUBLISH.BROADCAST", "news", "everyone"); v.Int != 2 {
+		t.Errorf("PUBLISH.BROADCAST = %+v, want 2 receivers", v)
+	}
+	for _, sub := range []*conn{sub1, sub2} {
+		if v := sub.read(t); len(v.Array) != 3 || v.Array[2].Str != "everyone" {
+			t.Errorf("broadcast message = %+v", v)
+		}
+	}
+
+	if v := master.do(t, "PUBLISH.TENANT", "*", "news", "x"); v.Type != protocol.Error {
+		t.Errorf("PUBLISH.TENANT to a reserved tenant = %+v", v)
+	}
+	if v := sub1.do(t, "PUBLISH.BROADCAST", "news", "x"); v.Type != protocol.Error || !strings.Contains(v.Str, "only master token") {
+		t.Errorf("PUBLISH.BROADCAST by a tenant = %+v", v)
+	}
+}
+
+func TestTenantAdministration(t *testing.T) {
+	addr := startTenantServer(t)
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+
+	if v := admin.do(t, "TENANT", "CREATE", "acme", "MAXCHANNELS", "2"); v.Str != "OK" {
+		t.Fatalf("TENANT CREATE = %+v", v)
+	}
+	if v := admin.do(t, "TENANT", "CREATE", "acme"); v.Type != protocol.Error || !strings.Contains(v.Str, "already exists") {
+		t.Errorf("duplicate TENANT CREATE = %+v", v)
+	}
+	for _, name := range []string{"*", "token:token1"} {
+		if v := admin.do(t, "TENANT", "CREATE", name); v.Type != protocol.Error || !strings.Contains(v.Str, "reserved") {
+			t.Errorf("TENANT CREATE %s = %+v", name, v)
+		}
+	}
+	v := admin.do(t, "TENANT", "LIST")
+	if len(v.Array) != 1 || v.Array[0].Array[0].Str != "acme" || v.Array[0].Array[2].Str != "2" {
+		t.Errorf("TENANT LIST = %+v", v)
+	}
+
+	v = admin.do(t, "TOKEN", "CREATE", "acme", "PUBLISH", "news.*")
+	if len(v.Array) != 2 {
+		t.Fatalf("TOKEN CREATE = %+v", v)
+	}
+	id, token := v.Array[0].Str, v.Array[1].Str
+	if v := admin.do(t, "TOKEN", "CREATE", "nobody"); v.Type != protocol.Error {
+		t.Errorf("TOKEN CREATE for a missing tenant = %+v", v)
+	}
+	if v := admin.do(t, "TOKEN", "LIST", "acme"); len(v.Array) != 1 || v.Array[0].Array[1].Str == token {
+		t.Errorf("TOKEN LIST = %+v, want one redacted token", v)
+	}
+
+	tenant := dial(t, addr)
+	if v := tenant.do(t, "AUTH", token); v.Str != "OK" {
+		t.Fatalf("AUTH with a created token = %+v", v)
+	}
+	if v := tenant.do(t, "TENANT", "LIST"); v.Type != protocol.Error || !strings.Contains(v.Str, "only master token") {
+		t.Errorf("TENANT LIST by a tenant = %+v", v)
+	}
+	if v := tenant.do(t, "PUBLISH", "news.eu", "x"); v.Type != protocol.Integer {
+		t.Errorf("PUBLISH allowed by the ACL = %+v", v)
+	}
+	if v := tenant.do(t, "PUBLISH", "billing", "x"); v.Type != protocol.Error || !strings.HasPrefix(v.Str, "NOPERM") {
+		t.Errorf("PUBLISH outside the ACL = %+v", v)
+	}
+
+	if v := admin.do(t, "TOKEN", "DEACTIVATE", id); v.Str != "OK" {
+		t.Fatalf("TOKEN DEACTIVATE = %+v", v)
+	}
+	tenant.expectClosed(t, "token revoked")
+	if v := dial(t, addr).do(t, "AUTH", token); v.Type != protocol.Error {
+		t.Errorf("AUTH with a deactivated token = %+v", v)
+	}
+	if v := admin.do(t, "TOKEN", "ACTIVATE", id); v.Str != "OK" {
+		t.Errorf("TOKEN ACTIVATE = %+v", v)
+	}
+
+	if v := admin.do(t, "TENANT", "DEACTIVATE", "acme"); v.Str != "OK" {
+		t.Errorf("TENANT DEACTIVATE = %+v", v)
+	}
+	if v := dial(t, addr).do(t, "AUTH", token); v.Type != protocol.Error {
+		t.Errorf("AUTH with a token of a deactivated tenant = %+v", v)
+	}
+	if v := admin.do(t, "TENANT", "DELETE", "acme"); v.Str != "OK" {
+		t.Errorf("TENANT DELETE = %+v", v)
+	}
+	if v := admin.do(t, "TOKEN", "LIST", "acme"); len(v.Array) != 0 {
+		t.Errorf("TOKEN LIST after TENANT DELETE = %+v", v)
+	}
+}
+
+func TestWebhookACL(t *testing.T) {
+	addr := startTenantServer(t)
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	admin.do(t, "TENANT", "CREATE", "acme")
+	v := admin.do(t, "TOKEN", "CREATE", "acme", "SUBSCRIBE", "orders.*")
+	if len(v.Array) != 2 {
+		t.Fatalf("TOKEN CREATE = %+v", v)
+	}
+
+	tenant := dial(t, addr)
+	tenant.do(t, "AUTH", v.Array[1].Str)
+	for _, pattern := range []string{"*", "billing.*"} {
+		if v := tenant.do(t, "WEBHOOK", "ADD", pattern, "https://203.0.113.10/hook", "s3cret"); v.Type != protocol.Error || !strings.HasPrefix(v.Str, "NOPERM") {
+			t.Errorf("WEBHOOK ADD %s outside the subscribe ACL = %+v", pattern, v)
+		}
+	}
+	if v := tenant.do(t, "WEBHOOK", "LIST"); len(v.Array) != 0 {
+		t.Errorf("WEBHOOK LIST = %+v, want no webhooks", v)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	addr := startTenantServer(t)
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	admin.do(t, "TENANT", "CREATE", "acme")
+	v := admin.do(t, "TOKEN", "CREATE", "acme", "SUBSCRIBE", "news")
+	id, old := v.Array[0].Str, v.Array[1].Str
+
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", old)
+	sub.do(t, "SUBSCRIBE", "news")
+
+	v = admin.do(t, "TOKEN", "ROTATE", id, "1")
+	if len(v.Array) != 2 || v.Array[1].Str == old {
+		t.Fatalf("TOKEN ROTATE = %+v", v)
+	}
+	renewed := dial(t, addr)
+	if v := renewed.do(t, "AUTH", v.Array[1].Str); v.Str != "OK" {
+		t.Errorf("AUTH with the new token = %+v", v)
+	}
+	if v := renewed.do(t, "SUBSCRIBE", "billing"); v.Type != protocol.Error || !strings.HasPrefix(v.Str, "NOPERM") {
+		t.Errorf("the new token did not keep the ACL: %+v", v)
+	}
+	if v := dial(t, addr).do(t, "AUTH", old); v.Str != "OK" {
+		t.Errorf("AUTH with the old token during the grace period = %+v", v)
+	}
+	if v := admin.do(t, "TOKEN", "ROTATE", id); v.Type != protocol.Error {
+		t.Errorf("rotating a token twice = %+v", v)
+	}
+
+	// The old token is revoked once the grace period ends
+	sub.expectClosed(t, "token revoked")
+	if v := dial(t, addr).do(t, "AUTH", old); v.Type != protocol.Error {
+		t.Errorf("AUTH with the old token after the grace period = %+v", v)
+	}
+}
+
+func TestTokenRotationRollback(t *testing.T) {
+	db := newTenantDB(t)
+	_, addr := serveDB(t, db)
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	admin.do(t, "TENANT", "CREATE", "acme")
+	id := admin.do(t, "TOKEN", "CREATE", "acme").Array[0].Str
+
+	// The old token cannot be given an end, so the new one is removed
+	db.Exec("CREATE TRIGGER no_updates BEFORE UPDATE ON clients BEGIN SELECT RAISE(FAIL, 'read only'); END")
+	if v := admin.do(t, "TOKEN", "ROTATE", id); v.Type != protocol.Error {
+		t.Errorf("TOKEN ROTATE with a failing update = %+v", v)
+	}
+	if v := admin.do(t, "TOKEN", "LIST", "acme"); len(v.Array) != 1 || v.Array[0].Array[0].Str != id {
+		t.Errorf("TOKEN LIST after a failed rotation = %+v, want only token %s", v, id)
+	}
+}
+
+func TestTokenRecheck(t *testing.T) {
+	srv, addr := newTenantServer(t)
+	srv.SetLimits(config.Limits{TokenRecheck: 20 * time.Millisecond})
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	admin.do(t, "TENANT", "CREATE", "acme")
+	v := admin.do(t, "TOKEN", "CREATE", "acme")
+	id, _ := strconv.ParseInt(v.Array[0].Str, 10, 64)
+
+	sub := dial(t, addr)
+	sub.do(t, "AUTH", v.Array[1].Str)
+	sub.do(t, "SUBSCRIBE", "news")
+
+	// A token deactivated through another node is only seen in the store
+	if err := srv.Auth().Store().UpdateToken(auth.Token{ID: id, Active: false}); err != nil {
+		t.Fatalf("UpdateToken() error = %v", err)
+	}
+	sub.expectClosed(t, "token revoked")
+	if v := admin.do(t, "PING"); v.Str != "PONG" {
+		t.Errorf("master connection after the recheck = %+v", v)
+	}
+}
+
+func TestRevokeClosesGatewaySessions(t *testing.T) {
+	srv, addr := newTenantServer(t)
+	api := httpapi.New(srv.Auth(), srv.PubSub())
+	api.SetSessions(srv)
+	hs := httptest.NewServer(api.Handler())
+	defer hs.Close()
+
+	admin := dial(t, addr)
+	admin.do(t, "AUTH", "MASTER_TOKEN")
+	admin.do(t, "TENANT", "CREATE", "acme")
+	v := admin.do(t, "TOKEN", "CREATE", "acme")
+	id, token := v.Array[0].Str, v.Array[1].Str
+
+	// A WebSocket session that never subscribed
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/v1/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer ws.CloseNow()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := ws.ReadMessage(); err != nil || !strings.Contains(string(data), "authenticated") {
+		t.Fatalf("first frame = %s, %v", data, err)
+	}
+
+	// An SSE stream
+	req, _ := http.NewRequest("GET", hs.URL+"/v1/stream?channels=news", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /v1/stream = %v, %v", resp, err)
+	}
+	defer resp.Body.Close()
+
+	if v := admin.do(t, "TOKEN", "DEACTIVATE", id); v.Str != "OK" {
+		t.Fatalf("TOKEN DEACTIVATE = %+v", v)
+	}
+
+	if _, data, err := ws.ReadMessage(); err != nil || !strings.Contains(string(data), "token revoked") {
+		t.Errorf("WebSocket frame after revocation = %s, %v", data, err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("WebSocket session still open after revocation")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "event: error\ndata: token revoked") {
+		t.Errorf("SSE stream after revocation = %q", body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ClientCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ClientCount() = %d, want only the admin connection", srv.ClientCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReliableSubscribe(t *testing.T) {
+	addr := startServer(t, config.Limits{})
+	first := dial(t, addr)
+	first.do(t, "AUTH", "token1")
+	if v := first.do(t, "RSUBSCRIBE", "billing", "invoices"); len(v.Array) != 3 || v.Array[0].Str != "rsubscribe" {
+		t.Fatalf("RSUBSCRIBE = %+v", v)
+	}
+	pub := dial(t, addr)
+	pub.do(t, "AUTH", "token1")
+
+	if v := pub.do(t, "PUBLISH", "invoices", "inv-1"); v.Int != 0 {
+		t.Errorf("PUBLISH = %+v, want no plain subscribers", v)
+	}
+	v := first.read(t)
+	if len(v.Array) != 5 || v.Array[0].Str != "rmessage" || v.Array[1].Str != "billing" || v.Array[4].Str != "inv-1" {
+		t.Fatalf("reliable message = %+v", v)
+	}
+	id := v.Array[3].Str
+	if v := pub.do(t, "RPENDING", "billing"); len(v.Array) != 1 || v.Array[0].Array[0].Str != id || v.Array[0].Array[3].Str != "1" {
+		t.Errorf("RPENDING = %+v", v)
+	}
+	if v := first.do(t, "ACK", "billing", id); v.Int != 1 {
+		t.Errorf("ACK = %+v, want 1", v)
+	}
+	if v := first.do(t, "ACK", "billing", id); v.Int != 0 {
+		t.Errorf("second ACK = %+v, want 0", v)
+	}
+
+	// A message held by a consumer that goes away is delivered to another
+	second := dial(t, addr)
+	second.do(t, "AUTH", "token1")
+	second.do(t, "RSUBSCRIBE", "billing", "invoices")
+	pub.do(t, "PUBLISH", "invoices", "inv-2")
+	pub.do(t, "PUBLISH", "invoices", "inv-3")
+	held := first.read(t)
+	first.Close()
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		v := second.read(t)
+		got[v.Array[4].Str] = true
+	}
+	if !got[held.Array[4].Str] || len(got) != 2 {
+		t.Errorf("second consumer got %v, want both messages including %q", got, held.Array[4].Str)
+	}
+
+	other := dial(t, addr)
+	other.do(t, "AUTH", "token2")
+	if v := other.do(t, "RPENDING", "billing"); v.Type != protocol.Error {
+		t.Errorf("RPENDING of another tenant's group = %+v", v)
+	}
+	if v := other.do(t, "RDESTROY", "billing"); v.Type != protocol.Integer || v.Int != 0 {
+		t.Errorf("RDESTROY of another tenant's group = %+v, want 0", v)
+	}
+	if v := other.do(t, "RDESTROY", "billing", "extra"); v.Type != protocol.Error {
+		t.Errorf("RDESTROY with extra arguments = %+v", v)
+	}
+	if v := pub.do(t, "RDESTROY", "billing"); v.Type != protocol.Error || !strings.Contains(v.Str, "has consumers") {
+		t.Errorf("RDESTROY of a group with consumers = %+v", v)
+	}
+
+	// DISCONNECT reaches consumers without plain subscriptions
+	master := dial(t, addr)
+	master.do(t, "AUTH", "MASTER_TOKEN")
+	if v := master.do(t, "DISCONNECT", "token1"); v.Int != 1 {
+		t.Errorf("DISCONNECT = %+v, want 1 client", v)
+	}
+	if v := second.read(t); v.Type != protocol.Error || !strings.Contains(v.Str, "disconnected by master") {
+		t.Errorf("consumer after DISCONNECT got %+v", v)
+	}
+}
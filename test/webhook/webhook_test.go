@@ -0,0 +1,328 @@
+package webhook_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"redix/pkg/auth"
+	"redix/pkg/client"
+	"redix/pkg/webhook"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// proxied counts the requests that reached the proxy set in the
+// environment by TestMain
+var proxied atomic.Int32
+
+// TestMain runs the tests with a proxy in the environment, which
+// deliveries must not use. net/http reads the proxy variables once, so
+// they are set before any test runs.
+func TestMain(m *testing.M) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	}))
+	os.Setenv("HTTP_PROXY", proxy.URL)
+	os.Setenv("HTTPS_PROXY", proxy.URL)
+	code := m.Run()
+	proxy.Close()
+	os.Exit(code)
+}
+
+// newStore creates a webhook store backed by an in-memory database
+func newStore(t *testing.T) *webhook.Store {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			pattern TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL
+		);
+		CREATE TABLE webhook_dead_letters (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL,
+			message_id INTEGER NOT NULL,
+			channel TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			failed_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test tables: %v", err)
+	}
+	return webhook.NewStore(db)
+}
+
+// fastOptions returns options with short retry delays that allow
+// webhooks on loopback, where the test receivers listen
+func fastOptions() webhook.Options {
+	return webhook.Options{
+		Concurrency:     2,
+		MaxAttempts:     3,
+		BaseDelay:       time.Millisecond,
+		MaxDelay:        5 * time.Millisecond,
+		Timeout:         time.Second,
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeliverySignedAndFiltered(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		payloads []webhook.Payload
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify("s3cret", r.Header.Get(webhook.TimestampHeader), body, r.Header.Get(webhook.SignatureHeader)) {
+			t.Errorf("invalid signature %q", r.Header.Get(webhook.SignatureHeader))
+		}
+		var p webhook.Payload
+		json.Unmarshal(body, &p)
+		mu.Lock()
+		payloads = append(payloads, p)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	d := webhook.NewDispatcher(newStore(t), fastOptions())
+	defer d.Close()
+
+	if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "orders.*", URL: receiver.URL, Secret: "s3cret"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	d.Notify("token1", client.Message{ID: 1, Topic: "orders.created", Payload: "a"})
+	d.Notify("token1", client.Message{ID: 2, Topic: "users.created", Payload: "b"})
+	d.Notify("token2", client.Message{ID: 3, Topic: "orders.created", Payload: "c"})
+	d.Notify(auth.AllTenants, client.Message{ID: 4, Topic: "orders.paid", Payload: "d"})
+
+	waitFor(t, func() bool { return d.Stats().Delivered == 2 })
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 2 {
+		t.Fatalf("received %d deliveries, want 2", len(payloads))
+	}
+	got := map[string]bool{payloads[0].Message: true, payloads[1].Message: true}
+	if !got["a"] || !got["d"] {
+		t.Errorf("received %v, want messages a and d", payloads)
+	}
+}
+
+func TestRetryThenSucceed(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	d := webhook.NewDispatcher(newStore(t), fastOptions())
+	defer d.Close()
+	d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: receiver.URL})
+
+	d.Notify("token1", client.Message{ID: 1, Topic: "orders", Payload: "a"})
+
+	waitFor(t, func() bool { return d.Stats().Delivered == 1 })
+	st := d.Stats()
+	if st.Failed != 2 || st.Retried != 2 || st.DeadLettered != 0 {
+		t.Errorf("Stats() = %+v, want 2 failures and 2 retries", st)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	store := newStore(t)
+	d := webhook.NewDispatcher(store, fastOptions())
+	defer d.Close()
+	id, _ := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: receiver.URL})
+
+	d.Notify("token1", client.Message{ID: 7, Topic: "orders", Payload: "a"})
+
+	waitFor(t, func() bool { return d.Stats().DeadLettered == 1 })
+	dls, err := store.DeadLetters(id)
+	if err != nil {
+		t.Fatalf("DeadLetters() error = %v", err)
+	}
+	if len(dls) != 1 || dls[0].MessageID != 7 || dls[0].Attempts != 3 {
+		t.Errorf("DeadLetters() = %+v, want one record of message 7 after 3 attempts", dls)
+	}
+}
+
+func TestAddRemoveAndLoad(t *testing.T) {
+	store := newStore(t)
+	d := webhook.NewDispatcher(store, fastOptions())
+	defer d.Close()
+
+	if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: "ftp://example.com"}); err == nil {
+		t.Error("Add() with non-http URL succeeded, want error")
+	}
+
+	id, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: "http://203.0.113.10/hook"})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	reloaded := webhook.NewDispatcher(store, fastOptions())
+	defer reloaded.Close()
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if subs := reloaded.List("token1"); len(subs) != 1 || subs[0].ID != id {
+		t.Errorf("List() after Load() = %+v, want subscription %d", subs, id)
+	}
+
+	if removed, _ := d.Remove("token2", id); removed {
+		t.Error("Remove() by another token succeeded")
+	}
+	if removed, _ := d.Remove("token1", id); !removed {
+		t.Error("Remove() by owner failed")
+	}
+	if subs := d.List("token1"); len(subs) != 0 {
+		t.Errorf("List() after Remove() = %+v, want empty", subs)
+	}
+}
+
+func TestAddRejectsInternalURLs(t *testing.T) {
+	opts := fastOptions()
+	opts.AllowedNetworks = nil
+	d := webhook.NewDispatcher(newStore(t), opts)
+	defer d.Close()
+
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://0.0.0.0/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/hook",
+		"https://192.168.0.10/hook",
+		"http://[fd00::1]/hook",
+	} {
+		if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: u}); !errors.Is(err, webhook.ErrForbiddenAddress) {
+			t.Errorf("Add(%s) error = %v, want ErrForbiddenAddress", u, err)
+		}
+	}
+
+	d.SetAllowedNetworks([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: "http://10.1.2.3/hook"}); err != nil {
+		t.Errorf("Add() in an allowed network error = %v", err)
+	}
+	if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: "http://192.168.0.10/hook"}); !errors.Is(err, webhook.ErrForbiddenAddress) {
+		t.Errorf("Add() outside the allowed networks error = %v, want ErrForbiddenAddress", err)
+	}
+}
+
+func TestDeliveryRechecksAddress(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	store := newStore(t)
+	d := webhook.NewDispatcher(store, fastOptions())
+	defer d.Close()
+	id, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: receiver.URL})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Deliveries check the address they connect to, not only the URL added
+	d.SetAllowedNetworks(nil)
+	d.Notify("token1", client.Message{ID: 1, Topic: "orders", Payload: "a"})
+	waitFor(t, func() bool { return d.Stats().DeadLettered == 1 })
+	if calls.Load() != 0 {
+		t.Errorf("receiver called %d times, want 0", calls.Load())
+	}
+	if dls, _ := store.DeadLetters(id); len(dls) != 1 || !strings.Contains(dls[0].LastError, "private address") {
+		t.Errorf("DeadLetters() = %+v, want a forbidden address error", dls)
+	}
+}
+
+func TestDeliveryIgnoresProxy(t *testing.T) {
+	opts := fastOptions()
+	opts.MaxAttempts = 1
+	d := webhook.NewDispatcher(newStore(t), opts)
+	defer d.Close()
+	if _, err := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: "http://203.0.113.10/hook"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Through the proxy the address check would only see the proxy
+	d.Notify("token1", client.Message{ID: 1, Topic: "orders", Payload: "a"})
+	waitFor(t, func() bool { st := d.Stats(); return st.Delivered+st.DeadLettered == 1 })
+	if n := proxied.Load(); n != 0 {
+		t.Errorf("proxy received %d requests, want 0", n)
+	}
+}
+
+func TestRetryQueueBounded(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	store := newStore(t)
+	opts := fastOptions()
+	opts.QueueSize = 1
+	opts.BaseDelay, opts.MaxDelay = time.Hour, time.Hour
+	d := webhook.NewDispatcher(store, opts)
+	defer d.Close()
+	id, _ := d.Add(webhook.Subscription{Tenant: "token1", Pattern: "*", URL: receiver.URL})
+
+	// The first failure waits for a retry; the retry queue is then full,
+	// so the second failure is dead-lettered right away
+	d.Notify("token1", client.Message{ID: 1, Topic: "orders", Payload: "a"})
+	waitFor(t, func() bool { return d.Stats().Retried == 1 })
+	d.Notify("token1", client.Message{ID: 2, Topic: "orders", Payload: "b"})
+	waitFor(t, func() bool { return d.Stats().DeadLettered == 1 })
+
+	if st := d.Stats(); st.Failed != 2 || st.Retried != 1 {
+		t.Errorf("Stats() = %+v, want 2 failures and 1 retry", st)
+	}
+	dls, _ := store.DeadLetters(id)
+	if len(dls) != 1 || dls[0].MessageID != 2 || !strings.Contains(dls[0].LastError, "retry queue full") {
+		t.Errorf("DeadLetters() = %+v, want message 2 with a full retry queue", dls)
+	}
+}